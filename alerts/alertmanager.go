@@ -0,0 +1,272 @@
+package alerts
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/dlefevre/go.garagedoor-service/logging"
+	"github.com/google/uuid"
+)
+
+// Logger of the alerts component.
+var logger = logging.Logger("alerts")
+
+// Source reported in the event log for alert events.
+const source = "alerts"
+
+// Identifier of the left open alert.
+const LeftOpen = "left_open"
+
+// Enumeration of alert levels.
+const (
+	LevelNone     = "none"     // LevelNone means the alert isn't raised
+	LevelWarning  = "warning"  // LevelWarning is used for the first notification and its repeats
+	LevelCritical = "critical" // LevelCritical is used once the alert is escalated
+)
+
+// ErrNotFound is returned when acknowledging an alert that doesn't exist.
+var ErrNotFound = errors.New("alerts: alert not found")
+
+// ErrNotRaised is returned when acknowledging an alert that isn't raised.
+var ErrNotRaised = errors.New("alerts: alert is not raised")
+
+var (
+	instance *AlertManager
+	once     sync.Once
+)
+
+// Alert describes the state of an alert.
+type Alert struct {
+	ID             string     `json:"id"`
+	Level          string     `json:"level"`
+	Since          *time.Time `json:"since,omitempty"`
+	LastNotified   *time.Time `json:"last_notified,omitempty"`
+	Notifications  int        `json:"notifications"`
+	Acknowledged   bool       `json:"acknowledged"`
+	AcknowledgedBy string     `json:"acknowledged_by,omitempty"`
+}
+
+// AlertManager raises an alert when the door is left open, repeats it until it is acknowledged, escalates it after a
+// while, and clears it when the door closes. Notifications are recorded as events in the DoorControllerService.
+type AlertManager struct {
+	enabled       bool
+	threshold     time.Duration
+	repeat        time.Duration
+	escalateAfter time.Duration
+
+	openSince  time.Time
+	alert      Alert
+	listenerID uuid.UUID
+	listeners  map[uuid.UUID]func(Alert)
+	stop       chan struct{}
+	wg         sync.WaitGroup
+	lock       sync.Mutex
+}
+
+// GetAlertManager returns the one and only AlertManager instance.
+func GetAlertManager() *AlertManager {
+	once.Do(func() {
+		instance = newAlertManager()
+	})
+	return instance
+}
+
+// Creates a new AlertManager object.
+func newAlertManager() *AlertManager {
+	return &AlertManager{
+		enabled:       config.GetLeftOpenEnabled(),
+		threshold:     config.GetLeftOpenThreshold(),
+		repeat:        config.GetLeftOpenRepeat(),
+		escalateAfter: config.GetLeftOpenEscalateAfter(),
+		alert: Alert{
+			ID:    LeftOpen,
+			Level: LevelNone,
+		},
+		listeners: make(map[uuid.UUID]func(Alert)),
+	}
+}
+
+// Start tracking the door state.
+func (a *AlertManager) Start() {
+	if !a.enabled {
+		logger.Info().Msg("left open alert is disabled")
+		return
+	}
+	dc := controller.GetDoorControllerService()
+	a.lock.Lock()
+	if dc.GetStateStr() != "closed" {
+		a.openSince = time.Now()
+	}
+	a.lock.Unlock()
+
+	a.listenerID = dc.AddStateListener(func(event controller.StateEvent) {
+		a.stateChanged(event.State)
+	})
+	a.stop = make(chan struct{})
+	a.wg.Add(1)
+	go a.loop()
+}
+
+// Stop tracking the door state.
+func (a *AlertManager) Stop() {
+	if a.stop == nil {
+		return
+	}
+	controller.GetDoorControllerService().RemoveStateListener(a.listenerID)
+	close(a.stop)
+	a.wg.Wait()
+	a.stop = nil
+}
+
+// List returns the state of all alerts.
+func (a *AlertManager) List() []Alert {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return []Alert{a.alert}
+}
+
+// Acknowledge stops further notifications for a raised alert, until it is cleared.
+func (a *AlertManager) Acknowledge(id string, by string) (Alert, error) {
+	a.lock.Lock()
+	if id != a.alert.ID {
+		a.lock.Unlock()
+		return Alert{}, ErrNotFound
+	}
+	if a.alert.Level == LevelNone {
+		a.lock.Unlock()
+		return a.alert, ErrNotRaised
+	}
+	a.alert.Acknowledged = true
+	a.alert.AcknowledgedBy = by
+	alert := a.alert
+	a.lock.Unlock()
+
+	logger.Info().Msgf("alert %s acknowledged by %s", id, by)
+	controller.GetDoorControllerService().RecordEvent(controller.Event{
+		Type:    controller.EventAlertAcked,
+		Source:  by,
+		Level:   alert.Level,
+		Message: fmt.Sprintf("Alert %s acknowledged", id),
+	})
+	a.notifyListeners(alert)
+	return alert, nil
+}
+
+// AddListener adds a listener for changes to alerts. Returns an index that can be used to remove the listener.
+func (a *AlertManager) AddListener(handler func(Alert)) uuid.UUID {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	id := uuid.New()
+	a.listeners[id] = handler
+	return id
+}
+
+// RemoveListener removes a listener by index.
+func (a *AlertManager) RemoveListener(id uuid.UUID) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.listeners, id)
+}
+
+// Main loop for checking the alert.
+func (a *AlertManager) loop() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case now := <-ticker.C:
+			a.check(now)
+		}
+	}
+}
+
+// State listener, keeping track of since when the door is open. A door in an unknown state counts as open.
+func (a *AlertManager) stateChanged(state string) {
+	a.lock.Lock()
+	if state == "closed" {
+		a.openSince = time.Time{}
+	} else if a.openSince.IsZero() {
+		a.openSince = time.Now()
+	}
+	a.lock.Unlock()
+	a.check(time.Now())
+}
+
+// Raise, repeat, escalate or clear the alert, depending on how long the door has been open.
+func (a *AlertManager) check(now time.Time) {
+	a.lock.Lock()
+	var event *controller.Event
+	if a.openSince.IsZero() {
+		if a.alert.Level != LevelNone {
+			event = &controller.Event{
+				Type:    controller.EventAlertCleared,
+				Source:  source,
+				State:   "closed",
+				Message: "All clear: the garage door is closed",
+			}
+			a.alert = Alert{
+				ID:    LeftOpen,
+				Level: LevelNone,
+			}
+		}
+	} else if open := now.Sub(a.openSince); open >= a.threshold && !a.alert.Acknowledged {
+		level := LevelWarning
+		if open >= a.escalateAfter {
+			level = LevelCritical
+		}
+		due := a.alert.Level == LevelNone || level != a.alert.Level ||
+			now.Sub(*a.alert.LastNotified) >= a.repeat
+		if due {
+			if a.alert.Since == nil {
+				since := a.openSince
+				a.alert.Since = &since
+			}
+			a.alert.Level = level
+			a.alert.LastNotified = &now
+			a.alert.Notifications++
+			event = &controller.Event{
+				Type:    controller.EventAlert,
+				Source:  source,
+				State:   "open",
+				Level:   level,
+				Message: fmt.Sprintf("The garage door has been open for %s", formatDuration(open)),
+			}
+		}
+	}
+	alert := a.alert
+	a.lock.Unlock()
+
+	if event != nil {
+		logger.Warn().Msg(event.Message)
+		controller.GetDoorControllerService().RecordEvent(*event)
+		a.notifyListeners(alert)
+	}
+}
+
+// Notify all listeners of a change to an alert.
+func (a *AlertManager) notifyListeners(alert Alert) {
+	a.lock.Lock()
+	listeners := make([]func(Alert), 0, len(a.listeners))
+	for _, listener := range a.listeners {
+		listeners = append(listeners, listener)
+	}
+	a.lock.Unlock()
+
+	for _, listener := range listeners {
+		listener(alert)
+	}
+}
+
+// Format a duration in minutes, e.g. "10m" or "1h5m".
+func formatDuration(d time.Duration) string {
+	return strings.TrimSuffix(d.Truncate(time.Minute).String(), "0s")
+}
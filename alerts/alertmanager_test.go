@@ -0,0 +1,118 @@
+package alerts
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	os.Setenv("GARAGESERVICE_CONFIG_PATH", "..")
+	dataDir, _ := os.MkdirTemp("", "garagedoor-service-test")
+	os.Setenv("GARAGESERVICE_DATA_DIR", dataDir)
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+}
+
+// Return the alert events recorded after the given event id.
+func alertEvents(since uint64) []controller.Event {
+	result := make([]controller.Event, 0)
+	for _, event := range controller.GetDoorControllerService().GetEvents(since) {
+		if event.Type == controller.EventAlert || event.Type == controller.EventAlertCleared {
+			result = append(result, event)
+		}
+	}
+	return result
+}
+
+// Return the id of the last recorded event.
+func lastEventID() uint64 {
+	events := controller.GetDoorControllerService().GetEvents(0)
+	if len(events) == 0 {
+		return 0
+	}
+	return events[len(events)-1].ID
+}
+
+func TestEscalation(t *testing.T) {
+	a := newAlertManager()
+	a.threshold = 10 * time.Minute
+	a.repeat = 15 * time.Minute
+	a.escalateAfter = time.Hour
+	notified := 0
+	a.AddListener(func(alert Alert) {
+		notified++
+	})
+
+	since := lastEventID()
+	opened := time.Now()
+	a.stateChanged("open")
+	a.openSince = opened
+
+	a.check(opened.Add(5 * time.Minute))
+	a.check(opened.Add(10 * time.Minute))
+	a.check(opened.Add(20 * time.Minute))
+	a.check(opened.Add(25 * time.Minute))
+	a.check(opened.Add(60 * time.Minute))
+	events := alertEvents(since)
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 alert events, got %d", len(events))
+	}
+	if events[0].Level != LevelWarning || events[1].Level != LevelWarning || events[2].Level != LevelCritical {
+		t.Fatalf("Expected warning, warning, critical, got %s, %s, %s", events[0].Level, events[1].Level, events[2].Level)
+	}
+	if alert := a.List()[0]; alert.Level != LevelCritical || alert.Notifications != 3 {
+		t.Fatalf("Expected critical alert with 3 notifications, got %+v", alert)
+	}
+
+	a.stateChanged("closed")
+	events = alertEvents(since)
+	if len(events) != 4 || events[3].Type != controller.EventAlertCleared {
+		t.Fatalf("Expected an all clear event, got %+v", events)
+	}
+	if alert := a.List()[0]; alert.Level != LevelNone {
+		t.Fatalf("Expected alert to be cleared, got %+v", alert)
+	}
+	if notified != 4 {
+		t.Fatalf("Expected listener to be notified 4 times, got %d", notified)
+	}
+}
+
+func TestAcknowledge(t *testing.T) {
+	a := newAlertManager()
+	a.threshold = 10 * time.Minute
+	a.repeat = 15 * time.Minute
+	a.escalateAfter = time.Hour
+
+	if _, err := a.Acknowledge(LeftOpen, "test"); !errors.Is(err, ErrNotRaised) {
+		t.Fatalf("Expected ErrNotRaised, got %v", err)
+	}
+	if _, err := a.Acknowledge("unknown", "test"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+
+	since := lastEventID()
+	opened := time.Now()
+	a.openSince = opened
+	a.check(opened.Add(10 * time.Minute))
+	if _, err := a.Acknowledge(LeftOpen, "test"); err != nil {
+		t.Fatalf("Error acknowledging alert: %v", err)
+	}
+	a.check(opened.Add(30 * time.Minute))
+	a.check(opened.Add(90 * time.Minute))
+	if events := alertEvents(since); len(events) != 1 {
+		t.Fatalf("Expected no notifications after acknowledgement, got %d events", len(events))
+	}
+}
+
+func TestLevels(t *testing.T) {
+	// The configuration verifies the level filters of notification channels against its own list.
+	if !slices.Equal(config.AlertLevels, []string{LevelWarning, LevelCritical}) {
+		t.Fatalf("Expected config.AlertLevels to list the alert levels, got %v", config.AlertLevels)
+	}
+}
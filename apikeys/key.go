@@ -0,0 +1,72 @@
+package apikeys
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/scheduler"
+)
+
+// Key is an API key that can be used to authenticate, with its bcrypt hash and restrictions.
+type Key struct {
+	KeySpec
+	Hash    string
+	Source  string
+	Created *time.Time
+	scopes  map[string]bool
+	windows []*scheduler.Window
+	invalid bool
+}
+
+// Create a Key. Keys with invalid time windows are never accepted.
+func newKey(spec KeySpec, hash string, source string, created *time.Time, loc *time.Location) *Key {
+	key := &Key{
+		KeySpec: spec,
+		Hash:    hash,
+		Source:  source,
+		Created: created,
+		scopes:  make(map[string]bool),
+	}
+	for _, scope := range spec.Scopes {
+		key.scopes[scope] = true
+	}
+	for _, window := range spec.Windows {
+		w, err := scheduler.ParseWindow(window, loc)
+		if err != nil {
+			logger.Error().Msgf("API key %s has an invalid window, disabling it: %v", spec.Name, err)
+			key.invalid = true
+			continue
+		}
+		key.windows = append(key.windows, w)
+	}
+	return key
+}
+
+// Usable checks if the key can be used at the given time. Returns an error describing why not.
+func (k *Key) Usable(now time.Time) error {
+	if k.invalid {
+		return fmt.Errorf("API key %s is disabled", k.Name)
+	}
+	if k.Expires != nil && now.After(*k.Expires) {
+		return fmt.Errorf("API key %s expired", k.Name)
+	}
+	if len(k.windows) == 0 {
+		return nil
+	}
+	for _, window := range k.windows {
+		if window.Active(now) {
+			return nil
+		}
+	}
+	return fmt.Errorf("API key %s used outside its time windows", k.Name)
+}
+
+// Allows checks if the key grants a scope. The admin scope grants all scopes. A key restricted to another door grants
+// nothing on this one, not even administration.
+func (k *Key) Allows(scope string) bool {
+	if k.Door != "" && k.Door != config.GetDoorID() {
+		return false
+	}
+	return k.scopes[config.ScopeAdmin] || k.scopes[scope]
+}
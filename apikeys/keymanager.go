@@ -0,0 +1,491 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/logging"
+	"github.com/dlefevre/go.garagedoor-service/scheduler"
+	"github.com/dlefevre/go.garagedoor-service/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Logger of the apikeys component.
+var logger = logging.Logger("apikeys")
+
+// Names of the documents holding the runtime keys, and when each key was last used. The usage is kept apart, as
+// only the running service writes it, while the keys can also be changed with the command line.
+const (
+	keysDocument  = "api_keys"
+	usageDocument = "api_key_usage"
+)
+
+// Interval at which the keys document is checked for changes made by another process, e.g. the command line. A key
+// revoked by another process is refused within this interval.
+const refreshInterval = 2 * time.Second
+
+// Interval at which the last used timestamps are saved.
+const usageSaveInterval = time.Minute
+
+// Prefix of generated secrets, so they are easy to recognize.
+const secretPrefix = "gdk_"
+
+// Sources of keys.
+const (
+	SourceConfig  = "config"  // SourceConfig is used for keys defined in the configuration file
+	SourceRuntime = "runtime" // SourceRuntime is used for keys created at runtime
+)
+
+// Errors returned when managing keys.
+var (
+	ErrNotFound = errors.New("apikeys: key not found")
+	ErrExists   = errors.New("apikeys: a key with this name already exists")
+	ErrStatic   = errors.New("apikeys: key is defined in the configuration file")
+	ErrInvalid  = errors.New("apikeys: invalid key")
+)
+
+var (
+	instance *KeyManager
+	once     sync.Once
+)
+
+// KeySpec describes a key to create. Only the name and the scopes are mandatory.
+type KeySpec struct {
+	Name    string     `json:"name"`
+	Scopes  []string   `json:"scopes"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Windows []string   `json:"windows,omitempty"`
+	Door    string     `json:"door,omitempty"`
+}
+
+// KeyStatus describes a key, without its hash.
+type KeyStatus struct {
+	KeySpec
+	Source   string     `json:"source"`
+	Created  *time.Time `json:"created,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// A persisted runtime key.
+type storedKey struct {
+	KeySpec
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+// The persisted runtime keys.
+type storedKeys struct {
+	Keys []storedKey `json:"keys"`
+}
+
+// KeyManager keeps the API keys: the static keys from the configuration file, and the keys created at runtime, which
+// are persisted in the store. Changes lock the keys document, so changes made at the same time by the service and the
+// command line are both kept. Every change clears the cache of verified keys.
+type KeyManager struct {
+	store      *storage.Store
+	verifier   *verifier
+	loc        *time.Location
+	static     []*Key
+	runtime    []*Key
+	usage      map[string]time.Time
+	usageDirty bool
+	modTime    time.Time
+	loaded     bool
+	checked    time.Time
+	stop       chan struct{}
+	wg         sync.WaitGroup
+	lock       sync.Mutex
+}
+
+// GetKeyManager returns the one and only KeyManager instance.
+func GetKeyManager() *KeyManager {
+	once.Do(func() {
+		instance = newKeyManager(storage.GetStore(), config.GetAPIKeys())
+	})
+	return instance
+}
+
+// Creates a new KeyManager object for the given static keys. Time windows use the time zone of the scheduler.
+func newKeyManager(store *storage.Store, cfgs []config.APIKeyConfig) *KeyManager {
+	loc, err := time.LoadLocation(config.GetSchedulerTimezone())
+	if err != nil {
+		logger.Error().Msgf("Invalid scheduler time zone, using UTC for API key windows: %v", err)
+		loc = time.UTC
+	}
+	m := &KeyManager{
+		store: store,
+		verifier: newVerifier(config.GetKeyCacheTTL(), config.GetKeyCacheNegativeTTL(), config.GetKeyCacheSize(),
+			config.GetKeyVerifyRate()),
+		loc:   loc,
+		usage: make(map[string]time.Time),
+	}
+	m.static = m.staticKeys(cfgs)
+	if err := store.Load(usageDocument, &m.usage); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		logger.Error().Msgf("Error loading API key usage: %v", err)
+	}
+	return m
+}
+
+// Start periodically saving when the keys were last used.
+func (m *KeyManager) Start() {
+	m.stop = make(chan struct{})
+	m.wg.Add(1)
+	go m.loop()
+}
+
+// Stop saving when the keys were last used, after a last save.
+func (m *KeyManager) Stop() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	m.wg.Wait()
+	m.stop = nil
+	m.saveUsage()
+}
+
+// Save the last used timestamps at a regular interval.
+func (m *KeyManager) loop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(usageSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.saveUsage()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Verify returns the key matching a secret. Returns ErrUnknownKey if there is none, or ErrThrottled when too many
+// unknown secrets were checked recently. The result is cached, see verifier, until the keys document changes.
+func (m *KeyManager) Verify(secret string, now time.Time) (*Key, error) {
+	m.lock.Lock()
+	m.refresh(now)
+	m.lock.Unlock()
+	return m.verifier.verify(secret, now, m.Keys)
+}
+
+// Reload replaces the static keys, e.g. after the configuration file changed.
+func (m *KeyManager) Reload(cfgs []config.APIKeyConfig) {
+	static := m.staticKeys(cfgs)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.static = static
+	m.verifier.invalidate()
+	logger.Info().Msgf("Reloaded %d API keys from the configuration file", len(static))
+}
+
+// Keys returns all keys that can be used to authenticate, static keys first.
+func (m *KeyManager) Keys() []*Key {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.refresh(time.Now())
+	return append(append([]*Key{}, m.static...), m.runtime...)
+}
+
+// Used records that a key was used.
+func (m *KeyManager) Used(name string, now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.usage[name] = now
+	m.usageDirty = true
+}
+
+// List returns the status of all keys, sorted by name.
+func (m *KeyManager) List() []KeyStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.refresh(time.Now())
+	result := make([]KeyStatus, 0, len(m.static)+len(m.runtime))
+	for _, key := range m.static {
+		result = append(result, m.status(key))
+	}
+	for _, key := range m.runtime {
+		result = append(result, m.status(key))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Create a runtime key. Returns the status of the key and its secret, which isn't stored and can't be retrieved
+// afterwards.
+func (m *KeyManager) Create(spec KeySpec) (KeyStatus, string, error) {
+	now := time.Now()
+	if err := m.validate(spec, now); err != nil {
+		return KeyStatus{}, "", err
+	}
+	secret, hash, err := generateSecret()
+	if err != nil {
+		return KeyStatus{}, "", err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	err = m.update(func(stored *storedKeys) error {
+		if m.findStatic(spec.Name) != nil || storedIndex(*stored, spec.Name) >= 0 {
+			return ErrExists
+		}
+		stored.Keys = append(stored.Keys, storedKey{
+			KeySpec: spec,
+			Hash:    hash,
+			Created: now,
+		})
+		return nil
+	})
+	if err != nil {
+		return KeyStatus{}, "", err
+	}
+	logger.Info().Msgf("Created API key %s with scopes %v", spec.Name, spec.Scopes)
+	return m.status(m.find(spec.Name)), secret, nil
+}
+
+// Revoke a runtime key. Static keys can only be removed from the configuration file.
+func (m *KeyManager) Revoke(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	err := m.update(func(stored *storedKeys) error {
+		index, err := m.runtimeIndex(*stored, name)
+		if err != nil {
+			return err
+		}
+		stored.Keys = append(stored.Keys[:index], stored.Keys[index+1:]...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	delete(m.usage, name)
+	m.usageDirty = true
+	logger.Info().Msgf("Revoked API key %s", name)
+	return nil
+}
+
+// Rotate replaces the secret of a runtime key, keeping its name and restrictions. Returns the status of the key and
+// the new secret. The old secret stops working right away.
+func (m *KeyManager) Rotate(name string) (KeyStatus, string, error) {
+	secret, hash, err := generateSecret()
+	if err != nil {
+		return KeyStatus{}, "", err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	err = m.update(func(stored *storedKeys) error {
+		index, err := m.runtimeIndex(*stored, name)
+		if err != nil {
+			return err
+		}
+		stored.Keys[index].Hash = hash
+		return nil
+	})
+	if err != nil {
+		return KeyStatus{}, "", err
+	}
+	logger.Info().Msgf("Rotated API key %s", name)
+	return m.status(m.find(name)), secret, nil
+}
+
+// Validate the specification of a new key.
+func (m *KeyManager) validate(spec KeySpec, now time.Time) error {
+	if spec.Name == "" {
+		return fmt.Errorf("%w: name is mandatory", ErrInvalid)
+	}
+	if len(spec.Scopes) == 0 {
+		return fmt.Errorf("%w: at least one scope is required", ErrInvalid)
+	}
+	for _, scope := range spec.Scopes {
+		if !validScope(scope) {
+			return fmt.Errorf("%w: unknown scope %s", ErrInvalid, scope)
+		}
+	}
+	if spec.Expires != nil && !spec.Expires.After(now) {
+		return fmt.Errorf("%w: expiry must be in the future", ErrInvalid)
+	}
+	for _, window := range spec.Windows {
+		if _, err := scheduler.ParseWindow(window, m.loc); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+	}
+	if spec.Door != "" && spec.Door != config.GetDoorID() {
+		return fmt.Errorf("%w: door %s isn't this door", ErrInvalid, spec.Door)
+	}
+	return nil
+}
+
+// Reload the runtime keys if the document changed since it was last read. The document is checked at most once per
+// refresh interval. The caller must hold the lock.
+func (m *KeyManager) refresh(now time.Time) {
+	if m.loaded && now.Sub(m.checked) < refreshInterval {
+		return
+	}
+	m.checked = now
+	modTime, err := m.store.ModTime(keysDocument)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		logger.Error().Msgf("Error checking API keys: %v", err)
+		return
+	}
+	if m.loaded && modTime.Equal(m.modTime) {
+		return
+	}
+
+	var stored storedKeys
+	if err == nil {
+		if err := m.store.Load(keysDocument, &stored); err != nil {
+			logger.Error().Msgf("Error loading API keys: %v", err)
+			return
+		}
+	}
+	m.apply(stored, modTime)
+}
+
+// Change the persisted runtime keys while holding the lock of the keys document, starting from the keys as persisted,
+// and use them. Another process may change the document right after the lock is released, so the document is read
+// again with the next refresh. The caller must hold the lock.
+func (m *KeyManager) update(change func(stored *storedKeys) error) error {
+	var stored storedKeys
+	if err := m.store.Update(keysDocument, &stored, func() error { return change(&stored) }); err != nil {
+		return err
+	}
+	m.apply(stored, time.Time{})
+	return nil
+}
+
+// Use a set of runtime keys. The caller must hold the lock.
+func (m *KeyManager) apply(stored storedKeys, modTime time.Time) {
+	m.runtime = nil
+	for _, s := range stored.Keys {
+		created := s.Created
+		m.runtime = append(m.runtime, newKey(s.KeySpec, s.Hash, SourceRuntime, &created, m.loc))
+	}
+	m.modTime = modTime
+	if m.loaded {
+		m.verifier.invalidate()
+	}
+	m.loaded = true
+}
+
+// Create the static keys from the configuration file.
+func (m *KeyManager) staticKeys(cfgs []config.APIKeyConfig) []*Key {
+	var keys []*Key
+	for _, cfg := range cfgs {
+		spec := KeySpec{
+			Name:    cfg.Name,
+			Scopes:  cfg.Scopes,
+			Windows: cfg.Windows,
+			Door:    cfg.Door,
+		}
+		if !cfg.Expires.IsZero() {
+			expires := cfg.Expires
+			spec.Expires = &expires
+		}
+		keys = append(keys, newKey(spec, cfg.Key, SourceConfig, nil, m.loc))
+	}
+	return keys
+}
+
+// Save the last used timestamps, if they changed.
+func (m *KeyManager) saveUsage() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.usageDirty {
+		return
+	}
+	if err := m.store.Save(usageDocument, m.usage); err != nil {
+		logger.Error().Msgf("Error saving API key usage: %v", err)
+		return
+	}
+	m.usageDirty = false
+}
+
+// Find a key by name. The caller must hold the lock.
+func (m *KeyManager) find(name string) *Key {
+	if key := m.findStatic(name); key != nil {
+		return key
+	}
+	for _, key := range m.runtime {
+		if key.Name == name {
+			return key
+		}
+	}
+	return nil
+}
+
+// Find a static key by name. The caller must hold the lock.
+func (m *KeyManager) findStatic(name string) *Key {
+	for _, key := range m.static {
+		if key.Name == name {
+			return key
+		}
+	}
+	return nil
+}
+
+// Find the index of a runtime key in the persisted keys, to change it. Returns ErrStatic for a static key, and
+// ErrNotFound if there is none. The caller must hold the lock.
+func (m *KeyManager) runtimeIndex(stored storedKeys, name string) (int, error) {
+	if index := storedIndex(stored, name); index >= 0 {
+		return index, nil
+	}
+	if m.findStatic(name) != nil {
+		return -1, ErrStatic
+	}
+	return -1, ErrNotFound
+}
+
+// Find the index of a key in the persisted keys, or -1 if there is none.
+func storedIndex(stored storedKeys, name string) int {
+	for i, s := range stored.Keys {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Describe a key. The caller must hold the lock.
+func (m *KeyManager) status(key *Key) KeyStatus {
+	status := KeyStatus{
+		KeySpec: key.KeySpec,
+		Source:  key.Source,
+		Created: key.Created,
+	}
+	if used, ok := m.usage[key.Name]; ok {
+		status.LastUsed = &used
+	}
+	return status
+}
+
+// Generate a secret and its bcrypt hash.
+func generateSecret() (string, string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", "", err
+	}
+	secret := secretPrefix + base64.RawURLEncoding.EncodeToString(data)
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", err
+	}
+	return secret, string(hash), nil
+}
+
+// Check if a scope exists.
+func validScope(scope string) bool {
+	for _, s := range config.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
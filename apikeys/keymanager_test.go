@@ -0,0 +1,282 @@
+package apikeys
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	os.Setenv("GARAGESERVICE_CONFIG_PATH", "..")
+}
+
+func TestKeyRestrictions(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	expires := now.Add(24 * time.Hour)
+	key := newKey(KeySpec{
+		Name:    "walker",
+		Scopes:  []string{config.ScopeDoorOperate},
+		Expires: &expires,
+		Windows: []string{"07:00-09:00", "11:30-12:30"},
+	}, "", SourceRuntime, nil, time.UTC)
+	if err := key.Usable(now); err != nil {
+		t.Fatalf("Expected key to be usable: %v", err)
+	}
+	if err := key.Usable(now.Add(2 * time.Hour)); err == nil {
+		t.Fatalf("Expected key to be refused outside its windows")
+	}
+	if err := key.Usable(now.Add(48 * time.Hour)); err == nil {
+		t.Fatalf("Expected key to be refused after expiry")
+	}
+	if !key.Allows(config.ScopeDoorOperate) || key.Allows(config.ScopeStateRead) || key.Allows(config.ScopeAdmin) {
+		t.Fatalf("Unexpected scopes for key")
+	}
+
+	admin := newKey(KeySpec{Name: "admin", Scopes: []string{config.ScopeAdmin}}, "", SourceRuntime, nil, time.UTC)
+	if !admin.Allows(config.ScopeDoorOperate) || !admin.Allows(config.ScopeStateRead) {
+		t.Fatalf("Expected admin scope to grant all scopes")
+	}
+	other := newKey(KeySpec{Name: "other", Scopes: []string{config.ScopeAdmin}, Door: "shed"}, "", SourceRuntime,
+		nil, time.UTC)
+	if other.Allows(config.ScopeDoorOperate) || other.Allows(config.ScopeStateRead) || other.Allows(config.ScopeAdmin) {
+		t.Fatalf("Expected key for another door to be refused")
+	}
+	invalid := newKey(KeySpec{Name: "invalid", Scopes: []string{config.ScopeAdmin}, Windows: []string{"25:00-26:00"}},
+		"", SourceRuntime, nil, time.UTC)
+	if err := invalid.Usable(now); err == nil {
+		t.Fatalf("Expected key with invalid window to be refused")
+	}
+}
+
+func TestCreateRevokeRotate(t *testing.T) {
+	store := storage.NewStore(t.TempDir())
+	m := newKeyManager(store, config.GetAPIKeys())
+
+	status, secret, err := m.Create(KeySpec{Name: "reader", Scopes: []string{config.ScopeStateRead}})
+	if err != nil {
+		t.Fatalf("Error creating key: %v", err)
+	}
+	if status.Source != SourceRuntime || status.Created == nil {
+		t.Fatalf("Unexpected key status: %+v", status)
+	}
+	if !matches(m.Keys(), "reader", secret) {
+		t.Fatalf("Expected the secret to match the stored hash")
+	}
+	_, _, err = m.Create(KeySpec{Name: "reader", Scopes: []string{config.ScopeAdmin}})
+	if !errors.Is(err, ErrExists) {
+		t.Fatalf("Expected ErrExists, got %v", err)
+	}
+	_, _, err = m.Create(KeySpec{Name: "test", Scopes: []string{config.ScopeAdmin}})
+	if !errors.Is(err, ErrExists) {
+		t.Fatalf("Expected ErrExists for the name of a static key, got %v", err)
+	}
+	if _, _, err := m.Create(KeySpec{Name: "bad", Scopes: []string{"root"}}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("Expected ErrInvalid, got %v", err)
+	}
+	spec := KeySpec{Name: "bad", Scopes: []string{config.ScopeStateRead}, Door: "shed"}
+	if _, _, err := m.Create(spec); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("Expected ErrInvalid for another door, got %v", err)
+	}
+
+	before := epoch(m)
+	_, rotated, err := m.Rotate("reader")
+	if err != nil {
+		t.Fatalf("Error rotating key: %v", err)
+	}
+	if epoch(m) == before {
+		t.Fatalf("Expected rotation to clear the cache")
+	}
+	if matches(m.Keys(), "reader", secret) || !matches(m.Keys(), "reader", rotated) {
+		t.Fatalf("Expected only the new secret to match after rotation")
+	}
+
+	m.Used("reader", time.Now())
+	m.saveUsage()
+	if list := m.List(); len(list) != 2 || list[0].Name != "reader" || list[0].LastUsed == nil {
+		t.Fatalf("Expected reader with last use and test, got %+v", list)
+	}
+
+	if err := m.Revoke("test"); !errors.Is(err, ErrStatic) {
+		t.Fatalf("Expected ErrStatic, got %v", err)
+	}
+	if err := m.Revoke("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	if err := m.Revoke("reader"); err != nil {
+		t.Fatalf("Error revoking key: %v", err)
+	}
+	if len(m.Keys()) != 1 {
+		t.Fatalf("Expected only the static key after revocation")
+	}
+}
+
+func TestChangesFromOtherProcess(t *testing.T) {
+	store := storage.NewStore(t.TempDir())
+	service := newKeyManager(store, nil)
+	if len(service.Keys()) != 0 {
+		t.Fatalf("Expected no keys")
+	}
+	before := epoch(service)
+
+	// The command line uses its own KeyManager on the same data directory.
+	cli := newKeyManager(storage.NewStore(store.Dir()), nil)
+	if _, _, err := cli.Create(KeySpec{Name: "cli", Scopes: []string{config.ScopeAdmin}}); err != nil {
+		t.Fatalf("Error creating key: %v", err)
+	}
+
+	service.lock.Lock()
+	service.checked = time.Time{}
+	service.lock.Unlock()
+	if keys := service.Keys(); len(keys) != 1 || keys[0].Name != "cli" {
+		t.Fatalf("Expected the key created by the command line, got %+v", keys)
+	}
+	if epoch(service) == before {
+		t.Fatalf("Expected the change to clear the cache")
+	}
+
+	// A key revoked by the command line is refused after the refresh interval, even when it was verified before.
+	_, secret, err := cli.Rotate("cli")
+	if err != nil {
+		t.Fatalf("Error rotating key: %v", err)
+	}
+	now := time.Now()
+	if _, err := service.Verify(secret, now.Add(refreshInterval)); err != nil {
+		t.Fatalf("Expected the rotated key to be verified, got %v", err)
+	}
+	if err := cli.Revoke("cli"); err != nil {
+		t.Fatalf("Error revoking key: %v", err)
+	}
+	if _, err := service.Verify(secret, now.Add(2*refreshInterval)); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Expected the revoked key to be refused, got %v", err)
+	}
+
+	// Changes made at the same time by the service and the command line are all kept.
+	var wg sync.WaitGroup
+	for i, m := range []*KeyManager{service, cli, service, cli} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			spec := KeySpec{Name: fmt.Sprintf("key%d", i), Scopes: []string{config.ScopeStateRead}}
+			if _, _, err := m.Create(spec); err != nil {
+				t.Errorf("Error creating key: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if list := newKeyManager(storage.NewStore(store.Dir()), nil).List(); len(list) != 4 {
+		t.Fatalf("Expected the 4 keys created concurrently, got %+v", list)
+	}
+}
+
+func matches(keys []*Key, name string, secret string) bool {
+	for _, key := range keys {
+		if key.Name == name {
+			return bcrypt.CompareHashAndPassword([]byte(key.Hash), []byte(secret)) == nil
+		}
+	}
+	return false
+}
+
+func epoch(m *KeyManager) uint64 {
+	m.verifier.lock.Lock()
+	defer m.verifier.lock.Unlock()
+	return m.verifier.epoch
+}
+
+func testKeys(t *testing.T, secret string) func() []*Key {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Error hashing secret: %v", err)
+	}
+	key := newKey(KeySpec{Name: "cached", Scopes: []string{config.ScopeAdmin}}, string(hash), SourceRuntime, nil,
+		time.UTC)
+	return func() []*Key {
+		return []*Key{key}
+	}
+}
+
+func TestVerifierCache(t *testing.T) {
+	v := newVerifier(time.Minute, time.Minute, 10, 100)
+	keys := testKeys(t, "secret")
+	now := time.Now()
+
+	key, err := v.verify("secret", now, keys)
+	if err != nil || key.Name != "cached" {
+		t.Fatalf("Expected key to be verified, got %v, %v", key, err)
+	}
+	for id := range v.verified {
+		if strings.Contains(id, "secret") {
+			t.Fatalf("Expected the cache not to hold the secret")
+		}
+	}
+	// Cached secrets aren't checked against the keys again.
+	none := func() []*Key { return nil }
+	if _, err := v.verify("secret", now.Add(30*time.Second), none); err != nil {
+		t.Fatalf("Expected cached key to be verified, got %v", err)
+	}
+	if _, err := v.verify("secret", now.Add(2*time.Minute), none); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Expected expired entry to be checked again, got %v", err)
+	}
+
+	if _, err := v.verify("wrong", now, keys); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Expected ErrUnknownKey, got %v", err)
+	}
+	if _, err := v.verify("wrong", now.Add(30*time.Second), func() []*Key {
+		t.Fatalf("Expected refused secret not to be checked again")
+		return nil
+	}); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Expected ErrUnknownKey, got %v", err)
+	}
+
+	v.invalidate()
+	if len(v.verified) != 0 || len(v.refused) != 0 {
+		t.Fatalf("Expected invalidate to clear the cache")
+	}
+}
+
+func TestVerifierBounds(t *testing.T) {
+	v := newVerifier(time.Minute, time.Minute, 3, 1000)
+	keys := testKeys(t, "secret")
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		v.verify(fmt.Sprintf("wrong-%d", i), now.Add(time.Duration(i)*time.Millisecond), keys)
+	}
+	if len(v.refused) != 3 {
+		t.Fatalf("Expected the refused secrets to be bounded to 3, got %d", len(v.refused))
+	}
+}
+
+func TestVerifierThrottle(t *testing.T) {
+	v := newVerifier(time.Minute, time.Minute, 100, 2)
+	keys := testKeys(t, "secret")
+	now := time.Now()
+	if _, err := v.verify("secret", now, keys); err != nil {
+		t.Fatalf("Expected key to be verified, got %v", err)
+	}
+
+	// The burst is twice the rate, one token was used for the valid key.
+	throttled := 0
+	for i := 0; i < 10; i++ {
+		if _, err := v.verify(fmt.Sprintf("wrong-%d", i), now, keys); errors.Is(err, ErrThrottled) {
+			throttled++
+		}
+	}
+	if throttled != 7 {
+		t.Fatalf("Expected 7 throttled verifications, got %d", throttled)
+	}
+	// Known keys are still verified, even when their entry expired.
+	if _, err := v.verify("secret", now.Add(2*time.Minute), keys); err != nil {
+		t.Fatalf("Expected known key to bypass the throttle, got %v", err)
+	}
+	if _, err := v.verify("wrong-new", now.Add(2*time.Minute+time.Second), keys); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Expected tokens to be refilled, got %v", err)
+	}
+}
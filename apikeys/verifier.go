@@ -0,0 +1,164 @@
+package apikeys
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Errors returned when verifying a key.
+var (
+	ErrUnknownKey = errors.New("apikeys: unknown key")
+	ErrThrottled  = errors.New("apikeys: too many unknown keys, try again later")
+)
+
+// A verified or refused key in the cache.
+type cacheEntry struct {
+	key     *Key
+	expires time.Time
+}
+
+// verifier checks secrets against the bcrypt hashes of the keys, and caches the result. Secrets are cached by an
+// HMAC with a random per-process key, so the cache never holds them in plain text. Both verified and refused secrets
+// are cached for a limited time, and the number of entries is bounded. Secrets that aren't in the cache are checked
+// at a limited rate, as every check runs bcrypt against all keys.
+type verifier struct {
+	hmacKey     []byte
+	ttl         time.Duration
+	negativeTTL time.Duration
+	size        int
+	rate        float64
+	burst       float64
+	tokens      float64
+	refilled    time.Time
+	verified    map[string]cacheEntry
+	refused     map[string]cacheEntry
+	epoch       uint64
+	lock        sync.Mutex
+}
+
+// Creates a new verifier. The rate is the number of uncached secrets checked per second, with a burst of twice the
+// rate.
+func newVerifier(ttl time.Duration, negativeTTL time.Duration, size int, rate float64) *verifier {
+	hmacKey := make([]byte, 32)
+	if _, err := rand.Read(hmacKey); err != nil {
+		panic(err)
+	}
+	return &verifier{
+		hmacKey:     hmacKey,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		size:        size,
+		rate:        rate,
+		burst:       2 * rate,
+		tokens:      2 * rate,
+		verified:    make(map[string]cacheEntry),
+		refused:     make(map[string]cacheEntry),
+	}
+}
+
+// Verify a secret against the given keys. Returns ErrUnknownKey if no key matches, or ErrThrottled if the secret
+// isn't cached and too many secrets were checked recently. Secrets of verified keys whose cache entry expired are
+// checked again without throttling, so a flood of unknown keys doesn't lock out known clients.
+func (v *verifier) verify(secret string, now time.Time, keys func() []*Key) (*Key, error) {
+	id := v.hash(secret)
+
+	v.lock.Lock()
+	if entry, ok := v.verified[id]; ok {
+		if now.Before(entry.expires) {
+			v.lock.Unlock()
+			return entry.key, nil
+		}
+	} else if entry, ok := v.refused[id]; ok && now.Before(entry.expires) {
+		v.lock.Unlock()
+		return nil, ErrUnknownKey
+	} else if !v.take(now) {
+		v.lock.Unlock()
+		return nil, ErrThrottled
+	}
+	epoch := v.epoch
+	v.lock.Unlock()
+
+	// Run bcrypt without holding the lock, so cached secrets are verified while this runs.
+	var match *Key
+	for _, key := range keys() {
+		if bcrypt.CompareHashAndPassword([]byte(key.Hash), []byte(secret)) == nil {
+			match = key
+			break
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	// Don't cache the result if the keys changed in the meantime.
+	if epoch == v.epoch {
+		if match != nil {
+			delete(v.refused, id)
+			v.store(v.verified, id, cacheEntry{key: match, expires: now.Add(v.ttl)}, now)
+		} else {
+			delete(v.verified, id)
+			v.store(v.refused, id, cacheEntry{expires: now.Add(v.negativeTTL)}, now)
+		}
+	}
+	if match == nil {
+		return nil, ErrUnknownKey
+	}
+	return match, nil
+}
+
+// Invalidate clears the cache, e.g. because keys were revoked, rotated or reloaded.
+func (v *verifier) invalidate() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.verified = make(map[string]cacheEntry)
+	v.refused = make(map[string]cacheEntry)
+	v.epoch++
+}
+
+// Compute the keyed hash identifying a secret in the cache.
+func (v *verifier) hash(secret string) string {
+	mac := hmac.New(sha256.New, v.hmacKey)
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Take a token to check an uncached secret. Returns false if there are none left. The caller must hold the lock.
+func (v *verifier) take(now time.Time) bool {
+	if !v.refilled.IsZero() {
+		v.tokens += now.Sub(v.refilled).Seconds() * v.rate
+		if v.tokens > v.burst {
+			v.tokens = v.burst
+		}
+	}
+	v.refilled = now
+	if v.tokens < 1 {
+		return false
+	}
+	v.tokens--
+	return true
+}
+
+// Add an entry to a cache. When the cache is full, expired entries are removed first, then the entry expiring first.
+// The caller must hold the lock.
+func (v *verifier) store(cache map[string]cacheEntry, id string, entry cacheEntry, now time.Time) {
+	if _, exists := cache[id]; !exists && len(cache) >= v.size {
+		oldest := ""
+		for key, e := range cache {
+			if !now.Before(e.expires) {
+				delete(cache, key)
+			} else if oldest == "" || e.expires.Before(cache[oldest].expires) {
+				oldest = key
+			}
+		}
+		if len(cache) >= v.size && oldest != "" {
+			delete(cache, oldest)
+		}
+	}
+	cache[id] = entry
+}
@@ -0,0 +1,509 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/logging"
+)
+
+// Logger of the audit component.
+var logger = logging.Logger("audit")
+
+// Enumeration of the types of audit entries.
+const (
+	TypeStart        = "start"         // TypeStart records a start of the service
+	TypeRotate       = "rotate"        // TypeRotate starts every file after a rotation, continuing the chain
+	TypeCommand      = "command"       // TypeCommand records an actuating command, with outcome accepted or rejected
+	TypeActuation    = "actuation"     // TypeActuation records a pulse on the toggle relay
+	TypeAuthFailure  = "auth_failure"  // TypeAuthFailure records a failed authentication
+	TypeBan          = "ban"           // TypeBan records a client banned after too many failed authentications
+	TypeUnban        = "unban"         // TypeUnban records a ban cleared by an administrator
+	TypeKeyCreate    = "key_create"    // TypeKeyCreate records the creation of an API key
+	TypeKeyRevoke    = "key_revoke"    // TypeKeyRevoke records the revocation of an API key
+	TypeKeyRotate    = "key_rotate"    // TypeKeyRotate records the rotation of the secret of an API key
+	TypeLock         = "lock"          // TypeLock records engaging the maintenance lock
+	TypeUnlock       = "unlock"        // TypeUnlock records releasing the maintenance lock
+	TypeConfigReload = "config_reload" // TypeConfigReload records a reload of the configuration
+	TypeLogLevels    = "log_levels"    // TypeLogLevels records a change of the log levels at runtime
+	TypeDropped      = "dropped"       // TypeDropped records entries dropped when the audit log couldn't keep up
+	TypeRepair       = "repair"        // TypeRepair follows a damaged line, e.g. torn by a crash
+)
+
+// Size of the chunks read backwards from the end of a file to find its last entry.
+const chunkSize = 64 * 1024
+
+// Maximum size in bytes of the actor, the message, and the keys and values of the details of an entry. Longer values,
+// e.g. paths or usernames sent by clients, are truncated, so entries stay small.
+const maxFieldSize = 1024
+
+// ErrBroken is returned by Verify when an entry was changed, removed or inserted.
+var ErrBroken = errors.New("audit: hash chain is broken")
+
+// Entry is a single line of the audit log. The hash covers the entry and the hash of the previous entry, so an entry
+// can't be changed or removed without breaking the chain. The sequence number increases by one with every entry,
+// across rotations.
+type Entry struct {
+	Seq     uint64            `json:"seq"`
+	Time    time.Time         `json:"time"`
+	Type    string            `json:"type"`
+	Actor   string            `json:"actor,omitempty"`
+	Outcome string            `json:"outcome,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+	Prev    string            `json:"prev"`
+	Hash    string            `json:"hash,omitempty"`
+}
+
+// Return the entry with its actor, message and details truncated to the maximum field size.
+func (e Entry) truncated() Entry {
+	e.Actor = truncate(e.Actor)
+	e.Message = truncate(e.Message)
+	if e.Details != nil {
+		details := make(map[string]string, len(e.Details))
+		for key, value := range e.Details {
+			details[truncate(key)] = truncate(value)
+		}
+		e.Details = details
+	}
+	return e
+}
+
+// Truncate a value to the maximum field size, on a character boundary, marking it with an ellipsis.
+func truncate(value string) string {
+	if len(value) <= maxFieldSize {
+		return value
+	}
+	cut := maxFieldSize
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut] + "…"
+}
+
+// Compute the hash of an entry: the SHA-256 of the hash of the previous entry, and the entry without its hash.
+func (e Entry) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(e.Prev+"\n"), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+var (
+	instance *Log
+	once     sync.Once
+)
+
+// Log is an append-only audit log in JSON lines, chained by hashes. Every append locks the file, so the service and
+// the command line tools can write to the same log. The file is rotated when it exceeds its maximum size, or when its
+// first entry is older than the maximum age. Rotated files are kept next to it, named after their last sequence
+// number, and the chain continues in the new file.
+type Log struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	lock    sync.Mutex
+}
+
+// GetAuditLog returns the one and only Log instance, configured from the configuration file, or nil when the audit
+// log is disabled.
+func GetAuditLog() *Log {
+	once.Do(func() {
+		if config.GetAuditEnabled() {
+			instance = NewLog(config.GetAuditFile(), config.GetAuditMaxSize(), config.GetAuditMaxAge())
+		}
+	})
+	return instance
+}
+
+// NewLog creates a new Log object writing to the given file. A zero maximum size or age disables rotation by size or
+// time.
+func NewLog(path string, maxSize int64, maxAge time.Duration) *Log {
+	return &Log{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+}
+
+// Path returns the path of the current file.
+func (l *Log) Path() string {
+	return l.path
+}
+
+// Record appends an entry to the audit log of the service. The entry is written in the background when the recorder
+// is running and has room for it, and synchronously otherwise, logging an error when it can't be written. Only failed
+// authentications are dropped when the recorder can't keep up. Does nothing when the audit log is disabled.
+func Record(entry Entry) {
+	l := GetAuditLog()
+	if l == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	r := GetRecorder()
+	if !r.queue(entry) {
+		r.write(entry)
+	}
+}
+
+// Append adds an entry to the log, setting its sequence number, time (unless set), and hashes. Values longer than the
+// maximum field size are truncated. Returns the entry as written.
+func (l *Log) Append(entry Entry) (Entry, error) {
+	entry = entry.truncated()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return Entry{}, fmt.Errorf("audit: failed to create directory: %w", err)
+	}
+	file, err := l.openLocked()
+	if err != nil {
+		return Entry{}, err
+	}
+	defer file.Close()
+
+	ends, err := readEnds(file)
+	if err != nil {
+		return Entry{}, err
+	}
+	last := ends.last
+	if !ends.terminated {
+		if _, err := file.Write([]byte{'\n'}); err != nil {
+			return Entry{}, fmt.Errorf("audit: failed to write entry: %w", err)
+		}
+	}
+	if ends.damaged > 0 {
+		if last, err = repair(file, ends); err != nil {
+			return Entry{}, err
+		}
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if l.rotationDue(ends.first, ends.size, entry.Time) {
+		rotatedFile, rotateEntry, err := l.rotate(last, entry.Time)
+		if err != nil {
+			return Entry{}, err
+		}
+		defer rotatedFile.Close()
+		file, last = rotatedFile, rotateEntry
+	}
+	return write(file, last, entry)
+}
+
+// Rotate the current file, keeping it under its rotated name. It is replaced by a new file that starts with a rotate
+// entry, so other writers never see an empty file. Returns the new file, locked, and the rotate entry. The caller
+// must hold the lock of the current file.
+func (l *Log) rotate(last Entry, now time.Time) (*os.File, Entry, error) {
+	rotated := l.rotatedPath(last.Seq)
+	file, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".tmp")
+	if err != nil {
+		return nil, Entry{}, fmt.Errorf("audit: failed to rotate: %w", err)
+	}
+	fail := func(err error) (*os.File, Entry, error) {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, Entry{}, fmt.Errorf("audit: failed to rotate: %w", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return fail(err)
+	}
+	entry, err := write(file, last, Entry{
+		Time:    now,
+		Type:    TypeRotate,
+		Message: "Continued from " + filepath.Base(rotated),
+	})
+	if err != nil {
+		return fail(err)
+	}
+	if err := os.Link(l.path, rotated); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(file.Name(), l.path); err != nil {
+		os.Remove(rotated)
+		return fail(err)
+	}
+	return file, entry, nil
+}
+
+// Open the current file for appending, and lock it exclusively. The lock is released when the file is closed. When
+// the file was rotated by another process while waiting for the lock, the new file is opened.
+func (l *Log) openLocked() (*os.File, error) {
+	for {
+		file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("audit: failed to open %s: %w", l.path, err)
+		}
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("audit: failed to lock %s: %w", l.path, err)
+		}
+		opened, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("audit: failed to open %s: %w", l.path, err)
+		}
+		if current, err := os.Stat(l.path); err == nil && os.SameFile(opened, current) {
+			return file, nil
+		}
+		file.Close()
+	}
+}
+
+// Check if the file must be rotated before appending an entry at the given time.
+func (l *Log) rotationDue(first Entry, size int64, now time.Time) bool {
+	if size == 0 {
+		return false
+	}
+	if l.maxSize > 0 && size >= l.maxSize {
+		return true
+	}
+	return l.maxAge > 0 && !first.Time.IsZero() && now.Sub(first.Time) >= l.maxAge
+}
+
+// Path of a rotated file whose last entry has the given sequence number, e.g. audit-0000000042.jsonl for audit.jsonl.
+func (l *Log) rotatedPath(seq uint64) string {
+	ext := filepath.Ext(l.path)
+	return fmt.Sprintf("%s-%010d%s", strings.TrimSuffix(l.path, ext), seq, ext)
+}
+
+// Files returns the rotated files and the current file of the log, oldest first.
+func (l *Log) Files() ([]string, error) {
+	ext := filepath.Ext(l.path)
+	rotated, err := filepath.Glob(strings.TrimSuffix(l.path, ext) + "-[0-9]*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rotated)
+	if _, err := os.Stat(l.path); err == nil {
+		rotated = append(rotated, l.path)
+	}
+	return rotated, nil
+}
+
+// Write an entry chained to the last one, and flush it to disk. Returns the entry as written.
+func write(file *os.File, last Entry, entry Entry) (Entry, error) {
+	entry.Seq = last.Seq + 1
+	entry.Prev = last.Hash
+	entry.Time = entry.Time.UTC()
+	hash, err := entry.computeHash()
+	if err != nil {
+		return Entry{}, fmt.Errorf("audit: failed to encode entry: %w", err)
+	}
+	entry.Hash = hash
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return Entry{}, fmt.Errorf("audit: failed to encode entry: %w", err)
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return Entry{}, fmt.Errorf("audit: failed to write entry: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return Entry{}, fmt.Errorf("audit: failed to write entry: %w", err)
+	}
+	return entry, nil
+}
+
+// Continue the chain after a damaged last line with a repair entry, chained to the entry before the damaged line.
+// Returns the repair entry.
+func repair(file *os.File, ends fileEnds) (Entry, error) {
+	logger.Warn().Msgf("Last line of %s is damaged, continuing the chain after entry %d", file.Name(), ends.last.Seq)
+	return write(file, ends.last, Entry{
+		Time:    time.Now(),
+		Type:    TypeRepair,
+		Actor:   "system",
+		Message: fmt.Sprintf("Skipped a damaged line of %d bytes after entry %d", ends.damaged, ends.last.Seq),
+		Details: map[string]string{"bytes": strconv.FormatInt(ends.damaged, 10)},
+	})
+}
+
+// The first and the last entry of a file, its size, and whether it ends with a newline. When the last line is damaged,
+// e.g. torn by a crash while it was written, the last entry is the one before it, and damaged is the length of the
+// damaged line.
+type fileEnds struct {
+	first      Entry
+	last       Entry
+	size       int64
+	damaged    int64
+	terminated bool
+}
+
+// Read the ends of a file. An empty file has no entries. Only the last line may be damaged, as the chain can't be
+// continued otherwise.
+func readEnds(file *os.File) (fileEnds, error) {
+	failed := func(err error) (fileEnds, error) {
+		return fileEnds{}, fmt.Errorf("audit: failed to read %s: %w", file.Name(), err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return failed(err)
+	}
+	ends := fileEnds{size: info.Size(), terminated: true}
+	if ends.size == 0 {
+		return ends, nil
+	}
+	end := make([]byte, 1)
+	if _, err := file.ReadAt(end, ends.size-1); err != nil {
+		return failed(err)
+	}
+	ends.terminated = end[0] == '\n'
+
+	line, start, err := readLastLine(file, ends.size)
+	if err != nil {
+		return failed(err)
+	}
+	if json.Unmarshal(line, &ends.last) != nil {
+		ends.last = Entry{}
+		ends.damaged = int64(len(line))
+		if start == 0 {
+			// The damaged line is the only one, the chain starts over.
+			return ends, nil
+		}
+		if line, _, err = readLastLine(file, start); err != nil {
+			return failed(err)
+		}
+		if json.Unmarshal(line, &ends.last) != nil {
+			ends.last.Hash = ""
+		}
+	}
+	if ends.last.Hash == "" {
+		return fileEnds{}, fmt.Errorf("audit: last entry of %s is invalid, refusing to continue the chain",
+			file.Name())
+	}
+
+	head, err := bufio.NewReader(io.NewSectionReader(file, 0, ends.size)).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return failed(err)
+	}
+	if err := json.Unmarshal(head, &ends.first); err != nil {
+		return fileEnds{}, fmt.Errorf("audit: first entry of %s is invalid: %w", file.Name(), err)
+	}
+	return ends, nil
+}
+
+// Read the last line of a file of the given size, without its newline, and its offset. The file is read backwards in
+// chunks until the newline before the last line, so lines of any length are found.
+func readLastLine(file *os.File, size int64) ([]byte, int64, error) {
+	var tail []byte
+	for offset := size; offset > 0; {
+		n := min(chunkSize, offset)
+		offset -= n
+		chunk := make([]byte, n, n+int64(len(tail)))
+		if _, err := file.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		tail = bytes.TrimRight(append(chunk, tail...), "\n")
+		if i := bytes.LastIndexByte(tail, '\n'); i >= 0 {
+			return tail[i+1:], offset + int64(i) + 1, nil
+		}
+	}
+	return tail, 0, nil
+}
+
+// Result of the verification of a chain.
+type Result struct {
+	Entries  int    // Entries is the number of verified entries
+	FirstSeq uint64 // FirstSeq is the sequence number of the first entry
+	LastSeq  uint64 // LastSeq is the sequence number of the last entry
+	Anchored bool   // Anchored is true if the chain starts at the very first entry, rather than in a removed file
+	Repaired int    // Repaired is the number of damaged lines skipped, each followed by a repair entry
+}
+
+// Verify checks the hash chain of the given files, oldest first. Returns the result, or an error wrapping ErrBroken
+// with the file and line where the chain is broken.
+func Verify(files []string) (Result, error) {
+	var result Result
+	var last Entry
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			return result, err
+		}
+		err = verifyFile(file, &result, &last)
+		file.Close()
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// Verify the entries of a file, continuing the chain from the last entry of the previous file. A damaged line, e.g.
+// torn by a crash, is skipped when it is followed by a repair entry with its length.
+func verifyFile(file *os.File, result *Result, last *Entry) error {
+	reader := bufio.NewReader(file)
+	line := 0
+	damagedLine, damagedSize := 0, 0
+	var damagedErr error
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("%w at %s:%d: %v", ErrBroken, file.Name(), line+1, err)
+		}
+		if len(data) == 0 && damagedLine > 0 {
+			return fmt.Errorf("%w at %s:%d: invalid entry: %v", ErrBroken, file.Name(), damagedLine, damagedErr)
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		line++
+		broken := func(format string, args ...any) error {
+			return fmt.Errorf("%w at %s:%d: %s", ErrBroken, file.Name(), line, fmt.Sprintf(format, args...))
+		}
+		var entry Entry
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&entry); err != nil {
+			if damagedLine > 0 {
+				return broken("invalid entry: %v", err)
+			}
+			damagedLine, damagedSize, damagedErr = line, len(bytes.TrimRight(data, "\n")), err
+			continue
+		}
+		if damagedLine > 0 {
+			if entry.Type != TypeRepair || entry.Details["bytes"] != strconv.Itoa(damagedSize) {
+				return fmt.Errorf("%w at %s:%d: invalid entry: %v", ErrBroken, file.Name(), damagedLine, damagedErr)
+			}
+			result.Repaired++
+			damagedLine = 0
+		}
+		if hash, err := entry.computeHash(); err != nil || hash != entry.Hash {
+			return broken("entry %d was modified", entry.Seq)
+		}
+		if result.Entries == 0 {
+			result.FirstSeq = entry.Seq
+			result.Anchored = entry.Seq == 1 && entry.Prev == ""
+		} else {
+			if entry.Seq != last.Seq+1 {
+				return broken("expected entry %d, found entry %d", last.Seq+1, entry.Seq)
+			}
+			if entry.Prev != last.Hash {
+				return broken("entry %d doesn't follow entry %d", entry.Seq, last.Seq)
+			}
+		}
+		result.Entries++
+		result.LastSeq = entry.Seq
+		*last = entry
+	}
+}
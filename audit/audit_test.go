@@ -0,0 +1,256 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Append n command entries to a log.
+func appendEntries(t *testing.T, l *Log, n int, now time.Time) {
+	for i := 0; i < n; i++ {
+		if _, err := l.Append(Entry{Time: now, Type: TypeCommand, Actor: "key:test", Outcome: "accepted"}); err != nil {
+			t.Fatalf("Error appending entry: %v", err)
+		}
+	}
+}
+
+func TestAppendAndVerify(t *testing.T) {
+	l := NewLog(filepath.Join(t.TempDir(), "audit.jsonl"), 0, 0)
+	appendEntries(t, l, 5, time.Now())
+	entry, err := l.Append(Entry{Type: TypeLock, Actor: "user:admin", Message: "painting"})
+	if err != nil || entry.Seq != 6 || entry.Prev == "" || entry.Hash == "" {
+		t.Fatalf("Expected sixth entry to be chained, got %+v, %v", entry, err)
+	}
+	if info, err := os.Stat(l.Path()); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected audit log only readable by the owner, got %v, %v", info, err)
+	}
+
+	result, err := Verify([]string{l.Path()})
+	if err != nil || result.Entries != 6 || result.FirstSeq != 1 || result.LastSeq != 6 || !result.Anchored {
+		t.Fatalf("Expected valid chain of 6 entries, got %+v, %v", result, err)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	original := func() []string {
+		os.Remove(path)
+		appendEntries(t, NewLog(path, 0, 0), 4, time.Now())
+		data, _ := os.ReadFile(path)
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	tests := map[string]func(lines []string) []string{
+		"edit": func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], "key:test", "key:other", 1)
+			return lines
+		},
+		"delete": func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		},
+		"swap": func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		},
+		"extra field": func(lines []string) []string {
+			lines[2] = strings.Replace(lines[2], "{", `{"note":"x",`, 1)
+			return lines
+		},
+	}
+	for name, tamper := range tests {
+		lines := tamper(original())
+		os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+		if _, err := Verify([]string{path}); !errors.Is(err, ErrBroken) {
+			t.Fatalf("Expected %s to break the chain, got %v", name, err)
+		}
+	}
+
+	// A log with more than one damaged line at the end isn't continued.
+	lines := original()
+	os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n{\"seq\":5,\n{\"seq\":6,"), 0600)
+	if _, err := NewLog(path, 0, 0).Append(Entry{Type: TypeStart}); err == nil {
+		t.Fatalf("Expected append after invalid last entries to fail")
+	}
+}
+
+func TestRepair(t *testing.T) {
+	l := NewLog(filepath.Join(t.TempDir(), "audit.jsonl"), 0, 0)
+	appendEntries(t, l, 3, time.Now())
+	file, _ := os.OpenFile(l.Path(), os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(`{"seq":4,"time":`)
+	file.Close()
+	if _, err := Verify([]string{l.Path()}); !errors.Is(err, ErrBroken) {
+		t.Fatalf("Expected a torn last line to break the chain until it is repaired, got %v", err)
+	}
+
+	// The torn line is skipped by a repair entry, chained to the entry before it.
+	entry, err := l.Append(Entry{Type: TypeStart})
+	if err != nil || entry.Seq != 5 {
+		t.Fatalf("Expected append after a torn line to continue the chain, got %+v, %v", entry, err)
+	}
+	result, err := Verify([]string{l.Path()})
+	if err != nil || result.Entries != 5 || result.Repaired != 1 {
+		t.Fatalf("Expected valid chain of 5 entries with a repaired line, got %+v, %v", result, err)
+	}
+
+	// A repair entry doesn't cover a damaged line of another length.
+	data, _ := os.ReadFile(l.Path())
+	os.WriteFile(l.Path(), []byte(strings.Replace(string(data), "\"time\":\n", "\"time\":0\n", 1)), 0600)
+	if _, err := Verify([]string{l.Path()}); !errors.Is(err, ErrBroken) {
+		t.Fatalf("Expected a changed damaged line to break the chain, got %v", err)
+	}
+
+	// The recorder reports failing writes until an entry is written again.
+	os.WriteFile(l.Path(), []byte("{\n{"), 0600)
+	r := newRecorder(l, 1)
+	r.write(Entry{Type: TypeCommand})
+	if r.Err() == nil {
+		t.Fatalf("Expected the recorder to report the failed write")
+	}
+	os.Remove(l.Path())
+	r.write(Entry{Type: TypeCommand})
+	if err := r.Err(); err != nil {
+		t.Fatalf("Expected the recorder to recover, got %v", err)
+	}
+}
+
+func TestLongEntries(t *testing.T) {
+	l := NewLog(filepath.Join(t.TempDir(), "audit.jsonl"), 0, 0)
+	entry, err := l.Append(Entry{
+		Type:    TypeAuthFailure,
+		Actor:   "ip:127.0.0.1",
+		Details: map[string]string{"path": "/" + strings.Repeat("a", 70000)},
+	})
+	path := entry.Details["path"]
+	if err != nil || len(path) > maxFieldSize+len("…") || !strings.HasSuffix(path, "…") {
+		t.Fatalf("Expected long path to be truncated, got %d bytes, %v", len(path), err)
+	}
+
+	// An entry longer than a chunk, e.g. written before values were truncated, doesn't break the chain.
+	file, err := os.OpenFile(l.Path(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("Error opening audit log: %v", err)
+	}
+	if _, err := write(file, entry, Entry{Type: TypeCommand, Message: strings.Repeat("b", 3*chunkSize)}); err != nil {
+		t.Fatalf("Error writing long entry: %v", err)
+	}
+	file.Close()
+	appendEntries(t, l, 2, time.Now())
+	if result, err := Verify([]string{l.Path()}); err != nil || result.Entries != 4 {
+		t.Fatalf("Expected valid chain of 4 entries, got %+v, %v", result, err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	// Rotation by size continues the chain in the new file.
+	l := NewLog(filepath.Join(dir, "audit.jsonl"), 1000, 0)
+	appendEntries(t, l, 20, now)
+	files, err := l.Files()
+	if err != nil || len(files) < 3 || files[len(files)-1] != l.Path() {
+		t.Fatalf("Expected rotated files followed by the current file, got %v, %v", files, err)
+	}
+	for _, file := range files {
+		if info, _ := os.Stat(file); info.Size() > 1000+400 {
+			t.Fatalf("Expected %s to be rotated near the maximum size, got %d bytes", file, info.Size())
+		}
+	}
+	result, err := Verify(files)
+	if err != nil || !result.Anchored || result.Entries != 20+len(files)-1 {
+		t.Fatalf("Expected chain across rotated files, got %+v, %v", result, err)
+	}
+
+	// Removing a rotated file breaks the chain, removing the oldest one leaves a valid chain that isn't anchored.
+	if _, err := Verify(append([]string{files[0]}, files[2:]...)); !errors.Is(err, ErrBroken) {
+		t.Fatalf("Expected missing file to break the chain, got %v", err)
+	}
+	if result, err := Verify(files[1:]); err != nil || result.Anchored {
+		t.Fatalf("Expected valid chain that isn't anchored, got %+v, %v", result, err)
+	}
+
+	// Rotation by time happens when the first entry is too old.
+	l = NewLog(filepath.Join(dir, "timed.jsonl"), 0, 24*time.Hour)
+	appendEntries(t, l, 2, now.Add(-25*time.Hour))
+	appendEntries(t, l, 1, now)
+	files, _ = l.Files()
+	if len(files) != 2 {
+		t.Fatalf("Expected one rotated file, got %v", files)
+	}
+	if result, err := Verify(files); err != nil || result.Entries != 4 {
+		t.Fatalf("Expected chain of 4 entries including the rotation, got %+v, %v", result, err)
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	// Separate Log objects behave like separate processes, sharing only the file lock.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l := NewLog(path, 2000, 0)
+			for j := 0; j < 25; j++ {
+				if _, err := l.Append(Entry{Type: TypeCommand, Actor: "key:test"}); err != nil {
+					t.Errorf("Error appending entry: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	files, _ := NewLog(path, 0, 0).Files()
+	result, err := Verify(files)
+	if err != nil || result.LastSeq != uint64(result.Entries) || result.Entries < 100 {
+		t.Fatalf("Expected a single chain of all entries, got %+v, %v", result, err)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	l := NewLog(filepath.Join(t.TempDir(), "audit.jsonl"), 0, 0)
+	r := newRecorder(l, 2)
+	if r.queue(Entry{Type: TypeCommand}) {
+		t.Fatalf("Expected entries not to be queued before the recorder is started")
+	}
+
+	// While the log is busy, failed authentications beyond the size of the queue are dropped, and counted in a dropped
+	// entry. Other entries are left to be written synchronously.
+	r.Start()
+	l.lock.Lock()
+	for i := 0; i < 10; i++ {
+		r.queue(Entry{Time: time.Now(), Type: TypeAuthFailure, Actor: "ip:127.0.0.1"})
+	}
+	if r.queue(Entry{Time: time.Now(), Type: TypeActuation, Actor: "key:test"}) {
+		t.Fatalf("Expected an actuation not to be dropped when the queue is full")
+	}
+	l.lock.Unlock()
+	r.Stop()
+
+	data, _ := os.ReadFile(l.Path())
+	failures, dropped := 0, 0
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry Entry
+		json.Unmarshal([]byte(line), &entry)
+		switch entry.Type {
+		case TypeAuthFailure:
+			failures++
+		case TypeDropped:
+			dropped, _ = strconv.Atoi(entry.Details["count"])
+		}
+	}
+	if failures == 0 || dropped == 0 || failures+dropped != 10 {
+		t.Fatalf("Expected written and dropped entries to add up to 10, got %d and %d:\n%s", failures, dropped, data)
+	}
+	if result, err := Verify([]string{l.Path()}); err != nil || result.Entries != failures+1 {
+		t.Fatalf("Expected valid chain with the dropped entry, got %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of entries waiting to be written, above which failed authentications are dropped.
+const queueSize = 256
+
+var (
+	recorder     *Recorder
+	recorderOnce sync.Once
+)
+
+// Recorder is a singleton that writes the entries of the service to the audit log in the background, so commands,
+// actuations and requests never wait for the file lock or the disk. When the queue is full, e.g. during a flood of
+// failed authentications, failed authentications are dropped, and the number of dropped entries is recorded once the
+// queue drains. Other entries are never dropped: they are written synchronously instead. Until it is started, all
+// entries are written synchronously, e.g. by the command line tools.
+type Recorder struct {
+	log     *Log
+	size    int
+	entries chan Entry
+	dropped atomic.Uint64
+	running bool
+	done    chan struct{}
+	err     error
+	lock    sync.RWMutex
+}
+
+// GetRecorder returns the one and only Recorder instance, writing to the audit log of the service.
+func GetRecorder() *Recorder {
+	recorderOnce.Do(func() {
+		recorder = newRecorder(GetAuditLog(), queueSize)
+	})
+	return recorder
+}
+
+// Creates a new Recorder object writing to the given log, with a queue of the given size.
+func newRecorder(l *Log, size int) *Recorder {
+	return &Recorder{
+		log:  l,
+		size: size,
+	}
+}
+
+// Start writing queued entries. Does nothing when the audit log is disabled.
+func (r *Recorder) Start() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.running || r.log == nil {
+		return
+	}
+	r.entries = make(chan Entry, r.size)
+	r.done = make(chan struct{})
+	r.running = true
+	go r.loop(r.entries, r.done)
+}
+
+// Stop writing in the background, after writing the queued entries. Later entries are written synchronously.
+func (r *Recorder) Stop() {
+	r.lock.Lock()
+	if !r.running {
+		r.lock.Unlock()
+		return
+	}
+	r.running = false
+	close(r.entries)
+	r.lock.Unlock()
+	<-r.done
+}
+
+// Queue an entry. When the queue is full, a failed authentication is dropped. Returns false when the entry must be
+// written synchronously: when the recorder isn't running, or the queue is full and the entry can't be dropped.
+func (r *Recorder) queue(entry Entry) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if !r.running {
+		return false
+	}
+	select {
+	case r.entries <- entry:
+	default:
+		if entry.Type != TypeAuthFailure {
+			return false
+		}
+		r.dropped.Add(1)
+	}
+	return true
+}
+
+// Write the queued entries until the queue is closed.
+func (r *Recorder) loop(entries <-chan Entry, done chan<- struct{}) {
+	defer close(done)
+	for entry := range entries {
+		r.write(entry)
+		r.recordDropped()
+	}
+	r.recordDropped()
+}
+
+// Err returns the error of the last write, or nil when it succeeded.
+func (r *Recorder) Err() error {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.err
+}
+
+// Write an entry, logging an error when it can't be written. The error is kept until an entry is written again.
+func (r *Recorder) write(entry Entry) {
+	_, err := r.log.Append(entry)
+	if err != nil {
+		logger.Error().Msgf("Error writing audit log: %v", err)
+	}
+	r.lock.Lock()
+	r.err = err
+	r.lock.Unlock()
+}
+
+// Record the number of entries dropped since the last call, if any.
+func (r *Recorder) recordDropped() {
+	dropped := r.dropped.Swap(0)
+	if dropped == 0 {
+		return
+	}
+	message := fmt.Sprintf("%d entries were dropped, as the audit log couldn't keep up", dropped)
+	logger.Warn().Msg(message)
+	r.write(Entry{
+		Type:    TypeDropped,
+		Actor:   "system",
+		Message: message,
+		Details: map[string]string{"count": strconv.FormatUint(dropped, 10)},
+	})
+}
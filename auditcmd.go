@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dlefevre/go.garagedoor-service/audit"
+	"github.com/dlefevre/go.garagedoor-service/config"
+)
+
+// Usage of the audit subcommand.
+const auditUsage = `Usage: garagedoor-service audit <command> [arguments]
+
+Commands:
+  verify [files]   verify the hash chain of the audit log, or of the given files, oldest first
+
+Without files, the rotated files and the current file of audit.file are verified. Every entry carries the hash of the
+previous one, so changed, inserted or removed entries break the chain. Removing the newest entries can only be
+detected by comparing the last sequence number with an earlier copy, e.g. from a backup or a remote log. A damaged
+last line, e.g. torn by a crash, is skipped by the service with a repair entry that continues the chain.
+`
+
+// Run the audit subcommand. Returns the exit code.
+func runAudit(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprint(stderr, auditUsage)
+		return 2
+	}
+	if err := config.Verify(); err != nil {
+		fmt.Fprintf(stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	files := args[1:]
+	if len(files) == 0 {
+		var err error
+		if files, err = audit.NewLog(config.GetAuditFile(), 0, 0).Files(); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		if len(files) == 0 {
+			fmt.Fprintf(stderr, "Error: no audit log found at %s\n", config.GetAuditFile())
+			return 1
+		}
+	}
+
+	result, err := audit.Verify(files)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "Verified %d entries (%d to %d) in %d files\n", result.Entries, result.FirstSeq,
+		result.LastSeq, len(files))
+	if result.Entries > 0 && !result.Anchored {
+		fmt.Fprintf(stdout, "The chain starts at entry %d, earlier entries weren't verified\n", result.FirstSeq)
+	}
+	if result.Repaired > 0 {
+		fmt.Fprintf(stdout, "Skipped %d damaged lines, each followed by a repair entry\n", result.Repaired)
+	}
+	return 0
+}
+
+// Exit with the result of the audit subcommand, if it was requested.
+func handleAuditCommand() {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAudit(os.Args[2:], os.Stdout, os.Stderr))
+	}
+}
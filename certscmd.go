@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/pki"
+	"github.com/dlefevre/go.garagedoor-service/storage"
+)
+
+// Usage of the certs subcommand.
+const certsUsage = `Usage: garagedoor-service certs <command> [arguments]
+
+Commands:
+  issue -name <name> [-days <days>]
+                   issue a client certificate for a device, signed by the local CA
+  revoke <name|serial>
+                   revoke the current client certificate issued for a name, or a client certificate by serial number
+  ca [-out <file>] export the CA certificate, for installation on phones and browsers
+  server           create the local CA and the server certificate for tls.hostnames, or renew the server certificate
+                   when it expires soon or doesn't cover all hosts
+
+The local CA is kept in tls.dir, and created when it doesn't exist yet. To authenticate with a client certificate,
+add its subject with a name and scopes to tls.client_certs, and pin its fingerprint so a certificate issued later
+for the same subject isn't accepted. The mapping is reloaded on SIGHUP. Revoked certificates are refused within
+seconds. Most phones import client certificates as PKCS #12, e.g.
+  openssl pkcs12 -export -in <name>.crt -inkey <name>.key -out <name>.p12
+`
+
+// Run the certs subcommand, managing the local CA. A running service picks up a renewed server certificate within
+// seconds. Returns the exit code.
+func runCerts(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, certsUsage)
+		return 2
+	}
+	if err := config.Verify(); err != nil {
+		fmt.Fprintf(stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	authority := pki.NewAuthority(config.GetTLSDir())
+	var err error
+	switch args[0] {
+	case "issue":
+		err = issueCertCommand(authority, args[1:], stdout, stderr)
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprint(stderr, certsUsage)
+			return 2
+		}
+		err = revokeCertCommand(authority, args[1], stdout)
+	case "ca":
+		err = exportCACommand(authority, args[1:], stdout, stderr)
+	case "server":
+		if len(args) != 1 {
+			fmt.Fprint(stderr, certsUsage)
+			return 2
+		}
+		var issued bool
+		if issued, err = authority.EnsureServer(config.GetTLSHostnames(), time.Now()); err == nil {
+			if issued {
+				fmt.Fprintf(stdout, "Issued server certificate %s for %v\n", authority.CertFile(),
+					config.GetTLSHostnames())
+			} else {
+				fmt.Fprintf(stdout, "Server certificate %s is up to date\n", authority.CertFile())
+			}
+		}
+	default:
+		fmt.Fprint(stderr, certsUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Issue a client certificate from the command line flags, and print where it was written.
+func issueCertCommand(authority *pki.Authority, args []string, stdout io.Writer, stderr io.Writer) error {
+	flags := flag.NewFlagSet("certs issue", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	name := flags.String("name", "", "name of the device, used as common name of the certificate")
+	days := flags.Int("days", int(pki.ClientValidity/(24*time.Hour)), "validity in days")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *days <= 0 {
+		return fmt.Errorf("the validity must be at least one day")
+	}
+
+	certFile, keyFile, err := authority.IssueClient(*name, time.Duration(*days)*24*time.Hour, time.Now())
+	if err != nil {
+		return err
+	}
+	cert, err := authority.Client(*name)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Issued client certificate %s with key %s\n", certFile, keyFile)
+	fmt.Fprintf(stdout, "Map it to scopes in tls.client_certs with subject: %s\n", pki.Subject(*name))
+	fmt.Fprintf(stdout, "and pin it with fingerprint: %s\n", pki.Fingerprint(cert))
+	fmt.Fprintf(stdout, "Its serial number is %s, valid until %s\n", pki.Serial(cert.SerialNumber),
+		cert.NotAfter.Format(time.DateOnly))
+	return nil
+}
+
+// Revoke the current client certificate issued for a name, or a client certificate by serial number, e.g. when it was
+// issued by another CA or was replaced since. The revocation is recorded in the data directory.
+func revokeCertCommand(authority *pki.Authority, target string, stdout io.Writer) error {
+	revocation := pki.Revocation{Revoked: time.Now()}
+	cert, err := authority.Client(target)
+	switch {
+	case err == nil:
+		revocation.Serial = pki.Serial(cert.SerialNumber)
+		revocation.Name = target
+	case errors.Is(err, os.ErrNotExist) || errors.Is(err, pki.ErrInvalidName):
+		if revocation.Serial, err = pki.ParseSerial(target); err != nil {
+			return fmt.Errorf("no client certificate was issued for %s, and it isn't a serial number", target)
+		}
+	default:
+		return err
+	}
+	if err := pki.Revoke(storage.GetStore(), revocation); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Revoked client certificate with serial number %s\n", revocation.Serial)
+	return nil
+}
+
+// Export the CA certificate to a file, or to the standard output.
+func exportCACommand(authority *pki.Authority, args []string, stdout io.Writer, stderr io.Writer) error {
+	flags := flag.NewFlagSet("certs ca", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	out := flags.String("out", "", "file to write the CA certificate to, instead of the standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	data, err := authority.ExportCA()
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Exported CA certificate to %s\n", *out)
+	return nil
+}
+
+// Exit with the result of the certs subcommand, if it was requested.
+func handleCertsCommand() {
+	if len(os.Args) > 1 && os.Args[1] == "certs" {
+		os.Exit(runCerts(os.Args[2:], os.Stdout, os.Stderr))
+	}
+}
@@ -2,50 +2,259 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/rs/zerolog"
 	"github.com/spf13/viper"
 )
 
+// Scopes granted to API keys.
+const (
+	ScopeStateRead   = "state:read"   // ScopeStateRead allows reading the state, the events and the schedules
+	ScopeDoorOperate = "door:operate" // ScopeDoorOperate allows operating the door and acknowledging alerts
+	ScopeAdmin       = "admin"        // ScopeAdmin allows everything, including the maintenance lock and schedules
+)
+
+// Scopes is the list of all scopes.
+var Scopes = []string{ScopeStateRead, ScopeDoorOperate, ScopeAdmin}
+
+// EventTypes is the list of types of the events recorded by the controller, which webhook subscribers and notification
+// channels filter on. It mirrors the Event constants of the controller, which depends on this package.
+var EventTypes = []string{
+	"command", "command_rejected", "state", "lock", "unlock", "notification", "alert", "alert_cleared", "alert_acked",
+	"ban", "unban",
+}
+
+// AlertLevels is the list of levels of alerts, which notification channels filter on. It mirrors the Level constants
+// of the alerts package, apart from the level of alerts that aren't raised.
+var AlertLevels = []string{"warning", "critical"}
+
+// DefaultUserScopes is the list of scopes of users without scopes in the configuration file. Managing keys, bans, the
+// maintenance lock, schedules and log levels requires the admin scope to be granted explicitly.
+var DefaultUserScopes = []string{ScopeStateRead, ScopeDoorOperate}
+
+// ScheduleConfig describes a scheduled action or a time window, as defined in the configuration file.
+type ScheduleConfig struct {
+	Name     string   `mapstructure:"name"`
+	Cron     string   `mapstructure:"cron"`
+	Action   string   `mapstructure:"action"`
+	Window   string   `mapstructure:"window"`
+	Days     string   `mapstructure:"days"`
+	Deny     []string `mapstructure:"deny"`
+	Timezone string   `mapstructure:"timezone"`
+}
+
+// RuleConfig describes a rule, as defined in the configuration file. When all conditions hold, the action (open,
+// close, notify or publish) is run once. The rule is re-armed when the conditions no longer hold.
+type RuleConfig struct {
+	Name       string            `mapstructure:"name"`
+	Conditions []ConditionConfig `mapstructure:"conditions"`
+	Action     string            `mapstructure:"action"`
+	Message    string            `mapstructure:"message"`
+	Topic      string            `mapstructure:"topic"`
+	Payload    string            `mapstructure:"payload"`
+}
+
+// ConditionConfig describes a condition of a rule. A condition either checks the door state, optionally for a
+// minimum duration, or compares the last value received on an MQTT topic, optionally a field in a JSON payload.
+type ConditionConfig struct {
+	State string        `mapstructure:"state"`
+	For   time.Duration `mapstructure:"for"`
+	Topic string        `mapstructure:"topic"`
+	Field string        `mapstructure:"field"`
+	Op    string        `mapstructure:"op"`
+	Value string        `mapstructure:"value"`
+}
+
+// NotificationChannelConfig describes a notification channel, as defined in the configuration file. Depending on the
+// type (ntfy, gotify, smtp or webhook), only part of the fields are used.
+type NotificationChannelConfig struct {
+	Name       string            `mapstructure:"name"`
+	Type       string            `mapstructure:"type"`
+	URL        string            `mapstructure:"url"`
+	Token      string            `mapstructure:"token"`
+	Method     string            `mapstructure:"method"`
+	Headers    map[string]string `mapstructure:"headers"`
+	Host       string            `mapstructure:"host"`
+	Port       int               `mapstructure:"port"`
+	Username   string            `mapstructure:"username"`
+	Password   string            `mapstructure:"password"`
+	From       string            `mapstructure:"from"`
+	To         []string          `mapstructure:"to"`
+	Events     []string          `mapstructure:"events"`
+	Levels     []string          `mapstructure:"levels"`
+	Title      string            `mapstructure:"title"`
+	Template   string            `mapstructure:"template"`
+	Retries    int               `mapstructure:"retries"`
+	RateLimit  int               `mapstructure:"rate_limit"`
+	RatePeriod time.Duration     `mapstructure:"rate_period"`
+}
+
+// WebhookSubscriberConfig describes a webhook subscriber, as defined in the configuration file. Without event types,
+// the subscriber receives all events.
+type WebhookSubscriberConfig struct {
+	Name   string   `mapstructure:"name"`
+	URL    string   `mapstructure:"url"`
+	Events []string `mapstructure:"events"`
+	Secret string   `mapstructure:"secret"`
+}
+
+// UserConfig describes a user account for the browser login, as defined in the configuration file. The password is
+// a bcrypt hash. Users without scopes get the default user scopes.
+type UserConfig struct {
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	Scopes   []string `mapstructure:"scopes"`
+}
+
+// APIKeyConfig describes an API key, as defined in the configuration file. The key is a bcrypt hash. The key is only
+// accepted before its expiry (RFC 3339, optional) and during one of its time windows ("HH:MM-HH:MM" in the scheduler
+// time zone, optional). A key restricted to a door can only read and operate that door, which must be this door.
+type APIKeyConfig struct {
+	Name    string    `mapstructure:"name"`
+	Key     string    `mapstructure:"key"`
+	Scopes  []string  `mapstructure:"scopes"`
+	Expires time.Time `mapstructure:"expires"`
+	Windows []string  `mapstructure:"windows"`
+	Door    string    `mapstructure:"door"`
+}
+
+// ClientCertConfig maps the subject of a client certificate (e.g. "CN=alice-phone,O=Family") to a name, recorded as
+// source of its commands, and to scopes, as defined in the configuration file. When a fingerprint is given, only the
+// certificate with that SHA-256 fingerprint is accepted for the subject, so a reissued certificate is pinned again.
+type ClientCertConfig struct {
+	Subject     string   `mapstructure:"subject"`
+	Name        string   `mapstructure:"name"`
+	Fingerprint string   `mapstructure:"fingerprint"`
+	Scopes      []string `mapstructure:"scopes"`
+}
+
 var (
 	// All known configuration properties, and weither they are mandatory or not
 	knownKeys = map[string]bool{
-		"mode":                  true,
-		"bind.port":             true,
-		"bind.host":             true,
-		"gpio.toggle_pin":       true,
-		"gpio.open_pin":         true,
-		"gpio.closed_pin":       true,
-		"api_keys":              true,
-		"mqtt.enabled":          true,
-		"mqtt.url":              false,
-		"mqtt.username":         false,
-		"mqtt.password":         false,
-		"mqtt.client_id":        false,
-		"mqtt.discovery_prefix": false,
-		"mqtt.object_id":        false,
+		"mode":                            true,
+		"data_dir":                        false,
+		"door_id":                         false,
+		"bind.port":                       true,
+		"bind.host":                       true,
+		"gpio.toggle_pin":                 true,
+		"gpio.open_pin":                   true,
+		"gpio.closed_pin":                 true,
+		"api_keys":                        true,
+		"users":                           false,
+		"sessions.ttl":                    false,
+		"sessions.secure_cookie":          false,
+		"mqtt.enabled":                    true,
+		"mqtt.url":                        false,
+		"mqtt.username":                   false,
+		"mqtt.password":                   false,
+		"mqtt.client_id":                  false,
+		"mqtt.discovery_prefix":           false,
+		"mqtt.object_id":                  false,
+		"commands.min_interval":           false,
+		"commands.coalesce":               false,
+		"commands.lockout_count":          false,
+		"commands.lockout_window":         false,
+		"commands.lockout_duration":       false,
+		"scheduler.timezone":              false,
+		"scheduler.latitude":              false,
+		"scheduler.longitude":             false,
+		"schedules":                       false,
+		"rules":                           false,
+		"alerts.left_open.enabled":        false,
+		"alerts.left_open.threshold":      false,
+		"alerts.left_open.repeat":         false,
+		"alerts.left_open.escalate_after": false,
+		"notifications.door_name":         false,
+		"notifications.channels":          false,
+		"webhooks.subscribers":            false,
+		"webhooks.max_attempts":           false,
+		"webhooks.initial_backoff":        false,
+		"webhooks.max_backoff":            false,
+		"key_cache.ttl":                   false,
+		"key_cache.size":                  false,
+		"key_cache.negative_ttl":          false,
+		"key_cache.verify_rate":           false,
+		"trusted_proxies":                 false,
+		"auth_lockout.max_failures":       false,
+		"auth_lockout.window":             false,
+		"auth_lockout.ban_duration":       false,
+		"auth_lockout.max_ban_duration":   false,
+		"tls.enabled":                     false,
+		"tls.cert_file":                   false,
+		"tls.key_file":                    false,
+		"tls.min_version":                 false,
+		"tls.client_auth":                 false,
+		"tls.client_ca_file":              false,
+		"tls.client_certs":                false,
+		"tls.dir":                         false,
+		"tls.hostnames":                   false,
+		"metrics.enabled":                 false,
+		"metrics.auth":                    false,
+		"metrics.username":                false,
+		"metrics.password":                false,
+		"tracing.enabled":                 false,
+		"tracing.exporter":                false,
+		"tracing.endpoint":                false,
+		"tracing.sample_ratio":            false,
+		"audit.enabled":                   false,
+		"audit.file":                      false,
+		"audit.max_size":                  false,
+		"audit.max_age":                   false,
+		"log.level":                       false,
+		"log.levels":                      false,
+		"log.format":                      false,
+		"log.stderr":                      false,
+		"log.file":                        false,
+		"log.max_size":                    false,
+		"log.max_backups":                 false,
+		"log.syslog.enabled":              false,
+		"log.syslog.network":              false,
+		"log.syslog.address":              false,
+		"log.syslog.tag":                  false,
 	}
 
 	viperInst *viper.Viper
 	once      sync.Once
 )
 
+// Valid fingerprints of client certificates: SHA-256 in lowercase hex, after removing colons.
+var validFingerprint = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
 // Create a new Viper instance and load the configuration file.
 func loadConfig() {
-	viperInst = viper.New()
+	var err error
+	if viperInst, err = readConfig(); err != nil {
+		panic(fmt.Errorf("config: fatal error while parsing config file: %s", err))
+	}
+}
+
+// Read the configuration file into a new Viper instance.
+func readConfig() (*viper.Viper, error) {
+	v := viper.New()
 
-	viperInst.SetConfigName("config")
-	viperInst.SetConfigType("yaml")
+	v.SetConfigName("config")
+	v.SetConfigType("yaml")
 	configPath := os.Getenv("GARAGESERVICE_CONFIG_PATH")
 	if configPath != "" {
-		viperInst.AddConfigPath(configPath)
+		v.AddConfigPath(configPath)
 	}
-	viperInst.AddConfigPath(".")
+	v.AddConfigPath(".")
 
-	if err := viperInst.ReadInConfig(); err != nil {
-		panic(fmt.Errorf("config: fatal error while parsing config file: %s", err))
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
 	}
+	return v, nil
 }
 
 // Verifies that all mandatory keys are set in the configuration file,
@@ -57,6 +266,10 @@ func verifyKeys() error {
 		}
 	}
 	for _, key := range viperInst.AllKeys() {
+		// The levels of components are a map, whose keys are verified with the levels themselves.
+		if strings.HasPrefix(key, "log.levels.") {
+			continue
+		}
 		if _, found := knownKeys[key]; !found {
 			return fmt.Errorf("config: configuration property %s is unknown", key)
 		}
@@ -90,9 +303,84 @@ func Verify() error {
 	if closedPin < 0 {
 		return fmt.Errorf("config: gpio.closed_pin must be a valid pin number")
 	}
-	apiKeys := viperInst.GetStringSlice("api_keys")
-	if len(apiKeys) == 0 {
-		return fmt.Errorf("config: api_keys must contain at least one key")
+	apiKeys, err := getAPIKeys(viperInst)
+	if err != nil {
+		return err
+	}
+	if err := verifyAPIKeys(apiKeys); err != nil {
+		return err
+	}
+	if GetKeyCacheTTL() <= 0 || GetKeyCacheSize() <= 0 || GetKeyCacheNegativeTTL() <= 0 || GetKeyVerifyRate() <= 0 {
+		return fmt.Errorf("config: key_cache values must be positive")
+	}
+	for _, proxy := range GetTrustedProxies() {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return fmt.Errorf("config: trusted proxy %s must be an ip address or a cidr range", proxy)
+		}
+	}
+	if GetAuthMaxFailures() <= 0 || GetAuthFailureWindow() <= 0 || GetAuthBanDuration() <= 0 ||
+		GetAuthMaxBanDuration() < GetAuthBanDuration() {
+		return fmt.Errorf("config: auth_lockout values must be positive, and max_ban_duration at least ban_duration")
+	}
+	if err := verifyTLS(); err != nil {
+		return err
+	}
+	switch GetMetricsAuth() {
+	case "none", "api_key":
+	case "basic":
+		if GetMetricsUsername() == "" || GetMetricsPassword() == "" {
+			return fmt.Errorf("config: metrics.username and metrics.password must be set for basic authentication")
+		}
+	default:
+		return fmt.Errorf("config: metrics.auth must be either 'none', 'api_key' or 'basic'")
+	}
+	if exporter := GetTracingExporter(); exporter != "otlp" && exporter != "stdout" {
+		return fmt.Errorf("config: tracing.exporter must be either 'otlp' or 'stdout'")
+	}
+	if u, err := url.Parse(GetTracingEndpoint()); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("config: tracing.endpoint must be an http or https url")
+	}
+	if ratio := GetTracingSampleRatio(); ratio < 0 || ratio > 1 {
+		return fmt.Errorf("config: tracing.sample_ratio must be between 0 and 1")
+	}
+	if GetAuditMaxSize() < 0 || GetAuditMaxAge() < 0 {
+		return fmt.Errorf("config: audit.max_size and audit.max_age must not be negative")
+	}
+	if err := verifyLogLevels(GetLogLevel(), GetLogLevels()); err != nil {
+		return err
+	}
+	if format := GetLogFormat(); format != "console" && format != "json" {
+		return fmt.Errorf("config: log.format must be either 'console' or 'json'")
+	}
+	if GetLogMaxSize() < 0 || GetLogMaxBackups() < 0 {
+		return fmt.Errorf("config: log.max_size and log.max_backups must not be negative")
+	}
+	switch GetLogSyslogNetwork() {
+	case "", "udp", "tcp", "unix", "unixgram":
+	default:
+		return fmt.Errorf("config: log.syslog.network must be empty, 'udp', 'tcp', 'unix' or 'unixgram'")
+	}
+	users, err := getUsers()
+	if err != nil {
+		return err
+	}
+	usernames := make(map[string]bool)
+	for _, user := range users {
+		if user.Username == "" || user.Password == "" {
+			return fmt.Errorf("config: every user must have a username and a password")
+		}
+		if usernames[user.Username] {
+			return fmt.Errorf("config: username %s is not unique", user.Username)
+		}
+		usernames[user.Username] = true
+		for _, scope := range user.Scopes {
+			if !slices.Contains(Scopes, scope) {
+				return fmt.Errorf("config: user %s has an unknown scope %s", user.Username, scope)
+			}
+		}
+	}
+	if GetSessionTTL() <= 0 {
+		return fmt.Errorf("config: sessions.ttl must be positive")
 	}
 	mqttEnabled := viperInst.GetBool("mqtt.enabled")
 	if mqttEnabled {
@@ -114,6 +402,131 @@ func Verify() error {
 		}
 	}
 
+	if viperInst.GetDuration("commands.min_interval") < 0 {
+		return fmt.Errorf("config: commands.min_interval must not be negative")
+	}
+	if viperInst.GetInt("commands.lockout_count") < 0 {
+		return fmt.Errorf("config: commands.lockout_count must not be negative")
+	}
+	if viperInst.GetInt("commands.lockout_count") > 0 {
+		if viperInst.GetDuration("commands.lockout_window") <= 0 {
+			return fmt.Errorf("config: commands.lockout_window must be set when commands.lockout_count is set")
+		}
+		if viperInst.GetDuration("commands.lockout_duration") <= 0 {
+			return fmt.Errorf("config: commands.lockout_duration must be set when commands.lockout_count is set")
+		}
+	}
+
+	if _, err := time.LoadLocation(viperInst.GetString("scheduler.timezone")); err != nil {
+		return fmt.Errorf("config: scheduler.timezone must be a valid time zone: %v", err)
+	}
+	if lat := viperInst.GetFloat64("scheduler.latitude"); lat < -90 || lat > 90 {
+		return fmt.Errorf("config: scheduler.latitude must be between -90 and 90")
+	}
+	if lon := viperInst.GetFloat64("scheduler.longitude"); lon < -180 || lon > 180 {
+		return fmt.Errorf("config: scheduler.longitude must be between -180 and 180")
+	}
+	if viperInst.GetBool("alerts.left_open.enabled") {
+		if GetLeftOpenThreshold() <= 0 || GetLeftOpenRepeat() <= 0 || GetLeftOpenEscalateAfter() <= 0 {
+			return fmt.Errorf("config: alerts.left_open durations must be positive")
+		}
+	}
+	schedules, err := getSchedules()
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, schedule := range schedules {
+		if schedule.Name == "" {
+			return fmt.Errorf("config: every schedule must have a name")
+		}
+		if names[schedule.Name] {
+			return fmt.Errorf("config: schedule name %s is not unique", schedule.Name)
+		}
+		names[schedule.Name] = true
+	}
+	rules, err := getRules()
+	if err != nil {
+		return err
+	}
+	channels, err := getNotificationChannels()
+	if err != nil {
+		return err
+	}
+	if err := verifyNotificationChannels(channels); err != nil {
+		return err
+	}
+	subscribers, err := getWebhookSubscribers()
+	if err != nil {
+		return err
+	}
+	if err := verifyWebhookSubscribers(subscribers); err != nil {
+		return err
+	}
+	if GetWebhookMaxAttempts() <= 0 || GetWebhookInitialBackoff() <= 0 || GetWebhookMaxBackoff() <= 0 {
+		return fmt.Errorf("config: webhooks.max_attempts and backoff durations must be positive")
+	}
+	names = make(map[string]bool)
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return fmt.Errorf("config: every rule must have a name")
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("config: rule name %s is not unique", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+
+	return nil
+}
+
+// Verify the notification channels: their names must be unique, and the event types and alert levels they filter on
+// known.
+func verifyNotificationChannels(channels []NotificationChannelConfig) error {
+	names := make(map[string]bool)
+	for _, channel := range channels {
+		if channel.Name == "" {
+			return fmt.Errorf("config: every notification channel must have a name")
+		}
+		if names[channel.Name] {
+			return fmt.Errorf("config: notification channel name %s is not unique", channel.Name)
+		}
+		names[channel.Name] = true
+		for _, event := range channel.Events {
+			if !slices.Contains(EventTypes, event) {
+				return fmt.Errorf("config: notification channel %s has an unknown event type %s", channel.Name, event)
+			}
+		}
+		for _, level := range channel.Levels {
+			if !slices.Contains(AlertLevels, level) {
+				return fmt.Errorf("config: notification channel %s has an unknown level %s", channel.Name, level)
+			}
+		}
+	}
+	return nil
+}
+
+// Verify the webhook subscribers: their names must be unique, their urls http or https, and their events known.
+func verifyWebhookSubscribers(subscribers []WebhookSubscriberConfig) error {
+	names := make(map[string]bool)
+	for _, subscriber := range subscribers {
+		if subscriber.Name == "" || subscriber.URL == "" {
+			return fmt.Errorf("config: every webhook subscriber must have a name and a url")
+		}
+		if names[subscriber.Name] {
+			return fmt.Errorf("config: webhook subscriber name %s is not unique", subscriber.Name)
+		}
+		names[subscriber.Name] = true
+		if u, err := url.Parse(subscriber.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+			u.Host == "" {
+			return fmt.Errorf("config: webhook subscriber %s must have an http or https url", subscriber.Name)
+		}
+		for _, event := range subscriber.Events {
+			if !slices.Contains(EventTypes, event) {
+				return fmt.Errorf("config: webhook subscriber %s has an unknown event type %s", subscriber.Name, event)
+			}
+		}
+	}
 	return nil
 }
 
@@ -123,6 +536,19 @@ func GetMode() string {
 	return viperInst.GetString("mode")
 }
 
+// GetDataDir returns the directory where persistent state is stored. The GARAGESERVICE_DATA_DIR environment
+// variable takes precedence over the configuration file. Defaults to "data".
+func GetDataDir() string {
+	once.Do(loadConfig)
+	if dataDir := os.Getenv("GARAGESERVICE_DATA_DIR"); dataDir != "" {
+		return dataDir
+	}
+	if !viperInst.IsSet("data_dir") {
+		return "data"
+	}
+	return viperInst.GetString("data_dir")
+}
+
 // GetBindPort returns the port to bind the web server to.
 func GetBindPort() int {
 	once.Do(loadConfig)
@@ -153,10 +579,629 @@ func GetClosedPin() int {
 	return viperInst.GetInt("gpio.closed_pin")
 }
 
-// GetAPIKeys returns the list of API keys.
-func GetAPIKeys() []string {
+// GetAPIKeys returns the API keys defined in the configuration file.
+func GetAPIKeys() []APIKeyConfig {
+	once.Do(loadConfig)
+	keys, err := getAPIKeys(viperInst)
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+// ReadAPIKeys reads the configuration file again, and returns its API keys, so they can be reloaded without a
+// restart. The other properties keep their value until the next restart.
+func ReadAPIKeys() ([]APIKeyConfig, error) {
+	v, err := readConfig()
+	if err != nil {
+		return nil, fmt.Errorf("config: error while parsing config file: %v", err)
+	}
+	keys, err := getAPIKeys(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyAPIKeys(keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Decode the API keys from a configuration. Keys given as a plain hash, as in older configuration files, are named
+// after their position and get all scopes.
+func getAPIKeys(v *viper.Viper) ([]APIKeyConfig, error) {
+	var keys []APIKeyConfig
+	hooks := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		legacyAPIKeyHook,
+		mapstructure.StringToTimeHookFunc(time.RFC3339),
+		mapstructure.StringToSliceHookFunc(","),
+	))
+	if err := v.UnmarshalKey("api_keys", &keys, hooks); err != nil {
+		return nil, fmt.Errorf("config: api_keys are invalid: %v", err)
+	}
+	raw, _ := v.Get("api_keys").([]any)
+	for i := range keys {
+		if i < len(raw) {
+			if _, legacy := raw[i].(string); legacy {
+				keys[i].Name = fmt.Sprintf("key%d", i+1)
+				keys[i].Scopes = Scopes
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Verify that the API keys are valid.
+func verifyAPIKeys(keys []APIKeyConfig) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("config: api_keys must contain at least one key")
+	}
+	validScopes := make(map[string]bool)
+	for _, scope := range Scopes {
+		validScopes[scope] = true
+	}
+	names := make(map[string]bool)
+	for _, key := range keys {
+		if key.Name == "" || key.Key == "" {
+			return fmt.Errorf("config: every api key must have a name and a key")
+		}
+		if names[key.Name] {
+			return fmt.Errorf("config: api key name %s is not unique", key.Name)
+		}
+		names[key.Name] = true
+		if len(key.Scopes) == 0 {
+			return fmt.Errorf("config: api key %s must have at least one scope", key.Name)
+		}
+		for _, scope := range key.Scopes {
+			if !validScopes[scope] {
+				return fmt.Errorf("config: api key %s has an unknown scope %s", key.Name, scope)
+			}
+		}
+		for _, window := range key.Windows {
+			if err := verifyWindow(window); err != nil {
+				return fmt.Errorf("config: api key %s has an invalid window: %v", key.Name, err)
+			}
+		}
+		if key.Door != "" && key.Door != GetDoorID() {
+			return fmt.Errorf("config: api key %s is restricted to door %s, but this is door %s", key.Name, key.Door,
+				GetDoorID())
+		}
+	}
+	return nil
+}
+
+// Verify a daily time window of the form "HH:MM-HH:MM", as accepted by the scheduler, which depends on this package.
+func verifyWindow(window string) error {
+	bounds := strings.SplitN(window, "-", 2)
+	if len(bounds) != 2 {
+		return fmt.Errorf("window must be of the form HH:MM-HH:MM, got %q", window)
+	}
+	var tods [2]time.Time
+	for i, bound := range bounds {
+		tod, err := time.Parse("15:04", strings.TrimSpace(bound))
+		if err != nil {
+			return fmt.Errorf("invalid time of day %q", bound)
+		}
+		tods[i] = tod
+	}
+	if tods[0].Equal(tods[1]) {
+		return fmt.Errorf("window %q is empty", window)
+	}
+	return nil
+}
+
+// Decode hook turning an API key given as a plain hash into an APIKeyConfig.
+func legacyAPIKeyHook(from reflect.Type, to reflect.Type, data any) (any, error) {
+	if from.Kind() == reflect.String && to == reflect.TypeOf(APIKeyConfig{}) {
+		return map[string]any{"key": data}, nil
+	}
+	return data, nil
+}
+
+// GetKeyCacheTTL returns how long a verified API key is cached before its hash is checked again. Defaults to
+// 5 minutes.
+func GetKeyCacheTTL() time.Duration {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("key_cache.ttl") {
+		return 5 * time.Minute
+	}
+	return viperInst.GetDuration("key_cache.ttl")
+}
+
+// GetKeyCacheSize returns the maximum number of verified and of refused API keys in the cache. Defaults to 256.
+func GetKeyCacheSize() int {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("key_cache.size") {
+		return 256
+	}
+	return viperInst.GetInt("key_cache.size")
+}
+
+// GetKeyCacheNegativeTTL returns how long a refused API key is refused without checking it again. Defaults to
+// 1 minute.
+func GetKeyCacheNegativeTTL() time.Duration {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("key_cache.negative_ttl") {
+		return time.Minute
+	}
+	return viperInst.GetDuration("key_cache.negative_ttl")
+}
+
+// GetKeyVerifyRate returns the number of unknown API keys that are checked against the hashes per second. Unknown
+// keys beyond this rate are refused without checking them, to bound the time spent on bcrypt. Defaults to 5.
+func GetKeyVerifyRate() float64 {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("key_cache.verify_rate") {
+		return 5
+	}
+	return viperInst.GetFloat64("key_cache.verify_rate")
+}
+
+// GetTrustedProxies returns the addresses and cidr ranges of the reverse proxies whose X-Forwarded-For header is
+// believed. Without trusted proxies, the header is ignored, and the address of the peer is used as client address.
+func GetTrustedProxies() []string {
+	once.Do(loadConfig)
+	return viperInst.GetStringSlice("trusted_proxies")
+}
+
+// GetAuthMaxFailures returns the number of failed authentications within the failure window after which a client is
+// banned. Defaults to 5.
+func GetAuthMaxFailures() int {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("auth_lockout.max_failures") {
+		return 5
+	}
+	return viperInst.GetInt("auth_lockout.max_failures")
+}
+
+// GetAuthFailureWindow returns the window in which failed authentications are counted. Defaults to 10 minutes.
+func GetAuthFailureWindow() time.Duration {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("auth_lockout.window") {
+		return 10 * time.Minute
+	}
+	return viperInst.GetDuration("auth_lockout.window")
+}
+
+// GetAuthBanDuration returns how long a client is banned the first time. Every next ban of the same client lasts
+// twice as long. Defaults to 1 minute.
+func GetAuthBanDuration() time.Duration {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("auth_lockout.ban_duration") {
+		return time.Minute
+	}
+	return viperInst.GetDuration("auth_lockout.ban_duration")
+}
+
+// GetAuthMaxBanDuration returns the maximum duration of a ban. A client without failures for this long starts again
+// with the initial ban duration. Defaults to 24 hours.
+func GetAuthMaxBanDuration() time.Duration {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("auth_lockout.max_ban_duration") {
+		return 24 * time.Hour
+	}
+	return viperInst.GetDuration("auth_lockout.max_ban_duration")
+}
+
+// Verify the TLS configuration.
+func verifyTLS() error {
+	if !GetTLSEnabled() {
+		return nil
+	}
+	if (GetTLSCertFile() == "") != (GetTLSKeyFile() == "") {
+		return fmt.Errorf("config: tls.cert_file and tls.key_file must be set together")
+	}
+	if version := GetTLSMinVersion(); version != "1.2" && version != "1.3" {
+		return fmt.Errorf("config: tls.min_version must be either '1.2' or '1.3'")
+	}
+	switch GetTLSClientAuth() {
+	case "none", "optional", "require":
+	default:
+		return fmt.Errorf("config: tls.client_auth must be either 'none', 'optional' or 'require'")
+	}
+	certs, err := getTLSClientCerts(viperInst)
+	if err != nil {
+		return err
+	}
+	return verifyTLSClientCerts(certs)
+}
+
+// Verify the mapping of client certificates to names and scopes.
+func verifyTLSClientCerts(certs []ClientCertConfig) error {
+	validScopes := make(map[string]bool)
+	for _, scope := range Scopes {
+		validScopes[scope] = true
+	}
+	subjects := make(map[string]bool)
+	for _, cert := range certs {
+		if cert.Subject == "" || cert.Name == "" {
+			return fmt.Errorf("config: every client certificate must have a subject and a name")
+		}
+		if subjects[cert.Subject] {
+			return fmt.Errorf("config: client certificate subject %s is not unique", cert.Subject)
+		}
+		subjects[cert.Subject] = true
+		if cert.Fingerprint != "" && !validFingerprint.MatchString(cert.Fingerprint) {
+			return fmt.Errorf("config: client certificate %s has an invalid fingerprint, expected a SHA-256 "+
+				"fingerprint in hex", cert.Name)
+		}
+		for _, scope := range cert.Scopes {
+			if !validScopes[scope] {
+				return fmt.Errorf("config: client certificate %s has an unknown scope %s", cert.Name, scope)
+			}
+		}
+	}
+	return nil
+}
+
+// GetTLSEnabled returns whether the web server serves HTTPS instead of HTTP.
+func GetTLSEnabled() bool {
+	once.Do(loadConfig)
+	return viperInst.GetBool("tls.enabled")
+}
+
+// GetTLSCertFile returns the PEM file with the server certificate, followed by the intermediate certificates. When not
+// set, a server certificate issued by the local CA is used.
+func GetTLSCertFile() string {
+	once.Do(loadConfig)
+	return viperInst.GetString("tls.cert_file")
+}
+
+// GetTLSKeyFile returns the PEM file with the private key of the server certificate.
+func GetTLSKeyFile() string {
+	once.Do(loadConfig)
+	return viperInst.GetString("tls.key_file")
+}
+
+// GetTLSMinVersion returns the minimum TLS version, either "1.2" or "1.3". Defaults to "1.2".
+func GetTLSMinVersion() string {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("tls.min_version") {
+		return "1.2"
+	}
+	return viperInst.GetString("tls.min_version")
+}
+
+// GetTLSClientAuth returns whether client certificates are verified: "none", "optional" (verified when given) or
+// "require". Defaults to "none".
+func GetTLSClientAuth() string {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("tls.client_auth") {
+		return "none"
+	}
+	return viperInst.GetString("tls.client_auth")
+}
+
+// GetTLSClientCAFile returns the PEM file with the CA certificates client certificates are verified against. When not
+// set, client certificates are verified against the local CA.
+func GetTLSClientCAFile() string {
+	once.Do(loadConfig)
+	return viperInst.GetString("tls.client_ca_file")
+}
+
+// GetTLSDir returns the directory of the local CA, with its certificate and key, the server certificate it issued
+// and the client certificates issued for devices. Defaults to the "tls" directory in the data directory.
+func GetTLSDir() string {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("tls.dir") {
+		return filepath.Join(GetDataDir(), "tls")
+	}
+	return viperInst.GetString("tls.dir")
+}
+
+// GetTLSHostnames returns the host names and IP addresses covered by the server certificate issued by the local CA.
+// Defaults to the host name of the machine and localhost.
+func GetTLSHostnames() []string {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("tls.hostnames") {
+		hosts := []string{"localhost", "127.0.0.1"}
+		if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+			hosts = append([]string{hostname}, hosts...)
+		}
+		return hosts
+	}
+	return viperInst.GetStringSlice("tls.hostnames")
+}
+
+// GetTLSClientCerts returns the mapping of client certificate subjects to names and scopes.
+func GetTLSClientCerts() []ClientCertConfig {
+	once.Do(loadConfig)
+	certs, err := getTLSClientCerts(viperInst)
+	if err != nil {
+		panic(err)
+	}
+	return certs
+}
+
+// ReadTLSClientCerts reads the mapping of client certificates from the configuration file again, e.g. to reload it
+// after the file changed. Unlike GetTLSClientCerts, the mapping is verified and errors are returned.
+func ReadTLSClientCerts() ([]ClientCertConfig, error) {
+	v, err := readConfig()
+	if err != nil {
+		return nil, fmt.Errorf("config: error while parsing config file: %v", err)
+	}
+	certs, err := getTLSClientCerts(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyTLSClientCerts(certs); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// Decode the client certificate mapping from the configuration file.
+func getTLSClientCerts(v *viper.Viper) ([]ClientCertConfig, error) {
+	var certs []ClientCertConfig
+	if err := v.UnmarshalKey("tls.client_certs", &certs); err != nil {
+		return nil, fmt.Errorf("config: tls.client_certs are invalid: %v", err)
+	}
+	// Fingerprints are accepted as printed by openssl, with colons and in uppercase.
+	for i := range certs {
+		certs[i].Fingerprint = strings.ToLower(strings.ReplaceAll(certs[i].Fingerprint, ":", ""))
+	}
+	return certs, nil
+}
+
+// GetMetricsEnabled returns whether the metrics are exposed on /metrics. Defaults to true.
+func GetMetricsEnabled() bool {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("metrics.enabled") {
+		return true
+	}
+	return viperInst.GetBool("metrics.enabled")
+}
+
+// GetMetricsAuth returns how scrapes of the metrics are authenticated: "none", "api_key" (like other requests, with
+// the state:read scope) or "basic" (with the metrics username and password). Defaults to "api_key".
+func GetMetricsAuth() string {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("metrics.auth") {
+		return "api_key"
+	}
+	return viperInst.GetString("metrics.auth")
+}
+
+// GetMetricsUsername returns the username for basic authentication of metrics scrapes.
+func GetMetricsUsername() string {
+	once.Do(loadConfig)
+	return viperInst.GetString("metrics.username")
+}
+
+// GetMetricsPassword returns the bcrypt hash of the password for basic authentication of metrics scrapes.
+func GetMetricsPassword() string {
+	once.Do(loadConfig)
+	return viperInst.GetString("metrics.password")
+}
+
+// GetTracingEnabled returns whether OpenTelemetry traces are exported. Defaults to false.
+func GetTracingEnabled() bool {
+	once.Do(loadConfig)
+	return viperInst.GetBool("tracing.enabled")
+}
+
+// GetTracingExporter returns where traces are exported: "otlp" (to the tracing endpoint) or "stdout" (for local
+// debugging). Defaults to "otlp".
+func GetTracingExporter() string {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("tracing.exporter") {
+		return "otlp"
+	}
+	return viperInst.GetString("tracing.exporter")
+}
+
+// GetTracingEndpoint returns the URL of the OTLP/HTTP collector, e.g. http://collector:4318. The path defaults to
+// /v1/traces. Defaults to http://localhost:4318.
+func GetTracingEndpoint() string {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("tracing.endpoint") {
+		return "http://localhost:4318"
+	}
+	return viperInst.GetString("tracing.endpoint")
+}
+
+// GetTracingSampleRatio returns the fraction of traces that is sampled, between 0 and 1. Traces continued from a
+// sampled parent, e.g. in an MQTT message, are always sampled. Defaults to 1.
+func GetTracingSampleRatio() float64 {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("tracing.sample_ratio") {
+		return 1
+	}
+	return viperInst.GetFloat64("tracing.sample_ratio")
+}
+
+// GetAuditEnabled returns whether security-relevant actions are recorded in the audit log. Defaults to true.
+func GetAuditEnabled() bool {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("audit.enabled") {
+		return true
+	}
+	return viperInst.GetBool("audit.enabled")
+}
+
+// GetAuditFile returns the path of the audit log. Defaults to audit.jsonl in the data directory.
+func GetAuditFile() string {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("audit.file") {
+		return filepath.Join(GetDataDir(), "audit.jsonl")
+	}
+	return viperInst.GetString("audit.file")
+}
+
+// GetAuditMaxSize returns the size in bytes above which the audit log is rotated, e.g. from 10MB. Zero disables
+// rotation by size. Defaults to 10 MiB.
+func GetAuditMaxSize() int64 {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("audit.max_size") {
+		return 10 * 1024 * 1024
+	}
+	return int64(viperInst.GetSizeInBytes("audit.max_size"))
+}
+
+// GetAuditMaxAge returns the age of the first entry of the audit log above which it is rotated. Zero disables
+// rotation by time. Defaults to 0.
+func GetAuditMaxAge() time.Duration {
+	once.Do(loadConfig)
+	return viperInst.GetDuration("audit.max_age")
+}
+
+// GetLogLevel returns the minimum level of log messages, for components without a level of their own. Defaults to
+// "info".
+func GetLogLevel() string {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("log.level") {
+		return "info"
+	}
+	return viperInst.GetString("log.level")
+}
+
+// GetLogLevels returns the minimum level of log messages per component, e.g. "gpio" or "http".
+func GetLogLevels() map[string]string {
+	once.Do(loadConfig)
+	return viperInst.GetStringMapString("log.levels")
+}
+
+// GetLogFormat returns the format of log messages: "console" for humans, or "json". Defaults to "json".
+func GetLogFormat() string {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("log.format") {
+		return "json"
+	}
+	return viperInst.GetString("log.format")
+}
+
+// GetLogStderr returns whether log messages are written to the standard error. Defaults to true.
+func GetLogStderr() bool {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("log.stderr") {
+		return true
+	}
+	return viperInst.GetBool("log.stderr")
+}
+
+// GetLogFile returns the path of the file log messages are written to. Empty when they aren't written to a file.
+func GetLogFile() string {
+	once.Do(loadConfig)
+	return viperInst.GetString("log.file")
+}
+
+// GetLogMaxSize returns the size in bytes above which the log file is rotated, e.g. from 10MB. Zero disables
+// rotation. Defaults to 10 MiB.
+func GetLogMaxSize() int64 {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("log.max_size") {
+		return 10 * 1024 * 1024
+	}
+	return int64(viperInst.GetSizeInBytes("log.max_size"))
+}
+
+// GetLogMaxBackups returns the number of rotated log files that are kept. Defaults to 3.
+func GetLogMaxBackups() int {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("log.max_backups") {
+		return 3
+	}
+	return viperInst.GetInt("log.max_backups")
+}
+
+// GetLogSyslogEnabled returns whether log messages are sent to syslog.
+func GetLogSyslogEnabled() bool {
+	once.Do(loadConfig)
+	return viperInst.GetBool("log.syslog.enabled")
+}
+
+// GetLogSyslogNetwork returns the network of the syslog server, e.g. "udp". Empty for the local syslog daemon.
+func GetLogSyslogNetwork() string {
+	once.Do(loadConfig)
+	return viperInst.GetString("log.syslog.network")
+}
+
+// GetLogSyslogAddress returns the address of the syslog server. Ignored for the local syslog daemon.
+func GetLogSyslogAddress() string {
+	once.Do(loadConfig)
+	return viperInst.GetString("log.syslog.address")
+}
+
+// GetLogSyslogTag returns the tag of the messages sent to syslog. Defaults to "garagedoor-service".
+func GetLogSyslogTag() string {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("log.syslog.tag") {
+		return "garagedoor-service"
+	}
+	return viperInst.GetString("log.syslog.tag")
+}
+
+// ReadLogLevels reads the configuration file again, and returns the default level and the levels per component, so
+// they can be reloaded without a restart.
+func ReadLogLevels() (string, map[string]string, error) {
+	v, err := readConfig()
+	if err != nil {
+		return "", nil, fmt.Errorf("config: error while parsing config file: %v", err)
+	}
+	level := "info"
+	if v.IsSet("log.level") {
+		level = v.GetString("log.level")
+	}
+	levels := v.GetStringMapString("log.levels")
+	if err := verifyLogLevels(level, levels); err != nil {
+		return "", nil, err
+	}
+	return level, levels, nil
+}
+
+// Verify that the log levels are valid. The components are only known to the logging package, which verifies them.
+func verifyLogLevels(level string, levels map[string]string) error {
+	if _, err := zerolog.ParseLevel(level); err != nil || level == "" {
+		return fmt.Errorf("config: log.level %q is not a valid level", level)
+	}
+	for component, level := range levels {
+		if _, err := zerolog.ParseLevel(level); err != nil || level == "" {
+			return fmt.Errorf("config: log.levels.%s %q is not a valid level", component, level)
+		}
+	}
+	return nil
+}
+
+// GetUsers returns the user accounts for the browser login.
+func GetUsers() []UserConfig {
+	once.Do(loadConfig)
+	users, err := getUsers()
+	if err != nil {
+		panic(err)
+	}
+	return users
+}
+
+// Decode the user accounts from the configuration file.
+func getUsers() ([]UserConfig, error) {
+	var users []UserConfig
+	if err := viperInst.UnmarshalKey("users", &users); err != nil {
+		return nil, fmt.Errorf("config: users are invalid: %v", err)
+	}
+	for i := range users {
+		if len(users[i].Scopes) == 0 {
+			users[i].Scopes = DefaultUserScopes
+		}
+	}
+	return users, nil
+}
+
+// GetSessionTTL returns how long a browser session remains valid after login. Defaults to 12 hours.
+func GetSessionTTL() time.Duration {
 	once.Do(loadConfig)
-	return viperInst.GetStringSlice("api_keys")
+	if !viperInst.IsSet("sessions.ttl") {
+		return 12 * time.Hour
+	}
+	return viperInst.GetDuration("sessions.ttl")
+}
+
+// GetSessionSecureCookie returns whether session cookies are only sent over HTTPS. Defaults to true, and should only
+// be disabled when the service isn't behind a TLS terminating proxy, e.g. during development.
+func GetSessionSecureCookie() bool {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("sessions.secure_cookie") {
+		return true
+	}
+	return viperInst.GetBool("sessions.secure_cookie")
 }
 
 // GetMQTTEnabled returns whether MQTT is enabled.
@@ -218,3 +1263,223 @@ func GetMQTTObjectID() string {
 	}
 	return viperInst.GetString("mqtt.object_id")
 }
+
+// GetDoorID returns the identifier of the door, reported in state events. Defaults to "garage_door".
+func GetDoorID() string {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("door_id") {
+		return "garage_door"
+	}
+	return viperInst.GetString("door_id")
+}
+
+// GetCommandMinInterval returns the minimum interval between two accepted door commands, so a double-tapped button
+// doesn't reverse the door. The GARAGESERVICE_COMMAND_MIN_INTERVAL environment variable takes precedence over the
+// configuration file. Defaults to 2 seconds.
+func GetCommandMinInterval() time.Duration {
+	once.Do(loadConfig)
+	if interval := os.Getenv("GARAGESERVICE_COMMAND_MIN_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			return d
+		}
+	}
+	if !viperInst.IsSet("commands.min_interval") {
+		return 2 * time.Second
+	}
+	return viperInst.GetDuration("commands.min_interval")
+}
+
+// GetCommandCoalesce returns whether duplicate queued commands are coalesced.
+func GetCommandCoalesce() bool {
+	once.Do(loadConfig)
+	return viperInst.GetBool("commands.coalesce")
+}
+
+// GetCommandLockoutCount returns the number of commands within the lockout window that triggers a lockout.
+// Zero disables the lockout.
+func GetCommandLockoutCount() int {
+	once.Do(loadConfig)
+	return viperInst.GetInt("commands.lockout_count")
+}
+
+// GetCommandLockoutWindow returns the window in which commands are counted for the lockout.
+func GetCommandLockoutWindow() time.Duration {
+	once.Do(loadConfig)
+	return viperInst.GetDuration("commands.lockout_window")
+}
+
+// GetCommandLockoutDuration returns how long commands are refused once the lockout is triggered.
+func GetCommandLockoutDuration() time.Duration {
+	once.Do(loadConfig)
+	return viperInst.GetDuration("commands.lockout_duration")
+}
+
+// GetSchedulerTimezone returns the default time zone for schedules. Defaults to the local time zone.
+func GetSchedulerTimezone() string {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("scheduler.timezone") {
+		return "Local"
+	}
+	return viperInst.GetString("scheduler.timezone")
+}
+
+// GetSchedulerLatitude returns the latitude used to compute sunrise and sunset.
+func GetSchedulerLatitude() float64 {
+	once.Do(loadConfig)
+	return viperInst.GetFloat64("scheduler.latitude")
+}
+
+// GetSchedulerLongitude returns the longitude used to compute sunrise and sunset.
+func GetSchedulerLongitude() float64 {
+	once.Do(loadConfig)
+	return viperInst.GetFloat64("scheduler.longitude")
+}
+
+// GetSchedules returns the schedules defined in the configuration file.
+func GetSchedules() []ScheduleConfig {
+	once.Do(loadConfig)
+	schedules, err := getSchedules()
+	if err != nil {
+		panic(err)
+	}
+	return schedules
+}
+
+// Decode the schedules from the configuration file.
+func getSchedules() ([]ScheduleConfig, error) {
+	var schedules []ScheduleConfig
+	if err := viperInst.UnmarshalKey("schedules", &schedules); err != nil {
+		return nil, fmt.Errorf("config: schedules are invalid: %v", err)
+	}
+	return schedules, nil
+}
+
+// GetRules returns the rules defined in the configuration file.
+func GetRules() []RuleConfig {
+	once.Do(loadConfig)
+	rules, err := getRules()
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// Decode the rules from the configuration file.
+func getRules() ([]RuleConfig, error) {
+	var rules []RuleConfig
+	if err := viperInst.UnmarshalKey("rules", &rules); err != nil {
+		return nil, fmt.Errorf("config: rules are invalid: %v", err)
+	}
+	return rules, nil
+}
+
+// GetLeftOpenEnabled returns whether the left open alert is enabled.
+func GetLeftOpenEnabled() bool {
+	once.Do(loadConfig)
+	return viperInst.GetBool("alerts.left_open.enabled")
+}
+
+// GetLeftOpenThreshold returns how long the door must be open before the left open alert is raised.
+// Defaults to 10 minutes.
+func GetLeftOpenThreshold() time.Duration {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("alerts.left_open.threshold") {
+		return 10 * time.Minute
+	}
+	return viperInst.GetDuration("alerts.left_open.threshold")
+}
+
+// GetLeftOpenRepeat returns the interval at which the left open alert is repeated. Defaults to 15 minutes.
+func GetLeftOpenRepeat() time.Duration {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("alerts.left_open.repeat") {
+		return 15 * time.Minute
+	}
+	return viperInst.GetDuration("alerts.left_open.repeat")
+}
+
+// GetLeftOpenEscalateAfter returns how long the door must be open before the left open alert is escalated.
+// Defaults to 1 hour.
+func GetLeftOpenEscalateAfter() time.Duration {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("alerts.left_open.escalate_after") {
+		return time.Hour
+	}
+	return viperInst.GetDuration("alerts.left_open.escalate_after")
+}
+
+// GetNotificationDoorName returns the name of the door used in notifications. Defaults to "Garage Door".
+func GetNotificationDoorName() string {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("notifications.door_name") {
+		return "Garage Door"
+	}
+	return viperInst.GetString("notifications.door_name")
+}
+
+// GetNotificationChannels returns the notification channels defined in the configuration file.
+func GetNotificationChannels() []NotificationChannelConfig {
+	once.Do(loadConfig)
+	channels, err := getNotificationChannels()
+	if err != nil {
+		panic(err)
+	}
+	return channels
+}
+
+// Decode the notification channels from the configuration file.
+func getNotificationChannels() ([]NotificationChannelConfig, error) {
+	var channels []NotificationChannelConfig
+	if err := viperInst.UnmarshalKey("notifications.channels", &channels); err != nil {
+		return nil, fmt.Errorf("config: notifications.channels are invalid: %v", err)
+	}
+	return channels, nil
+}
+
+// GetWebhookSubscribers returns the webhook subscribers defined in the configuration file.
+func GetWebhookSubscribers() []WebhookSubscriberConfig {
+	once.Do(loadConfig)
+	subscribers, err := getWebhookSubscribers()
+	if err != nil {
+		panic(err)
+	}
+	return subscribers
+}
+
+// Decode the webhook subscribers from the configuration file.
+func getWebhookSubscribers() ([]WebhookSubscriberConfig, error) {
+	var subscribers []WebhookSubscriberConfig
+	if err := viperInst.UnmarshalKey("webhooks.subscribers", &subscribers); err != nil {
+		return nil, fmt.Errorf("config: webhooks.subscribers are invalid: %v", err)
+	}
+	return subscribers, nil
+}
+
+// GetWebhookMaxAttempts returns the number of delivery attempts of a webhook before it is moved to the dead letters.
+// Defaults to 8.
+func GetWebhookMaxAttempts() int {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("webhooks.max_attempts") {
+		return 8
+	}
+	return viperInst.GetInt("webhooks.max_attempts")
+}
+
+// GetWebhookInitialBackoff returns the delay before the first retry of a failed webhook delivery. The delay doubles
+// with every retry. Defaults to 10 seconds.
+func GetWebhookInitialBackoff() time.Duration {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("webhooks.initial_backoff") {
+		return 10 * time.Second
+	}
+	return viperInst.GetDuration("webhooks.initial_backoff")
+}
+
+// GetWebhookMaxBackoff returns the maximum delay between retries of a failed webhook delivery. Defaults to 1 hour.
+func GetWebhookMaxBackoff() time.Duration {
+	once.Do(loadConfig)
+	if !viperInst.IsSet("webhooks.max_backoff") {
+		return time.Hour
+	}
+	return viperInst.GetDuration("webhooks.max_backoff")
+}
@@ -2,7 +2,10 @@ package config
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -50,9 +53,78 @@ func TestAPIKeys(t *testing.T) {
 	if len(keys) != 1 {
 		t.Fatalf("Expected 1 API key, got %d", len(keys))
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(keys[0]), []byte("test")); err != nil {
+	if err := bcrypt.CompareHashAndPassword([]byte(keys[0].Key), []byte("test")); err != nil {
 		t.Fatalf("Expected API key to be bcrypt digest of 'test'")
 	}
+	if keys[0].Name != "test" || len(keys[0].Scopes) != 3 || !keys[0].Expires.IsZero() {
+		t.Fatalf("Unexpected API key: %+v", keys[0])
+	}
+}
+
+func TestAPIKeyRestrictions(t *testing.T) {
+	key := APIKeyConfig{Name: "a", Key: "hash", Scopes: []string{ScopeStateRead}, Door: GetDoorID(),
+		Windows: []string{"07:00-09:00", "22:00-06:00"}}
+	if err := verifyAPIKeys([]APIKeyConfig{key}); err != nil {
+		t.Fatalf("Expected valid restrictions to be accepted, got %v", err)
+	}
+	for _, window := range []string{"07:00", "7-9", "09:00-09:00", "07:00-25:00"} {
+		invalid := key
+		invalid.Windows = []string{window}
+		if err := verifyAPIKeys([]APIKeyConfig{invalid}); err == nil {
+			t.Fatalf("Expected window %s to be refused", window)
+		}
+	}
+	invalid := key
+	invalid.Door = "shed_door"
+	if err := verifyAPIKeys([]APIKeyConfig{invalid}); err == nil {
+		t.Fatalf("Expected a key restricted to another door to be refused")
+	}
+}
+
+func TestUsers(t *testing.T) {
+	users := GetUsers()
+	if len(users) != 1 || users[0].Username != "admin" || len(users[0].Scopes) != 1 ||
+		users[0].Scopes[0] != ScopeAdmin {
+		t.Fatalf("Unexpected users: %+v", users)
+	}
+}
+
+func TestLegacyAPIKeys(t *testing.T) {
+	original := viperInst.Get("api_keys")
+	defer viperInst.Set("api_keys", original)
+
+	viperInst.Set("api_keys", []any{
+		"$2y$10$3lHF35DW58Cse5gtU9DBMukIcUkQNNclSk3SDLArd4g2/8xC12Qb2",
+		map[string]any{
+			"name":    "limited",
+			"key":     "$2y$10$3lHF35DW58Cse5gtU9DBMukIcUkQNNclSk3SDLArd4g2/8xC12Qb2",
+			"scopes":  []any{"state:read"},
+			"expires": "2030-01-01T00:00:00Z",
+			"windows": []any{"07:00-09:00"},
+		},
+	})
+	keys := GetAPIKeys()
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 API keys, got %d", len(keys))
+	}
+	if keys[0].Name != "key1" || len(keys[0].Scopes) != len(Scopes) {
+		t.Fatalf("Expected plain hash to be a key with all scopes, got %+v", keys[0])
+	}
+	if keys[1].Name != "limited" || keys[1].Expires.Year() != 2030 || len(keys[1].Windows) != 1 {
+		t.Fatalf("Unexpected API key: %+v", keys[1])
+	}
+	if err := Verify(); err != nil {
+		t.Fatalf("Expected configuration to be valid: %v", err)
+	}
+
+	viperInst.Set("api_keys", []any{map[string]any{"name": "noscope", "key": "x"}})
+	if err := Verify(); err == nil {
+		t.Fatalf("Expected key without scopes to be refused")
+	}
+	viperInst.Set("api_keys", []any{map[string]any{"name": "bad", "key": "x", "scopes": []any{"root"}}})
+	if err := Verify(); err == nil {
+		t.Fatalf("Expected unknown scope to be refused")
+	}
 }
 
 func TestMQTT(t *testing.T) {
@@ -72,3 +144,146 @@ func TestMQTT(t *testing.T) {
 		t.Fatalf("Expected MQTT object ID to be 'garage_door', got %s", GetMQTTObjectID())
 	}
 }
+
+func TestKeyCache(t *testing.T) {
+	if GetKeyCacheTTL() != 5*time.Minute || GetKeyCacheNegativeTTL() != time.Minute {
+		t.Fatalf("Unexpected key cache ttls: %v, %v", GetKeyCacheTTL(), GetKeyCacheNegativeTTL())
+	}
+	if GetKeyCacheSize() != 256 || GetKeyVerifyRate() != 5 {
+		t.Fatalf("Unexpected key cache bounds: %d, %v", GetKeyCacheSize(), GetKeyVerifyRate())
+	}
+	keys, err := ReadAPIKeys()
+	if err != nil || len(keys) != 1 || keys[0].Name != "test" {
+		t.Fatalf("Expected to read the API keys again, got %+v, %v", keys, err)
+	}
+}
+
+func TestCommandMinInterval(t *testing.T) {
+	if GetCommandMinInterval() != 2*time.Second {
+		t.Fatalf("Expected a minimum interval of 2s, got %v", GetCommandMinInterval())
+	}
+	original := viperInst.Get("commands.min_interval")
+	defer viperInst.Set("commands.min_interval", original)
+	viperInst.Set("commands.min_interval", nil)
+	if GetCommandMinInterval() != 2*time.Second {
+		t.Fatalf("Expected a default minimum interval of 2s, got %v", GetCommandMinInterval())
+	}
+	t.Setenv("GARAGESERVICE_COMMAND_MIN_INTERVAL", "0s")
+	if GetCommandMinInterval() != 0 {
+		t.Fatalf("Expected the environment to override the minimum interval, got %v", GetCommandMinInterval())
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	if len(GetTrustedProxies()) != 0 {
+		t.Fatalf("Expected no trusted proxies, got %v", GetTrustedProxies())
+	}
+	if GetAuthMaxFailures() != 5 || GetAuthFailureWindow() != 10*time.Minute {
+		t.Fatalf("Unexpected failure limits: %d, %v", GetAuthMaxFailures(), GetAuthFailureWindow())
+	}
+	if GetAuthBanDuration() != time.Minute || GetAuthMaxBanDuration() != 24*time.Hour {
+		t.Fatalf("Unexpected ban durations: %v, %v", GetAuthBanDuration(), GetAuthMaxBanDuration())
+	}
+}
+
+func TestTLS(t *testing.T) {
+	if GetTLSEnabled() || GetTLSMinVersion() != "1.2" || GetTLSClientAuth() != "none" {
+		t.Fatalf("Unexpected TLS defaults: %v, %s, %s", GetTLSEnabled(), GetTLSMinVersion(), GetTLSClientAuth())
+	}
+	if len(GetTLSClientCerts()) != 0 {
+		t.Fatalf("Expected no client certificates, got %+v", GetTLSClientCerts())
+	}
+}
+
+func TestTLSClientCertFingerprints(t *testing.T) {
+	pinned := strings.Repeat("ab", 32)
+	if err := verifyTLSClientCerts([]ClientCertConfig{{Subject: "CN=a", Name: "a", Fingerprint: pinned}}); err != nil {
+		t.Fatalf("Expected a SHA-256 fingerprint to be accepted, got %v", err)
+	}
+	if err := verifyTLSClientCerts([]ClientCertConfig{{Subject: "CN=a", Name: "a", Fingerprint: "abcd"}}); err == nil {
+		t.Fatalf("Expected a short fingerprint to be refused")
+	}
+}
+
+func TestWebhookSubscribers(t *testing.T) {
+	valid := WebhookSubscriberConfig{Name: "a", URL: "https://example.com/hook", Events: []string{"state"}}
+	if err := verifyWebhookSubscribers([]WebhookSubscriberConfig{valid}); err != nil {
+		t.Fatalf("Expected valid subscriber to be accepted, got %v", err)
+	}
+	invalid := []WebhookSubscriberConfig{
+		{Name: "a", URL: "ftp://example.com/hook"},
+		{Name: "a", URL: "example.com/hook"},
+		{Name: "a", URL: "https://example.com/hook", Events: []string{"opened"}},
+	}
+	for _, subscriber := range invalid {
+		if err := verifyWebhookSubscribers([]WebhookSubscriberConfig{subscriber}); err == nil {
+			t.Fatalf("Expected subscriber %+v to be refused", subscriber)
+		}
+	}
+}
+
+func TestNotificationChannels(t *testing.T) {
+	valid := NotificationChannelConfig{Name: "a", Events: []string{"alert"}, Levels: []string{"critical"}}
+	if err := verifyNotificationChannels([]NotificationChannelConfig{valid}); err != nil {
+		t.Fatalf("Expected valid channel to be accepted, got %v", err)
+	}
+	invalid := []NotificationChannelConfig{
+		{Name: "a", Events: []string{"alerts"}},
+		{Name: "a", Levels: []string{"error"}},
+	}
+	for _, channel := range invalid {
+		if err := verifyNotificationChannels([]NotificationChannelConfig{channel}); err == nil {
+			t.Fatalf("Expected channel %+v to be refused", channel)
+		}
+	}
+}
+
+func TestTLSDir(t *testing.T) {
+	if GetTLSDir() != filepath.Join(GetDataDir(), "tls") {
+		t.Fatalf("Expected the tls directory in the data directory, got %s", GetTLSDir())
+	}
+	if hosts := GetTLSHostnames(); len(hosts) < 2 || hosts[len(hosts)-1] != "127.0.0.1" {
+		t.Fatalf("Expected localhost in the default host names, got %v", hosts)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	if !GetMetricsEnabled() || GetMetricsAuth() != "api_key" {
+		t.Fatalf("Unexpected metrics configuration: %v, %s", GetMetricsEnabled(), GetMetricsAuth())
+	}
+}
+
+func TestTracing(t *testing.T) {
+	if GetTracingEnabled() || GetTracingExporter() != "otlp" || GetTracingEndpoint() != "http://localhost:4318" ||
+		GetTracingSampleRatio() != 1 {
+		t.Fatalf("Unexpected tracing configuration: %v, %s, %s, %v", GetTracingEnabled(), GetTracingExporter(),
+			GetTracingEndpoint(), GetTracingSampleRatio())
+	}
+}
+
+func TestLog(t *testing.T) {
+	if GetLogLevel() != "info" || len(GetLogLevels()) != 0 || GetLogFormat() != "json" || !GetLogStderr() ||
+		GetLogFile() != "" || GetLogMaxSize() != 10*1024*1024 || GetLogMaxBackups() != 3 || GetLogSyslogEnabled() ||
+		GetLogSyslogTag() != "garagedoor-service" {
+		t.Fatalf("Unexpected log configuration: %s, %v, %s, %v, %s, %d, %d, %v, %s", GetLogLevel(), GetLogLevels(),
+			GetLogFormat(), GetLogStderr(), GetLogFile(), GetLogMaxSize(), GetLogMaxBackups(), GetLogSyslogEnabled(),
+			GetLogSyslogTag())
+	}
+	if level, levels, err := ReadLogLevels(); err != nil || level != "info" || len(levels) != 0 {
+		t.Fatalf("Expected log levels to be read again, got %s, %v, %v", level, levels, err)
+	}
+	if err := verifyLogLevels("info", map[string]string{"gpio": "loud"}); err == nil {
+		t.Fatalf("Expected invalid level of a component to be rejected")
+	}
+	if err := verifyLogLevels("", nil); err == nil {
+		t.Fatalf("Expected empty level to be rejected")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	if !GetAuditEnabled() || GetAuditFile() != filepath.Join(GetDataDir(), "audit.jsonl") ||
+		GetAuditMaxSize() != 10*1024*1024 || GetAuditMaxAge() != 0 {
+		t.Fatalf("Unexpected audit configuration: %v, %s, %d, %v", GetAuditEnabled(), GetAuditFile(),
+			GetAuditMaxSize(), GetAuditMaxAge())
+	}
+}
@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+)
+
+// Errors returned when a command is refused.
+var (
+	ErrTooSoon    = errors.New("command rejected: minimum interval between commands has not elapsed")
+	ErrDuplicate  = errors.New("command rejected: an identical command is already queued")
+	ErrLockedOut  = errors.New("command rejected: too many commands, temporarily locked out")
+	ErrQueueFull  = errors.New("command rejected: command queue is full")
+	ErrNotRunning = errors.New("command rejected: door controller is not running")
+	ErrDenied     = errors.New("command rejected: denied")
+)
+
+// IsRateLimited returns true if the error was caused by the command policy, rather than by the controller itself.
+func IsRateLimited(err error) bool {
+	return errors.Is(err, ErrTooSoon) || errors.Is(err, ErrDuplicate) || errors.Is(err, ErrLockedOut)
+}
+
+// commandPolicy decides whether actuating commands are accepted. It enforces a minimum interval between commands,
+// coalesces duplicates of commands that are queued or executing, and locks out commands after too many within a time
+// window.
+type commandPolicy struct {
+	minInterval     time.Duration
+	coalesce        bool
+	lockoutCount    int
+	lockoutWindow   time.Duration
+	lockoutDuration time.Duration
+
+	lastAccepted time.Time
+	accepted     []time.Time
+	lockedUntil  time.Time
+	pending      int
+	queued       map[Enum]int
+	lock         sync.Mutex
+}
+
+// Creates a new commandPolicy object based on the configuration.
+func newCommandPolicy() *commandPolicy {
+	return &commandPolicy{
+		minInterval:     config.GetCommandMinInterval(),
+		coalesce:        config.GetCommandCoalesce(),
+		lockoutCount:    config.GetCommandLockoutCount(),
+		lockoutWindow:   config.GetCommandLockoutWindow(),
+		lockoutDuration: config.GetCommandLockoutDuration(),
+		queued:          make(map[Enum]int),
+	}
+}
+
+// Check if a command may be queued at the given time. When admitted, the command is registered as queued, and must
+// either be committed with commit() once it is on the queue, or released with cancel() when it could not be queued.
+// While a command is admitted but not committed, other commands are too soon.
+func (p *commandPolicy) admit(cmd Enum, now time.Time) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if now.Before(p.lockedUntil) {
+		return ErrLockedOut
+	}
+	if p.coalesce && p.queued[cmd] > 0 {
+		return ErrDuplicate
+	}
+	if p.minInterval > 0 && (p.pending > 0 ||
+		!p.lastAccepted.IsZero() && now.Sub(p.lastAccepted) < p.minInterval) {
+		return ErrTooSoon
+	}
+
+	p.pending++
+	p.queued[cmd]++
+	return nil
+}
+
+// Record an admitted command as accepted once it is on the queue, counting it for the minimum interval and the
+// lockout. Must be followed by dequeued() once the command was executed.
+func (p *commandPolicy) commit(now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.pending > 0 {
+		p.pending--
+	}
+	p.lastAccepted = now
+	if p.lockoutCount > 0 {
+		recent := p.accepted[:0]
+		for _, t := range p.accepted {
+			if now.Sub(t) < p.lockoutWindow {
+				recent = append(recent, t)
+			}
+		}
+		p.accepted = append(recent, now)
+		if len(p.accepted) >= p.lockoutCount {
+			p.lockedUntil = now.Add(p.lockoutDuration)
+			p.accepted = p.accepted[:0]
+		}
+	}
+}
+
+// Release an admitted command that could not be queued after all, without counting it.
+func (p *commandPolicy) cancel(cmd Enum) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.pending > 0 {
+		p.pending--
+	}
+	if p.queued[cmd] > 0 {
+		p.queued[cmd]--
+	}
+}
+
+// Release a command that was taken off the queue and executed.
+func (p *commandPolicy) dequeued(cmd Enum) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.queued[cmd] > 0 {
+		p.queued[cmd]--
+	}
+}
+
+// Forget all queued commands, e.g. when the command queue is recreated.
+func (p *commandPolicy) reset() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.pending = 0
+	p.queued = make(map[Enum]int)
+}
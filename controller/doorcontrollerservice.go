@@ -1,12 +1,22 @@
 package controller
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dlefevre/go.garagedoor-service/audit"
+	"github.com/dlefevre/go.garagedoor-service/config"
 	"github.com/dlefevre/go.garagedoor-service/gpio"
+	"github.com/dlefevre/go.garagedoor-service/logging"
+	"github.com/dlefevre/go.garagedoor-service/metrics"
+	"github.com/dlefevre/go.garagedoor-service/storage"
+	"github.com/dlefevre/go.garagedoor-service/tracing"
 	"github.com/google/uuid"
-	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Enum pseudo-type.
@@ -15,11 +25,38 @@ type Enum uint
 // Queue size for the command channel.
 const queueSize = 10
 
+// The command and state loops send a heartbeat at least every heartbeatInterval. A loop without heartbeat for
+// heartbeatTimeout is considered stalled.
+const (
+	heartbeatInterval = time.Second
+	heartbeatTimeout  = 10 * time.Second
+)
+
+// Reported by Liveness for the loops of a stopped controller.
+var errStopped = errors.New("door controller is not running")
+
+// Recorded on the confirmation span when the sensors don't report the door open or closed after a relay pulse.
+var errNoConfirmation = errors.New("no sensor confirmation within the attribution window")
+
+// Tracer for the spans of the door controller.
+var tracer = tracing.Tracer("controller")
+
+// Logger of the controller component.
+var logger = logging.Logger("controller")
+
+// Names of the loops reported by Liveness.
+const (
+	LoopCommand = "command_loop"
+	LoopState   = "state_loop"
+)
+
 // Enumeration of commands.
 const (
 	CmdDummy  Enum = iota // CmdDummy does nothing, but prevents errors when closing the channel.
 	CmdToggle             // CmdToggle identifies the toggle command
 	CmdState              // CmdState identifies the state request command
+	CmdOpen               // CmdOpen identifies the open command, which only toggles a closed door
+	CmdClose              // CmdClose identifies the close command, which only toggles an open door
 )
 
 // Enumeration of states.
@@ -37,13 +74,25 @@ var (
 
 // DoorControllerService implements the service for controlling the garagedoor and reporting its state.
 type DoorControllerService struct {
-	command        chan Enum
-	stateListeners map[uuid.UUID]func(string)
-	state          Enum
-	lock           sync.RWMutex
-	adapter        gpio.GPIOAdapter
-	wg             sync.WaitGroup
-	running        bool
+	command       chan queuedCommand
+	states        *eventBus[StateEvent]
+	commandGuards map[uuid.UUID]func(command string, source string) error
+	state         Enum
+	lock          sync.RWMutex
+	adapter       gpio.GPIOAdapter
+	wg            sync.WaitGroup
+	running       atomic.Bool
+	policy        *commandPolicy
+	events        *eventLog
+	maintenance   *maintenanceLock
+	doorID        string
+	previous      Enum
+	changed       time.Time
+	sequence      uint64
+	lastActuation actuation
+	commandBeat   atomic.Int64
+	stateBeat     atomic.Int64
+	statePending  atomic.Bool
 }
 
 // GetDoorControllerService returns the one and only DoorControllerServiceImpl instance.
@@ -57,13 +106,18 @@ func GetDoorControllerService() *DoorControllerService {
 // Creates a new DoorControllerServiceImpl object.
 func newDoorControllerService() *DoorControllerService {
 	return &DoorControllerService{
-		command:        nil,
-		stateListeners: make(map[uuid.UUID]func(string)),
-		state:          StateUninitialized,
-		lock:           sync.RWMutex{},
-		adapter:        gpio.GetGPIOAdapter(),
-		wg:             sync.WaitGroup{},
-		running:        false,
+		command:       nil,
+		states:        newEventBus[StateEvent]("state"),
+		commandGuards: make(map[uuid.UUID]func(command string, source string) error),
+		state:         StateUninitialized,
+		lock:          sync.RWMutex{},
+		adapter:       gpio.GetGPIOAdapter(),
+		wg:            sync.WaitGroup{},
+		policy:        newCommandPolicy(),
+		events:        newEventLog(),
+		maintenance:   newMaintenanceLock(storage.GetStore()),
+		doorID:        config.GetDoorID(),
+		previous:      StateUninitialized,
 	}
 }
 
@@ -75,41 +129,65 @@ func (d *DoorControllerService) Reset() {
 	d.state = StateUnknown
 }
 
-// Main loop for handling commands.
+// Main loop for handling commands. The loop wakes up every heartbeatInterval to send a heartbeat, also without
+// commands.
 func (d *DoorControllerService) commandLoop() {
 	defer d.wg.Done()
-
-	for d.running {
-		switch <-d.command {
-		case CmdToggle:
-			d.toggle()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for d.running.Load() {
+		d.commandBeat.Store(time.Now().UnixNano())
+		var queued queuedCommand
+		select {
+		case queued = <-d.command:
+		case <-heartbeat.C:
+			continue
+		}
+		switch queued.cmd {
+		case CmdToggle, CmdOpen, CmdClose:
+			d.execute(queued)
 		case CmdState:
-			d.broadcastState()
+			d.statePending.Store(false)
+			d.broadcastState(CauseRefresh, queued.source)
 		case CmdDummy:
 			// Do nothing
 		default:
-			log.Warn().Msgf("unknown command: %v", d.command)
+			logger.Warn().Msgf("unknown command: %v", queued.cmd)
 		}
 	}
 
-	log.Info().Msg("commandLoop exiting")
+	logger.Info().Msg("commandLoop exiting")
 }
 
 // Main loop for reading and broadcasting the state of the garagedoor.
 func (d *DoorControllerService) stateLoop() {
 	defer d.wg.Done()
 
-	for d.running {
+	for d.running.Load() {
+		d.stateBeat.Store(time.Now().UnixNano())
 		state := d.readCurrentState()
 		if d.stateDiffers(state) {
-			d.setState(state)
-			d.broadcastState()
+			cause, source := d.setState(state)
+			event := d.broadcastState(cause, source)
+			d.events.add(Event{
+				Type:       EventState,
+				Source:     source,
+				State:      event.State,
+				StateEvent: &event,
+			})
+		}
+		d.expireConfirmation(time.Now())
+		if d.maintenance.expired(time.Now()) {
+			if err := d.Unlock("expiry"); err != nil {
+				logger.Error().Msgf("failed to release expired maintenance lock: %v", err)
+			}
 		}
 
 		time.Sleep(250 * time.Millisecond)
 	}
 
-	log.Info().Msg("stateLoop exiting")
+	logger.Info().Msg("stateLoop exiting")
 }
 
 // Start all goroutines.
@@ -117,8 +195,13 @@ func (d *DoorControllerService) Start() {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	d.running = true
-	d.command = make(chan Enum, queueSize)
+	d.running.Store(true)
+	d.command = make(chan queuedCommand, queueSize)
+	d.statePending.Store(false)
+	d.policy.reset()
+	now := time.Now().UnixNano()
+	d.commandBeat.Store(now)
+	d.stateBeat.Store(now)
 	go d.commandLoop()
 	go d.stateLoop()
 	d.wg.Add(2)
@@ -127,23 +210,122 @@ func (d *DoorControllerService) Start() {
 // Stop all goroutines, gracefully.
 func (d *DoorControllerService) Stop() {
 	d.lock.Lock()
-	d.running = false
+	d.running.Store(false)
 	close(d.command)
 	d.lock.Unlock()
-	log.Info().Msg("Stopping DoorControllerService")
+	logger.Info().Msg("Stopping DoorControllerService")
 
 	d.wg.Wait()
-	log.Info().Msg("DoorControllerService stopped")
+	d.lock.Lock()
+	if d.lastActuation.pending {
+		d.lastActuation.confirm.AddEvent("controller stopped")
+		d.lastActuation.confirm.End()
+		d.lastActuation.pending = false
+	}
+	d.lock.Unlock()
+	logger.Info().Msg("DoorControllerService stopped")
+}
+
+// RequestToggle puts a toggle command on the command queue. The source identifies the caller, and is recorded
+// in the event log. An error is returned when the command is refused, either by the command policy or because
+// the command can't be queued. The execution of the command is traced as part of the trace in ctx, if any; it isn't
+// cancelled with ctx.
+func (d *DoorControllerService) RequestToggle(ctx context.Context, source string) error {
+	return d.requestCommand(ctx, CmdToggle, source)
+}
+
+// RequestOpen puts an open command on the command queue. The door is only toggled if it is closed when the command
+// is executed. See RequestToggle for the meaning of the context, the source and the returned error.
+func (d *DoorControllerService) RequestOpen(ctx context.Context, source string) error {
+	return d.requestCommand(ctx, CmdOpen, source)
 }
 
-// RequestToggle puts a toggle command on the command queue
-func (d *DoorControllerService) RequestToggle() {
-	d.command <- CmdToggle
+// RequestClose puts a close command on the command queue. The door is only toggled if it is open when the command
+// is executed. See RequestToggle for the meaning of the context, the source and the returned error.
+func (d *DoorControllerService) RequestClose(ctx context.Context, source string) error {
+	return d.requestCommand(ctx, CmdClose, source)
 }
 
-// RequestState puts a state update request on the command queue
+// RequestState puts a state update request on the command queue. The state is broadcast as a refresh. It never
+// blocks: requests are coalesced, so at most one is queued, and they are dropped when the controller isn't running or
+// the queue is full, so they can't crowd out actuating commands.
 func (d *DoorControllerService) RequestState() {
-	d.command <- CmdState
+	if !d.statePending.CompareAndSwap(false, true) {
+		return
+	}
+	if err := d.enqueue(queuedCommand{cmd: CmdState}); err != nil {
+		d.statePending.Store(false)
+		logger.Debug().Msgf("state request dropped: %v", err)
+	}
+}
+
+// Lock engages the maintenance lock, refusing all remote actuation until Unlock is called or the duration has
+// passed. A zero duration locks the door indefinitely. The lock is persisted, and survives restarts.
+func (d *DoorControllerService) Lock(reason string, duration time.Duration, source string) (LockStatus, error) {
+	status, err := d.maintenance.engage(reason, duration, source, time.Now())
+	if err != nil {
+		return status, err
+	}
+	logger.Warn().Msgf("door locked for maintenance by %s: %s", source, reason)
+	details := map[string]string{}
+	if status.Expires != nil {
+		details["expires"] = status.Expires.Format(time.RFC3339)
+	}
+	audit.Record(audit.Entry{
+		Type:    audit.TypeLock,
+		Actor:   source,
+		Message: reason,
+		Details: details,
+	})
+	d.events.add(Event{
+		Type:    EventLock,
+		Source:  source,
+		Message: reason,
+	})
+	d.broadcastState(CauseRefresh, source)
+	return status, nil
+}
+
+// Unlock releases the maintenance lock. Unlocking a door that isn't locked has no effect.
+func (d *DoorControllerService) Unlock(source string) error {
+	released, err := d.maintenance.release()
+	if err != nil || !released {
+		return err
+	}
+	logger.Info().Msgf("maintenance lock released by %s", source)
+	audit.Record(audit.Entry{
+		Type:  audit.TypeUnlock,
+		Actor: source,
+	})
+	d.events.add(Event{
+		Type:   EventUnlock,
+		Source: source,
+	})
+	d.broadcastState(CauseRefresh, source)
+	return nil
+}
+
+// GetLockStatus returns the status of the maintenance lock.
+func (d *DoorControllerService) GetLockStatus() LockStatus {
+	return d.maintenance.get()
+}
+
+// RecordEvent adds an event to the event log, e.g. a notification raised by another component. The id and, when not
+// set, the timestamp are assigned by the log. Returns the recorded event.
+func (d *DoorControllerService) RecordEvent(event Event) Event {
+	return d.events.add(event)
+}
+
+// GetEvents returns the retained events with an id greater than the given one. Use 0 to get all events.
+func (d *DoorControllerService) GetEvents(since uint64) []Event {
+	return d.events.since(since)
+}
+
+// GetStateEvent returns the current state as a refresh event, e.g. to send an initial state to a new listener.
+func (d *DoorControllerService) GetStateEvent() StateEvent {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.stateEvent(CauseRefresh, "")
 }
 
 // GetStateStr returns a string representation of the current state.
@@ -153,32 +335,227 @@ func (d *DoorControllerService) GetStateStr() string {
 
 // Ready checks if the component is running and the state has been updated with a proper value.
 func (d *DoorControllerService) Ready() bool {
-	return d.running && d.state != StateUninitialized
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.running.Load() && d.state != StateUninitialized
+}
+
+// Liveness returns, for the command and the state loop, nil if the loop sent a heartbeat recently, or an error
+// describing why it is considered stalled.
+func (d *DoorControllerService) Liveness(now time.Time) map[string]error {
+	loops := map[string]*atomic.Int64{
+		LoopCommand: &d.commandBeat,
+		LoopState:   &d.stateBeat,
+	}
+	result := make(map[string]error)
+	for name, beat := range loops {
+		if !d.running.Load() {
+			result[name] = errStopped
+			continue
+		}
+		last := time.Unix(0, beat.Load())
+		if age := now.Sub(last); age > heartbeatTimeout {
+			result[name] = fmt.Errorf("no heartbeat for %v", age.Round(time.Second))
+		} else {
+			result[name] = nil
+		}
+	}
+	return result
+}
+
+// Alive checks if both the command and the state loop sent a heartbeat recently.
+func (d *DoorControllerService) Alive(now time.Time) bool {
+	for _, err := range d.Liveness(now) {
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckAdapter returns an error if the GPIO adapter can't read or write the pins.
+func (d *DoorControllerService) CheckAdapter() error {
+	return d.adapter.Check()
 }
 
 // AddStateListener adds a listerer for state changes. When added, no initial state is sent.
-// If an update is needed, RequestState() should be called.
+// If an update is needed, RequestState() should be called. The listener is called from its own goroutine, with a
+// bounded queue that drops the oldest state when the listener can't keep up.
+// Returns an index that can be used to remove the listener.
+func (d *DoorControllerService) AddStateListener(handler func(StateEvent)) uuid.UUID {
+	return d.SubscribeState(SubscriberOptions{Name: "listener"}, handler).ID()
+}
+
+// SubscribeState adds a listener for state changes, with the given queue size and overflow policy.
+func (d *DoorControllerService) SubscribeState(opts SubscriberOptions, handler func(StateEvent)) *Subscription {
+	return d.states.subscribe(opts, handler)
+}
+
+// RemoveStateListener removes a listener by index. It is safe to call from within the listener.
+func (d *DoorControllerService) RemoveStateListener(id uuid.UUID) {
+	d.states.remove(id)
+}
+
+// AddEventListener adds a listener for events recorded in the event log. Like state listeners, event listeners are
+// called from their own goroutine, and drop the oldest events when they can't keep up.
 // Returns an index that can be used to remove the listener.
-func (d *DoorControllerService) AddStateListener(handler func(string)) uuid.UUID {
+func (d *DoorControllerService) AddEventListener(handler func(Event)) uuid.UUID {
+	return d.SubscribeEvents(SubscriberOptions{Name: "listener"}, handler).ID()
+}
+
+// SubscribeEvents adds a listener for events recorded in the event log, with the given queue size and overflow
+// policy.
+func (d *DoorControllerService) SubscribeEvents(opts SubscriberOptions, handler func(Event)) *Subscription {
+	return d.events.bus.subscribe(opts, handler)
+}
+
+// RemoveEventListener removes an event listener by index. It is safe to call from within the listener.
+func (d *DoorControllerService) RemoveEventListener(id uuid.UUID) {
+	d.events.bus.remove(id)
+}
+
+// GetBusStats returns the subscribers of the state and event buses, and the number of items they dropped.
+func (d *DoorControllerService) GetBusStats() BusStats {
+	stats := BusStats{
+		Subscribers:  append(d.states.stats(), d.events.bus.stats()...),
+		Dropped:      d.states.dropped.Load() + d.events.bus.dropped.Load(),
+		Disconnected: d.states.disconnected.Load() + d.events.bus.disconnected.Load(),
+	}
+	return stats
+}
+
+// AddCommandGuard adds a guard that is consulted before an actuating command (toggle, open, close) is accepted.
+// A guard refuses a command by returning an error, which should wrap ErrDenied.
+// Returns an index that can be used to remove the guard.
+func (d *DoorControllerService) AddCommandGuard(guard func(command string, source string) error) uuid.UUID {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	id := uuid.New()
-	d.stateListeners[id] = handler
+	d.commandGuards[id] = guard
 	return id
 }
 
-// RemoveStateListener removes a listener by index.
-func (d *DoorControllerService) RemoveStateListener(id uuid.UUID) {
+// RemoveCommandGuard removes a guard by index.
+func (d *DoorControllerService) RemoveCommandGuard(id uuid.UUID) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	delete(d.stateListeners, id)
+	delete(d.commandGuards, id)
+}
+
+// Consult all command guards, returning the first refusal.
+func (d *DoorControllerService) checkGuards(cmd Enum, source string) error {
+	d.lock.RLock()
+	guards := make([]func(string, string) error, 0, len(d.commandGuards))
+	for _, guard := range d.commandGuards {
+		guards = append(guards, guard)
+	}
+	d.lock.RUnlock()
+
+	for _, guard := range guards {
+		if err := guard(commandStr(cmd), source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Queue an actuating command after checking it against the command policy, and record the outcome.
+func (d *DoorControllerService) requestCommand(ctx context.Context, cmd Enum, source string) error {
+	_, span := tracer.Start(ctx, "controller.request", trace.WithAttributes(
+		tracing.AttrCommand.String(commandStr(cmd)),
+		tracing.AttrSource.String(source)))
+	defer span.End()
+	now := time.Now()
+	var err error
+	if d.maintenance.get().Locked && !d.maintenance.expired(now) {
+		err = ErrMaintenanceLock
+	} else if err = d.checkGuards(cmd, source); err == nil {
+		err = d.policy.admit(cmd, now)
+	}
+	if err == nil {
+		err = d.enqueue(queuedCommand{cmd: cmd, source: source, queued: now, span: span.SpanContext()})
+		if err != nil {
+			d.policy.cancel(cmd)
+		} else {
+			d.policy.commit(now)
+		}
+	}
+
+	if err != nil {
+		tracing.RecordError(span, err)
+		metrics.Commands.WithLabelValues(commandStr(cmd), source, "rejected").Inc()
+		logger.Warn().Msgf("%s command from %s refused: %v", commandStr(cmd), source, err)
+		audit.Record(audit.Entry{
+			Type:    audit.TypeCommand,
+			Actor:   source,
+			Outcome: "rejected",
+			Message: err.Error(),
+			Details: map[string]string{"command": commandStr(cmd)},
+		})
+		d.events.add(Event{
+			Type:    EventCommandRejected,
+			Source:  source,
+			Command: commandStr(cmd),
+			Message: err.Error(),
+		})
+		return err
+	}
+	metrics.Commands.WithLabelValues(commandStr(cmd), source, "accepted").Inc()
+	audit.Record(audit.Entry{
+		Type:    audit.TypeCommand,
+		Actor:   source,
+		Outcome: "accepted",
+		Details: map[string]string{"command": commandStr(cmd)},
+	})
+	d.events.add(Event{
+		Type:    EventCommand,
+		Source:  source,
+		Command: commandStr(cmd),
+	})
+	return nil
+}
+
+// Put a command on the queue without blocking.
+func (d *DoorControllerService) enqueue(queued queuedCommand) error {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if !d.running.Load() {
+		return ErrNotRunning
+	}
+	select {
+	case d.command <- queued:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Generate a string representation of a command.
+func commandStr(cmd Enum) string {
+	switch cmd {
+	case CmdToggle:
+		return "toggle"
+	case CmdState:
+		return "state"
+	case CmdOpen:
+		return "open"
+	case CmdClose:
+		return "close"
+	default:
+		return "unknown"
+	}
 }
 
 // Generate a string representation of the current state.
 func (d *DoorControllerService) stateStr() string {
 	d.lock.RLock()
 	defer d.lock.RUnlock()
-	switch d.state {
+	return stateName(d.state)
+}
+
+// Generate a string representation of a state.
+func stateName(state Enum) string {
+	switch state {
 	case StateOpen:
 		return "open"
 	case StateClosed:
@@ -195,30 +572,146 @@ func (d *DoorControllerService) stateDiffers(state Enum) bool {
 	return d.state != state
 }
 
-// Set the object's state to the given state.
-func (d *DoorControllerService) setState(state Enum) {
+// Set the object's state to the given state, remembering the previous state. Returns the cause of the transition,
+// and the source of the command that caused it. The transition is counted in the metrics, and for transitions caused
+// by a command ending in the open or closed state, the travel time since the relay pulse is observed.
+func (d *DoorControllerService) setState(state Enum) (cause string, source string) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	now := time.Now()
+	d.previous = d.state
 	d.state = state
+	d.changed = now
+	metrics.SetDoorState(stateName(state))
+	if d.previous != StateUninitialized {
+		metrics.StateTransitions.WithLabelValues(stateName(d.previous), stateName(state)).Inc()
+	}
+	if !d.lastActuation.time.IsZero() && now.Sub(d.lastActuation.time) <= commandAttributionWindow {
+		if state == StateOpen || state == StateClosed {
+			metrics.TravelTime.WithLabelValues(stateName(state)).Observe(now.Sub(d.lastActuation.time).Seconds())
+		}
+		if d.lastActuation.pending {
+			d.lastActuation.confirm.AddEvent("state", trace.WithAttributes(tracing.AttrState.String(stateName(state))))
+			if state == StateOpen || state == StateClosed {
+				d.lastActuation.confirm.SetAttributes(tracing.AttrState.String(stateName(state)))
+				d.lastActuation.confirm.End()
+				d.lastActuation.pending = false
+			}
+		}
+		return CauseCommand, d.lastActuation.source
+	}
+	return CauseSensor, ""
 }
 
-// Broadcast the current state to all listeners.
-func (d *DoorControllerService) broadcastState() {
-	d.lock.RLock()
-	defer d.lock.RUnlock()
-	for _, listener := range d.stateListeners {
-		listener(d.stateStr())
+// Create a state event for the current state. Events caused by a command carry the span of its confirmation. The
+// caller must hold the lock.
+func (d *DoorControllerService) stateEvent(cause string, source string) StateEvent {
+	var span trace.SpanContext
+	if cause == CauseCommand && d.lastActuation.confirm != nil {
+		span = d.lastActuation.confirm.SpanContext()
 	}
+	return StateEvent{
+		DoorID:   d.doorID,
+		State:    stateName(d.state),
+		Previous: stateName(d.previous),
+		Changed:  d.changed,
+		Sequence: d.sequence,
+		Cause:    cause,
+		Source:   source,
+		span:     span,
+	}
+}
+
+// Broadcast the current state to all listeners, returning the event. Publishing doesn't block, so it is done while
+// holding the lock to keep the events in sequence.
+func (d *DoorControllerService) broadcastState(cause string, source string) StateEvent {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.sequence++
+	event := d.stateEvent(cause, source)
+	d.states.publish(event)
+	return event
 }
 
-// Toggle the garagedoor.
-func (d *DoorControllerService) toggle() {
+// Execute an actuating command taken from the queue. The time it spent on the queue and its execution are traced as
+// part of the request. The command counts as queued until the relay pulse is done, so an identical command requested
+// meanwhile is coalesced rather than reversing the door.
+func (d *DoorControllerService) execute(queued queuedCommand) {
+	defer d.policy.dequeued(queued.cmd)
+	attributes := trace.WithAttributes(
+		tracing.AttrCommand.String(commandStr(queued.cmd)),
+		tracing.AttrSource.String(queued.source))
+	parent := trace.ContextWithSpanContext(context.Background(), queued.span)
+	_, wait := tracer.Start(parent, "controller.queue", attributes, trace.WithTimestamp(queued.queued))
+	wait.End()
+	ctx, span := tracer.Start(parent, "controller.execute", attributes)
+	defer span.End()
+
+	switch queued.cmd {
+	case CmdToggle:
+		d.toggle(ctx, queued.source)
+	case CmdOpen:
+		d.toggleIf(ctx, StateClosed, queued.source)
+	case CmdClose:
+		d.toggleIf(ctx, StateOpen, queued.source)
+	}
+}
+
+// Toggle the garagedoor, on behalf of the given source. The relay pulse is traced, and a confirmation span is started
+// that ends when the sensors report the door open or closed.
+func (d *DoorControllerService) toggle(ctx context.Context, source string) {
+	_, confirm := tracer.Start(ctx, "controller.confirm")
+	d.lock.Lock()
+	if d.lastActuation.pending {
+		d.lastActuation.confirm.AddEvent("superseded by another command")
+		d.lastActuation.confirm.End()
+	}
+	d.lastActuation = actuation{
+		source:  source,
+		time:    time.Now(),
+		confirm: confirm,
+		pending: true,
+	}
+	d.lock.Unlock()
+
+	_, pulse := tracer.Start(ctx, "controller.toggle")
+	defer pulse.End()
+	state := d.stateStr()
+	metrics.RelayPulses.Inc()
 	d.adapter.WriteTogglePin(true)
 	time.Sleep(250 * time.Millisecond)
 	d.adapter.WriteTogglePin(false)
+	audit.Record(audit.Entry{
+		Type:    audit.TypeActuation,
+		Actor:   source,
+		Details: map[string]string{"state": state},
+	})
 	time.Sleep(250 * time.Millisecond)
 }
 
+// Toggle the garagedoor, but only if it is in the given state.
+func (d *DoorControllerService) toggleIf(ctx context.Context, state Enum, source string) {
+	if d.stateDiffers(state) {
+		logger.Info().Msgf("door is %s, ignoring command", d.stateStr())
+		trace.SpanFromContext(ctx).AddEvent("command ignored",
+			trace.WithAttributes(tracing.AttrState.String(d.stateStr())))
+		return
+	}
+	d.toggle(ctx, source)
+}
+
+// End the confirmation span of the last actuation as failed when the sensors didn't report the door open or closed
+// within the attribution window.
+func (d *DoorControllerService) expireConfirmation(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.lastActuation.pending && now.Sub(d.lastActuation.time) > commandAttributionWindow {
+		tracing.RecordError(d.lastActuation.confirm, errNoConfirmation)
+		d.lastActuation.confirm.End()
+		d.lastActuation.pending = false
+	}
+}
+
 // Read the current state from the two pins connected to the magnetic switches.
 func (d *DoorControllerService) readCurrentState() Enum {
 	open := d.adapter.ReadOpenPin()
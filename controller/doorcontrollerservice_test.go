@@ -1,16 +1,30 @@
 package controller
 
 import (
+	"context"
+	"errors"
 	"os"
+	"slices"
 	"testing"
 	"time"
 
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/storage"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 func init() {
 	// Set the environment variable for the configuration path
 	os.Setenv("GARAGESERVICE_CONFIG_PATH", "..")
+	dataDir, _ := os.MkdirTemp("", "garagedoor-service-test")
+	os.Setenv("GARAGESERVICE_DATA_DIR", dataDir)
+	// The tests toggle the door in quick succession.
+	os.Setenv("GARAGESERVICE_COMMAND_MIN_INTERVAL", "0s")
 	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
 }
 
@@ -50,7 +64,9 @@ func TestToggle(t *testing.T) {
 		t.Fatalf("Expected state to be closed, got %s", controller.GetStateStr())
 	}
 
-	controller.RequestToggle()
+	if err := controller.RequestToggle(context.Background(), "test"); err != nil {
+		t.Fatalf("Expected toggle to be accepted, got %v", err)
+	}
 	time.Sleep(1 * time.Second)
 	if controller.GetStateStr() != "open" {
 		t.Fatalf("Expected state to be open, got %s", controller.GetStateStr())
@@ -63,23 +79,596 @@ func TestListener(t *testing.T) {
 	controller := GetDoorControllerService()
 	controller.Reset()
 	controller.Start()
+	defer controller.Stop()
 
-	state := ""
-	controller.AddStateListener(func(s string) {
-		state = s
+	states := make(chan StateEvent, 100)
+	id := controller.AddStateListener(func(event StateEvent) {
+		states <- event
 	})
+	defer controller.RemoveStateListener(id)
 
 	controller.RequestState()
+	awaitState(t, states, "closed")
+
+	if err := controller.RequestToggle(context.Background(), "test"); err != nil {
+		t.Fatalf("Expected toggle to be accepted, got %v", err)
+	}
+	awaitState(t, states, "open")
+	awaitIdle(t, controller)
+}
+
+func TestCommandPolicy(t *testing.T) {
+	policy := &commandPolicy{
+		minInterval:     time.Second,
+		coalesce:        true,
+		lockoutCount:    3,
+		lockoutWindow:   time.Minute,
+		lockoutDuration: 5 * time.Minute,
+		queued:          make(map[Enum]int),
+	}
+	now := time.Now()
+
+	// A command that could not be queued doesn't count for the minimum interval or the lockout.
+	for i := 0; i < 3; i++ {
+		if err := policy.admit(CmdToggle, now); err != nil {
+			t.Fatalf("Expected cancelled command not to count, got %v", err)
+		}
+		policy.cancel(CmdToggle)
+	}
+
+	if err := policy.admit(CmdToggle, now); err != nil {
+		t.Fatalf("Expected first command to be accepted, got %v", err)
+	}
+	if err := policy.admit(CmdOpen, now); !errors.Is(err, ErrTooSoon) {
+		t.Fatalf("Expected command while another is admitted to be rejected, got %v", err)
+	}
+	policy.commit(now)
+	if err := policy.admit(CmdToggle, now.Add(2*time.Second)); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("Expected queued duplicate to be rejected, got %v", err)
+	}
+	policy.dequeued(CmdToggle)
+	if err := policy.admit(CmdToggle, now.Add(500*time.Millisecond)); !errors.Is(err, ErrTooSoon) {
+		t.Fatalf("Expected command within minimum interval to be rejected, got %v", err)
+	}
+	if err := policy.admit(CmdToggle, now.Add(2*time.Second)); err != nil {
+		t.Fatalf("Expected second command to be accepted, got %v", err)
+	}
+	policy.commit(now.Add(2 * time.Second))
+	policy.dequeued(CmdToggle)
+	if err := policy.admit(CmdToggle, now.Add(4*time.Second)); err != nil {
+		t.Fatalf("Expected third command to be accepted, got %v", err)
+	}
+	policy.commit(now.Add(4 * time.Second))
+	policy.dequeued(CmdToggle)
+	if err := policy.admit(CmdToggle, now.Add(6*time.Second)); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("Expected command after lockout to be rejected, got %v", err)
+	}
+	if err := policy.admit(CmdToggle, now.Add(6*time.Minute)); err != nil {
+		t.Fatalf("Expected command after lockout expiry to be accepted, got %v", err)
+	}
+}
+
+func TestEventLog(t *testing.T) {
+	controller := GetDoorControllerService()
+	controller.Reset()
+	controller.Start()
+	defer controller.Stop()
+
+	time.Sleep(1 * time.Second)
+	last := uint64(0)
+	if events := controller.GetEvents(0); len(events) > 0 {
+		last = events[len(events)-1].ID
+	}
+	if err := controller.RequestToggle(context.Background(), "test"); err != nil {
+		t.Fatalf("Expected toggle to be accepted, got %v", err)
+	}
 	time.Sleep(1 * time.Second)
-	if state != "closed" {
-		t.Fatalf("Expected state to be closed, got %s", state)
+
+	events := controller.GetEvents(last)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	if events[0].Type != EventCommand || events[0].Source != "test" || events[0].Command != "toggle" {
+		t.Fatalf("Expected toggle command event from test, got %+v", events[0])
+	}
+	if events[1].Type != EventState || events[1].State != "open" {
+		t.Fatalf("Expected open state event, got %+v", events[1])
+	}
+}
+
+func TestMaintenanceLock(t *testing.T) {
+	controller := GetDoorControllerService()
+	controller.Reset()
+	controller.Start()
+	defer controller.Stop()
+
+	if _, err := controller.Lock("testing", 0, "test"); err != nil {
+		t.Fatalf("Error engaging maintenance lock: %v", err)
+	}
+	if err := controller.RequestToggle(context.Background(), "test"); !errors.Is(err, ErrMaintenanceLock) {
+		t.Fatalf("Expected toggle to be refused while locked, got %v", err)
+	}
+
+	restored := newMaintenanceLock(storage.GetStore())
+	if status := restored.get(); !status.Locked || status.Reason != "testing" {
+		t.Fatalf("Expected maintenance lock to be restored, got %+v", status)
 	}
 
-	controller.RequestToggle()
+	if err := controller.Unlock("test"); err != nil {
+		t.Fatalf("Error releasing maintenance lock: %v", err)
+	}
+	if err := controller.RequestToggle(context.Background(), "test"); err != nil {
+		t.Fatalf("Expected toggle to be accepted after unlock, got %v", err)
+	}
+}
+
+func TestMaintenanceLockExpiry(t *testing.T) {
+	controller := GetDoorControllerService()
+	controller.Reset()
+	controller.Start()
+	defer controller.Stop()
+
+	if _, err := controller.Lock("testing", 500*time.Millisecond, "test"); err != nil {
+		t.Fatalf("Error engaging maintenance lock: %v", err)
+	}
+	if !controller.GetLockStatus().Locked {
+		t.Fatalf("Expected door to be locked")
+	}
 	time.Sleep(1 * time.Second)
-	if state != "open" {
-		t.Fatalf("Expected state to be open, got %s", state)
+	if controller.GetLockStatus().Locked {
+		t.Fatalf("Expected maintenance lock to have expired")
 	}
+}
 
-	controller.Stop()
+func TestOpenClose(t *testing.T) {
+	controller := GetDoorControllerService()
+	controller.Reset()
+	controller.Start()
+	defer controller.Stop()
+
+	time.Sleep(1 * time.Second)
+	if err := controller.RequestClose(context.Background(), "test"); err != nil {
+		t.Fatalf("Expected close to be accepted, got %v", err)
+	}
+	time.Sleep(1 * time.Second)
+	if controller.GetStateStr() != "closed" {
+		t.Fatalf("Expected state to remain closed, got %s", controller.GetStateStr())
+	}
+	if err := controller.RequestOpen(context.Background(), "test"); err != nil {
+		t.Fatalf("Expected open to be accepted, got %v", err)
+	}
+	time.Sleep(1 * time.Second)
+	if controller.GetStateStr() != "open" {
+		t.Fatalf("Expected state to be open, got %s", controller.GetStateStr())
+	}
+}
+
+func TestCommandGuard(t *testing.T) {
+	controller := GetDoorControllerService()
+	controller.Reset()
+	controller.Start()
+	defer controller.Stop()
+
+	id := controller.AddCommandGuard(func(command string, source string) error {
+		if command == "toggle" {
+			return ErrDenied
+		}
+		return nil
+	})
+	if err := controller.RequestToggle(context.Background(), "test"); !errors.Is(err, ErrDenied) {
+		t.Fatalf("Expected toggle to be denied, got %v", err)
+	}
+	controller.RemoveCommandGuard(id)
+	if err := controller.RequestToggle(context.Background(), "test"); err != nil {
+		t.Fatalf("Expected toggle to be accepted after removing the guard, got %v", err)
+	}
+}
+
+func TestEventBusDropOldest(t *testing.T) {
+	bus := newEventBus[int]("test")
+	release := make(chan struct{})
+	received := make(chan int, 10)
+	bus.subscribe(SubscriberOptions{Name: "slow", QueueSize: 2}, func(item int) {
+		<-release
+		received <- item
+	})
+
+	// The first item is taken by the blocked handler, the queue holds two more, and the oldest queued item is dropped.
+	bus.publish(1)
+	time.Sleep(50 * time.Millisecond)
+	for i := 2; i <= 4; i++ {
+		bus.publish(i)
+	}
+	close(release)
+
+	expected := []int{1, 3, 4}
+	for _, want := range expected {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("Expected item %d, got %d", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for item %d", want)
+		}
+	}
+	stats := bus.stats()
+	if len(stats) != 1 || stats[0].Dropped != 1 || bus.dropped.Load() != 1 {
+		t.Fatalf("Expected 1 dropped item, got %+v", stats)
+	}
+}
+
+func TestEventBusStall(t *testing.T) {
+	s := &subscriber[int]{size: 1, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	s.push(1)
+
+	// Only the first dropped item of a stall is reported, until the subscriber catches up.
+	for i, want := range []bool{true, false, false} {
+		if _, dropped, stalled := s.push(i + 2); !dropped || stalled != want {
+			t.Fatalf("Expected item %d to be dropped with stalled %v, got %v, %v", i+2, want, dropped, stalled)
+		}
+	}
+	for _, ok := s.next(); ok; _, ok = s.next() {
+	}
+	s.push(5)
+	if _, dropped, stalled := s.push(6); !dropped || !stalled {
+		t.Fatalf("Expected a new stall after catching up, got %v, %v", dropped, stalled)
+	}
+	if s.dropped != 4 {
+		t.Fatalf("Expected 4 dropped items, got %d", s.dropped)
+	}
+}
+
+func TestEventBusDisconnect(t *testing.T) {
+	bus := newEventBus[int]("test")
+	release := make(chan struct{})
+	defer close(release)
+	subscription := bus.subscribe(SubscriberOptions{Name: "slow", QueueSize: 1, Policy: Disconnect}, func(item int) {
+		<-release
+	})
+
+	bus.publish(1)
+	time.Sleep(50 * time.Millisecond)
+	bus.publish(2)
+	bus.publish(3)
+
+	select {
+	case <-subscription.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the slow subscriber to be disconnected")
+	}
+	if len(bus.stats()) != 0 || bus.disconnected.Load() != 1 {
+		t.Fatalf("Expected the subscriber to be removed from the bus")
+	}
+}
+
+func TestRemoveListenerFromCallback(t *testing.T) {
+	controller := GetDoorControllerService()
+	controller.Reset()
+	controller.Start()
+	defer controller.Stop()
+	states := watchStates(t, controller)
+
+	calls := make(chan StateEvent, 10)
+	var id uuid.UUID
+	id = controller.AddStateListener(func(event StateEvent) {
+		controller.RemoveStateListener(id)
+		calls <- event
+	})
+	controller.RequestState()
+	var first StateEvent
+	select {
+	case first = <-calls:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the listener to be called")
+	}
+
+	// The controller isn't blocked, and the listener isn't called anymore. It was removed before the next state was
+	// broadcast, so it can't receive it.
+	controller.RequestState()
+	awaitEvent(t, states, "a later state", func(event StateEvent) bool {
+		return event.Sequence > first.Sequence
+	})
+	if len(calls) != 0 {
+		t.Fatalf("Expected the listener to be removed")
+	}
+	if err := controller.RequestToggle(context.Background(), "test"); err != nil {
+		t.Fatalf("Expected toggle to be accepted, got %v", err)
+	}
+	awaitState(t, states, "open")
+	if len(calls) != 0 {
+		t.Fatalf("Expected the listener to be removed")
+	}
+
+	// Close the door again for the next tests.
+	awaitIdle(t, controller)
+	if err := controller.RequestToggle(context.Background(), "test"); err != nil {
+		t.Fatalf("Expected toggle to be accepted, got %v", err)
+	}
+	awaitState(t, states, "closed")
+	awaitIdle(t, controller)
+}
+
+func TestRequestStateCoalesced(t *testing.T) {
+	controller := GetDoorControllerService()
+	controller.Reset()
+
+	// State requests don't block when the controller isn't running.
+	controller.RequestState()
+
+	// State requests are coalesced, and never take the place of actuating commands.
+	controller.Start()
+	defer controller.Stop()
+	states := watchStates(t, controller)
+	for i := 0; i < 3*queueSize; i++ {
+		controller.RequestState()
+	}
+	if queued := len(controller.command); queued > 1 {
+		t.Fatalf("Expected at most one queued state request, got %d", queued)
+	}
+	if err := controller.RequestToggle(context.Background(), "test"); err != nil {
+		t.Fatalf("Expected toggle to be accepted after state requests, got %v", err)
+	}
+	awaitState(t, states, "open")
+
+	// Close the door again for the next tests.
+	awaitIdle(t, controller)
+	if err := controller.RequestToggle(context.Background(), "test"); err != nil {
+		t.Fatalf("Expected toggle to be accepted, got %v", err)
+	}
+	awaitState(t, states, "closed")
+	awaitIdle(t, controller)
+}
+
+func TestDoubleTap(t *testing.T) {
+	controller := GetDoorControllerService()
+	controller.Reset()
+	controller.Start()
+	defer controller.Stop()
+	states := watchStates(t, controller)
+	controller.RequestState()
+	awaitState(t, states, "closed")
+
+	// A second toggle while the first one is pulsing the relay is coalesced, rather than reversing the door.
+	if err := controller.RequestToggle(context.Background(), "test"); err != nil {
+		t.Fatalf("Expected toggle to be accepted, got %v", err)
+	}
+	awaitCondition(t, "the toggle to be taken off the queue", func() bool {
+		return len(controller.command) == 0
+	})
+	if err := controller.RequestToggle(context.Background(), "test"); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("Expected toggle during the pulse to be coalesced, got %v", err)
+	}
+	awaitState(t, states, "open")
+	awaitIdle(t, controller)
+
+	// With a minimum interval, a second toggle is refused even after the first one was executed.
+	setMinInterval(controller, time.Minute)
+	defer setMinInterval(controller, 0)
+	if err := controller.RequestToggle(context.Background(), "test"); !errors.Is(err, ErrTooSoon) {
+		t.Fatalf("Expected toggle within the minimum interval to be refused, got %v", err)
+	}
+
+	// Close the door again for the next tests.
+	setMinInterval(controller, 0)
+	if err := controller.RequestToggle(context.Background(), "test"); err != nil {
+		t.Fatalf("Expected toggle to be accepted, got %v", err)
+	}
+	awaitState(t, states, "closed")
+	awaitIdle(t, controller)
+}
+
+// Change the minimum interval of the command policy of the controller.
+func setMinInterval(controller *DoorControllerService, interval time.Duration) {
+	controller.policy.lock.Lock()
+	defer controller.policy.lock.Unlock()
+	controller.policy.minInterval = interval
+}
+
+// Wait until the controller executed all commands.
+func awaitIdle(t *testing.T, controller *DoorControllerService) {
+	t.Helper()
+	awaitCondition(t, "all commands to be executed", func() bool {
+		controller.policy.lock.Lock()
+		defer controller.policy.lock.Unlock()
+		for _, queued := range controller.policy.queued {
+			if queued > 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Wait until a condition holds, failing the test when it doesn't within a few seconds.
+func awaitCondition(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Subscribe to the state events of the controller for the duration of the test.
+func watchStates(t *testing.T, controller *DoorControllerService) <-chan StateEvent {
+	states := make(chan StateEvent, 100)
+	subscription := controller.SubscribeState(SubscriberOptions{Name: t.Name()}, func(event StateEvent) {
+		states <- event
+	})
+	t.Cleanup(subscription.Close)
+	return states
+}
+
+// Wait for a state event with the given state, failing the test when none is received within a few seconds.
+func awaitState(t *testing.T, states <-chan StateEvent, state string) {
+	t.Helper()
+	awaitEvent(t, states, "state "+state, func(event StateEvent) bool {
+		return event.State == state
+	})
+}
+
+// Wait for a state event matching a condition, failing the test when none is received within a few seconds.
+func awaitEvent(t *testing.T, states <-chan StateEvent, description string, matches func(StateEvent) bool) {
+	t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case event := <-states:
+			if matches(event) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Expected %s", description)
+		}
+	}
+}
+
+func TestEventTypes(t *testing.T) {
+	// The configuration verifies the event filters against its own list, as it can't depend on the controller.
+	types := []string{EventCommand, EventCommandRejected, EventState, EventLock, EventUnlock, EventNotification,
+		EventAlert, EventAlertCleared, EventAlertAcked, EventBan, EventUnban}
+	for _, eventType := range types {
+		if !slices.Contains(config.EventTypes, eventType) {
+			t.Fatalf("Expected event type %s in config.EventTypes", eventType)
+		}
+	}
+	if len(config.EventTypes) != len(types) {
+		t.Fatalf("Expected config.EventTypes to list the event types of the controller, got %v", config.EventTypes)
+	}
+}
+
+func TestStateEvent(t *testing.T) {
+	controller := GetDoorControllerService()
+	controller.Reset()
+	controller.Start()
+	defer controller.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	events := make(chan StateEvent, 10)
+	id := controller.AddStateListener(func(event StateEvent) {
+		events <- event
+	})
+	defer controller.RemoveStateListener(id)
+	next := func() StateEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for state event")
+		}
+		return StateEvent{}
+	}
+
+	controller.RequestState()
+	refresh := next()
+	if refresh.Cause != CauseRefresh || refresh.State != "closed" || refresh.DoorID != "garage_door" {
+		t.Fatalf("Expected refresh of closed door, got %+v", refresh)
+	}
+
+	if err := controller.RequestToggle(context.Background(), "test"); err != nil {
+		t.Fatalf("Expected toggle to be accepted, got %v", err)
+	}
+	transition := next()
+	if transition.Cause != CauseCommand || transition.Source != "test" {
+		t.Fatalf("Expected transition caused by command from test, got %+v", transition)
+	}
+	if transition.State != "open" || transition.Previous != "closed" || transition.Sequence <= refresh.Sequence {
+		t.Fatalf("Expected transition from closed to open with a higher sequence, got %+v", transition)
+	}
+	if transition.Changed.Before(refresh.Changed) {
+		t.Fatalf("Expected change timestamp to advance, got %s", transition.Changed)
+	}
+
+	controller.RequestToggle(context.Background(), "test")
+	time.Sleep(500 * time.Millisecond)
+}
+
+func TestLiveness(t *testing.T) {
+	controller := GetDoorControllerService()
+	if controller.Alive(time.Now()) {
+		t.Fatalf("Expected stopped controller not to be alive")
+	}
+	controller.Reset()
+	controller.Start()
+	defer controller.Stop()
+
+	// The command loop sends heartbeats without commands.
+	time.Sleep(2500 * time.Millisecond)
+	now := time.Now()
+	if !controller.Alive(now) {
+		t.Fatalf("Expected controller to be alive, got %v", controller.Liveness(now))
+	}
+	if time.Since(time.Unix(0, controller.commandBeat.Load())) > 2*heartbeatInterval {
+		t.Fatalf("Expected a recent heartbeat of the command loop")
+	}
+	liveness := controller.Liveness(now.Add(heartbeatTimeout + time.Second))
+	if liveness[LoopCommand] == nil || liveness[LoopState] == nil {
+		t.Fatalf("Expected stalled loops after the heartbeat timeout, got %v", liveness)
+	}
+	if err := controller.CheckAdapter(); err != nil {
+		t.Fatalf("Expected mock adapter to be healthy, got %v", err)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	controller := GetDoorControllerService()
+	controller.Reset()
+	controller.Start()
+	defer controller.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	events := make(chan StateEvent, 10)
+	subscription := controller.SubscribeState(SubscriberOptions{Name: "test"}, func(event StateEvent) {
+		events <- event
+	})
+	defer subscription.Close()
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+	if err := controller.RequestToggle(ctx, "test"); err != nil {
+		t.Fatalf("Expected toggle to be accepted, got %v", err)
+	}
+	parent.End()
+
+	// The state event caused by the command carries the span of its confirmation.
+	var event StateEvent
+	select {
+	case event = <-events:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected a state event")
+	}
+	if event.Cause != CauseCommand || event.SpanContext().TraceID() != parent.SpanContext().TraceID() {
+		t.Fatalf("Expected command state event in the trace of the request, got %+v", event)
+	}
+
+	// All spans, from the request to the sensor confirmation, are part of the same trace. The execution ends after
+	// the relay pulse, which may be after the state event.
+	expected := []string{"controller.request", "controller.queue", "controller.execute", "controller.toggle",
+		"controller.confirm"}
+	names := make(map[string]bool)
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+		for _, span := range recorder.Ended() {
+			if span.SpanContext().TraceID() != parent.SpanContext().TraceID() {
+				t.Fatalf("Expected span %s in the trace of the request", span.Name())
+			}
+			names[span.Name()] = true
+		}
+		if len(names) > len(expected) {
+			break
+		}
+	}
+	for _, name := range expected {
+		if !names[name] {
+			t.Fatalf("Expected span %s to be ended, got %v", name, names)
+		}
+	}
+	controller.RequestToggle(context.Background(), "test")
+	time.Sleep(time.Second)
 }
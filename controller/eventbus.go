@@ -0,0 +1,256 @@
+package controller
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/dlefevre/go.garagedoor-service/metrics"
+	"github.com/google/uuid"
+)
+
+// Default size of the queue of a subscriber.
+const defaultSubscriberQueueSize = 32
+
+// OverflowPolicy determines what happens when the queue of a subscriber is full.
+type OverflowPolicy int
+
+// Enumeration of overflow policies.
+const (
+	DropOldest OverflowPolicy = iota // DropOldest discards the oldest queued item to make room for the new one
+	Disconnect                       // Disconnect closes the subscription, e.g. to drop a slow client
+)
+
+// SubscriberOptions configures a subscription. The name is only used in logs and statistics. A queue size of 0 uses
+// the default size.
+type SubscriberOptions struct {
+	Name      string
+	QueueSize int
+	Policy    OverflowPolicy
+}
+
+// SubscriberStats describes the queue of a subscriber.
+type SubscriberStats struct {
+	ID      uuid.UUID `json:"id"`
+	Name    string    `json:"name"`
+	Bus     string    `json:"bus"`
+	Queued  int       `json:"queued"`
+	Dropped uint64    `json:"dropped"`
+}
+
+// BusStats describes the subscribers of the state and event buses, and the number of items they dropped.
+type BusStats struct {
+	Subscribers  []SubscriberStats `json:"subscribers"`
+	Dropped      uint64            `json:"dropped"`
+	Disconnected uint64            `json:"disconnected"`
+}
+
+// Subscription is a handle to a subscriber of a bus. Its handler is called from a goroutine dedicated to the
+// subscription, one item at a time, in the order the items were published.
+type Subscription struct {
+	id     uuid.UUID
+	done   chan struct{}
+	cancel func()
+}
+
+// ID returns the id of the subscription, which can be used to remove the listener.
+func (s *Subscription) ID() uuid.UUID {
+	return s.id
+}
+
+// Done returns a channel that is closed when the subscription ends, either because it was closed, or because it was
+// disconnected by its overflow policy.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close ends the subscription. Queued items are discarded. It is safe to call Close from within the handler.
+func (s *Subscription) Close() {
+	s.cancel()
+}
+
+// A subscriber with a bounded queue, delivering items to its handler in its own goroutine.
+type subscriber[T any] struct {
+	id      uuid.UUID
+	name    string
+	policy  OverflowPolicy
+	size    int
+	handler func(T)
+	queue   []T
+	dropped uint64
+	stalled bool
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+	lock    sync.Mutex
+}
+
+// Queue an item. Returns false if the subscriber is closed, possibly as a result of this call, and whether an item was
+// dropped. Stalled is only true for the first item dropped since the subscriber last caught up.
+func (s *subscriber[T]) push(item T) (accepted bool, dropped bool, stalled bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false, false, false
+	}
+	if len(s.queue) >= s.size {
+		s.dropped++
+		if s.policy == Disconnect {
+			s.close()
+			return false, true, false
+		}
+		s.queue = s.queue[1:]
+		dropped = true
+		stalled = !s.stalled
+		s.stalled = true
+	}
+	s.queue = append(s.queue, item)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return true, dropped, stalled
+}
+
+// Close the subscriber. The caller must hold the lock.
+func (s *subscriber[T]) close() {
+	if !s.closed {
+		s.closed = true
+		s.queue = nil
+		close(s.done)
+	}
+}
+
+// Deliver queued items to the handler, until the subscriber is closed.
+func (s *subscriber[T]) run() {
+	for {
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+		for {
+			item, ok := s.next()
+			if !ok {
+				break
+			}
+			s.handler(item)
+		}
+	}
+}
+
+// Take the next queued item. Returns false when the queue is empty or the subscriber is closed. An empty queue means
+// the subscriber caught up, so the next dropped item starts a new stall.
+func (s *subscriber[T]) next() (T, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var item T
+	if s.closed || len(s.queue) == 0 {
+		s.stalled = false
+		return item, false
+	}
+	item = s.queue[0]
+	s.queue = s.queue[1:]
+	return item, true
+}
+
+// eventBus fans out items to its subscribers. Publishing never blocks: every subscriber has a bounded queue, and a
+// subscriber that can't keep up loses items or is disconnected, depending on its overflow policy.
+type eventBus[T any] struct {
+	name         string
+	subscribers  map[uuid.UUID]*subscriber[T]
+	dropped      atomic.Uint64
+	disconnected atomic.Uint64
+	lock         sync.Mutex
+}
+
+// Creates a new eventBus object.
+func newEventBus[T any](name string) *eventBus[T] {
+	return &eventBus[T]{
+		name:        name,
+		subscribers: make(map[uuid.UUID]*subscriber[T]),
+	}
+}
+
+// Add a subscriber, and start delivering items to its handler.
+func (b *eventBus[T]) subscribe(opts SubscriberOptions, handler func(T)) *Subscription {
+	s := &subscriber[T]{
+		id:      uuid.New(),
+		name:    opts.Name,
+		policy:  opts.Policy,
+		size:    opts.QueueSize,
+		handler: handler,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if s.size <= 0 {
+		s.size = defaultSubscriberQueueSize
+	}
+
+	b.lock.Lock()
+	b.subscribers[s.id] = s
+	b.lock.Unlock()
+	go s.run()
+
+	return &Subscription{
+		id:   s.id,
+		done: s.done,
+		cancel: func() {
+			b.remove(s.id)
+		},
+	}
+}
+
+// Remove a subscriber. This doesn't wait for the handler to return, so it is safe to call from within the handler.
+func (b *eventBus[T]) remove(id uuid.UUID) {
+	b.lock.Lock()
+	s, ok := b.subscribers[id]
+	delete(b.subscribers, id)
+	b.lock.Unlock()
+	if ok {
+		s.lock.Lock()
+		s.close()
+		s.lock.Unlock()
+	}
+}
+
+// Publish an item to all subscribers.
+func (b *eventBus[T]) publish(item T) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for id, s := range b.subscribers {
+		accepted, dropped, stalled := s.push(item)
+		if dropped {
+			b.dropped.Add(1)
+			metrics.EventQueueDrops.WithLabelValues(b.name).Inc()
+		}
+		if !accepted {
+			delete(b.subscribers, id)
+			if dropped {
+				b.disconnected.Add(1)
+				logger.Warn().Msgf("%s subscriber %s can't keep up, disconnecting it", b.name, s.name)
+			}
+		} else if stalled {
+			logger.Warn().Msgf("%s subscriber %s can't keep up, dropping the oldest items until it catches up",
+				b.name, s.name)
+		}
+	}
+}
+
+// Collect the statistics of the subscribers.
+func (b *eventBus[T]) stats() []SubscriberStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	result := make([]SubscriberStats, 0, len(b.subscribers))
+	for _, s := range b.subscribers {
+		s.lock.Lock()
+		result = append(result, SubscriberStats{
+			ID:      s.id,
+			Name:    s.name,
+			Bus:     b.name,
+			Queued:  len(s.queue),
+			Dropped: s.dropped,
+		})
+		s.lock.Unlock()
+	}
+	return result
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"sync"
+	"time"
+)
+
+// Number of events retained in the event log.
+const eventLogSize = 100
+
+// Enumeration of event types.
+const (
+	EventCommand         = "command"          // EventCommand is recorded when a command is accepted
+	EventCommandRejected = "command_rejected" // EventCommandRejected is recorded when a command is refused
+	EventState           = "state"            // EventState is recorded when the door changes state
+	EventLock            = "lock"             // EventLock is recorded when the maintenance lock is engaged
+	EventUnlock          = "unlock"           // EventUnlock is recorded when the maintenance lock is released
+	EventNotification    = "notification"     // EventNotification is recorded when a component asks to notify users
+	EventAlert           = "alert"            // EventAlert is recorded when an alert is raised, repeated or escalated
+	EventAlertCleared    = "alert_cleared"    // EventAlertCleared is recorded when the cause of an alert is gone
+	EventAlertAcked      = "alert_acked"      // EventAlertAcked is recorded when an alert is acknowledged
+	EventBan             = "ban"              // EventBan is recorded when a client is banned
+	EventUnban           = "unban"            // EventUnban is recorded when a ban is cleared
+)
+
+// Event is a single entry in the event log. State events carry the state event that was broadcast to the state
+// listeners, with the previous state, the cause and the sequence number.
+type Event struct {
+	ID         uint64      `json:"id"`
+	Time       time.Time   `json:"time"`
+	Type       string      `json:"type"`
+	Source     string      `json:"source,omitempty"`
+	Command    string      `json:"command,omitempty"`
+	State      string      `json:"state,omitempty"`
+	Level      string      `json:"level,omitempty"`
+	Message    string      `json:"message,omitempty"`
+	StateEvent *StateEvent `json:"state_event,omitempty"`
+}
+
+// eventLog retains the most recent events in a ring buffer, and publishes new events on its bus.
+type eventLog struct {
+	events []Event
+	lastID uint64
+	bus    *eventBus[Event]
+	lock   sync.Mutex
+}
+
+// Creates a new eventLog object.
+func newEventLog() *eventLog {
+	return &eventLog{
+		events: make([]Event, 0, eventLogSize),
+		bus:    newEventBus[Event]("event"),
+	}
+}
+
+// Add an event to the log, assigning it an id and a timestamp.
+func (l *eventLog) add(event Event) Event {
+	l.lock.Lock()
+	l.lastID++
+	event.ID = l.lastID
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if len(l.events) == eventLogSize {
+		copy(l.events, l.events[1:])
+		l.events = l.events[:eventLogSize-1]
+	}
+	l.events = append(l.events, event)
+
+	// Publishing doesn't block, so it is done while holding the lock to keep the events in order.
+	l.bus.publish(event)
+	l.lock.Unlock()
+	return event
+}
+
+// Return all retained events with an id greater than the given one.
+func (l *eventLog) since(id uint64) []Event {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	result := make([]Event, 0, len(l.events))
+	for _, event := range l.events {
+		if event.ID > id {
+			result = append(result, event)
+		}
+	}
+	return result
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/storage"
+)
+
+// Name of the document the maintenance lock is persisted in.
+const lockDocument = "maintenance_lock"
+
+// ErrMaintenanceLock is returned when a command is refused because the door is locked for maintenance.
+var ErrMaintenanceLock = errors.New("command rejected: door is locked for maintenance")
+
+// LockStatus describes the maintenance lock. While locked, all remote actuation is refused.
+type LockStatus struct {
+	Locked  bool       `json:"locked"`
+	Reason  string     `json:"reason,omitempty"`
+	Source  string     `json:"source,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// maintenanceLock keeps track of the maintenance lock, and persists it in the store.
+type maintenanceLock struct {
+	status LockStatus
+	store  *storage.Store
+	lock   sync.RWMutex
+}
+
+// Creates a new maintenanceLock object, restoring a previously persisted lock from the store.
+func newMaintenanceLock(store *storage.Store) *maintenanceLock {
+	m := &maintenanceLock{
+		store: store,
+	}
+	if err := store.Load(lockDocument, &m.status); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		logger.Error().Msgf("failed to restore maintenance lock: %v", err)
+	}
+	if m.status.Locked {
+		logger.Warn().Msgf("door is locked for maintenance: %s", m.status.Reason)
+	}
+	return m
+}
+
+// Engage the lock. A zero duration locks the door until it is explicitly unlocked.
+func (m *maintenanceLock) engage(reason string, duration time.Duration, source string, now time.Time) (LockStatus, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	status := LockStatus{
+		Locked: true,
+		Reason: reason,
+		Source: source,
+		Since:  &now,
+	}
+	if duration > 0 {
+		expires := now.Add(duration)
+		status.Expires = &expires
+	}
+	if err := m.store.Save(lockDocument, status); err != nil {
+		return m.status, err
+	}
+	m.status = status
+	return status, nil
+}
+
+// Release the lock. Returns false if the door wasn't locked.
+func (m *maintenanceLock) release() (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.status.Locked {
+		return false, nil
+	}
+	if err := m.store.Delete(lockDocument); err != nil {
+		return false, err
+	}
+	m.status = LockStatus{}
+	return true, nil
+}
+
+// Get the current status of the lock.
+func (m *maintenanceLock) get() LockStatus {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.status
+}
+
+// Check if the lock has expired at the given time.
+func (m *maintenanceLock) expired(now time.Time) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.status.Locked && m.status.Expires != nil && !now.Before(*m.status.Expires)
+}
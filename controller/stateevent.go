@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Window after a relay pulse in which state transitions are attributed to the command that caused the pulse.
+const commandAttributionWindow = 30 * time.Second
+
+// Enumeration of causes of a state event.
+const (
+	CauseSensor  = "sensor"  // CauseSensor means the sensors reported a transition, e.g. after using the remote
+	CauseCommand = "command" // CauseCommand means the sensors reported a transition shortly after a door command
+	CauseRefresh = "refresh" // CauseRefresh means the state didn't change, but was broadcast on request
+)
+
+// StateEvent is delivered to state listeners when the state is broadcast. Changed is the time the door entered its
+// current state, which is older than the event for refreshes. The sequence number increases with every broadcast.
+// Source identifies the caller that initiated the event, e.g. the source of the command that moved the door.
+type StateEvent struct {
+	DoorID   string    `json:"door_id"`
+	State    string    `json:"state"`
+	Previous string    `json:"previous"`
+	Changed  time.Time `json:"changed"`
+	Sequence uint64    `json:"sequence"`
+	Cause    string    `json:"cause"`
+	Source   string    `json:"source,omitempty"`
+	span     trace.SpanContext
+}
+
+// SpanContext returns the span context of the command that caused the event, to continue its trace when the event is
+// passed on, e.g. in MQTT user properties. It is invalid for events that weren't caused by a traced command.
+func (e StateEvent) SpanContext() trace.SpanContext {
+	return e.span
+}
+
+// An actuation of the relay, used to attribute the following state transitions to a command. The confirm span lasts
+// until the sensors report the door open or closed, and pending is set until then.
+type actuation struct {
+	source  string
+	time    time.Time
+	confirm trace.Span
+	pending bool
+}
+
+// A command on the command queue, with the source that requested it, the time it was queued and the span of the
+// request, to trace its execution as part of the request.
+type queuedCommand struct {
+	cmd    Enum
+	source string
+	queued time.Time
+	span   trace.SpanContext
+}
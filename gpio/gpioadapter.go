@@ -8,6 +8,7 @@ type GPIOAdapter interface {
 	ReadOpenPin() bool
 	ReadClosedPin() bool
 	Reset() error
+	Check() error
 }
 
 // GetGPIOAdapter returns the GPIO adapter based on the current mode.
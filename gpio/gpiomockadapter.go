@@ -2,13 +2,18 @@ package gpio
 
 import (
 	"fmt"
+	"sync"
 
-	"github.com/rs/zerolog/log"
+	"github.com/dlefevre/go.garagedoor-service/logging"
 )
 
+// Logger of the gpio component.
+var logger = logging.Logger("gpio")
+
 // GPIOMockAdapter is a mock GPIO adapter, which:
 // - mimicks the behavior of the garage door, without the delays of a physical door and motor.
 // - reports all actions to the log.
+// The pins can be written and read from different goroutines.
 type GPIOMockAdapter struct {
 	togglePin      int
 	openPin        int
@@ -16,11 +21,12 @@ type GPIOMockAdapter struct {
 	togglePinState bool
 	openState      bool
 	closedState    bool
+	lock           sync.Mutex
 }
 
 // NewGPIOMockAdapter creates a new GPIOMockAdapter.
 func NewGPIOMockAdapter(togglePin int, openPin int, closedPin int) *GPIOMockAdapter {
-	log.Info().Msg("Mock GPIO: Creating mock GPIO adapter")
+	logger.Info().Msg("Mock GPIO: Creating mock GPIO adapter")
 	return &GPIOMockAdapter{
 		togglePin:   togglePin,
 		openPin:     openPin,
@@ -32,9 +38,11 @@ func NewGPIOMockAdapter(togglePin int, openPin int, closedPin int) *GPIOMockAdap
 
 // WriteTogglePin sets the toggle pin to high when value is true.
 func (g *GPIOMockAdapter) WriteTogglePin(value bool) {
-	log.Info().Msg(fmt.Sprintf("Mock GPIO: Writing to pin %d: %v", g.togglePin, value))
+	logger.Debug().Msg(fmt.Sprintf("Mock GPIO: Writing to pin %d: %v", g.togglePin, value))
+	g.lock.Lock()
+	defer g.lock.Unlock()
 	if !g.togglePinState && value {
-		log.Info().Msg("Mock GPIO: Toggling garage door")
+		logger.Info().Msg("Mock GPIO: Toggling garage door")
 		g.openState = !g.openState
 		g.closedState = !g.closedState
 	}
@@ -43,20 +51,31 @@ func (g *GPIOMockAdapter) WriteTogglePin(value bool) {
 
 // ReadOpenPin returns true if the open pin is high, and false otherwise.
 func (g *GPIOMockAdapter) ReadOpenPin() bool {
-	log.Info().Msg(fmt.Sprintf("Mock GPIO: Reading from pin %d: %v", g.openPin, g.openState))
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	logger.Debug().Msg(fmt.Sprintf("Mock GPIO: Reading from pin %d: %v", g.openPin, g.openState))
 	return g.openState
 }
 
 // ReadClosedPin returns true if the closed pin is high, and false otherwise.
 func (g *GPIOMockAdapter) ReadClosedPin() bool {
-	log.Info().Msg(fmt.Sprintf("Mock GPIO: Reading from pin %d: %v", g.closedPin, g.closedState))
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	logger.Debug().Msg(fmt.Sprintf("Mock GPIO: Reading from pin %d: %v", g.closedPin, g.closedState))
 	return g.closedState
 }
 
 // Reset the pins to their initial state.
 func (g *GPIOMockAdapter) Reset() error {
-	log.Info().Msg("Mock GPIO: Resetting pins")
+	logger.Info().Msg("Mock GPIO: Resetting pins")
+	g.lock.Lock()
+	defer g.lock.Unlock()
 	g.openState = false
 	g.closedState = true
 	return nil
 }
+
+// Check always succeeds for the mock adapter.
+func (g *GPIOMockAdapter) Check() error {
+	return nil
+}
@@ -7,7 +7,10 @@ import (
 	"github.com/stianeikeland/go-rpio/v4"
 )
 
-var once sync.Once
+var (
+	once    sync.Once
+	openErr error
+)
 
 // GPIORPiAdapter is an adapter for the Raspberry Pi GPIO pins.
 type GPIORPiAdapter struct {
@@ -19,7 +22,7 @@ type GPIORPiAdapter struct {
 // NewGPIORPiAdapter creates a new GPIORPiAdapter.
 func NewGPIORPiAdapter(togglePin int, openPin int, closedPin int) *GPIORPiAdapter {
 	once.Do(func() {
-		rpio.Open()
+		openErr = rpio.Open()
 	})
 
 	adapter := &GPIORPiAdapter{
@@ -59,3 +62,11 @@ func (g *GPIORPiAdapter) ReadClosedPin() bool {
 func (g *GPIORPiAdapter) Reset() error {
 	return fmt.Errorf("the `Reset` function isn't implemented for the GPIORPiAdapter")
 }
+
+// Check returns an error if the GPIO memory couldn't be mapped, in which case the pins can't be read or written.
+func (g *GPIORPiAdapter) Check() error {
+	if openErr != nil {
+		return fmt.Errorf("failed to open GPIO: %v", openErr)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/apikeys"
+	"github.com/dlefevre/go.garagedoor-service/audit"
+	"github.com/dlefevre/go.garagedoor-service/config"
+)
+
+// Usage of the keys subcommand.
+const keysUsage = `Usage: garagedoor-service keys <command> [arguments]
+
+Commands:
+  create -name <name> -scopes <scopes> [-expires <time>] [-windows <windows>] [-door <door>]
+                   create a key, and print its secret
+  list             list the keys, with when they were last used
+  revoke <name>    revoke a key
+  rotate <name>    replace the secret of a key, and print the new secret
+
+Scopes are state:read, door:operate and admin, separated by commas. The expiry uses RFC 3339 (e.g.
+2026-12-31T23:59:59+01:00), windows use HH:MM-HH:MM and are separated by commas. Only keys created with this command
+or the API can be revoked and rotated; keys in the configuration file must be changed there. A running service applies
+the changes within seconds.
+`
+
+// Run the keys subcommand, managing the API keys in the data directory. A running service applies the changes within
+// seconds. Returns the exit code.
+func runKeys(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, keysUsage)
+		return 2
+	}
+	if err := config.Verify(); err != nil {
+		fmt.Fprintf(stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	km := apikeys.GetKeyManager()
+	var err error
+	switch args[0] {
+	case "create":
+		err = createKeyCommand(km, args[1:], stdout, stderr)
+	case "list":
+		listKeysCommand(km, stdout)
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprint(stderr, keysUsage)
+			return 2
+		}
+		if err = km.Revoke(args[1]); err == nil {
+			recordKeyCommand(audit.TypeKeyRevoke, args[1])
+			fmt.Fprintf(stdout, "Revoked key %s\n", args[1])
+		}
+	case "rotate":
+		if len(args) != 2 {
+			fmt.Fprint(stderr, keysUsage)
+			return 2
+		}
+		var secret string
+		if _, secret, err = km.Rotate(args[1]); err == nil {
+			recordKeyCommand(audit.TypeKeyRotate, args[1])
+			fmt.Fprintf(stdout, "Rotated key %s, the new secret is shown only once:\n%s\n", args[1], secret)
+		}
+	default:
+		fmt.Fprint(stderr, keysUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Create a key from the command line flags, and print its secret.
+func createKeyCommand(km *apikeys.KeyManager, args []string, stdout io.Writer, stderr io.Writer) error {
+	flags := flag.NewFlagSet("keys create", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	name := flags.String("name", "", "name of the key, recorded as source of its commands")
+	scopes := flags.String("scopes", "", "comma separated scopes")
+	expires := flags.String("expires", "", "expiry, in RFC 3339 format")
+	windows := flags.String("windows", "", "comma separated time windows (HH:MM-HH:MM)")
+	door := flags.String("door", "", "door the key is restricted to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	spec := apikeys.KeySpec{
+		Name:    *name,
+		Scopes:  splitList(*scopes),
+		Windows: splitList(*windows),
+		Door:    *door,
+	}
+	if *expires != "" {
+		t, err := time.Parse(time.RFC3339, *expires)
+		if err != nil {
+			return fmt.Errorf("invalid expiry: %v", err)
+		}
+		spec.Expires = &t
+	}
+	_, secret, err := km.Create(spec)
+	if err != nil {
+		return err
+	}
+	recordKeyCommand(audit.TypeKeyCreate, spec.Name)
+	fmt.Fprintf(stdout, "Created key %s, the secret is shown only once:\n%s\n", spec.Name, secret)
+	return nil
+}
+
+// Record a change of an API key in the audit log, on behalf of the user running the command.
+func recordKeyCommand(entryType string, name string) {
+	actor := "cli"
+	if u, err := user.Current(); err == nil {
+		actor = "cli:" + u.Username
+	}
+	audit.Record(audit.Entry{
+		Type:    entryType,
+		Actor:   actor,
+		Details: map[string]string{"key": name},
+	})
+}
+
+// Print the keys as a table.
+func listKeysCommand(km *apikeys.KeyManager, stdout io.Writer) {
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSOURCE\tSCOPES\tEXPIRES\tWINDOWS\tDOOR\tLAST USED")
+	for _, key := range km.List() {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			key.Name,
+			key.Source,
+			strings.Join(key.Scopes, ","),
+			formatTime(key.Expires),
+			orDash(strings.Join(key.Windows, ",")),
+			orDash(key.Door),
+			formatTime(key.LastUsed))
+	}
+	w.Flush()
+}
+
+// Split a comma separated list, ignoring empty elements.
+func splitList(value string) []string {
+	var result []string
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			result = append(result, element)
+		}
+	}
+	return result
+}
+
+// Format an optional time for a table.
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+// Replace an empty value by a dash, for a table.
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// Exit with the result of the keys subcommand, if it was requested.
+func handleKeysCommand() {
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		os.Exit(runKeys(os.Args[2:], os.Stdout, os.Stderr))
+	}
+}
@@ -0,0 +1,120 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// A log file that is rotated when it would exceed its maximum size. The rotated files get the suffixes .1 (the newest)
+// up to the maximum number of backups, older ones are removed. When rotating fails, messages are still written to the
+// current file, and rotating is retried once another maximum size was written.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	lock       sync.Mutex
+}
+
+// Open a log file for appending, creating it when it doesn't exist. A zero maximum size disables rotation.
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	file, size, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	f.file, f.size = file, size
+	return f, nil
+}
+
+// Open the current file, returning it with its size.
+func (f *rotatingFile) open() (*os.File, int64, error) {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// Write appends a message, rotating the file first when the message doesn't fit anymore.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error rotating log file %s: %v\n", f.path, err)
+			f.size = 0
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate the file, shifting the backups and removing the oldest one. The current file is only replaced once the new
+// one is open, so it remains usable when rotating fails.
+func (f *rotatingFile) rotate() error {
+	if err := f.shift(); err != nil {
+		return err
+	}
+	file, size, err := f.open()
+	if err != nil {
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error closing rotated log file %s: %v\n", f.path, err)
+	}
+	f.file, f.size = file, size
+	return nil
+}
+
+// Move the current file to the first backup, shifting the backups and removing the oldest one. Without backups, the
+// current file is removed.
+func (f *rotatingFile) shift() error {
+	if f.maxBackups == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.Remove(f.backup(f.maxBackups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(f.backup(i), f.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.backup(1))
+}
+
+// Path of the given backup.
+func (f *rotatingFile) backup(n int) string {
+	return fmt.Sprintf("%s.%d", f.path, n)
+}
+
+// Close closes the file. Later writes fail.
+func (f *rotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
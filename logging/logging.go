@@ -0,0 +1,261 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Main is the component of the global logger of zerolog, used by the main package.
+const Main = "main"
+
+var (
+	instance *Logging
+	once     sync.Once
+)
+
+// Logging is a singleton that routes the log messages of all components to the configured outputs. Every component
+// logs through its own logger, and has its own minimum level, which can be changed at runtime. Until it is started,
+// messages of level info and above are written to the standard error in json, like zerolog does by default.
+type Logging struct {
+	level      zerolog.Level
+	levels     map[string]zerolog.Level
+	components map[string]bool
+	output     zerolog.LevelWriter
+	closers    []io.Closer
+	lock       sync.RWMutex
+}
+
+// Levels describes the default level and the levels of the components that override it.
+type Levels struct {
+	Level  string            `json:"level"`
+	Levels map[string]string `json:"levels"`
+}
+
+// Writer of a component, dropping the messages below the level of the component.
+type componentWriter struct {
+	logging   *Logging
+	component string
+}
+
+// GetLogging returns the one and only Logging instance.
+func GetLogging() *Logging {
+	once.Do(func() {
+		instance = &Logging{
+			level:      zerolog.InfoLevel,
+			levels:     make(map[string]zerolog.Level),
+			components: map[string]bool{Main: true},
+			output:     zerolog.MultiLevelWriter(os.Stderr),
+		}
+	})
+	return instance
+}
+
+// Logger returns the logger of a component, named after its package. Loggers can be created before logging is
+// started, e.g. in package variables.
+func Logger(component string) zerolog.Logger {
+	return GetLogging().logger(component)
+}
+
+// Create the logger of a component, and register the component.
+func (l *Logging) logger(component string) zerolog.Logger {
+	l.lock.Lock()
+	l.components[component] = true
+	l.lock.Unlock()
+	return zerolog.New(componentWriter{logging: l, component: component}).
+		With().
+		Timestamp().
+		Str("component", component).
+		Logger()
+}
+
+// Start writing log messages to the configured outputs, with the configured levels. The global logger of zerolog is
+// replaced by the logger of the main component.
+func (l *Logging) Start() error {
+	var writers []io.Writer
+	var closers []io.Closer
+	format := func(w io.Writer, color bool) io.Writer {
+		if config.GetLogFormat() != "console" {
+			return w
+		}
+		return zerolog.ConsoleWriter{Out: w, TimeFormat: time.RFC3339, NoColor: !color}
+	}
+	if config.GetLogStderr() {
+		writers = append(writers, format(os.Stderr, isTerminal(os.Stderr)))
+	}
+	if path := config.GetLogFile(); path != "" {
+		file, err := openRotatingFile(path, config.GetLogMaxSize(), config.GetLogMaxBackups())
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %v", err)
+		}
+		writers = append(writers, format(file, false))
+		closers = append(closers, file)
+	}
+	if config.GetLogSyslogEnabled() {
+		w, err := syslog.Dial(config.GetLogSyslogNetwork(), config.GetLogSyslogAddress(),
+			syslog.LOG_INFO|syslog.LOG_DAEMON, config.GetLogSyslogTag())
+		if err != nil {
+			closeAll(closers)
+			return fmt.Errorf("failed to connect to syslog: %v", err)
+		}
+		writers = append(writers, zerolog.SyslogLevelWriter(w))
+		closers = append(closers, w)
+	}
+	if err := l.SetLevels(Levels{Level: config.GetLogLevel(), Levels: config.GetLogLevels()}, true); err != nil {
+		closeAll(closers)
+		return err
+	}
+
+	l.lock.Lock()
+	previous := l.closers
+	l.output = zerolog.MultiLevelWriter(writers...)
+	l.closers = closers
+	l.lock.Unlock()
+	closeAll(previous)
+	log.Logger = l.logger(Main)
+	return nil
+}
+
+// Stop writing log messages to the log file and syslog. Later messages are only written to the standard error.
+func (l *Logging) Stop() {
+	l.lock.Lock()
+	closers := l.closers
+	l.output = zerolog.MultiLevelWriter(os.Stderr)
+	l.closers = nil
+	l.lock.Unlock()
+	closeAll(closers)
+}
+
+// Levels returns the default level and the levels of the components that override it.
+func (l *Logging) Levels() Levels {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	levels := Levels{
+		Level:  l.level.String(),
+		Levels: make(map[string]string, len(l.levels)),
+	}
+	for component, level := range l.levels {
+		levels.Levels[component] = level.String()
+	}
+	return levels
+}
+
+// Components returns the names of the components that log, sorted.
+func (l *Logging) Components() []string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	components := make([]string, 0, len(l.components))
+	for component := range l.components {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	return components
+}
+
+// SetLevels changes the levels. An empty default level keeps the current one. With replace, the levels of the
+// components replace the current ones, otherwise they are merged, and a component with level "default" follows the
+// default level again. Nothing is changed when a level or a component is invalid.
+func (l *Logging) SetLevels(levels Levels, replace bool) error {
+	var level zerolog.Level
+	if levels.Level != "" {
+		var err error
+		if level, err = parseLevel(levels.Level); err != nil {
+			return err
+		}
+	}
+	overrides := make(map[string]zerolog.Level)
+	var defaults []string
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for component, name := range levels.Levels {
+		if !l.components[component] {
+			return fmt.Errorf("logging: unknown component %s", component)
+		}
+		if name == "default" && !replace {
+			defaults = append(defaults, component)
+			continue
+		}
+		componentLevel, err := parseLevel(name)
+		if err != nil {
+			return err
+		}
+		overrides[component] = componentLevel
+	}
+
+	if levels.Level != "" {
+		l.level = level
+	}
+	if replace {
+		l.levels = make(map[string]zerolog.Level)
+	}
+	for component, level := range overrides {
+		l.levels[component] = level
+	}
+	for _, component := range defaults {
+		delete(l.levels, component)
+	}
+
+	// Messages below every level aren't even built.
+	lowest := l.level
+	for _, level := range l.levels {
+		lowest = min(lowest, level)
+	}
+	zerolog.SetGlobalLevel(lowest)
+	return nil
+}
+
+// Parse the name of a level.
+func parseLevel(name string) (zerolog.Level, error) {
+	level, err := zerolog.ParseLevel(name)
+	if err != nil || name == "" {
+		return zerolog.NoLevel, fmt.Errorf("logging: %q is not a valid level", name)
+	}
+	return level, nil
+}
+
+// Write a message of a component to the outputs, unless it is below the level of the component.
+func (l *Logging) write(component string, level zerolog.Level, p []byte) (int, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	minimum, found := l.levels[component]
+	if !found {
+		minimum = l.level
+	}
+	if level < minimum && level != zerolog.NoLevel {
+		return len(p), nil
+	}
+	return l.output.WriteLevel(level, p)
+}
+
+// Write writes a message without level.
+func (w componentWriter) Write(p []byte) (int, error) {
+	return w.logging.write(w.component, zerolog.NoLevel, p)
+}
+
+// WriteLevel writes a message of the given level.
+func (w componentWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	return w.logging.write(w.component, level, p)
+}
+
+// Returns whether a file is a terminal, to only color console output for humans.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Close all outputs, logging errors to the standard error.
+func closeAll(closers []io.Closer) {
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing log output: %v\n", err)
+		}
+	}
+}
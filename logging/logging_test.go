@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestLevels(t *testing.T) {
+	var out bytes.Buffer
+	l := GetLogging()
+	l.output = zerolog.MultiLevelWriter(&out)
+	defer l.Stop()
+	gpio := Logger("gpio")
+	web := Logger("web")
+
+	if err := l.SetLevels(Levels{Level: "info", Levels: map[string]string{"gpio": "warn"}}, true); err != nil {
+		t.Fatalf("Error setting levels: %v", err)
+	}
+	gpio.Info().Msg("gpio info")
+	gpio.Warn().Msg("gpio warn")
+	web.Debug().Msg("web debug")
+	web.Info().Msg("web info")
+	if got := out.String(); strings.Contains(got, "gpio info") || strings.Contains(got, "web debug") ||
+		!strings.Contains(got, "gpio warn") || !strings.Contains(got, `"component":"web"`) ||
+		!strings.Contains(got, "web info") {
+		t.Fatalf("Expected messages to be filtered per component, got:\n%s", got)
+	}
+
+	// Merged levels keep the other components, "default" makes a component follow the default level again.
+	out.Reset()
+	if err := l.SetLevels(Levels{Levels: map[string]string{"web": "debug", "gpio": "default"}}, false); err != nil {
+		t.Fatalf("Error merging levels: %v", err)
+	}
+	gpio.Info().Msg("gpio info")
+	web.Debug().Msg("web debug")
+	if got := out.String(); !strings.Contains(got, "gpio info") || !strings.Contains(got, "web debug") {
+		t.Fatalf("Expected merged levels to apply, got:\n%s", got)
+	}
+	if levels := l.Levels(); levels.Level != "info" || len(levels.Levels) != 1 || levels.Levels["web"] != "debug" {
+		t.Fatalf("Unexpected levels %+v", levels)
+	}
+	if zerolog.GlobalLevel() != zerolog.DebugLevel {
+		t.Fatalf("Expected global level to be the lowest level, got %v", zerolog.GlobalLevel())
+	}
+
+	// Invalid levels and unknown components change nothing.
+	for _, levels := range []Levels{
+		{Level: "loud"},
+		{Levels: map[string]string{"web": "loud"}},
+		{Level: "error", Levels: map[string]string{"garage": "info"}},
+	} {
+		if err := l.SetLevels(levels, true); err == nil {
+			t.Fatalf("Expected levels %+v to be rejected", levels)
+		}
+	}
+	if levels := l.Levels(); levels.Level != "info" || levels.Levels["web"] != "debug" {
+		t.Fatalf("Expected rejected levels not to change anything, got %+v", levels)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.log")
+	f, err := openRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatalf("Error opening log file: %v", err)
+	}
+	line := []byte(strings.Repeat("x", 39) + "\n")
+	for i := 0; i < 10; i++ {
+		if _, err := f.Write(line); err != nil {
+			t.Fatalf("Error writing log file: %v", err)
+		}
+	}
+	f.Close()
+	if _, err := f.Write(line); err == nil {
+		t.Fatalf("Expected write to a closed file to fail")
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if info, err := os.Stat(name); err != nil || info.Size() > 100 {
+			t.Fatalf("Expected %s within the maximum size, got %v, %v", name, info, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("Expected only 2 backups to be kept")
+	}
+}
+
+func TestRotatingFileFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.log")
+	f, err := openRotatingFile(path, 100, 1)
+	if err != nil {
+		t.Fatalf("Error opening log file: %v", err)
+	}
+	defer f.Close()
+
+	// A backup that can't be removed makes rotating fail, but messages are still written to the current file.
+	os.MkdirAll(filepath.Join(path+".1", "blocked"), 0700)
+	line := []byte(strings.Repeat("x", 39) + "\n")
+	for i := 0; i < 5; i++ {
+		if _, err := f.Write(line); err != nil {
+			t.Fatalf("Expected writes to continue when rotating fails, got %v", err)
+		}
+	}
+	if data, err := os.ReadFile(path); err != nil || len(data) != 5*len(line) {
+		t.Fatalf("Expected all messages in the current file, got %d bytes, %v", len(data), err)
+	}
+
+	// Rotating succeeds again once the backup can be removed.
+	os.RemoveAll(path + ".1")
+	for i := 0; i < 5; i++ {
+		if _, err := f.Write(line); err != nil {
+			t.Fatalf("Error writing log file: %v", err)
+		}
+	}
+	if info, err := os.Stat(path + ".1"); err != nil || info.IsDir() {
+		t.Fatalf("Expected the file to be rotated, got %v, %v", info, err)
+	}
+}
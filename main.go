@@ -4,33 +4,121 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
+	"github.com/dlefevre/go.garagedoor-service/alerts"
+	"github.com/dlefevre/go.garagedoor-service/apikeys"
+	"github.com/dlefevre/go.garagedoor-service/audit"
 	"github.com/dlefevre/go.garagedoor-service/config"
 	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/dlefevre/go.garagedoor-service/logging"
 	"github.com/dlefevre/go.garagedoor-service/mqtt"
+	"github.com/dlefevre/go.garagedoor-service/notifier"
+	"github.com/dlefevre/go.garagedoor-service/rules"
+	"github.com/dlefevre/go.garagedoor-service/scheduler"
+	"github.com/dlefevre/go.garagedoor-service/systemd"
+	"github.com/dlefevre/go.garagedoor-service/tracing"
 	"github.com/dlefevre/go.garagedoor-service/web"
+	"github.com/dlefevre/go.garagedoor-service/webhooks"
 
 	"github.com/rs/zerolog/log"
 )
 
 func main() {
+	handleKeysCommand()
+	handleCertsCommand()
+	handleAuditCommand()
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
 	log.Info().Msg("Verifying configuration")
-	config.Verify()
+	if err := config.Verify(); err != nil {
+		log.Fatal().Msgf("Invalid configuration: %v", err)
+	}
+
+	lg := logging.GetLogging()
+	if err := lg.Start(); err != nil {
+		log.Fatal().Msgf("Error starting logging: %v", err)
+	}
+	defer lg.Stop()
+
+	ar := audit.GetRecorder()
+	ar.Start()
+	defer ar.Stop()
+	audit.Record(audit.Entry{
+		Type:    audit.TypeStart,
+		Actor:   "system",
+		Details: map[string]string{"pid": strconv.Itoa(os.Getpid())},
+	})
+
+	log.Info().Msg("Starting Tracing")
+	tr := tracing.GetTracing()
+	if err := tr.Start(); err != nil {
+		log.Fatal().Msgf("Error starting tracing: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tr.Stop(ctx); err != nil {
+			log.Error().Msgf("Error flushing traces: %v", err)
+		}
+	}()
 
 	log.Info().Msg("Starting Door Controller Service")
 	dc := controller.GetDoorControllerService()
 	dc.Start()
 	defer dc.Stop()
 
+	log.Info().Msg("Starting Scheduler")
+	sc := scheduler.GetScheduler()
+	if err := sc.Start(); err != nil {
+		log.Fatal().Msgf("Error starting scheduler: %v", err)
+	}
+	defer sc.Stop()
+
+	log.Info().Msg("Starting Key Manager")
+	km := apikeys.GetKeyManager()
+	km.Start()
+	defer km.Stop()
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+	go reloadOnSignal(reload, km, web.GetWebService())
+
 	log.Info().Msg("Starting Web Service")
 	ws := web.GetWebService()
 	ws.Start()
 	defer ws.Stop()
 
+	log.Info().Msg("Starting Notifier")
+	nt := notifier.GetNotifier()
+	if err := nt.Start(); err != nil {
+		log.Fatal().Msgf("Error starting notifier: %v", err)
+	}
+	defer nt.Stop()
+
+	log.Info().Msg("Starting Webhook Dispatcher")
+	wd := webhooks.GetDispatcher()
+	if err := wd.Start(); err != nil {
+		log.Fatal().Msgf("Error starting webhook dispatcher: %v", err)
+	}
+	defer wd.Stop()
+
+	log.Info().Msg("Starting Alert Manager")
+	am := alerts.GetAlertManager()
+	am.Start()
+	defer am.Stop()
+
+	log.Info().Msg("Starting Rules Engine")
+	re := rules.GetRulesEngine()
+	if err := re.Start(); err != nil {
+		log.Fatal().Msgf("Error starting rules engine: %v", err)
+	}
+	defer re.Stop()
+
 	if config.GetMQTTEnabled() {
 		log.Info().Msg("Setting connection to MQTT Broker")
 		ms := mqtt.GetMQTTService()
@@ -39,6 +127,110 @@ func main() {
 		}
 	}
 
+	go notifyReady(ctx, dc)
+	if wp := startWatchdog(dc); wp != nil {
+		defer wp.Stop()
+	}
+
 	<-ctx.Done()
 	log.Info().Msg("Shutting down")
+	if _, err := systemd.Notify(systemd.Stopping); err != nil {
+		log.Error().Msgf("%v", err)
+	}
+}
+
+// Notify systemd that the service is ready, once the door controller has read the pins. The web server is already
+// listening when this is called.
+func notifyReady(ctx context.Context, dc *controller.DoorControllerService) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for !dc.Ready() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+	notified, err := systemd.Notify(systemd.Ready)
+	if err != nil {
+		log.Error().Msgf("%v", err)
+	} else if notified {
+		log.Info().Msg("Notified systemd that the service is ready")
+	}
+}
+
+// Start sending watchdog notifications to systemd while the loops of the door controller are alive, when the unit has
+// a watchdog. Returns nil without watchdog.
+func startWatchdog(dc *controller.DoorControllerService) *systemd.WatchdogPinger {
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		log.Fatal().Msgf("%v", err)
+	}
+	if interval == 0 {
+		return nil
+	}
+	log.Info().Msgf("Sending watchdog notifications to systemd, the watchdog interval is %v", interval)
+	wp := systemd.NewWatchdogPinger(interval, dc.Alive)
+	if err := wp.Start(); err != nil {
+		log.Fatal().Msgf("Error starting watchdog: %v", err)
+	}
+	return wp
+}
+
+// Reload the API keys, the mapping of client certificates and the log levels from the configuration file whenever a
+// signal is received, e.g. SIGHUP. This also clears the cache of verified keys, and undoes changes of the log levels
+// made at runtime.
+func reloadOnSignal(signals <-chan os.Signal, km *apikeys.KeyManager, ws *web.WebService) {
+	for range signals {
+		log.Info().Msg("Reloading API keys, client certificates and log levels")
+		failed := false
+		keys, err := config.ReadAPIKeys()
+		if err != nil {
+			log.Error().Msgf("Error reloading API keys, keeping the current keys: %v", err)
+			recordReloadFailure(err)
+			failed = true
+		} else {
+			km.Reload(keys)
+		}
+		certs, err := config.ReadTLSClientCerts()
+		if err != nil {
+			log.Error().Msgf("Error reloading client certificates, keeping the current mapping: %v", err)
+			recordReloadFailure(err)
+			failed = true
+		} else {
+			ws.ReloadClientCerts(certs)
+		}
+		level, levels, err := config.ReadLogLevels()
+		if err == nil {
+			err = logging.GetLogging().SetLevels(logging.Levels{Level: level, Levels: levels}, true)
+		}
+		if err != nil {
+			log.Error().Msgf("Error reloading log levels, keeping the current levels: %v", err)
+			recordReloadFailure(err)
+			failed = true
+		}
+		if failed {
+			continue
+		}
+		audit.Record(audit.Entry{
+			Type:    audit.TypeConfigReload,
+			Actor:   "signal",
+			Outcome: "ok",
+			Details: map[string]string{
+				"keys":         strconv.Itoa(len(keys)),
+				"client_certs": strconv.Itoa(len(certs)),
+				"log_level":    level,
+			},
+		})
+	}
+}
+
+// Record a failed reload of the configuration in the audit log.
+func recordReloadFailure(err error) {
+	audit.Record(audit.Entry{
+		Type:    audit.TypeConfigReload,
+		Actor:   "signal",
+		Outcome: "failed",
+		Message: err.Error(),
+	})
 }
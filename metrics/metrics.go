@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace of all metrics.
+const namespace = "garagedoor"
+
+// States reported by the door state gauge.
+var states = []string{"open", "closed", "unknown"}
+
+// Metrics of the service. The components update them directly; they are exposed in the Prometheus text format by
+// Handler.
+var (
+	// DoorState is 1 for the current state of the door, and 0 for the other states.
+	DoorState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "door_state",
+		Help:      "Current state of the door, 1 for the current state and 0 for the others.",
+	}, []string{"state"})
+
+	// StateTransitions counts the state transitions of the door.
+	StateTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "state_transitions_total",
+		Help:      "Number of state transitions of the door.",
+	}, []string{"from", "to"})
+
+	// Commands counts the actuating commands by command, source and result (accepted or rejected).
+	Commands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "commands_total",
+		Help:      "Number of actuating commands, by command, source and result.",
+	}, []string{"command", "source", "result"})
+
+	// RelayPulses counts the pulses on the toggle relay.
+	RelayPulses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "relay_pulses_total",
+		Help:      "Number of pulses on the toggle relay.",
+	})
+
+	// TravelTime observes the time from a relay pulse until the door reports the open or closed state.
+	TravelTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "travel_seconds",
+		Help:      "Time from a relay pulse until the door is open or closed.",
+		Buckets:   []float64{2.5, 5, 7.5, 10, 12.5, 15, 20, 25, 30},
+	}, []string{"to"})
+
+	// AuthFailures counts the failed authentications by method (api_key, login or metrics).
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Number of failed authentications, by method.",
+	}, []string{"method"})
+
+	// WebSocketClients is the number of connected websocket clients.
+	WebSocketClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_clients",
+		Help:      "Number of connected websocket clients.",
+	})
+
+	// MQTTConnected is 1 while connected to the MQTT broker.
+	MQTTConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mqtt_connected",
+		Help:      "1 while connected to the MQTT broker, 0 otherwise.",
+	})
+
+	// MQTTPublishFailures counts the messages that failed to be published to the MQTT broker.
+	MQTTPublishFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_publish_failures_total",
+		Help:      "Number of messages that failed to be published to the MQTT broker.",
+	})
+
+	// EventQueueDrops counts the items dropped by subscribers of the state and event buses that couldn't keep up.
+	EventQueueDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "event_queue_dropped_total",
+		Help:      "Number of items dropped by subscribers that couldn't keep up, by bus.",
+	}, []string{"bus"})
+
+	registry = prometheus.NewRegistry()
+)
+
+func init() {
+	registry.MustRegister(
+		DoorState,
+		StateTransitions,
+		Commands,
+		RelayPulses,
+		TravelTime,
+		AuthFailures,
+		WebSocketClients,
+		MQTTConnected,
+		MQTTPublishFailures,
+		EventQueueDrops,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// SetDoorState sets the door state gauge to the given state ("open", "closed" or "unknown").
+func SetDoorState(state string) {
+	for _, s := range states {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		DoorState.WithLabelValues(s).Set(value)
+	}
+}
+
+// Handler returns the handler serving the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
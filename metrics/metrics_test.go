@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	SetDoorState("open")
+	SetDoorState("closed")
+	Commands.WithLabelValues("toggle", "key:test", "accepted").Inc()
+	TravelTime.WithLabelValues("closed").Observe(12)
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+	for _, expected := range []string{
+		`garagedoor_door_state{state="closed"} 1`,
+		`garagedoor_door_state{state="open"} 0`,
+		`garagedoor_commands_total{command="toggle",result="accepted",source="key:test"} 1`,
+		`garagedoor_travel_seconds_bucket{to="closed",le="12.5"} 1`,
+		`garagedoor_travel_seconds_bucket{to="closed",le="10"} 0`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("Expected %q in the metrics:\n%s", expected, body)
+		}
+	}
+}
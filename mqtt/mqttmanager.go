@@ -5,15 +5,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dlefevre/go.garagedoor-service/alerts"
 	"github.com/dlefevre/go.garagedoor-service/config"
 	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/dlefevre/go.garagedoor-service/logging"
+	"github.com/dlefevre/go.garagedoor-service/metrics"
+	"github.com/dlefevre/go.garagedoor-service/tracing"
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
 	"github.com/google/uuid"
-	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -21,14 +27,45 @@ var (
 	once     sync.Once
 )
 
+// Tracer for the spans of received commands.
+var tracer = tracing.Tracer("mqtt")
+
+// Logger of the mqtt component.
+var logger = logging.Logger("mqtt")
+
+// Number of command results waiting to be published, above which results are dropped.
+const resultQueueSize = 64
+
+// CommandResult is published on the result topic for every command received on the action or lock topic, containing
+// the command, the result (ok or nok) and, when the command was refused, the reason.
+type CommandResult struct {
+	Command string    `json:"command"`
+	Result  string    `json:"result"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
 // MQTTManager is a singleton that encapsulates the MQTT client and .
 type MQTTManager struct {
-	actionTopic        string
-	stateTopic         string
-	autoDiscoveryTopic string
-	listenerId         uuid.UUID
-	mqttCfg            autopaho.ClientConfig
-	connectionManager  *autopaho.ConnectionManager
+	actionTopic            string
+	stateTopic             string
+	attributesTopic        string
+	resultTopic            string
+	autoDiscoveryTopic     string
+	lockActionTopic        string
+	lockStateTopic         string
+	lockAutoDiscoveryTopic string
+	alertStateTopic        string
+	alertAttributesTopic   string
+	alertDiscoveryTopic    string
+	listenerId             uuid.UUID
+	alertListenerId        uuid.UUID
+	mqttCfg                autopaho.ClientConfig
+	connectionManager      *autopaho.ConnectionManager
+	subscriptions          map[string][]func(topic string, payload []byte)
+	results                chan *paho.Publish
+	connected              atomic.Bool
+	lock                   sync.RWMutex
 }
 
 // GetMQTTService returns the one and only MQTTService instance.
@@ -48,7 +85,18 @@ func newMQTTService() *MQTTManager {
 	mqttService := &MQTTManager{
 		actionTopic:        fmt.Sprintf("%s/cover/%s/action", config.GetMQTTDiscoveryPrefix(), config.GetMQTTObjectID()),
 		stateTopic:         fmt.Sprintf("%s/cover/%s/state", config.GetMQTTDiscoveryPrefix(), config.GetMQTTObjectID()),
+		attributesTopic:    fmt.Sprintf("%s/cover/%s/attributes", config.GetMQTTDiscoveryPrefix(), config.GetMQTTObjectID()),
+		resultTopic:        fmt.Sprintf("%s/cover/%s/result", config.GetMQTTDiscoveryPrefix(), config.GetMQTTObjectID()),
 		autoDiscoveryTopic: fmt.Sprintf("%s/cover/%s/config", config.GetMQTTDiscoveryPrefix(), config.GetMQTTObjectID()),
+		lockActionTopic:    fmt.Sprintf("%s/switch/%s_lock/action", config.GetMQTTDiscoveryPrefix(), config.GetMQTTObjectID()),
+		lockStateTopic:     fmt.Sprintf("%s/switch/%s_lock/state", config.GetMQTTDiscoveryPrefix(), config.GetMQTTObjectID()),
+		lockAutoDiscoveryTopic: fmt.Sprintf("%s/switch/%s_lock/config", config.GetMQTTDiscoveryPrefix(),
+			config.GetMQTTObjectID()),
+		alertStateTopic:      fmt.Sprintf("%s/sensor/%s_alert/state", config.GetMQTTDiscoveryPrefix(), config.GetMQTTObjectID()),
+		alertAttributesTopic: fmt.Sprintf("%s/sensor/%s_alert/attributes", config.GetMQTTDiscoveryPrefix(), config.GetMQTTObjectID()),
+		alertDiscoveryTopic:  fmt.Sprintf("%s/sensor/%s_alert/config", config.GetMQTTDiscoveryPrefix(), config.GetMQTTObjectID()),
+		subscriptions:        make(map[string][]func(topic string, payload []byte)),
+		results:              make(chan *paho.Publish, resultQueueSize),
 	}
 	mqttCfg := autopaho.ClientConfig{
 		ServerUrls:                    []*url.URL{u},
@@ -77,28 +125,50 @@ func (s *MQTTManager) Connect(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to create connection manager: %v", err)
 	}
+	s.lock.Lock()
 	s.connectionManager = cm
+	s.lock.Unlock()
+	go s.resultLoop(ctx, cm)
 	return nil
 }
 
+// manager returns the connection manager, or nil when Connect wasn't called yet.
+func (s *MQTTManager) manager() *autopaho.ConnectionManager {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.connectionManager
+}
+
 func (s *MQTTManager) connectHandler(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
-	log.Info().Msgf("connected to MQTT broker: %s", connAck.String())
+	logger.Info().Msgf("connected to MQTT broker: %s", connAck.String())
+	s.setConnected(true)
 
-	// Subscribe to the action topic.
+	// Subscribe to the action topics, and the topics registered through Subscribe.
+	topics := []string{s.actionTopic, s.lockActionTopic}
+	s.lock.RLock()
+	for filter := range s.subscriptions {
+		topics = append(topics, filter)
+	}
+	s.lock.RUnlock()
+	subscriptions := make([]paho.SubscribeOptions, 0, len(topics))
+	for _, topic := range topics {
+		subscriptions = append(subscriptions, paho.SubscribeOptions{
+			Topic: topic,
+			QoS:   1,
+		})
+	}
 	if _, err := cm.Subscribe(context.Background(), &paho.Subscribe{
-		Subscriptions: []paho.SubscribeOptions{
-			{
-				Topic: s.actionTopic,
-				QoS:   1,
-			},
-		},
+		Subscriptions: subscriptions,
 	}); err != nil {
-		log.Error().Msgf("failed to subscribe (%s). This is likely to mean no messages will be received.", err)
+		logger.Error().Msgf("failed to subscribe (%s). This is likely to mean no messages will be received.", err)
 	}
-	log.Info().Msgf("subscribed to MQTT topic: %s", s.actionTopic)
+	logger.Info().Msgf("subscribed to MQTT topics: %v", topics)
 
 	s.registerStateListener()
 	s.sendHomeAssistantAutodiscoveryPayload()
+	s.sendLockAutodiscoveryPayload()
+	s.sendAlertAutodiscoveryPayload()
+	s.registerAlertListener()
 
 	go func() {
 		time.Sleep(5 * time.Second)
@@ -106,41 +176,267 @@ func (s *MQTTManager) connectHandler(cm *autopaho.ConnectionManager, connAck *pa
 	}()
 }
 
+// Connected checks if the connection to the broker is up.
+func (s *MQTTManager) Connected() bool {
+	return s.connected.Load()
+}
+
+// Record whether the connection to the broker is up.
+func (s *MQTTManager) setConnected(connected bool) {
+	s.connected.Store(connected)
+	if connected {
+		metrics.MQTTConnected.Set(1)
+	} else {
+		metrics.MQTTConnected.Set(0)
+	}
+}
+
+// Subscribe registers a handler for messages on the given topic filter, which may contain wildcards. Subscriptions
+// are renewed whenever the connection to the broker is (re-)established.
+func (s *MQTTManager) Subscribe(filter string, handler func(topic string, payload []byte)) error {
+	s.lock.Lock()
+	_, subscribed := s.subscriptions[filter]
+	s.subscriptions[filter] = append(s.subscriptions[filter], handler)
+	cm := s.connectionManager
+	s.lock.Unlock()
+
+	if subscribed || cm == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{
+			{
+				Topic: filter,
+				QoS:   1,
+			},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %v", filter, err)
+	}
+	logger.Info().Msgf("subscribed to MQTT topic: %s", filter)
+	return nil
+}
+
+// Publish publishes a message on the given topic.
+func (s *MQTTManager) Publish(topic string, payload []byte, retain bool) error {
+	cm := s.manager()
+	if cm == nil {
+		return fmt.Errorf("not connected to MQTT broker")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := cm.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		Payload: payload,
+		QoS:     1,
+		Retain:  retain,
+	}); err != nil {
+		metrics.MQTTPublishFailures.Inc()
+		return fmt.Errorf("failed to publish to %s: %v", topic, err)
+	}
+	return nil
+}
+
+// Dispatch a message to the handlers registered through Subscribe.
+func (s *MQTTManager) subscriptionHandler(pr paho.PublishReceived) (bool, error) {
+	s.lock.RLock()
+	handlers := make([]func(string, []byte), 0)
+	for filter, filterHandlers := range s.subscriptions {
+		if topicMatches(filter, pr.Packet.Topic) {
+			handlers = append(handlers, filterHandlers...)
+		}
+	}
+	s.lock.RUnlock()
+
+	if len(handlers) == 0 {
+		logger.Warn().Msgf("received message on unexpected topic: %s", pr.Packet.Topic)
+		return false, nil
+	}
+	for _, handler := range handlers {
+		handler(pr.Packet.Topic, pr.Packet.Payload)
+	}
+	return true, nil
+}
+
+// Check if a topic matches a topic filter, which may contain the + and # wildcards.
+func topicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
 func (s *MQTTManager) connectErrorHandler(err error) {
-	log.Error().Msgf("mqtt connection error: %v", err)
+	logger.Error().Msgf("mqtt connection error: %v", err)
+	s.setConnected(false)
 }
 
 func (s *MQTTManager) publishHandler(pr paho.PublishReceived) (bool, error) {
+	if pr.Packet.Topic == s.lockActionTopic {
+		return s.lockHandler(pr)
+	}
+	if pr.Packet.Topic != s.actionTopic {
+		return s.subscriptionHandler(pr)
+	}
+
 	dc := controller.GetDoorControllerService()
 	command := string(pr.Packet.Payload)
 	switch command {
 	case "open", "close", "stop", "toggle":
-		dc.RequestToggle()
+		// Continue the trace of the sender, if it propagated one in the user properties.
+		ctx, span := tracer.Start(tracing.ExtractMQTT(context.Background(), pr.Packet.Properties),
+			"mqtt.receive "+pr.Packet.Topic,
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(tracing.AttrCommand.String(command)))
+		defer span.End()
+		var err error
+		switch command {
+		case "open":
+			err = dc.RequestOpen(ctx, "mqtt")
+		case "close":
+			err = dc.RequestClose(ctx, "mqtt")
+		default:
+			err = dc.RequestToggle(ctx, "mqtt")
+		}
+		s.queueResult(pr.Packet, command, err)
+		if err != nil {
+			tracing.RecordError(span, err)
+			logger.Warn().Msgf("command '%s' refused: %v", command, err)
+			return false, err
+		}
 	case "state":
 		dc.RequestState()
 	default:
-		log.Warn().Msgf("received unknown command: %s", command)
-		return false, fmt.Errorf("unknown command: %s", command)
+		logger.Warn().Msgf("received unknown command: %s", command)
+		err := fmt.Errorf("unknown command: %s", command)
+		s.queueResult(pr.Packet, command, err)
+		return false, err
+	}
+
+	logger.Trace().Msgf("received command '%s' to DoorControllerService", command)
+	return true, nil
+}
+
+// Handle commands for the maintenance lock switch.
+func (s *MQTTManager) lockHandler(pr paho.PublishReceived) (bool, error) {
+	dc := controller.GetDoorControllerService()
+	command := string(pr.Packet.Payload)
+	var err error
+	switch command {
+	case "ON":
+		if _, err = dc.Lock("locked from Home Assistant", 0, "mqtt"); err != nil {
+			logger.Error().Msgf("failed to engage maintenance lock: %v", err)
+		}
+	case "OFF":
+		if err = dc.Unlock("mqtt"); err != nil {
+			logger.Error().Msgf("failed to release maintenance lock: %v", err)
+		}
+	default:
+		logger.Warn().Msgf("received unknown lock command: %s", command)
+		err = fmt.Errorf("unknown lock command: %s", command)
+	}
+	s.queueResult(pr.Packet, "lock "+command, err)
+	if err != nil {
+		return false, err
 	}
 
-	log.Trace().Msgf("received command '%s' to DoorControllerService", command)
+	logger.Trace().Msgf("received lock command '%s'", command)
 	return true, nil
 }
 
+// Queue the result of a command for the result topic, and for the response topic of the command when the sender set
+// one, as in the request/response pattern of MQTT v5. The results are published in order by resultLoop, as a publish
+// handler can't wait for the acknowledgement, which is received by the same goroutine. When the queue is full, e.g.
+// during a flood of commands or with a slow broker, the result is dropped.
+func (s *MQTTManager) queueResult(command *paho.Publish, name string, err error) {
+	result := CommandResult{
+		Command: name,
+		Result:  "ok",
+		Time:    time.Now(),
+	}
+	if err != nil {
+		result.Result = "nok"
+		result.Message = err.Error()
+	}
+	payload, err := json.Marshal(result)
+	if err != nil {
+		logger.Error().Msgf("failed to marshal command result: %v", err)
+		return
+	}
+
+	messages := []*paho.Publish{
+		{
+			Topic:   s.resultTopic,
+			Payload: payload,
+			QoS:     1,
+		},
+	}
+	if command.Properties != nil && command.Properties.ResponseTopic != "" {
+		messages = append(messages, &paho.Publish{
+			Topic:   command.Properties.ResponseTopic,
+			Payload: payload,
+			QoS:     1,
+			Properties: &paho.PublishProperties{
+				CorrelationData: command.Properties.CorrelationData,
+			},
+		})
+	}
+	for _, message := range messages {
+		select {
+		case s.results <- message:
+		default:
+			metrics.MQTTPublishFailures.Inc()
+			logger.Warn().Msgf("dropped command result for MQTT topic %s, too many results are waiting", message.Topic)
+		}
+	}
+}
+
+// Publish the queued command results with the connection manager, until the context is done.
+func (s *MQTTManager) resultLoop(ctx context.Context, cm *autopaho.ConnectionManager) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-s.results:
+			if _, err := cm.Publish(ctx, message); err != nil {
+				metrics.MQTTPublishFailures.Inc()
+				logger.Error().Msgf("failed to publish command result to MQTT topic %s: %v", message.Topic, err)
+			}
+		}
+	}
+}
+
 func (s *MQTTManager) clientErrorHandler(err error) {
-	log.Error().Msgf("mqtt client error: %v", err)
+	logger.Error().Msgf("mqtt client error: %v", err)
+	s.setConnected(false)
 }
 
 func (s *MQTTManager) disconnectHandler(d *paho.Disconnect) {
+	s.setConnected(false)
 	if d.Properties != nil {
-		log.Info().Msgf("server requested disconnect: %s\n", d.Properties.ReasonString)
+		logger.Info().Msgf("server requested disconnect: %s\n", d.Properties.ReasonString)
 	} else {
-		log.Info().Msgf("server requested disconnect; reason code: %d\n", d.ReasonCode)
+		logger.Info().Msgf("server requested disconnect; reason code: %d\n", d.ReasonCode)
 	}
 	dc := controller.GetDoorControllerService()
 	if s.listenerId != uuid.Nil {
 		dc.RemoveStateListener(s.listenerId)
 	}
+	if s.alertListenerId != uuid.Nil {
+		alerts.GetAlertManager().RemoveListener(s.alertListenerId)
+	}
 }
 
 func (s *MQTTManager) registerStateListener() {
@@ -148,7 +444,8 @@ func (s *MQTTManager) registerStateListener() {
 	if s.listenerId != uuid.Nil {
 		dc.RemoveStateListener(s.listenerId)
 	}
-	s.listenerId = dc.AddStateListener(func(state string) {
+	s.listenerId = dc.AddStateListener(func(event controller.StateEvent) {
+		state := event.State
 		if state == "unknown" {
 			state = "open"
 		}
@@ -158,40 +455,139 @@ func (s *MQTTManager) registerStateListener() {
 			QoS:     1,
 			Retain:  true,
 		}
-		if _, err := s.connectionManager.Publish(context.Background(), message); err != nil {
-			log.Error().Msgf("failed to publish state (%s): %v", state, err)
+		tracing.InjectMQTT(trace.ContextWithSpanContext(context.Background(), event.SpanContext()), message)
+		if _, err := s.manager().Publish(context.Background(), message); err != nil {
+			metrics.MQTTPublishFailures.Inc()
+			logger.Error().Msgf("failed to publish state (%s): %v", state, err)
 		} else {
-			log.Trace().Msgf("published state '%s' to MQTT topic: %s", state, s.stateTopic)
+			logger.Trace().Msgf("published state '%s' to MQTT topic: %s", state, s.stateTopic)
 		}
+		s.publishLockStatus(dc.GetLockStatus(), event)
 	})
 
 	// Delay the initial state update to ensure pins are at least read once.
 	for i := 0; !dc.Ready(); i++ {
 		time.Sleep(100 * time.Millisecond)
 		if i > 50 {
-			log.Warn().Msg("initial state update delayed too long")
+			logger.Warn().Msg("initial state update delayed too long")
 			break
 		}
 	}
 
 	dc.RequestState()
-	log.Info().Msgf("registered state listener for MQTT topic: %s", s.stateTopic)
+	logger.Info().Msgf("registered state listener for MQTT topic: %s", s.stateTopic)
+}
+
+// Register a listener that publishes changes to the left open alert, and publish its current state.
+func (s *MQTTManager) registerAlertListener() {
+	am := alerts.GetAlertManager()
+	if s.alertListenerId != uuid.Nil {
+		am.RemoveListener(s.alertListenerId)
+	}
+	s.alertListenerId = am.AddListener(func(alert alerts.Alert) {
+		if alert.ID == alerts.LeftOpen {
+			s.publishAlert(alert)
+		}
+	})
+	for _, alert := range am.List() {
+		if alert.ID == alerts.LeftOpen {
+			s.publishAlert(alert)
+		}
+	}
+	logger.Info().Msgf("registered alert listener for MQTT topic: %s", s.alertStateTopic)
+}
+
+// Publish the level of the left open alert as sensor state, and the alert itself as sensor attributes.
+func (s *MQTTManager) publishAlert(alert alerts.Alert) {
+	attributes, err := json.Marshal(alert)
+	if err != nil {
+		logger.Error().Msgf("failed to marshal alert: %v", err)
+		return
+	}
+	messages := []*paho.Publish{
+		{
+			Topic:   s.alertStateTopic,
+			Payload: []byte(alert.Level),
+			QoS:     1,
+			Retain:  true,
+		},
+		{
+			Topic:   s.alertAttributesTopic,
+			Payload: attributes,
+			QoS:     1,
+			Retain:  true,
+		},
+	}
+	for _, message := range messages {
+		if _, err := s.manager().Publish(context.Background(), message); err != nil {
+			metrics.MQTTPublishFailures.Inc()
+			logger.Error().Msgf("failed to publish to MQTT topic %s: %v", message.Topic, err)
+		} else {
+			logger.Trace().Msgf("published '%s' to MQTT topic: %s", message.Payload, message.Topic)
+		}
+	}
+}
+
+// Publish the status of the maintenance lock, both as state of the lock switch and as attributes of the cover. The
+// attributes also contain the details of the last state transition.
+func (s *MQTTManager) publishLockStatus(status controller.LockStatus, event controller.StateEvent) {
+	lockState := "OFF"
+	if status.Locked {
+		lockState = "ON"
+	}
+	attributes, err := json.Marshal(map[string]interface{}{
+		"lock":           status,
+		"previous_state": event.Previous,
+		"changed":        event.Changed,
+		"cause":          event.Cause,
+		"source":         event.Source,
+		"sequence":       event.Sequence,
+	})
+	if err != nil {
+		logger.Error().Msgf("failed to marshal attributes: %v", err)
+		return
+	}
+
+	messages := []*paho.Publish{
+		{
+			Topic:   s.lockStateTopic,
+			Payload: []byte(lockState),
+			QoS:     1,
+			Retain:  true,
+		},
+		{
+			Topic:   s.attributesTopic,
+			Payload: attributes,
+			QoS:     1,
+			Retain:  true,
+		},
+	}
+	tracing.InjectMQTT(trace.ContextWithSpanContext(context.Background(), event.SpanContext()), messages[1])
+	for _, message := range messages {
+		if _, err := s.manager().Publish(context.Background(), message); err != nil {
+			metrics.MQTTPublishFailures.Inc()
+			logger.Error().Msgf("failed to publish to MQTT topic %s: %v", message.Topic, err)
+		} else {
+			logger.Trace().Msgf("published '%s' to MQTT topic: %s", message.Payload, message.Topic)
+		}
+	}
 }
 
 func (s *MQTTManager) sendHomeAssistantAutodiscoveryPayload() {
 	// Define the autodiscovery payload
 	payload := map[string]interface{}{
-		"name":          "Garage Door",
-		"command_topic": s.actionTopic,
-		"state_topic":   s.stateTopic,
-		"payload_open":  "open",
-		"payload_close": "close",
-		"payload_stop":  "stop",
-		"state_open":    "open",
-		"state_closed":  "closed",
-		"unique_id":     config.GetMQTTObjectID(),
-		"object_id":     config.GetMQTTObjectID(),
-		"icon":          "mdi:garage-variant",
+		"name":                  "Garage Door",
+		"command_topic":         s.actionTopic,
+		"state_topic":           s.stateTopic,
+		"json_attributes_topic": s.attributesTopic,
+		"payload_open":          "open",
+		"payload_close":         "close",
+		"payload_stop":          "stop",
+		"state_open":            "open",
+		"state_closed":          "closed",
+		"unique_id":             config.GetMQTTObjectID(),
+		"object_id":             config.GetMQTTObjectID(),
+		"icon":                  "mdi:garage-variant",
 		"device": map[string]interface{}{
 			"identifiers":  config.GetMQTTObjectID(),
 			"name":         "Garage Door",
@@ -203,7 +599,7 @@ func (s *MQTTManager) sendHomeAssistantAutodiscoveryPayload() {
 	// Convert the payload to JSON
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		log.Error().Msgf("failed to marshal autodiscovery payload: %v", err)
+		logger.Error().Msgf("failed to marshal autodiscovery payload: %v", err)
 		return
 	}
 
@@ -214,9 +610,90 @@ func (s *MQTTManager) sendHomeAssistantAutodiscoveryPayload() {
 		QoS:     1,
 		Retain:  true,
 	}
-	if _, err := s.connectionManager.Publish(context.Background(), message); err != nil {
-		log.Error().Msgf("failed to publish autodiscovery payload: %v", err)
+	if _, err := s.manager().Publish(context.Background(), message); err != nil {
+		metrics.MQTTPublishFailures.Inc()
+		logger.Error().Msgf("failed to publish autodiscovery payload: %v", err)
+	} else {
+		logger.Info().Msgf("published autodiscovery payload to MQTT topic: %s", s.autoDiscoveryTopic)
+	}
+}
+
+func (s *MQTTManager) sendLockAutodiscoveryPayload() {
+	// Define the autodiscovery payload
+	payload := map[string]interface{}{
+		"name":          "Garage Door Maintenance Lock",
+		"command_topic": s.lockActionTopic,
+		"state_topic":   s.lockStateTopic,
+		"payload_on":    "ON",
+		"payload_off":   "OFF",
+		"unique_id":     config.GetMQTTObjectID() + "_lock",
+		"object_id":     config.GetMQTTObjectID() + "_lock",
+		"icon":          "mdi:wrench-clock",
+		"device": map[string]interface{}{
+			"identifiers":  config.GetMQTTObjectID(),
+			"name":         "Garage Door",
+			"model":        "Generic Garage Door",
+			"manufacturer": "n/a",
+		},
+	}
+
+	// Convert the payload to JSON
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		logger.Error().Msgf("failed to marshal lock autodiscovery payload: %v", err)
+		return
+	}
+
+	// Publish the autodiscovery payload
+	message := &paho.Publish{
+		Topic:   s.lockAutoDiscoveryTopic,
+		Payload: payloadBytes,
+		QoS:     1,
+		Retain:  true,
+	}
+	if _, err := s.manager().Publish(context.Background(), message); err != nil {
+		metrics.MQTTPublishFailures.Inc()
+		logger.Error().Msgf("failed to publish lock autodiscovery payload: %v", err)
+	} else {
+		logger.Info().Msgf("published lock autodiscovery payload to MQTT topic: %s", s.lockAutoDiscoveryTopic)
+	}
+}
+
+func (s *MQTTManager) sendAlertAutodiscoveryPayload() {
+	// Define the autodiscovery payload
+	payload := map[string]interface{}{
+		"name":                  "Garage Door Left Open Alert",
+		"state_topic":           s.alertStateTopic,
+		"json_attributes_topic": s.alertAttributesTopic,
+		"unique_id":             config.GetMQTTObjectID() + "_alert",
+		"object_id":             config.GetMQTTObjectID() + "_alert",
+		"icon":                  "mdi:garage-alert-variant",
+		"device": map[string]interface{}{
+			"identifiers":  config.GetMQTTObjectID(),
+			"name":         "Garage Door",
+			"model":        "Generic Garage Door",
+			"manufacturer": "n/a",
+		},
+	}
+
+	// Convert the payload to JSON
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		logger.Error().Msgf("failed to marshal alert autodiscovery payload: %v", err)
+		return
+	}
+
+	// Publish the autodiscovery payload
+	message := &paho.Publish{
+		Topic:   s.alertDiscoveryTopic,
+		Payload: payloadBytes,
+		QoS:     1,
+		Retain:  true,
+	}
+	if _, err := s.manager().Publish(context.Background(), message); err != nil {
+		metrics.MQTTPublishFailures.Inc()
+		logger.Error().Msgf("failed to publish alert autodiscovery payload: %v", err)
 	} else {
-		log.Info().Msgf("published autodiscovery payload to MQTT topic: %s", s.autoDiscoveryTopic)
+		logger.Info().Msgf("published alert autodiscovery payload to MQTT topic: %s", s.alertDiscoveryTopic)
 	}
 }
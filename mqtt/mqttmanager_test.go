@@ -4,11 +4,14 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/eclipse/paho.golang/paho"
 	mochi_mqtt "github.com/mochi-mqtt/server/v2"
 	"github.com/mochi-mqtt/server/v2/hooks/auth"
 	"github.com/mochi-mqtt/server/v2/hooks/debug"
@@ -23,11 +26,29 @@ var (
 	server = mochi_mqtt.New(&mochi_mqtt.Options{
 		InlineClient: true,
 	})
-	state string = "unknown"
+	state  string = "unknown"
+	result string
+	lock   sync.Mutex
 )
 
+// lastState returns the last state published by the service.
+func lastState() string {
+	lock.Lock()
+	defer lock.Unlock()
+	return state
+}
+
+// lastResult returns the last command result published by the service.
+func lastResult() string {
+	lock.Lock()
+	defer lock.Unlock()
+	return result
+}
+
 func init() {
 	os.Setenv("GARAGESERVICE_CONFIG_PATH", "..")
+	dataDir, _ := os.MkdirTemp("", "garagedoor-service-test")
+	os.Setenv("GARAGESERVICE_DATA_DIR", dataDir)
 	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
 
 	sigs := make(chan os.Signal, 1)
@@ -64,9 +85,16 @@ func init() {
 		log.Fatal().Msgf("Could not add Listener: %v", err)
 	}
 
-	server.Subscribe("homeassistant/+/+/+", 0, func(cl *mochi_mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+	server.Subscribe("homeassistant/cover/+/state", 0, func(cl *mochi_mqtt.Client, sub packets.Subscription, pk packets.Packet) {
 		log.Info().Msgf("Received message: %s", pk.Payload)
+		lock.Lock()
 		state = string(pk.Payload)
+		lock.Unlock()
+	})
+	server.Subscribe("homeassistant/cover/+/result", 1, func(cl *mochi_mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		lock.Lock()
+		result = string(pk.Payload)
+		lock.Unlock()
 	})
 }
 
@@ -116,8 +144,8 @@ func TestPublish(t *testing.T) {
 		t.Fatalf("Error connecting to MQTT broker: %v", err)
 	}
 	time.Sleep(1 * time.Second)
-	if state != "closed" {
-		t.Fatalf("Expected state to be closed, got %s", state)
+	if lastState() != "closed" {
+		t.Fatalf("Expected state to be closed, got %s", lastState())
 	}
 
 	log.Info().Msg("Publishing message to action topic")
@@ -126,8 +154,70 @@ func TestPublish(t *testing.T) {
 	}
 
 	time.Sleep(1 * time.Second)
-	if state != "open" {
-		t.Fatalf("Expected state to be open, got %s", state)
+	if lastState() != "open" {
+		t.Fatalf("Expected state to be open, got %s", lastState())
+	}
+	if !strings.Contains(lastResult(), `"command":"open","result":"ok"`) {
+		t.Fatalf("Expected accepted command to be reported on the result topic, got %s", lastResult())
+	}
+
+	// Refused commands are reported on the result topic, with the reason.
+	if _, err := dc.Lock("painting", 0, "test"); err != nil {
+		t.Fatalf("Error engaging maintenance lock: %v", err)
+	}
+	defer dc.Unlock("test")
+	if err := server.Publish("homeassistant/cover/garage_door/action", []byte("close"), false, 1); err != nil {
+		t.Fatalf("Error publishing message: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if !strings.Contains(lastResult(), `"command":"close","result":"nok"`) ||
+		!strings.Contains(lastResult(), controller.ErrMaintenanceLock.Error()) {
+		t.Fatalf("Expected refused command to be reported on the result topic, got %s", lastResult())
+	}
+	if lastState() != "open" {
+		t.Fatalf("Expected refused command not to change the state, got %s", lastState())
 	}
 	done <- true
 }
+
+func TestTopicMatches(t *testing.T) {
+	cases := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"sensors/outdoor/temperature", "sensors/outdoor/temperature", true},
+		{"sensors/+/temperature", "sensors/outdoor/temperature", true},
+		{"sensors/#", "sensors/outdoor/temperature", true},
+		{"sensors/+", "sensors/outdoor/temperature", false},
+		{"sensors/indoor/temperature", "sensors/outdoor/temperature", false},
+		{"sensors/outdoor/temperature/#", "sensors/outdoor", false},
+	}
+	for _, c := range cases {
+		if topicMatches(c.filter, c.topic) != c.match {
+			t.Fatalf("Expected match of %s against %s to be %v", c.topic, c.filter, c.match)
+		}
+	}
+}
+
+func TestQueueResult(t *testing.T) {
+	s := &MQTTManager{
+		resultTopic: "homeassistant/cover/garage_door/result",
+		results:     make(chan *paho.Publish, 2),
+	}
+	command := &paho.Publish{Properties: &paho.PublishProperties{ResponseTopic: "client/response"}}
+
+	// Results are queued in order, and dropped when the queue is full, without blocking.
+	s.queueResult(command, "open", nil)
+	s.queueResult(&paho.Publish{}, "close", controller.ErrMaintenanceLock)
+	if len(s.results) != 2 {
+		t.Fatalf("Expected 2 queued results, got %d", len(s.results))
+	}
+	first, second := <-s.results, <-s.results
+	if first.Topic != s.resultTopic || !strings.Contains(string(first.Payload), `"command":"open"`) {
+		t.Fatalf("Expected the result of open on the result topic first, got %s %s", first.Topic, first.Payload)
+	}
+	if second.Topic != "client/response" {
+		t.Fatalf("Expected the result on the response topic second, got %s", second.Topic)
+	}
+}
@@ -0,0 +1,123 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+)
+
+// Timeout for HTTP requests made by drivers.
+const httpTimeout = 10 * time.Second
+
+// ntfyDriver publishes messages to an ntfy topic. See https://docs.ntfy.sh/publish/.
+type ntfyDriver struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// Create an ntfy driver. The URL is the full topic URL, e.g. https://ntfy.sh/my-topic.
+func newNtfyDriver(cfg config.NotificationChannelConfig) (*ntfyDriver, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("ntfy requires a url")
+	}
+	return &ntfyDriver{
+		url:   cfg.URL,
+		token: cfg.Token,
+		client: &http.Client{
+			Timeout: httpTimeout,
+		},
+	}, nil
+}
+
+// Send publishes a message, mapping the alert level to the ntfy priority.
+func (d *ntfyDriver) Send(ctx context.Context, message Message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, strings.NewReader(message.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", message.Title)
+	req.Header.Set("Tags", "garage")
+	switch message.Level {
+	case "critical":
+		req.Header.Set("Priority", "urgent")
+	case "warning":
+		req.Header.Set("Priority", "high")
+	}
+	if d.token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	}
+	return doRequest(d.client, req)
+}
+
+// gotifyDriver pushes messages to a Gotify server. See https://gotify.net/docs/pushmsg.
+type gotifyDriver struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// Create a Gotify driver. The URL is the base URL of the server, and the token an application token.
+func newGotifyDriver(cfg config.NotificationChannelConfig) (*gotifyDriver, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("gotify requires a url")
+	}
+	if cfg.Token == "" {
+		return nil, errors.New("gotify requires a token")
+	}
+	return &gotifyDriver{
+		url:   strings.TrimSuffix(cfg.URL, "/") + "/message",
+		token: cfg.Token,
+		client: &http.Client{
+			Timeout: httpTimeout,
+		},
+	}, nil
+}
+
+// Send pushes a message, mapping the alert level to the Gotify priority.
+func (d *gotifyDriver) Send(ctx context.Context, message Message) error {
+	priority := 3
+	switch message.Level {
+	case "critical":
+		priority = 8
+	case "warning":
+		priority = 5
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"title":    message.Title,
+		"message":  message.Body,
+		"priority": priority,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", d.token)
+	return doRequest(d.client, req)
+}
+
+// Perform a request, and turn non-2xx responses into errors.
+func doRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/dlefevre/go.garagedoor-service/logging"
+	"github.com/google/uuid"
+)
+
+// Logger of the notifier component.
+var logger = logging.Logger("notifier")
+
+// Size of the queue of pending messages per channel.
+const queueSize = 32
+
+// Default number of retries, and the delay before the first retry. The delay doubles with every retry.
+const (
+	defaultRetries = 3
+	initialBackoff = time.Second
+)
+
+// Timeout of a delivery, and the maximum time to wait for the pending messages when stopping.
+const (
+	sendTimeout     = 30 * time.Second
+	shutdownTimeout = 10 * time.Second
+)
+
+// Default templates for the title and the body of a message.
+const (
+	defaultTitle = "{{.DoorName}}"
+	defaultBody  = "{{if .Message}}{{.Message}}{{else}}{{.DoorName}} is {{.State}}{{end}}"
+)
+
+// Event types sent to a channel when none are configured.
+var defaultEvents = []string{controller.EventAlert, controller.EventAlertCleared, controller.EventNotification}
+
+var (
+	instance *Notifier
+	once     sync.Once
+)
+
+// Message is a rendered notification.
+type Message struct {
+	Title string
+	Body  string
+	Level string
+}
+
+// Driver delivers messages to a notification service.
+type Driver interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// TemplateData is the data available to the title and message templates of a channel.
+type TemplateData struct {
+	DoorName string
+	Event    string
+	State    string
+	Source   string
+	Level    string
+	Message  string
+	Duration string
+	Time     time.Time
+}
+
+// Functions available in templates. The json function encodes a value as JSON, e.g. for webhook bodies.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// A notification channel, which filters events, renders them and delivers them through its driver.
+type channel struct {
+	name       string
+	driver     Driver
+	events     map[string]bool
+	levels     map[string]bool
+	title      *template.Template
+	body       *template.Template
+	retries    int
+	backoff    time.Duration
+	rateLimit  int
+	ratePeriod time.Duration
+	sent       []time.Time
+	queue      chan Message
+}
+
+// Notifier delivers events from the DoorControllerService to the configured notification channels.
+type Notifier struct {
+	channels   []*channel
+	doorName   string
+	state      string
+	stateSince time.Time
+	listenerID uuid.UUID
+	stop       chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	lock       sync.Mutex
+}
+
+// GetNotifier returns the one and only Notifier instance.
+func GetNotifier() *Notifier {
+	once.Do(func() {
+		instance = &Notifier{
+			doorName: config.GetNotificationDoorName(),
+		}
+	})
+	return instance
+}
+
+// Start creates the channels from the configuration file, and subscribes to the events of the DoorControllerService.
+func (n *Notifier) Start() error {
+	channels := make([]*channel, 0)
+	for _, cfg := range config.GetNotificationChannels() {
+		c, err := newChannel(cfg)
+		if err != nil {
+			return fmt.Errorf("notifier: invalid channel %s: %v", cfg.Name, err)
+		}
+		channels = append(channels, c)
+	}
+
+	dc := controller.GetDoorControllerService()
+	n.lock.Lock()
+	n.channels = channels
+	n.state = dc.GetStateStr()
+	n.stateSince = time.Now()
+	n.lock.Unlock()
+	n.stop = make(chan struct{})
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+
+	for _, c := range channels {
+		n.wg.Add(1)
+		go n.deliver(c)
+	}
+	n.listenerID = dc.AddEventListener(n.eventReceived)
+	logger.Info().Msgf("notifier started with %d channels", len(channels))
+	return nil
+}
+
+// Stop unsubscribes from events, and delivers the pending messages without retrying failed deliveries. Messages that
+// aren't delivered within the shutdown timeout are abandoned.
+func (n *Notifier) Stop() {
+	controller.GetDoorControllerService().RemoveEventListener(n.listenerID)
+	n.lock.Lock()
+	for _, c := range n.channels {
+		close(c.queue)
+	}
+	n.channels = nil
+	n.lock.Unlock()
+	close(n.stop)
+
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		logger.Warn().Msgf("pending notifications not delivered within %s, abandoning them", shutdownTimeout)
+		n.cancel()
+		<-done
+	}
+	n.cancel()
+}
+
+// Create a channel from its configuration.
+func newChannel(cfg config.NotificationChannelConfig) (*channel, error) {
+	driver, err := newDriver(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := &channel{
+		name:       cfg.Name,
+		driver:     driver,
+		events:     make(map[string]bool),
+		levels:     make(map[string]bool),
+		retries:    defaultRetries,
+		backoff:    initialBackoff,
+		rateLimit:  cfg.RateLimit,
+		ratePeriod: cfg.RatePeriod,
+		queue:      make(chan Message, queueSize),
+	}
+	if cfg.Retries > 0 {
+		c.retries = cfg.Retries
+	}
+	if c.rateLimit > 0 && c.ratePeriod <= 0 {
+		c.ratePeriod = time.Hour
+	}
+
+	events := cfg.Events
+	if len(events) == 0 {
+		events = defaultEvents
+	}
+	for _, event := range events {
+		c.events[event] = true
+	}
+	for _, level := range cfg.Levels {
+		c.levels[level] = true
+	}
+
+	title := cfg.Title
+	if title == "" {
+		title = defaultTitle
+	}
+	if c.title, err = template.New("title").Funcs(templateFuncs).Parse(title); err != nil {
+		return nil, fmt.Errorf("invalid title template: %v", err)
+	}
+	body := cfg.Template
+	if body == "" {
+		body = defaultBody
+	}
+	if c.body, err = template.New("body").Funcs(templateFuncs).Parse(body); err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+	return c, nil
+}
+
+// Create the driver for the type of a channel.
+func newDriver(cfg config.NotificationChannelConfig) (Driver, error) {
+	switch cfg.Type {
+	case "ntfy":
+		return newNtfyDriver(cfg)
+	case "gotify":
+		return newGotifyDriver(cfg)
+	case "smtp":
+		return newSMTPDriver(cfg)
+	case "webhook":
+		return newWebhookDriver(cfg)
+	default:
+		return nil, fmt.Errorf("type must be ntfy, gotify, smtp or webhook, got %q", cfg.Type)
+	}
+}
+
+// Event listener, queueing a message on every channel that accepts the event.
+func (n *Notifier) eventReceived(event controller.Event) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if event.Type == controller.EventState && event.State != n.state {
+		n.state = event.State
+		n.stateSince = event.Time
+	}
+	data := TemplateData{
+		DoorName: n.doorName,
+		Event:    event.Type,
+		State:    event.State,
+		Source:   event.Source,
+		Level:    event.Level,
+		Message:  event.Message,
+		Duration: formatDuration(event.Time.Sub(n.stateSince)),
+		Time:     event.Time,
+	}
+	if data.State == "" {
+		data.State = n.state
+	}
+
+	for _, c := range n.channels {
+		if !c.accepts(event) {
+			continue
+		}
+		message, err := c.render(data)
+		if err != nil {
+			logger.Error().Msgf("failed to render notification for channel %s: %v", c.name, err)
+			continue
+		}
+		if !c.allow(event.Time) {
+			logger.Warn().Msgf("rate limit of notification channel %s exceeded, dropping message", c.name)
+			continue
+		}
+		select {
+		case c.queue <- message:
+		default:
+			logger.Warn().Msgf("queue of notification channel %s is full, dropping message", c.name)
+		}
+	}
+}
+
+// Check if the channel accepts an event, based on its type and level.
+func (c *channel) accepts(event controller.Event) bool {
+	if !c.events[event.Type] {
+		return false
+	}
+	return len(c.levels) == 0 || event.Level == "" || c.levels[event.Level]
+}
+
+// Render the title and body of a message.
+func (c *channel) render(data TemplateData) (Message, error) {
+	var title, body bytes.Buffer
+	if err := c.title.Execute(&title, data); err != nil {
+		return Message{}, err
+	}
+	if err := c.body.Execute(&body, data); err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Title: title.String(),
+		Body:  body.String(),
+		Level: data.Level,
+	}, nil
+}
+
+// Check the rate limit of the channel, and count the message if it is allowed. The caller must hold the lock.
+func (c *channel) allow(now time.Time) bool {
+	if c.rateLimit <= 0 {
+		return true
+	}
+	recent := c.sent[:0]
+	for _, t := range c.sent {
+		if now.Sub(t) < c.ratePeriod {
+			recent = append(recent, t)
+		}
+	}
+	c.sent = recent
+	if len(c.sent) >= c.rateLimit {
+		return false
+	}
+	c.sent = append(c.sent, now)
+	return true
+}
+
+// Deliver the queued messages of a channel, retrying failed deliveries with exponential backoff.
+func (n *Notifier) deliver(c *channel) {
+	defer n.wg.Done()
+
+	for message := range c.queue {
+		n.send(c, message)
+	}
+}
+
+// Send a message through a channel, retrying with exponential backoff until the notifier stops.
+func (n *Notifier) send(c *channel, message Message) {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(n.ctx, sendTimeout)
+		err := c.driver.Send(ctx, message)
+		cancel()
+		if err == nil {
+			logger.Debug().Msgf("notification sent through channel %s", c.name)
+			return
+		}
+		if attempt >= c.retries {
+			logger.Error().Msgf("failed to send notification through channel %s, giving up: %v", c.name, err)
+			return
+		}
+		select {
+		case <-n.stop:
+			logger.Error().Msgf("failed to send notification through channel %s while stopping: %v", c.name, err)
+			return
+		default:
+		}
+		logger.Warn().Msgf("failed to send notification through channel %s, retrying in %s: %v",
+			c.name, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-n.stop:
+			logger.Error().Msgf("failed to send notification through channel %s, stopping: %v", c.name, err)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// Format a duration in minutes, e.g. "10m" or "1h5m", or in seconds when shorter than a minute.
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return d.Truncate(time.Second).String()
+	}
+	return strings.TrimSuffix(d.Truncate(time.Minute).String(), "0s")
+}
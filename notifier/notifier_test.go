@@ -0,0 +1,309 @@
+package notifier
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	os.Setenv("GARAGESERVICE_CONFIG_PATH", "..")
+	dataDir, _ := os.MkdirTemp("", "garagedoor-service-test")
+	os.Setenv("GARAGESERVICE_DATA_DIR", dataDir)
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+}
+
+// Create a notifier for the given channels, and start delivering messages. The notifier is stopped at the end of the
+// test, after all queued messages were delivered.
+func startNotifier(t *testing.T, cfgs ...config.NotificationChannelConfig) *Notifier {
+	n := &Notifier{
+		doorName:   "Garage Door",
+		state:      "closed",
+		stateSince: time.Now(),
+		stop:       make(chan struct{}),
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	for _, cfg := range cfgs {
+		c, err := newChannel(cfg)
+		if err != nil {
+			t.Fatalf("Error creating channel %s: %v", cfg.Name, err)
+		}
+		c.backoff = 10 * time.Millisecond
+		n.channels = append(n.channels, c)
+		n.wg.Add(1)
+		go n.deliver(c)
+	}
+	return n
+}
+
+// Stop the notifier, waiting for all queued messages to be delivered.
+func stopNotifier(n *Notifier) {
+	for _, c := range n.channels {
+		close(c.queue)
+	}
+	n.wg.Wait()
+}
+
+// Records requests received by an HTTP test server.
+type recorder struct {
+	requests []*http.Request
+	bodies   []string
+	failures int
+	lock     sync.Mutex
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, string(body))
+}
+
+func TestNtfy(t *testing.T) {
+	rec := &recorder{failures: 2}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	n := startNotifier(t, config.NotificationChannelConfig{
+		Name:     "phone",
+		Type:     "ntfy",
+		URL:      server.URL + "/garage",
+		Template: "{{.DoorName}} open for {{.Duration}} ({{.Source}})",
+	})
+	n.eventReceived(controller.Event{
+		Type:   controller.EventAlert,
+		Time:   n.stateSince.Add(10 * time.Minute),
+		Source: "alerts",
+		Level:  "warning",
+	})
+	stopNotifier(n)
+
+	if len(rec.requests) != 1 {
+		t.Fatalf("Expected 1 request after retries, got %d", len(rec.requests))
+	}
+	if rec.requests[0].URL.Path != "/garage" || rec.requests[0].Header.Get("Priority") != "high" {
+		t.Fatalf("Expected high priority message on /garage, got %s %v", rec.requests[0].URL.Path, rec.requests[0].Header)
+	}
+	if rec.bodies[0] != "Garage Door open for 10m (alerts)" {
+		t.Fatalf("Unexpected message body: %s", rec.bodies[0])
+	}
+}
+
+func TestGotify(t *testing.T) {
+	rec := &recorder{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	n := startNotifier(t, config.NotificationChannelConfig{
+		Name:  "gotify",
+		Type:  "gotify",
+		URL:   server.URL,
+		Token: "secret",
+	})
+	n.eventReceived(controller.Event{
+		Type:    controller.EventNotification,
+		Time:    time.Now(),
+		Message: "Everyone left",
+	})
+	stopNotifier(n)
+
+	if len(rec.requests) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(rec.requests))
+	}
+	if rec.requests[0].URL.Path != "/message" || rec.requests[0].Header.Get("X-Gotify-Key") != "secret" {
+		t.Fatalf("Expected authenticated request on /message, got %s", rec.requests[0].URL.Path)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(rec.bodies[0]), &body); err != nil {
+		t.Fatalf("Error parsing body: %v", err)
+	}
+	if body["title"] != "Garage Door" || body["message"] != "Everyone left" {
+		t.Fatalf("Unexpected message: %v", body)
+	}
+}
+
+func TestWebhookFiltersAndRateLimit(t *testing.T) {
+	rec := &recorder{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	n := startNotifier(t, config.NotificationChannelConfig{
+		Name:       "hook",
+		Type:       "webhook",
+		URL:        server.URL,
+		Headers:    map[string]string{"x-token": "secret"},
+		Levels:     []string{"critical"},
+		Template:   `{"state": {{json .State}}, "message": {{json .Message}}}`,
+		RateLimit:  2,
+		RatePeriod: time.Hour,
+	})
+	now := time.Now()
+	n.eventReceived(controller.Event{Type: controller.EventAlert, Time: now, Level: "warning", Message: "warning"})
+	n.eventReceived(controller.Event{Type: controller.EventCommand, Time: now, Message: "command"})
+	for i := 0; i < 3; i++ {
+		n.eventReceived(controller.Event{Type: controller.EventAlert, Time: now, Level: "critical", State: "open",
+			Message: "critical " + strconv.Itoa(i)})
+	}
+	stopNotifier(n)
+
+	if len(rec.requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(rec.requests))
+	}
+	if rec.requests[0].Header.Get("Content-Type") != "application/json" || rec.requests[0].Header.Get("X-Token") != "secret" {
+		t.Fatalf("Expected JSON request with custom header, got %v", rec.requests[0].Header)
+	}
+	if rec.bodies[0] != `{"state": "open", "message": "critical 0"}` {
+		t.Fatalf("Unexpected body: %s", rec.bodies[0])
+	}
+}
+
+// Minimal SMTP server, accepting a single message and sending its data on the returned channel.
+func fakeSMTPServer(t *testing.T) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting SMTP server: %v", err)
+	}
+	messages := make(chan string, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		write := func(line string) {
+			conn.Write([]byte(line + "\r\n"))
+		}
+		write("220 localhost ESMTP")
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					messages <- data.String()
+					write("250 OK")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				write("250 localhost")
+			case cmd == "DATA":
+				inData = true
+				write("354 Go ahead")
+			case cmd == "QUIT":
+				write("221 Bye")
+				return
+			default:
+				write("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func TestSMTP(t *testing.T) {
+	address, messages := fakeSMTPServer(t)
+	host, port, _ := net.SplitHostPort(address)
+	portNumber, _ := strconv.Atoi(port)
+
+	n := startNotifier(t, config.NotificationChannelConfig{
+		Name:  "email",
+		Type:  "smtp",
+		Host:  host,
+		Port:  portNumber,
+		From:  "garage@example.com",
+		To:    []string{"family@example.com"},
+		Title: "{{.DoorName}}: {{.Level}}",
+	})
+	n.eventReceived(controller.Event{
+		Type:    controller.EventAlert,
+		Time:    time.Now(),
+		Level:   "critical",
+		Message: "The garage door has been open for 1h",
+	})
+
+	select {
+	case message := <-messages:
+		if !strings.Contains(message, "Subject: Garage Door: critical") {
+			t.Fatalf("Expected subject in message, got %s", message)
+		}
+		if !strings.Contains(message, "The garage door has been open for 1h") {
+			t.Fatalf("Expected body in message, got %s", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for email")
+	}
+	stopNotifier(n)
+}
+
+func TestInvalidChannel(t *testing.T) {
+	invalid := []config.NotificationChannelConfig{
+		{Name: "unknown", Type: "pigeon"},
+		{Name: "no-url", Type: "ntfy"},
+		{Name: "no-token", Type: "gotify", URL: "http://localhost"},
+		{Name: "no-recipients", Type: "smtp", Host: "localhost", From: "a@example.com"},
+		{Name: "bad-template", Type: "webhook", URL: "http://localhost", Template: "{{.Missing"},
+	}
+	for _, cfg := range invalid {
+		if _, err := newChannel(cfg); err == nil {
+			t.Fatalf("Expected channel %s to be invalid", cfg.Name)
+		}
+	}
+}
+
+func TestStopAbandonsRetries(t *testing.T) {
+	rec := &recorder{failures: 100}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	n := startNotifier(t, config.NotificationChannelConfig{
+		Name:    "hook",
+		Type:    "webhook",
+		URL:     server.URL,
+		Retries: 5,
+	})
+	n.channels[0].backoff = time.Hour
+	n.eventReceived(controller.Event{Type: controller.EventAlert, Time: time.Now(), Message: "first"})
+	n.eventReceived(controller.Event{Type: controller.EventAlert, Time: time.Now(), Message: "second"})
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	n.Stop()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected Stop not to wait for the backoff, took %s", elapsed)
+	}
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.failures != 98 {
+		t.Fatalf("Expected both messages to be sent once without retries, got %d attempts", 100-rec.failures)
+	}
+}
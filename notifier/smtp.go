@@ -0,0 +1,78 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+)
+
+// smtpDriver sends messages as plain text email. STARTTLS is used when the server supports it.
+type smtpDriver struct {
+	address  string
+	host     string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+// Create an SMTP driver. The port defaults to 587.
+func newSMTPDriver(cfg config.NotificationChannelConfig) (*smtpDriver, error) {
+	if cfg.Host == "" {
+		return nil, errors.New("smtp requires a host")
+	}
+	if cfg.From == "" || len(cfg.To) == 0 {
+		return nil, errors.New("smtp requires a from address and at least one to address")
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = 587
+	}
+	return &smtpDriver{
+		address:  net.JoinHostPort(cfg.Host, strconv.Itoa(port)),
+		host:     cfg.Host,
+		username: cfg.Username,
+		password: cfg.Password,
+		from:     cfg.From,
+		to:       cfg.To,
+	}, nil
+}
+
+// Send sends the message as an email, using the title as subject.
+func (d *smtpDriver) Send(ctx context.Context, message Message) error {
+	var auth smtp.Auth
+	if d.username != "" {
+		auth = smtp.PlainAuth("", d.username, d.password, d.host)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", d.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(d.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Title))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	// net/smtp doesn't support contexts, so run the delivery in the background and give up when the context is done.
+	result := make(chan error, 1)
+	go func() {
+		result <- smtp.SendMail(d.address, auth, d.from, d.to, []byte(msg.String()))
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,56 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+)
+
+// webhookDriver sends the rendered message body to an arbitrary URL.
+type webhookDriver struct {
+	url     string
+	method  string
+	headers map[string]string
+	client  *http.Client
+}
+
+// Create a webhook driver. The method defaults to POST.
+func newWebhookDriver(cfg config.NotificationChannelConfig) (*webhookDriver, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("webhook requires a url")
+	}
+	method := strings.ToUpper(cfg.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+	return &webhookDriver{
+		url:     cfg.URL,
+		method:  method,
+		headers: cfg.Headers,
+		client: &http.Client{
+			Timeout: httpTimeout,
+		},
+	}, nil
+}
+
+// Send sends the message body. Unless configured otherwise, the content type is JSON for bodies that are valid JSON,
+// and plain text for other bodies.
+func (d *webhookDriver) Send(ctx context.Context, message Message) error {
+	req, err := http.NewRequestWithContext(ctx, d.method, d.url, strings.NewReader(message.Body))
+	if err != nil {
+		return err
+	}
+	if json.Valid([]byte(message.Body)) {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	for name, value := range d.headers {
+		req.Header.Set(name, value)
+	}
+	return doRequest(d.client, req)
+}
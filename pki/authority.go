@@ -0,0 +1,313 @@
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Validity of the certificates. The server certificate stays within the 825 days accepted by Apple devices for
+// certificates of a CA installed by the user. Client certificates are short-lived by default, so a lost device that
+// wasn't revoked doesn't keep access for long.
+const (
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 825 * 24 * time.Hour
+	// ClientValidity is the default validity of client certificates.
+	ClientValidity = 90 * 24 * time.Hour
+	// The server certificate is renewed when it expires within this period.
+	renewBefore = 30 * 24 * time.Hour
+)
+
+// Names of the files in the directory of the authority.
+const (
+	caCertName     = "ca.crt"
+	caKeyName      = "ca.key"
+	serverCertName = "server.crt"
+	serverKeyName  = "server.key"
+	clientsDir     = "clients"
+)
+
+// Errors returned by the authority.
+var (
+	ErrInvalidName = errors.New("pki: names may only contain letters, digits, dots, dashes and underscores")
+	ErrNoCA        = errors.New("pki: the local CA doesn't exist yet")
+)
+
+// Valid names of client certificates, also used as file names.
+var validName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Authority is a local certificate authority, for LAN deployments without a public domain. It keeps its certificate
+// and key, the server certificate and the client certificates it issued as PEM files in a directory. Keys use ECDSA
+// P-256, and are only readable by the owner.
+type Authority struct {
+	dir  string
+	lock sync.Mutex
+}
+
+// NewAuthority creates a new Authority for the given directory. Nothing is created until a certificate is needed.
+func NewAuthority(dir string) *Authority {
+	return &Authority{
+		dir: dir,
+	}
+}
+
+// CAFile returns the path of the CA certificate.
+func (a *Authority) CAFile() string {
+	return filepath.Join(a.dir, caCertName)
+}
+
+// CertFile returns the path of the server certificate.
+func (a *Authority) CertFile() string {
+	return filepath.Join(a.dir, serverCertName)
+}
+
+// KeyFile returns the path of the private key of the server certificate.
+func (a *Authority) KeyFile() string {
+	return filepath.Join(a.dir, serverKeyName)
+}
+
+// Subject returns the subject of the client certificate issued for a name, as used to map it to scopes.
+func Subject(name string) string {
+	return pkix.Name{CommonName: name}.String()
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate in lowercase hex, as used to pin client certificates.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Client returns the current client certificate issued for a name.
+func (a *Authority) Client(name string) (*x509.Certificate, error) {
+	if !validName.MatchString(name) {
+		return nil, ErrInvalidName
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return readCert(filepath.Join(a.dir, clientsDir, name+".crt"))
+}
+
+// EnsureCA creates the CA certificate and key if they don't exist yet.
+func (a *Authority) EnsureCA() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, _, err := a.ca(true)
+	return err
+}
+
+// EnsureServer creates the CA and the server certificate for the given host names and IP addresses if they don't
+// exist yet. An existing server certificate is replaced when it doesn't cover all hosts, or expires within 30 days.
+// Returns true if a server certificate was issued.
+func (a *Authority) EnsureServer(hosts []string, now time.Time) (bool, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	caCert, caKey, err := a.ca(true)
+	if err != nil {
+		return false, err
+	}
+	if cert, err := readCert(a.CertFile()); err == nil && now.Add(renewBefore).Before(cert.NotAfter) &&
+		covers(cert, hosts) && cert.CheckSignatureFrom(caCert) == nil {
+		return false, nil
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "garagedoor-service"},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(serverValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+	if err := a.issue(template, caCert, caKey, a.CertFile(), a.KeyFile()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// IssueClient issues a client certificate for a device, valid for the given duration, and returns the paths of the
+// certificate and its key. The CA is created if it doesn't exist yet. An earlier certificate for the same name is
+// replaced, but stays valid until it expires.
+func (a *Authority) IssueClient(name string, validity time.Duration, now time.Time) (string, string, error) {
+	if !validName.MatchString(name) {
+		return "", "", ErrInvalidName
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	caCert, caKey, err := a.ca(true)
+	if err != nil {
+		return "", "", err
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certFile := filepath.Join(a.dir, clientsDir, name+".crt")
+	keyFile := filepath.Join(a.dir, clientsDir, name+".key")
+	if err := a.issue(template, caCert, caKey, certFile, keyFile); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// ExportCA returns the CA certificate in PEM format, for installation on phones and browsers. Returns ErrNoCA if the
+// CA doesn't exist yet.
+func (a *Authority) ExportCA() ([]byte, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, _, err := a.ca(false); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(a.CAFile())
+}
+
+// Load the CA certificate and key, creating them if they don't exist and create is set. The caller must hold the lock.
+func (a *Authority) ca(create bool) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	cert, certErr := readCert(a.CAFile())
+	key, keyErr := readKey(filepath.Join(a.dir, caKeyName))
+	if certErr == nil && keyErr == nil {
+		return cert, key, nil
+	}
+	if !errors.Is(certErr, os.ErrNotExist) || !errors.Is(keyErr, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("pki: the local CA in %s is incomplete or invalid: %v", a.dir,
+			errors.Join(certErr, keyErr))
+	}
+	if !create {
+		return nil, nil, ErrNoCA
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "garagedoor-service local CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+	}
+	if err := a.issue(template, nil, nil, a.CAFile(), filepath.Join(a.dir, caKeyName)); err != nil {
+		return nil, nil, err
+	}
+	return a.ca(false)
+}
+
+// Generate a key, and sign a certificate for it with the CA, or self-sign it without CA. Both are written as PEM
+// files. The caller must hold the lock.
+func (a *Authority) issue(template *x509.Certificate, caCert *x509.Certificate, caKey *ecdsa.PrivateKey,
+	certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("pki: failed to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return fmt.Errorf("pki: failed to generate serial number: %w", err)
+	}
+	template.SerialNumber = serial
+	if caCert == nil {
+		caCert, caKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("pki: failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("pki: failed to encode key: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0700); err != nil {
+		return fmt.Errorf("pki: failed to create directory: %w", err)
+	}
+	// Write the key first, so a reloading server never combines the new certificate with the old key.
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := writeFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// Write a file atomically, through a temporary file in the same directory.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("pki: failed to write %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("pki: failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("pki: failed to write %s: %w", path, err)
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return fmt.Errorf("pki: failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("pki: failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// Read a certificate from a PEM file.
+func readCert(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate in %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Read an ECDSA private key from a PEM file.
+func readKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no key in %s", path)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// Check if a certificate covers all hosts.
+func covers(cert *x509.Certificate, hosts []string) bool {
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnsureServer(t *testing.T) {
+	a := NewAuthority(filepath.Join(t.TempDir(), "tls"))
+	if _, err := a.ExportCA(); !errors.Is(err, ErrNoCA) {
+		t.Fatalf("Expected ErrNoCA before the CA is created, got %v", err)
+	}
+	now := time.Now()
+	hosts := []string{"garage.local", "192.168.1.20"}
+	if issued, err := a.EnsureServer(hosts, now); err != nil || !issued {
+		t.Fatalf("Expected server certificate to be issued, got %v, %v", issued, err)
+	}
+	if info, err := os.Stat(filepath.Join(a.dir, caKeyName)); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected CA key only readable by the owner, got %v, %v", info, err)
+	}
+
+	// The server certificate is verified by the exported CA, for all hosts.
+	caPEM, err := a.ExportCA()
+	if err != nil {
+		t.Fatalf("Error exporting CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	pair, err := tls.LoadX509KeyPair(a.CertFile(), a.KeyFile())
+	if err != nil {
+		t.Fatalf("Error loading server certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(pair.Certificate[0])
+	for _, host := range hosts {
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Fatalf("Expected server certificate to be valid for %s: %v", host, err)
+		}
+	}
+
+	// The certificate is only issued again when hosts change, or when it expires soon.
+	if issued, _ := a.EnsureServer(hosts, now); issued {
+		t.Fatalf("Expected existing server certificate to be kept")
+	}
+	if issued, _ := a.EnsureServer(append(hosts, "garage.example.org"), now); !issued {
+		t.Fatalf("Expected server certificate to be issued for a new host")
+	}
+	if issued, _ := a.EnsureServer(hosts, now.Add(serverValidity-24*time.Hour)); !issued {
+		t.Fatalf("Expected server certificate to be renewed before it expires")
+	}
+	again, _ := a.ExportCA()
+	if string(again) != string(caPEM) {
+		t.Fatalf("Expected the CA to be kept")
+	}
+}
+
+func TestIssueClient(t *testing.T) {
+	a := NewAuthority(t.TempDir())
+	if _, _, err := a.IssueClient("../escape", ClientValidity, time.Now()); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("Expected ErrInvalidName, got %v", err)
+	}
+	certFile, keyFile, err := a.IssueClient("alice-phone", ClientValidity, time.Now())
+	if err != nil {
+		t.Fatalf("Error issuing client certificate: %v", err)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Error loading client certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(pair.Certificate[0])
+	if cert.Subject.String() != Subject("alice-phone") || Subject("alice-phone") != "CN=alice-phone" {
+		t.Fatalf("Unexpected subject %s", cert.Subject)
+	}
+	current, err := a.Client("alice-phone")
+	if err != nil || Fingerprint(current) != Fingerprint(cert) || len(Fingerprint(cert)) != 64 {
+		t.Fatalf("Expected the issued certificate with a SHA-256 fingerprint, got %v", err)
+	}
+
+	caPEM, _ := a.ExportCA()
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Fatalf("Expected client certificate to be verified by the CA: %v", err)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots}); err == nil {
+		t.Fatalf("Expected client certificate not to be valid for servers")
+	}
+}
+
+func TestIncompleteCA(t *testing.T) {
+	a := NewAuthority(t.TempDir())
+	if err := a.EnsureCA(); err != nil {
+		t.Fatalf("Error creating CA: %v", err)
+	}
+	os.Remove(filepath.Join(a.dir, caKeyName))
+	if err := a.EnsureCA(); err == nil || errors.Is(err, ErrNoCA) {
+		t.Fatalf("Expected an error for a CA without key, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package pki
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/storage"
+)
+
+// Name of the document holding the revoked client certificates.
+const revocationsDocument = "revoked_certs"
+
+// ErrInvalidSerial is returned when a serial number isn't a hexadecimal number.
+var ErrInvalidSerial = errors.New("pki: serial numbers must be hexadecimal")
+
+// Revocation records a revoked client certificate.
+type Revocation struct {
+	Serial  string    `json:"serial"`
+	Name    string    `json:"name,omitempty"`
+	Revoked time.Time `json:"revoked"`
+}
+
+// The persisted revocations.
+type storedRevocations struct {
+	Certs []Revocation `json:"certs"`
+}
+
+// Serial returns the serial number of a certificate in lowercase hex, as used to revoke it.
+func Serial(serial *big.Int) string {
+	return serial.Text(16)
+}
+
+// ParseSerial normalizes a serial number in hex, as printed by the certs subcommand or openssl, with or without colons.
+func ParseSerial(serial string) (string, error) {
+	n, ok := new(big.Int).SetString(strings.ReplaceAll(serial, ":", ""), 16)
+	if !ok || n.Sign() <= 0 {
+		return "", ErrInvalidSerial
+	}
+	return Serial(n), nil
+}
+
+// Revoke records the client certificate with the given serial number as revoked in the store. Revoking a
+// certificate twice isn't an error.
+func Revoke(store *storage.Store, revocation Revocation) error {
+	var stored storedRevocations
+	return store.Update(revocationsDocument, &stored, func() error {
+		for _, revoked := range stored.Certs {
+			if revoked.Serial == revocation.Serial {
+				return nil
+			}
+		}
+		stored.Certs = append(stored.Certs, revocation)
+		return nil
+	})
+}
+
+// Revocations returns the revoked client certificates in the store, indexed by serial number.
+func Revocations(store *storage.Store) (map[string]Revocation, error) {
+	var stored storedRevocations
+	if err := store.Load(revocationsDocument, &stored); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	revocations := make(map[string]Revocation)
+	for _, revocation := range stored.Certs {
+		revocations[revocation.Serial] = revocation
+	}
+	return revocations, nil
+}
+
+// RevocationsModTime returns when the revoked client certificates in the store were last changed, or the zero time
+// when none were revoked.
+func RevocationsModTime(store *storage.Store) (time.Time, error) {
+	modTime, err := store.ModTime(revocationsDocument)
+	if errors.Is(err, storage.ErrNotFound) {
+		return time.Time{}, nil
+	}
+	return modTime, err
+}
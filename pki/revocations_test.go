@@ -0,0 +1,45 @@
+package pki
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/storage"
+)
+
+func TestParseSerial(t *testing.T) {
+	if serial, err := ParseSerial("0A:BC:01"); err != nil || serial != Serial(big.NewInt(0x0abc01)) {
+		t.Fatalf("Expected the serial in lowercase hex without colons, got %s, %v", serial, err)
+	}
+	for _, serial := range []string{"", "0", "xyz", "-1"} {
+		if _, err := ParseSerial(serial); !errors.Is(err, ErrInvalidSerial) {
+			t.Fatalf("Expected ErrInvalidSerial for %q, got %v", serial, err)
+		}
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	store := storage.NewStore(t.TempDir())
+	if revocations, err := Revocations(store); err != nil || len(revocations) != 0 {
+		t.Fatalf("Expected no revocations, got %v, %v", revocations, err)
+	}
+	if modTime, err := RevocationsModTime(store); err != nil || !modTime.IsZero() {
+		t.Fatalf("Expected no modification time without revocations, got %v, %v", modTime, err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := Revoke(store, Revocation{Serial: "abc1", Name: "alice-phone", Revoked: now}); err != nil {
+			t.Fatalf("Error revoking certificate: %v", err)
+		}
+	}
+	revocations, err := Revocations(store)
+	if err != nil || len(revocations) != 1 || revocations["abc1"].Name != "alice-phone" {
+		t.Fatalf("Expected one revoked certificate, got %v, %v", revocations, err)
+	}
+	if modTime, err := RevocationsModTime(store); err != nil || modTime.IsZero() {
+		t.Fatalf("Expected the modification time of the revocations, got %v, %v", modTime, err)
+	}
+}
@@ -0,0 +1,433 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/dlefevre/go.garagedoor-service/logging"
+	"github.com/dlefevre/go.garagedoor-service/mqtt"
+	"github.com/google/uuid"
+)
+
+// Logger of the rules component.
+var logger = logging.Logger("rules")
+
+// Interval at which rules are evaluated, in addition to evaluations triggered by state changes and MQTT messages.
+const evaluationInterval = time.Second
+
+var (
+	instance *RulesEngine
+	once     sync.Once
+)
+
+// RuleStatus describes a rule and the last time it fired.
+type RuleStatus struct {
+	Name       string     `json:"name"`
+	Action     string     `json:"action"`
+	Holds      bool       `json:"holds"`
+	LastFired  *time.Time `json:"last_fired,omitempty"`
+	LastResult string     `json:"last_result,omitempty"`
+}
+
+// A compiled condition.
+type condition struct {
+	state    string
+	duration time.Duration
+	topic    string
+	field    []string
+	op       string
+	value    string
+}
+
+// A compiled rule, with its evaluation state.
+type rule struct {
+	config     config.RuleConfig
+	conditions []condition
+	holds      bool
+	lastFired  time.Time
+	lastResult string
+}
+
+// RulesEngine evaluates rules over the door state, how long the door has been in that state, and the values received
+// on MQTT topics. Actions run on the rising edge, i.e. once each time all conditions of a rule start to hold.
+type RulesEngine struct {
+	rules      []*rule
+	values     map[string]string
+	state      string
+	stateSince time.Time
+	listenerID uuid.UUID
+	trigger    chan struct{}
+	stop       chan struct{}
+	wg         sync.WaitGroup
+	lock       sync.Mutex
+
+	// Hooks for the MQTT connection, replaced in tests.
+	subscribe func(filter string, handler func(topic string, payload []byte)) error
+	publish   func(topic string, payload []byte, retain bool) error
+}
+
+// GetRulesEngine returns the one and only RulesEngine instance.
+func GetRulesEngine() *RulesEngine {
+	once.Do(func() {
+		instance = newRulesEngine()
+	})
+	return instance
+}
+
+// Creates a new RulesEngine object.
+func newRulesEngine() *RulesEngine {
+	engine := &RulesEngine{
+		values: make(map[string]string),
+	}
+	if config.GetMQTTEnabled() {
+		engine.subscribe = mqtt.GetMQTTService().Subscribe
+		engine.publish = mqtt.GetMQTTService().Publish
+	}
+	return engine
+}
+
+// Start compiles the rules from the configuration file, subscribes to the MQTT topics they use, and starts
+// evaluating them.
+func (e *RulesEngine) Start() error {
+	rules := make([]*rule, 0)
+	topics := make(map[string]bool)
+	for _, cfg := range config.GetRules() {
+		r, err := compile(cfg)
+		if err != nil {
+			return fmt.Errorf("rules: invalid rule %s: %v", cfg.Name, err)
+		}
+		for _, c := range r.conditions {
+			if c.topic != "" {
+				topics[c.topic] = true
+			}
+		}
+		if (len(topics) > 0 || cfg.Action == "publish") && e.subscribe == nil {
+			return fmt.Errorf("rules: rule %s requires MQTT, which is disabled", cfg.Name)
+		}
+		rules = append(rules, r)
+	}
+
+	dc := controller.GetDoorControllerService()
+	e.lock.Lock()
+	e.rules = rules
+	e.state = dc.GetStateStr()
+	e.stateSince = time.Now()
+	e.lock.Unlock()
+
+	for topic := range topics {
+		if err := e.subscribe(topic, e.valueReceived); err != nil {
+			return err
+		}
+	}
+
+	e.listenerID = dc.AddStateListener(func(event controller.StateEvent) {
+		e.stateChanged(event.State)
+	})
+	e.trigger = make(chan struct{}, 1)
+	e.stop = make(chan struct{})
+	e.wg.Add(1)
+	go e.loop()
+
+	logger.Info().Msgf("rules engine started with %d rules", len(rules))
+	return nil
+}
+
+// Stop stops evaluating rules.
+func (e *RulesEngine) Stop() {
+	if e.stop == nil {
+		return
+	}
+	controller.GetDoorControllerService().RemoveStateListener(e.listenerID)
+	close(e.stop)
+	e.wg.Wait()
+	e.stop = nil
+	logger.Info().Msg("rules engine stopped")
+}
+
+// List returns the status of all rules, ordered by name.
+func (e *RulesEngine) List() []RuleStatus {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	result := make([]RuleStatus, 0, len(e.rules))
+	for _, r := range e.rules {
+		status := RuleStatus{
+			Name:       r.config.Name,
+			Action:     r.config.Action,
+			Holds:      r.holds,
+			LastResult: r.lastResult,
+		}
+		if !r.lastFired.IsZero() {
+			lastFired := r.lastFired
+			status.LastFired = &lastFired
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Compile a rule from the configuration, validating it along the way.
+func compile(cfg config.RuleConfig) (*rule, error) {
+	if len(cfg.Conditions) == 0 {
+		return nil, errors.New("at least one condition is required")
+	}
+	switch cfg.Action {
+	case "open", "close":
+	case "notify":
+		if cfg.Message == "" {
+			return nil, errors.New("notify requires a message")
+		}
+	case "publish":
+		if cfg.Topic == "" {
+			return nil, errors.New("publish requires a topic")
+		}
+		if strings.ContainsAny(cfg.Topic, "+#") {
+			return nil, fmt.Errorf("publish topic can't contain wildcards, got %q", cfg.Topic)
+		}
+	default:
+		return nil, fmt.Errorf("action must be open, close, notify or publish, got %q", cfg.Action)
+	}
+
+	r := &rule{
+		config: cfg,
+	}
+	for _, c := range cfg.Conditions {
+		compiled := condition{
+			state:    c.State,
+			duration: c.For,
+			topic:    c.Topic,
+			op:       c.Op,
+			value:    c.Value,
+		}
+		if compiled.op == "" {
+			compiled.op = "=="
+		}
+		if c.Field != "" {
+			compiled.field = strings.Split(c.Field, ".")
+		}
+		switch {
+		case c.State != "" && c.Topic == "":
+			if c.State != "open" && c.State != "closed" && c.State != "unknown" {
+				return nil, fmt.Errorf("state must be open, closed or unknown, got %q", c.State)
+			}
+		case c.Topic != "" && c.State == "":
+			if c.For != 0 {
+				return nil, errors.New("for can only be used with state conditions")
+			}
+			// A condition holds on the last value of one topic, so it can't be a filter matching several.
+			if strings.ContainsAny(c.Topic, "+#") {
+				return nil, fmt.Errorf("condition topic can't contain wildcards, got %q", c.Topic)
+			}
+			switch compiled.op {
+			case "==", "!=", "<", "<=", ">", ">=":
+			default:
+				return nil, fmt.Errorf("unknown operator %q", c.Op)
+			}
+		default:
+			return nil, errors.New("a condition must have either a state or a topic")
+		}
+		r.conditions = append(r.conditions, compiled)
+	}
+	return r, nil
+}
+
+// Main loop for evaluating rules.
+func (e *RulesEngine) loop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(evaluationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		case <-e.trigger:
+		}
+		e.evaluate(time.Now())
+	}
+}
+
+// Request an evaluation of the rules, without blocking.
+func (e *RulesEngine) requestEvaluation() {
+	select {
+	case e.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// State listener, keeping track of the door state and since when the door is in that state.
+func (e *RulesEngine) stateChanged(state string) {
+	e.lock.Lock()
+	changed := e.state != state
+	if changed {
+		e.state = state
+		e.stateSince = time.Now()
+	}
+	e.lock.Unlock()
+
+	if changed {
+		e.requestEvaluation()
+	}
+}
+
+// Handler for messages on subscribed MQTT topics.
+func (e *RulesEngine) valueReceived(topic string, payload []byte) {
+	e.lock.Lock()
+	e.values[topic] = string(payload)
+	e.lock.Unlock()
+	e.requestEvaluation()
+}
+
+// Evaluate all rules, and run the actions of those that started to hold.
+func (e *RulesEngine) evaluate(now time.Time) {
+	e.lock.Lock()
+	fired := make([]*rule, 0)
+	for _, r := range e.rules {
+		holds := true
+		for _, c := range r.conditions {
+			if !e.holds(c, now) {
+				holds = false
+				break
+			}
+		}
+		if holds && !r.holds {
+			fired = append(fired, r)
+		}
+		r.holds = holds
+	}
+	state := e.state
+	e.lock.Unlock()
+
+	for _, r := range fired {
+		result := "ok"
+		if err := e.run(r.config, state); err != nil {
+			logger.Warn().Msgf("rule %s failed to %s: %v", r.config.Name, r.config.Action, err)
+			result = err.Error()
+		} else {
+			logger.Info().Msgf("rule %s ran %s", r.config.Name, r.config.Action)
+		}
+		e.lock.Lock()
+		r.lastFired = now
+		r.lastResult = result
+		e.lock.Unlock()
+	}
+}
+
+// Check if a condition holds. The caller must hold the lock.
+func (e *RulesEngine) holds(c condition, now time.Time) bool {
+	if c.state != "" {
+		return e.state == c.state && now.Sub(e.stateSince) >= c.duration
+	}
+
+	value, found := e.values[c.topic]
+	if !found {
+		return false
+	}
+	if c.field != nil {
+		var ok bool
+		if value, ok = extractField(value, c.field); !ok {
+			return false
+		}
+	}
+	return compare(value, c.op, c.value)
+}
+
+// Run the action of a rule.
+func (e *RulesEngine) run(cfg config.RuleConfig, state string) error {
+	source := "rule:" + cfg.Name
+	dc := controller.GetDoorControllerService()
+	switch cfg.Action {
+	case "open":
+		return dc.RequestOpen(context.Background(), source)
+	case "close":
+		return dc.RequestClose(context.Background(), source)
+	case "notify":
+		dc.RecordEvent(controller.Event{
+			Type:    controller.EventNotification,
+			Source:  source,
+			State:   state,
+			Message: cfg.Message,
+		})
+		return nil
+	case "publish":
+		return e.publish(cfg.Topic, []byte(cfg.Payload), false)
+	default:
+		return fmt.Errorf("unknown action %s", cfg.Action)
+	}
+}
+
+// Extract a field from a JSON payload, following a path of object keys.
+func extractField(payload string, path []string) (string, bool) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(payload), &value); err != nil {
+		return "", false
+	}
+	for _, key := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = object[key]; !ok {
+			return "", false
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case nil:
+		return "null", true
+	default:
+		return "", false
+	}
+}
+
+// Compare a received value with the expected value. Values that both parse as numbers are compared numerically,
+// other values only support equality.
+func compare(actual string, op string, expected string) bool {
+	actual = strings.TrimSpace(actual)
+	a, errA := strconv.ParseFloat(actual, 64)
+	b, errB := strconv.ParseFloat(expected, 64)
+	if errA == nil && errB == nil {
+		switch op {
+		case "==":
+			return a == b
+		case "!=":
+			return a != b
+		case "<":
+			return a < b
+		case "<=":
+			return a <= b
+		case ">":
+			return a > b
+		case ">=":
+			return a >= b
+		}
+		return false
+	}
+
+	switch op {
+	case "==":
+		return actual == expected
+	case "!=":
+		return actual != expected
+	default:
+		return false
+	}
+}
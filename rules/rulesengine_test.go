@@ -0,0 +1,151 @@
+package rules
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	os.Setenv("GARAGESERVICE_CONFIG_PATH", "..")
+	dataDir, _ := os.MkdirTemp("", "garagedoor-service-test")
+	os.Setenv("GARAGESERVICE_DATA_DIR", dataDir)
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+}
+
+func TestCompile(t *testing.T) {
+	invalid := []config.RuleConfig{
+		{Name: "no-conditions", Action: "close"},
+		{Name: "bad-action", Action: "explode", Conditions: []config.ConditionConfig{{State: "open"}}},
+		{Name: "bad-state", Action: "close", Conditions: []config.ConditionConfig{{State: "ajar"}}},
+		{Name: "bad-op", Action: "close", Conditions: []config.ConditionConfig{{Topic: "t", Op: "~"}}},
+		{Name: "both", Action: "close", Conditions: []config.ConditionConfig{{State: "open", Topic: "t"}}},
+		{Name: "no-message", Action: "notify", Conditions: []config.ConditionConfig{{State: "open"}}},
+		{Name: "no-topic", Action: "publish", Conditions: []config.ConditionConfig{{State: "open"}}},
+		{Name: "wildcard", Action: "close", Conditions: []config.ConditionConfig{{Topic: "sensors/+/temperature"}}},
+		{Name: "wildcard-publish", Action: "publish", Topic: "alerts/#", Conditions: []config.ConditionConfig{{State: "open"}}},
+	}
+	for _, cfg := range invalid {
+		if _, err := compile(cfg); err == nil {
+			t.Fatalf("Expected rule %s to be invalid", cfg.Name)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	cases := []struct {
+		actual   string
+		op       string
+		expected string
+		result   bool
+	}{
+		{"-1.5", "<", "0", true},
+		{"3", "<", "0", false},
+		{"0", ">=", "0", true},
+		{"10", "!=", "10.0", false},
+		{"away", "==", "away", true},
+		{"home", "==", "away", false},
+		{"home", "<", "away", false},
+	}
+	for _, c := range cases {
+		if compare(c.actual, c.op, c.expected) != c.result {
+			t.Fatalf("Expected %s %s %s to be %v", c.actual, c.op, c.expected, c.result)
+		}
+	}
+}
+
+func TestExtractField(t *testing.T) {
+	payload := `{"occupancy": false, "climate": {"temperature": -2.5}}`
+	if value, ok := extractField(payload, []string{"occupancy"}); !ok || value != "false" {
+		t.Fatalf("Expected occupancy to be false, got %s", value)
+	}
+	if value, ok := extractField(payload, []string{"climate", "temperature"}); !ok || value != "-2.5" {
+		t.Fatalf("Expected temperature to be -2.5, got %s", value)
+	}
+	if _, ok := extractField(payload, []string{"missing"}); ok {
+		t.Fatalf("Expected missing field not to be found")
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	published := make([]string, 0)
+	r, err := compile(config.RuleConfig{
+		Name: "warn-when-freezing",
+		Conditions: []config.ConditionConfig{
+			{State: "open", For: 10 * time.Minute},
+			{Topic: "sensors/outdoor", Field: "temperature", Op: "<", Value: "0"},
+		},
+		Action:  "publish",
+		Topic:   "alerts/garage",
+		Payload: "freezing",
+	})
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+	now := time.Now()
+	e := &RulesEngine{
+		rules:      []*rule{r},
+		values:     make(map[string]string),
+		state:      "open",
+		stateSince: now,
+		publish: func(topic string, payload []byte, retain bool) error {
+			published = append(published, string(payload))
+			return nil
+		},
+	}
+
+	e.valueReceived("sensors/outdoor", []byte(`{"temperature": -3}`))
+	e.evaluate(now.Add(5 * time.Minute))
+	if len(published) != 0 {
+		t.Fatalf("Expected rule not to fire before the door is open for 10 minutes")
+	}
+	e.evaluate(now.Add(11 * time.Minute))
+	e.evaluate(now.Add(12 * time.Minute))
+	if len(published) != 1 {
+		t.Fatalf("Expected rule to fire once, fired %d times", len(published))
+	}
+
+	e.valueReceived("sensors/outdoor", []byte(`{"temperature": 2}`))
+	e.evaluate(now.Add(13 * time.Minute))
+	e.valueReceived("sensors/outdoor", []byte(`{"temperature": -1}`))
+	e.evaluate(now.Add(14 * time.Minute))
+	if len(published) != 2 {
+		t.Fatalf("Expected rule to fire again after being re-armed, fired %d times", len(published))
+	}
+	if status := e.List(); len(status) != 1 || status[0].LastFired == nil || status[0].LastResult != "ok" {
+		t.Fatalf("Expected rule status to report the last run, got %+v", status)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	r, err := compile(config.RuleConfig{
+		Name:       "notify-open",
+		Conditions: []config.ConditionConfig{{State: "open"}},
+		Action:     "notify",
+		Message:    "The door is open",
+	})
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+	e := &RulesEngine{
+		rules:      []*rule{r},
+		values:     make(map[string]string),
+		state:      "open",
+		stateSince: time.Now(),
+	}
+
+	dc := controller.GetDoorControllerService()
+	e.evaluate(time.Now())
+	events := dc.GetEvents(0)
+	if len(events) == 0 {
+		t.Fatalf("Expected a notification event")
+	}
+	last := events[len(events)-1]
+	if last.Type != controller.EventNotification || last.Source != "rule:notify-open" || last.Message != "The door is open" {
+		t.Fatalf("Expected notification event from the rule, got %+v", last)
+	}
+}
@@ -0,0 +1,335 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maximum time to look ahead when searching for the next run of an expression.
+const maxLookahead = 366 * 24 * time.Hour
+
+// Names that can be used in the month and day-of-week fields.
+var (
+	monthNames = map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}
+	dayNames = map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}
+)
+
+// expression is a parsed schedule expression, which determines when a scheduled action runs.
+type expression interface {
+	// next returns the first time after the given time the expression matches, in the given location.
+	// Returns false if no such time exists within a year.
+	next(after time.Time, loc *time.Location) (time.Time, bool)
+}
+
+// bitset holds the allowed values of a cron field.
+type bitset uint64
+
+// Check if the given value is in the set.
+func (b bitset) has(value int) bool {
+	return b&(1<<uint(value)) != 0
+}
+
+// cronExpression is a standard five-field cron expression: minute, hour, day of month, month and day of week.
+type cronExpression struct {
+	minutes  bitset
+	hours    bitset
+	days     bitset
+	months   bitset
+	weekdays bitset
+	// Standard cron semantics: when both day of month and day of week are restricted, either may match.
+	daysRestricted     bool
+	weekdaysRestricted bool
+}
+
+// Parse a five-field cron expression. Fields support "*", lists ("1,2"), ranges ("1-5"), steps ("*/15", "0-30/10")
+// and names for months ("jan") and days of the week ("mon"). Both 0 and 7 denote Sunday.
+func parseCron(expr string) (*cronExpression, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression must have 5 fields, got %d", len(fields))
+	}
+
+	c := &cronExpression{}
+	var err error
+	if c.minutes, err = parseField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute field: %w", err)
+	}
+	if c.hours, err = parseField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour field: %w", err)
+	}
+	if c.days, err = parseField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month field: %w", err)
+	}
+	if c.months, err = parseField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("month field: %w", err)
+	}
+	if c.weekdays, err = parseWeekdays(fields[4]); err != nil {
+		return nil, fmt.Errorf("day of week field: %w", err)
+	}
+	c.daysRestricted = fields[2] != "*"
+	c.weekdaysRestricted = fields[4] != "*"
+	return c, nil
+}
+
+// Parse a day-of-week field, mapping 7 to Sunday.
+func parseWeekdays(field string) (bitset, error) {
+	set, err := parseField(field, 0, 7, dayNames)
+	if err != nil {
+		return 0, err
+	}
+	if set.has(7) {
+		set = (set | 1) &^ (1 << 7)
+	}
+	return set, nil
+}
+
+// Parse a single cron field into a bitset of allowed values.
+func parseField(field string, min int, max int, names map[string]int) (bitset, error) {
+	var set bitset
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = parseValue(bounds[0], names); err != nil {
+				return 0, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = parseValue(bounds[1], names); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("value out of range in %q", part)
+		}
+
+		for value := low; value <= high; value += step {
+			set |= 1 << uint(value)
+		}
+	}
+	return set, nil
+}
+
+// Parse a numeric or named value of a cron field.
+func parseValue(value string, names map[string]int) (int, error) {
+	if n, found := names[strings.ToLower(value)]; found {
+		return n, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	return n, nil
+}
+
+// Check if the expression matches the given day.
+func (c *cronExpression) matchesDay(t time.Time) bool {
+	if !c.months.has(int(t.Month())) {
+		return false
+	}
+	dayMatch := c.days.has(t.Day())
+	weekdayMatch := c.weekdays.has(int(t.Weekday()))
+	if c.daysRestricted && c.weekdaysRestricted {
+		return dayMatch || weekdayMatch
+	}
+	return dayMatch && weekdayMatch
+}
+
+// next returns the first minute after the given time that matches the expression.
+func (c *cronExpression) next(after time.Time, loc *time.Location) (time.Time, bool) {
+	t := after.In(loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxLookahead)
+	for t.Before(limit) {
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.hours.has(t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if !c.minutes.has(t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// solarExpression runs at sunrise or sunset, with an optional offset, on the allowed days of the week.
+type solarExpression struct {
+	sunrise   bool
+	offset    time.Duration
+	weekdays  bitset
+	latitude  float64
+	longitude float64
+}
+
+// Parse a solar expression such as "@sunset", "@sunrise-15m" or "@sunset+30m mon-fri".
+func parseSolar(expr string, latitude float64, longitude float64) (*solarExpression, error) {
+	fields := strings.Fields(expr)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid solar expression %q", expr)
+	}
+
+	s := &solarExpression{
+		latitude:  latitude,
+		longitude: longitude,
+	}
+	event := fields[0]
+	switch {
+	case strings.HasPrefix(event, "@sunrise"):
+		s.sunrise = true
+		event = strings.TrimPrefix(event, "@sunrise")
+	case strings.HasPrefix(event, "@sunset"):
+		event = strings.TrimPrefix(event, "@sunset")
+	default:
+		return nil, fmt.Errorf("solar expression must start with @sunrise or @sunset, got %q", expr)
+	}
+	if event != "" {
+		offset, err := time.ParseDuration(event)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset in %q", expr)
+		}
+		s.offset = offset
+	}
+
+	s.weekdays = 0x7f
+	if len(fields) == 2 {
+		var err error
+		if s.weekdays, err = parseWeekdays(fields[1]); err != nil {
+			return nil, fmt.Errorf("day of week field: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// next returns the first sunrise or sunset, including the offset, after the given time.
+func (s *solarExpression) next(after time.Time, loc *time.Location) (time.Time, bool) {
+	local := after.In(loc)
+	// Start a day early, as a negative offset or the time zone can move the event to the previous day.
+	for day := -1; day <= 366; day++ {
+		date := time.Date(local.Year(), local.Month(), local.Day()+day, 12, 0, 0, 0, loc)
+		if !s.weekdays.has(int(date.Weekday())) {
+			continue
+		}
+		event, ok := sunEvent(date, s.latitude, s.longitude, s.sunrise)
+		if !ok {
+			continue
+		}
+		t := event.Add(s.offset).In(loc).Truncate(time.Minute)
+		if t.After(after) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseExpression parses either a cron expression or a solar expression, depending on its form.
+func parseExpression(expr string, latitude float64, longitude float64) (expression, error) {
+	if strings.HasPrefix(strings.TrimSpace(expr), "@") {
+		return parseSolar(expr, latitude, longitude)
+	}
+	return parseCron(expr)
+}
+
+// timeWindow is a daily window during which commands can be denied, e.g. "01:00-05:00". Windows that end before
+// they start wrap around midnight, and belong to the day on which they start.
+type timeWindow struct {
+	from     time.Duration
+	to       time.Duration
+	weekdays bitset
+}
+
+// Parse a time window of the form "HH:MM-HH:MM", restricted to the given day-of-week field ("" or "*" for all days).
+func parseWindow(window string, days string) (*timeWindow, error) {
+	bounds := strings.SplitN(window, "-", 2)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("window must be of the form HH:MM-HH:MM, got %q", window)
+	}
+	w := &timeWindow{}
+	var err error
+	if w.from, err = parseTimeOfDay(bounds[0]); err != nil {
+		return nil, err
+	}
+	if w.to, err = parseTimeOfDay(bounds[1]); err != nil {
+		return nil, err
+	}
+	if w.from == w.to {
+		return nil, fmt.Errorf("window %q is empty", window)
+	}
+	if days == "" {
+		days = "*"
+	}
+	if w.weekdays, err = parseWeekdays(days); err != nil {
+		return nil, fmt.Errorf("days: %w", err)
+	}
+	return w, nil
+}
+
+// Window is a daily time window, such as "07:00-22:00", for use outside the scheduler, e.g. to restrict API keys.
+type Window struct {
+	window *timeWindow
+	loc    *time.Location
+}
+
+// ParseWindow parses a time window of the form "HH:MM-HH:MM", in the given location.
+func ParseWindow(window string, loc *time.Location) (*Window, error) {
+	w, err := parseWindow(window, "")
+	if err != nil {
+		return nil, err
+	}
+	return &Window{window: w, loc: loc}, nil
+}
+
+// Active returns whether the window is active at the given time.
+func (w *Window) Active(t time.Time) bool {
+	return w.window.active(t, w.loc)
+}
+
+// Parse a time of day of the form "HH:MM".
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Check if the window is active at the given time, in the given location.
+func (w *timeWindow) active(t time.Time, loc *time.Location) bool {
+	local := t.In(loc)
+	tod := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute +
+		time.Duration(local.Second())*time.Second
+	if w.from < w.to {
+		return tod >= w.from && tod < w.to && w.weekdays.has(int(local.Weekday()))
+	}
+	if tod >= w.from {
+		return w.weekdays.has(int(local.Weekday()))
+	}
+	if tod < w.to {
+		return w.weekdays.has(int(local.AddDate(0, 0, -1).Weekday()))
+	}
+	return false
+}
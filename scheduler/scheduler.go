@@ -0,0 +1,417 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/dlefevre/go.garagedoor-service/logging"
+	"github.com/dlefevre/go.garagedoor-service/storage"
+	"github.com/google/uuid"
+)
+
+// Logger of the scheduler component.
+var logger = logging.Logger("scheduler")
+
+// Source reported to the DoorControllerService for scheduled commands.
+const source = "schedule"
+
+// Name of the document runtime schedules are persisted in.
+const schedulesDocument = "schedules"
+
+// Enumeration of schedule origins.
+const (
+	OriginConfig  = "config"  // OriginConfig identifies schedules defined in the configuration file
+	OriginRuntime = "runtime" // OriginRuntime identifies schedules added through the API
+)
+
+// Errors returned when managing schedules.
+var (
+	ErrInvalidSchedule = errors.New("scheduler: invalid schedule")
+	ErrExists          = errors.New("scheduler: a schedule with this name already exists")
+	ErrNotFound        = errors.New("scheduler: schedule not found")
+	ErrReadOnly        = errors.New("scheduler: schedule is defined in the configuration file")
+)
+
+var (
+	instance *Scheduler
+	once     sync.Once
+)
+
+// Schedule is either a scheduled action, which runs a command (open, close, toggle) when its cron or solar expression
+// matches, or a time window, which denies commands (open, close, toggle) while it is active.
+type Schedule struct {
+	Name     string   `json:"name"`
+	Cron     string   `json:"cron,omitempty"`
+	Action   string   `json:"action,omitempty"`
+	Window   string   `json:"window,omitempty"`
+	Days     string   `json:"days,omitempty"`
+	Deny     []string `json:"deny,omitempty"`
+	Timezone string   `json:"timezone,omitempty"`
+}
+
+// ScheduleStatus describes a schedule together with its origin and run information.
+type ScheduleStatus struct {
+	Schedule
+	Origin     string     `json:"origin"`
+	NextRun    *time.Time `json:"next_run,omitempty"`
+	LastRun    *time.Time `json:"last_run,omitempty"`
+	LastResult string     `json:"last_result,omitempty"`
+	Active     bool       `json:"active,omitempty"`
+}
+
+// A compiled schedule, with its run information.
+type entry struct {
+	schedule   Schedule
+	origin     string
+	loc        *time.Location
+	expression expression
+	window     *timeWindow
+	nextRun    time.Time
+	lastRun    time.Time
+	lastResult string
+}
+
+// Scheduler runs scheduled actions through the DoorControllerService, and denies commands during time windows.
+type Scheduler struct {
+	entries   map[string]*entry
+	location  *time.Location
+	latitude  float64
+	longitude float64
+	store     *storage.Store
+	guardID   uuid.UUID
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	lock      sync.Mutex
+}
+
+// GetScheduler returns the one and only Scheduler instance.
+func GetScheduler() *Scheduler {
+	once.Do(func() {
+		instance = newScheduler(storage.GetStore())
+	})
+	return instance
+}
+
+// Creates a new Scheduler object.
+func newScheduler(store *storage.Store) *Scheduler {
+	location, err := time.LoadLocation(config.GetSchedulerTimezone())
+	if err != nil {
+		logger.Error().Msgf("invalid scheduler time zone, using local time: %v", err)
+		location = time.Local
+	}
+	return &Scheduler{
+		entries:   make(map[string]*entry),
+		location:  location,
+		latitude:  config.GetSchedulerLatitude(),
+		longitude: config.GetSchedulerLongitude(),
+		store:     store,
+	}
+}
+
+// Start loads the schedules from the configuration file and the store, and starts running them.
+func (s *Scheduler) Start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.entries = make(map[string]*entry)
+	for _, cfg := range config.GetSchedules() {
+		schedule := Schedule{
+			Name:     cfg.Name,
+			Cron:     cfg.Cron,
+			Action:   cfg.Action,
+			Window:   cfg.Window,
+			Days:     cfg.Days,
+			Deny:     cfg.Deny,
+			Timezone: cfg.Timezone,
+		}
+		if err := s.addEntry(schedule, OriginConfig); err != nil {
+			return err
+		}
+	}
+
+	var stored []Schedule
+	if err := s.store.Load(schedulesDocument, &stored); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	for _, schedule := range stored {
+		if err := s.addEntry(schedule, OriginRuntime); err != nil {
+			logger.Error().Msgf("ignoring stored schedule %s: %v", schedule.Name, err)
+		}
+	}
+
+	dc := controller.GetDoorControllerService()
+	s.guardID = dc.AddCommandGuard(s.guard)
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+	go s.loop()
+
+	logger.Info().Msgf("scheduler started with %d schedules", len(s.entries))
+	return nil
+}
+
+// Stop stops running schedules, and removes the time window guard.
+func (s *Scheduler) Stop() {
+	if s.stop == nil {
+		return
+	}
+	dc := controller.GetDoorControllerService()
+	dc.RemoveCommandGuard(s.guardID)
+	close(s.stop)
+	s.wg.Wait()
+	s.stop = nil
+	logger.Info().Msg("scheduler stopped")
+}
+
+// List returns the status of all schedules, ordered by name.
+func (s *Scheduler) List() []ScheduleStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	result := make([]ScheduleStatus, 0, len(s.entries))
+	for _, e := range s.entries {
+		status := ScheduleStatus{
+			Schedule:   e.schedule,
+			Origin:     e.origin,
+			LastResult: e.lastResult,
+		}
+		if !e.nextRun.IsZero() {
+			nextRun := e.nextRun
+			status.NextRun = &nextRun
+		}
+		if !e.lastRun.IsZero() {
+			lastRun := e.lastRun
+			status.LastRun = &lastRun
+		}
+		if e.window != nil {
+			status.Active = e.window.active(now, e.loc)
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Add adds a schedule at runtime, and persists it in the store.
+func (s *Scheduler) Add(schedule Schedule) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, found := s.entries[schedule.Name]; found {
+		return ErrExists
+	}
+	if err := s.addEntry(schedule, OriginRuntime); err != nil {
+		return err
+	}
+	if err := s.persist(); err != nil {
+		delete(s.entries, schedule.Name)
+		return err
+	}
+	logger.Info().Msgf("added schedule %s", schedule.Name)
+	return nil
+}
+
+// Remove removes a schedule that was added at runtime. Schedules from the configuration file can't be removed.
+func (s *Scheduler) Remove(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, found := s.entries[name]
+	if !found {
+		return ErrNotFound
+	}
+	if e.origin == OriginConfig {
+		return ErrReadOnly
+	}
+	delete(s.entries, name)
+	if err := s.persist(); err != nil {
+		s.entries[name] = e
+		return err
+	}
+	logger.Info().Msgf("removed schedule %s", name)
+	return nil
+}
+
+// Compile a schedule and add it to the entries. The caller must hold the lock.
+func (s *Scheduler) addEntry(schedule Schedule, origin string) error {
+	e, err := s.compile(schedule, origin)
+	if err != nil {
+		return fmt.Errorf("%w %s: %v", ErrInvalidSchedule, schedule.Name, err)
+	}
+	if _, found := s.entries[schedule.Name]; found {
+		return fmt.Errorf("%w: %s", ErrExists, schedule.Name)
+	}
+	s.entries[schedule.Name] = e
+	return nil
+}
+
+// Compile a schedule into an entry, validating it along the way.
+func (s *Scheduler) compile(schedule Schedule, origin string) (*entry, error) {
+	if schedule.Name == "" {
+		return nil, errors.New("a name is required")
+	}
+	e := &entry{
+		schedule: schedule,
+		origin:   origin,
+		loc:      s.location,
+	}
+	if schedule.Timezone != "" {
+		loc, err := time.LoadLocation(schedule.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone: %v", err)
+		}
+		e.loc = loc
+	}
+
+	switch {
+	case schedule.Cron != "" && schedule.Window == "":
+		if !isCommand(schedule.Action) {
+			return nil, fmt.Errorf("action must be open, close or toggle, got %q", schedule.Action)
+		}
+		expr, err := parseExpression(schedule.Cron, s.latitude, s.longitude)
+		if err != nil {
+			return nil, err
+		}
+		e.expression = expr
+		if next, ok := expr.next(time.Now(), e.loc); ok {
+			e.nextRun = next
+		}
+	case schedule.Window != "" && schedule.Cron == "":
+		if len(schedule.Deny) == 0 {
+			return nil, errors.New("a window must deny at least one command")
+		}
+		for _, command := range schedule.Deny {
+			if !isCommand(command) {
+				return nil, fmt.Errorf("denied commands must be open, close or toggle, got %q", command)
+			}
+		}
+		window, err := parseWindow(schedule.Window, schedule.Days)
+		if err != nil {
+			return nil, err
+		}
+		e.window = window
+	default:
+		return nil, errors.New("either cron or window must be set")
+	}
+	return e, nil
+}
+
+// Persist the runtime schedules in the store. The caller must hold the lock.
+func (s *Scheduler) persist() error {
+	schedules := make([]Schedule, 0, len(s.entries))
+	for _, e := range s.entries {
+		if e.origin == OriginRuntime {
+			schedules = append(schedules, e.schedule)
+		}
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Name < schedules[j].Name
+	})
+	return s.store.Save(schedulesDocument, schedules)
+}
+
+// Main loop for running scheduled actions.
+func (s *Scheduler) loop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.runDue(now)
+		}
+	}
+}
+
+// Run all scheduled actions that are due at the given time.
+func (s *Scheduler) runDue(now time.Time) {
+	s.lock.Lock()
+	due := make([]*entry, 0)
+	for _, e := range s.entries {
+		if e.expression != nil && !e.nextRun.IsZero() && !now.Before(e.nextRun) {
+			due = append(due, e)
+			if next, ok := e.expression.next(now, e.loc); ok {
+				e.nextRun = next
+			} else {
+				e.nextRun = time.Time{}
+			}
+		}
+	}
+	s.lock.Unlock()
+
+	for _, e := range due {
+		result := "ok"
+		if err := run(e.schedule.Action); err != nil {
+			logger.Warn().Msgf("schedule %s failed to %s the door: %v", e.schedule.Name, e.schedule.Action, err)
+			result = err.Error()
+		} else {
+			logger.Info().Msgf("schedule %s requested to %s the door", e.schedule.Name, e.schedule.Action)
+		}
+		s.lock.Lock()
+		e.lastRun = now
+		e.lastResult = result
+		s.lock.Unlock()
+	}
+}
+
+// Run a command through the DoorControllerService.
+func run(command string) error {
+	dc := controller.GetDoorControllerService()
+	switch command {
+	case "open":
+		return dc.RequestOpen(context.Background(), source)
+	case "close":
+		return dc.RequestClose(context.Background(), source)
+	default:
+		return dc.RequestToggle(context.Background(), source)
+	}
+}
+
+// Command guard that denies commands during active time windows. Scheduled commands are never denied.
+func (s *Scheduler) guard(command string, commandSource string) error {
+	if commandSource == source {
+		return nil
+	}
+
+	// A toggle opens a closed door and closes an open one.
+	effective := command
+	if command == "toggle" {
+		switch controller.GetDoorControllerService().GetStateStr() {
+		case "closed":
+			effective = "open"
+		case "open":
+			effective = "close"
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for _, e := range s.entries {
+		if e.window == nil || !e.window.active(now, e.loc) {
+			continue
+		}
+		for _, denied := range e.schedule.Deny {
+			if denied == command || denied == effective {
+				return fmt.Errorf("%w by schedule %s", controller.ErrDenied, e.schedule.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Check if the given string is a command that can be scheduled or denied.
+func isCommand(command string) bool {
+	return command == "open" || command == "close" || command == "toggle"
+}
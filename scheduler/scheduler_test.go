@@ -0,0 +1,159 @@
+package scheduler
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/dlefevre/go.garagedoor-service/storage"
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	os.Setenv("GARAGESERVICE_CONFIG_PATH", "..")
+	dataDir, _ := os.MkdirTemp("", "garagedoor-service-test")
+	os.Setenv("GARAGESERVICE_DATA_DIR", dataDir)
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+}
+
+func nextHelper(t *testing.T, expr string, after time.Time, expected time.Time) {
+	e, err := parseExpression(expr, 50.85, 4.35)
+	if err != nil {
+		t.Fatalf("Error parsing %q: %v", expr, err)
+	}
+	next, ok := e.next(after, after.Location())
+	if !ok {
+		t.Fatalf("Expected %q to have a next run", expr)
+	}
+	if !next.Equal(expected) {
+		t.Fatalf("Expected next run of %q to be %v, got %v", expr, expected, next)
+	}
+}
+
+func TestCron(t *testing.T) {
+	brussels, err := time.LoadLocation("Europe/Brussels")
+	if err != nil {
+		t.Skipf("Time zone database not available: %v", err)
+	}
+	// Friday 2024-03-01 12:00
+	after := time.Date(2024, 3, 1, 12, 0, 0, 0, brussels)
+
+	nextHelper(t, "0 22 * * *", after, time.Date(2024, 3, 1, 22, 0, 0, 0, brussels))
+	nextHelper(t, "30 7 * * mon-fri", after, time.Date(2024, 3, 4, 7, 30, 0, 0, brussels))
+	nextHelper(t, "*/15 * * * *", after, time.Date(2024, 3, 1, 12, 15, 0, 0, brussels))
+	nextHelper(t, "0 0 1 jan *", after, time.Date(2025, 1, 1, 0, 0, 0, 0, brussels))
+	nextHelper(t, "0 9 15 * 0", after, time.Date(2024, 3, 3, 9, 0, 0, 0, brussels))
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * * * 8", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Fatalf("Expected %q to be invalid", expr)
+		}
+	}
+}
+
+func TestSolar(t *testing.T) {
+	brussels, err := time.LoadLocation("Europe/Brussels")
+	if err != nil {
+		t.Skipf("Time zone database not available: %v", err)
+	}
+	// Published times for Brussels on 2024-06-21: sunrise 05:29, sunset 22:00.
+	date := time.Date(2024, 6, 21, 12, 0, 0, 0, brussels)
+	sunrise, ok := sunEvent(date, 50.85, 4.35, true)
+	if !ok || sunrise.Sub(time.Date(2024, 6, 21, 5, 29, 0, 0, brussels)).Abs() > 3*time.Minute {
+		t.Fatalf("Expected sunrise around 05:29, got %v", sunrise.In(brussels))
+	}
+	sunset, ok := sunEvent(date, 50.85, 4.35, false)
+	if !ok || sunset.Sub(time.Date(2024, 6, 21, 22, 0, 0, 0, brussels)).Abs() > 3*time.Minute {
+		t.Fatalf("Expected sunset around 22:00, got %v", sunset.In(brussels))
+	}
+
+	// The sun doesn't set at the north pole in June.
+	if _, ok := sunEvent(date, 89, 0, false); ok {
+		t.Fatalf("Expected no sunset at the north pole in June")
+	}
+
+	e, err := parseExpression("@sunset+30m", 50.85, 4.35)
+	if err != nil {
+		t.Fatalf("Error parsing solar expression: %v", err)
+	}
+	next, ok := e.next(date, brussels)
+	if !ok || next.Sub(sunset.Add(30*time.Minute)).Abs() > time.Minute {
+		t.Fatalf("Expected next run 30 minutes after sunset, got %v", next)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	window, err := parseWindow("23:00-05:00", "mon")
+	if err != nil {
+		t.Fatalf("Error parsing window: %v", err)
+	}
+	// Monday 2024-03-04
+	if !window.active(time.Date(2024, 3, 4, 23, 30, 0, 0, time.UTC), time.UTC) {
+		t.Fatalf("Expected window to be active on Monday 23:30")
+	}
+	if !window.active(time.Date(2024, 3, 5, 4, 59, 0, 0, time.UTC), time.UTC) {
+		t.Fatalf("Expected window to be active on Tuesday 04:59")
+	}
+	if window.active(time.Date(2024, 3, 5, 5, 0, 0, 0, time.UTC), time.UTC) {
+		t.Fatalf("Expected window to be inactive on Tuesday 05:00")
+	}
+	if window.active(time.Date(2024, 3, 4, 4, 0, 0, 0, time.UTC), time.UTC) {
+		t.Fatalf("Expected window to be inactive on Monday 04:00, which belongs to Sunday")
+	}
+}
+
+func TestGuard(t *testing.T) {
+	s := newScheduler(storage.NewStore(t.TempDir()))
+	s.location = time.UTC
+	now := time.Now().UTC()
+	from := now.Add(-time.Hour).Format("15:04")
+	to := now.Add(time.Hour).Format("15:04")
+	if err := s.Add(Schedule{Name: "deny-open", Window: from + "-" + to, Deny: []string{"open"}}); err != nil {
+		t.Fatalf("Error adding window: %v", err)
+	}
+
+	if err := s.guard("open", "http"); !errors.Is(err, controller.ErrDenied) {
+		t.Fatalf("Expected open to be denied, got %v", err)
+	}
+	if err := s.guard("close", "http"); err != nil {
+		t.Fatalf("Expected close to be allowed, got %v", err)
+	}
+	if err := s.guard("open", source); err != nil {
+		t.Fatalf("Expected scheduled open to be allowed, got %v", err)
+	}
+}
+
+func TestAddRemove(t *testing.T) {
+	store := storage.NewStore(t.TempDir())
+	s := newScheduler(store)
+
+	schedule := Schedule{Name: "close-at-night", Cron: "0 22 * * *", Action: "close"}
+	if err := s.Add(schedule); err != nil {
+		t.Fatalf("Error adding schedule: %v", err)
+	}
+	if err := s.Add(schedule); !errors.Is(err, ErrExists) {
+		t.Fatalf("Expected duplicate schedule to be refused, got %v", err)
+	}
+	if err := s.Add(Schedule{Name: "invalid", Cron: "0 22 * * *", Action: "explode"}); !errors.Is(err, ErrInvalidSchedule) {
+		t.Fatalf("Expected invalid schedule to be refused, got %v", err)
+	}
+
+	list := s.List()
+	if len(list) != 1 || list[0].Name != "close-at-night" || list[0].NextRun == nil {
+		t.Fatalf("Expected one schedule with a next run, got %+v", list)
+	}
+
+	var stored []Schedule
+	if err := store.Load(schedulesDocument, &stored); err != nil || len(stored) != 1 {
+		t.Fatalf("Expected schedule to be persisted, got %v (%v)", stored, err)
+	}
+
+	if err := s.Remove("close-at-night"); err != nil {
+		t.Fatalf("Error removing schedule: %v", err)
+	}
+	if err := s.Remove("close-at-night"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package scheduler
+
+import (
+	"math"
+	"time"
+)
+
+// Zenith of the sun at sunrise and sunset, accounting for refraction and the apparent radius of the sun.
+const officialZenith = 90.833
+
+// Trigonometric helpers working in degrees.
+func sinDeg(deg float64) float64 { return math.Sin(deg * math.Pi / 180) }
+func cosDeg(deg float64) float64 { return math.Cos(deg * math.Pi / 180) }
+func tanDeg(deg float64) float64 { return math.Tan(deg * math.Pi / 180) }
+func asinDeg(x float64) float64  { return math.Asin(x) * 180 / math.Pi }
+func acosDeg(x float64) float64  { return math.Acos(x) * 180 / math.Pi }
+func atanDeg(x float64) float64  { return math.Atan(x) * 180 / math.Pi }
+
+// Normalize a value into the range [0, max).
+func normalize(value float64, max float64) float64 {
+	value = math.Mod(value, max)
+	if value < 0 {
+		value += max
+	}
+	return value
+}
+
+// sunEvent computes the time of sunrise (or sunset) on the date of the given time, in the time's location, for the
+// given coordinates. It uses the algorithm from the Almanac for Computers (1990), which is accurate to within a few
+// minutes, and requires no network access. Returns false if the sun doesn't rise or set on that date.
+func sunEvent(date time.Time, latitude float64, longitude float64, sunrise bool) (time.Time, bool) {
+	dayOfYear := float64(date.YearDay())
+	lngHour := longitude / 15
+
+	// Approximate time of the event, in days.
+	var t float64
+	if sunrise {
+		t = dayOfYear + (6-lngHour)/24
+	} else {
+		t = dayOfYear + (18-lngHour)/24
+	}
+
+	// Mean anomaly and true longitude of the sun.
+	m := 0.9856*t - 3.289
+	l := normalize(m+1.916*sinDeg(m)+0.020*sinDeg(2*m)+282.634, 360)
+
+	// Right ascension, in the same quadrant as the true longitude, converted to hours.
+	ra := normalize(atanDeg(0.91764*tanDeg(l)), 360)
+	ra += math.Floor(l/90)*90 - math.Floor(ra/90)*90
+	ra /= 15
+
+	// Declination of the sun, and its local hour angle.
+	sinDec := 0.39782 * sinDeg(l)
+	cosDec := cosDeg(asinDeg(sinDec))
+	cosH := (cosDeg(officialZenith) - sinDec*sinDeg(latitude)) / (cosDec * cosDeg(latitude))
+	if cosH > 1 || cosH < -1 {
+		return time.Time{}, false
+	}
+	var h float64
+	if sunrise {
+		h = 360 - acosDeg(cosH)
+	} else {
+		h = acosDeg(cosH)
+	}
+	h /= 15
+
+	// Local mean time of the event, converted to UTC.
+	localMean := h + ra - 0.06571*t - 6.622
+	ut := normalize(localMean-lngHour, 24)
+
+	y, mo, d := date.Date()
+	event := time.Date(y, mo, d, 0, 0, 0, 0, time.UTC).Add(time.Duration(ut * float64(time.Hour)))
+
+	// The UTC time may belong to the day before or after the requested local date.
+	loc := date.Location()
+	local := event.In(loc)
+	requested := time.Date(y, mo, d, 0, 0, 0, 0, loc)
+	if local.Before(requested) {
+		event = event.Add(24 * time.Hour)
+	} else if !local.Before(requested.AddDate(0, 0, 1)) {
+		event = event.Add(-24 * time.Hour)
+	}
+	return event, true
+}
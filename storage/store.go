@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+)
+
+// ErrNotFound is returned when a document doesn't exist in the store.
+var ErrNotFound = errors.New("storage: document not found")
+
+var (
+	instance *Store
+	once     sync.Once
+)
+
+// Interval during which the result of Check is reused, so frequent readiness probes don't keep writing to the data
+// directory.
+const checkInterval = 10 * time.Second
+
+// Store persists small JSON documents as individual files in the data directory.
+type Store struct {
+	dir      string
+	checked  time.Time
+	checkErr error
+	lock     sync.Mutex
+}
+
+// GetStore returns the one and only Store instance.
+func GetStore() *Store {
+	once.Do(func() {
+		instance = NewStore(config.GetDataDir())
+	})
+	return instance
+}
+
+// NewStore creates a new Store for the given directory. The directory is created when the first document is saved.
+func NewStore(dir string) *Store {
+	return &Store{
+		dir: dir,
+	}
+}
+
+// Dir returns the directory the store writes to.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Load reads the named document into v. Returns ErrNotFound if the document doesn't exist.
+func (s *Store) Load(name string, v any) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, err := os.ReadFile(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("storage: failed to read %s: %w", name, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("storage: failed to parse %s: %w", name, err)
+	}
+	return nil
+}
+
+// Save writes v as the named document. The document is replaced atomically.
+func (s *Store) Save(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("storage: failed to marshal %s: %w", name, err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return fmt.Errorf("storage: failed to create data directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(s.dir, name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("storage: failed to create %s: %w", name, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("storage: failed to write %s: %w", name, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("storage: failed to sync %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("storage: failed to close %s: %w", name, err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(name)); err != nil {
+		return fmt.Errorf("storage: failed to replace %s: %w", name, err)
+	}
+	return nil
+}
+
+// Update reads the named document into v, changes it with update, and saves it, while holding an exclusive file lock
+// on the document. Other processes updating the same document wait for the lock, so no change is lost. A document that
+// doesn't exist leaves v unchanged. When update returns an error, the document isn't saved and the error is returned.
+func (s *Store) Update(name string, v any, update func() error) error {
+	unlock, err := s.lockFile(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.Load(name, v); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err := update(); err != nil {
+		return err
+	}
+	return s.Save(name, v)
+}
+
+// Lock the named document exclusively, with a lock file next to it, as the document itself is replaced when saved.
+// Returns a function releasing the lock.
+func (s *Store) lockFile(name string) (func(), error) {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("storage: failed to create data directory: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(s.dir, name+".lock"), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("storage: failed to open lock of %s: %w", name, err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("storage: failed to lock %s: %w", name, err)
+	}
+	return func() {
+		file.Close()
+	}, nil
+}
+
+// Delete removes the named document. Deleting a document that doesn't exist isn't an error.
+func (s *Store) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := os.Remove(s.path(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("storage: failed to delete %s: %w", name, err)
+	}
+	return nil
+}
+
+// ModTime returns when the named document was last saved. Returns ErrNotFound if the document doesn't exist.
+func (s *Store) ModTime(name string) (time.Time, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	info, err := os.Stat(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, ErrNotFound
+	} else if err != nil {
+		return time.Time{}, fmt.Errorf("storage: failed to stat %s: %w", name, err)
+	}
+	return info.ModTime(), nil
+}
+
+// Check verifies that documents can be saved, by creating and removing a temporary file in the data directory. The
+// result is reused for checkInterval.
+func (s *Store) Check() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if !s.checked.IsZero() && now.Sub(s.checked) < checkInterval {
+		return s.checkErr
+	}
+	s.checked = now
+	s.checkErr = s.check()
+	return s.checkErr
+}
+
+// Create and remove a temporary file in the data directory. The caller must hold the lock.
+func (s *Store) check() error {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return fmt.Errorf("storage: failed to create data directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(s.dir, "check.*.tmp")
+	if err != nil {
+		return fmt.Errorf("storage: data directory isn't writable: %w", err)
+	}
+	tmp.Close()
+	if err := os.Remove(tmp.Name()); err != nil {
+		return fmt.Errorf("storage: failed to remove %s: %w", tmp.Name(), err)
+	}
+	return nil
+}
+
+// Get the path of the file for the named document.
+func (s *Store) path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
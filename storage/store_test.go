@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func init() {
+	os.Setenv("GARAGESERVICE_CONFIG_PATH", "..")
+}
+
+type document struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestSaveLoad(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	if err := store.Save("doc", document{Name: "test", Count: 3}); err != nil {
+		t.Fatalf("Error saving document: %v", err)
+	}
+	var doc document
+	if err := store.Load("doc", &doc); err != nil {
+		t.Fatalf("Error loading document: %v", err)
+	}
+	if doc.Name != "test" || doc.Count != 3 {
+		t.Fatalf("Expected loaded document to match saved document, got %+v", doc)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	var doc document
+	if err := store.Load("missing", &doc); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	if err := store.Save("doc", document{Name: "test"}); err != nil {
+		t.Fatalf("Error saving document: %v", err)
+	}
+	if err := store.Delete("doc"); err != nil {
+		t.Fatalf("Error deleting document: %v", err)
+	}
+	if err := store.Delete("doc"); err != nil {
+		t.Fatalf("Expected deleting a missing document to succeed, got %v", err)
+	}
+	var doc document
+	if err := store.Load("doc", &doc); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestModTime(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	if _, err := store.ModTime("doc"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	if err := store.Save("doc", document{Name: "test"}); err != nil {
+		t.Fatalf("Error saving document: %v", err)
+	}
+	modTime, err := store.ModTime("doc")
+	if err != nil || modTime.IsZero() {
+		t.Fatalf("Expected modification time, got %v, %v", modTime, err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	store := NewStore(filepath.Join(dir, "data"))
+	if err := store.Check(); err != nil {
+		t.Fatalf("Expected writable store, got %v", err)
+	}
+	if entries, _ := os.ReadDir(store.Dir()); len(entries) != 0 {
+		t.Fatalf("Expected the check to leave no files, got %v", entries)
+	}
+
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0o600)
+	if err := NewStore(file).Check(); err == nil {
+		t.Fatalf("Expected a store on a file to fail the check")
+	}
+
+	// The result is reused for a while, and checked again afterwards.
+	os.RemoveAll(store.Dir())
+	os.WriteFile(store.Dir(), nil, 0o600)
+	if err := store.Check(); err != nil {
+		t.Fatalf("Expected the result of the previous check, got %v", err)
+	}
+	store.checked = store.checked.Add(-checkInterval)
+	if err := store.Check(); err == nil {
+		t.Fatalf("Expected the check to be done again after the interval")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	dir := t.TempDir()
+
+	// Concurrent updates from separate stores, as from separate processes, are all kept.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var doc document
+			err := NewStore(dir).Update("doc", &doc, func() error {
+				doc.Count++
+				return nil
+			})
+			if err != nil {
+				t.Errorf("Error updating document: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	var doc document
+	if err := NewStore(dir).Load("doc", &doc); err != nil || doc.Count != 10 {
+		t.Fatalf("Expected 10 updates, got %+v, %v", doc, err)
+	}
+
+	// A failing update isn't saved.
+	failed := errors.New("failed")
+	err := NewStore(dir).Update("doc", &doc, func() error {
+		doc.Count = 0
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("Expected the error of the update, got %v", err)
+	}
+	if err := NewStore(dir).Load("doc", &doc); err != nil || doc.Count != 10 {
+		t.Fatalf("Expected the document to be unchanged, got %+v, %v", doc, err)
+	}
+}
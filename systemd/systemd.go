@@ -0,0 +1,175 @@
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/logging"
+)
+
+// Logger of the systemd component.
+var logger = logging.Logger("systemd")
+
+// File descriptor of the first socket passed by socket activation.
+const listenFDsStart = 3
+
+// Notification states sent to systemd.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notify sends a state notification to the service manager over the socket in NOTIFY_SOCKET, e.g. Ready. Returns
+// false without error when the service doesn't run under systemd, or the unit doesn't expect notifications.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// A leading @ denotes a socket in the abstract namespace.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("systemd: failed to connect to notify socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("systemd: failed to notify: %w", err)
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval within which the service manager expects a Watchdog notification, from
+// WATCHDOG_USEC. Returns 0 when the watchdog isn't enabled for this process.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	value, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("systemd: invalid WATCHDOG_USEC %q", usec)
+	}
+	return time.Duration(value) * time.Microsecond, nil
+}
+
+// Listeners returns the listening sockets passed by socket activation, in the order of the socket unit. Returns no
+// listeners when the service wasn't socket activated. The environment variables are cleared, so the sockets are only
+// taken once, and aren't passed on to child processes.
+func Listeners() ([]net.Listener, error) {
+	return listeners(listenFDsStart)
+}
+
+// Create the listeners for the sockets passed by socket activation, starting at the given file descriptor.
+func listeners(start int) ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("systemd: invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	result := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		fd := start + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		// FileListener duplicates the descriptor with close-on-exec set, the original is no longer needed.
+		file.Close()
+		if err != nil {
+			for _, l := range result {
+				l.Close()
+			}
+			return nil, fmt.Errorf("systemd: socket %s isn't a listening socket: %w", name, err)
+		}
+		result = append(result, listener)
+	}
+	return result, nil
+}
+
+// WatchdogPinger sends Watchdog notifications at half the watchdog interval, but only while the service is healthy,
+// so the service manager restarts a service that is stuck.
+type WatchdogPinger struct {
+	interval time.Duration
+	healthy  func(now time.Time) bool
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewWatchdogPinger creates a new WatchdogPinger object for the given watchdog interval, which checks the health of
+// the service with healthy before every notification.
+func NewWatchdogPinger(interval time.Duration, healthy func(now time.Time) bool) *WatchdogPinger {
+	return &WatchdogPinger{
+		interval: interval,
+		healthy:  healthy,
+	}
+}
+
+// Start sending notifications.
+func (w *WatchdogPinger) Start() error {
+	if w.interval <= 0 {
+		return errors.New("systemd: the watchdog interval must be positive")
+	}
+	w.stop = make(chan struct{})
+	w.wg.Add(1)
+	go w.run()
+	return nil
+}
+
+// Stop sending notifications.
+func (w *WatchdogPinger) Stop() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+// Main loop sending the notifications. A failed health check is only logged once until the service recovers.
+func (w *WatchdogPinger) run() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.interval / 2)
+	defer ticker.Stop()
+
+	healthy := true
+	for {
+		select {
+		case <-w.stop:
+			return
+		case now := <-ticker.C:
+			if !w.healthy(now) {
+				if healthy {
+					logger.Error().Msg("Service is unhealthy, withholding watchdog notifications")
+				}
+				healthy = false
+				continue
+			}
+			if !healthy {
+				logger.Info().Msg("Service recovered, resuming watchdog notifications")
+			}
+			healthy = true
+			if _, err := Notify(Watchdog); err != nil {
+				logger.Error().Msgf("Error sending watchdog notification: %v", err)
+			}
+		}
+	}
+}
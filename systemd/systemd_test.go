@@ -0,0 +1,164 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Create a fake notify socket, and point NOTIFY_SOCKET to it.
+func fakeNotifySocket(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Error creating notify socket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// Read the next notification from the fake notify socket, or return "" after the timeout.
+func readNotification(conn *net.UnixConn, timeout time.Duration) string {
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if notified, err := Notify(Ready); notified || err != nil {
+		t.Fatalf("Expected no notification without NOTIFY_SOCKET, got %v, %v", notified, err)
+	}
+
+	conn := fakeNotifySocket(t)
+	if notified, err := Notify(Ready); !notified || err != nil {
+		t.Fatalf("Expected notification, got %v, %v", notified, err)
+	}
+	if state := readNotification(conn, time.Second); state != Ready {
+		t.Fatalf("Expected %s, got %q", Ready, state)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	if _, err := Notify(Ready); err == nil {
+		t.Fatalf("Expected error for a missing notify socket")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if interval, err := WatchdogInterval(); interval != 0 || err != nil {
+		t.Fatalf("Expected no watchdog, got %v, %v", interval, err)
+	}
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval, err := WatchdogInterval(); interval != 30*time.Second || err != nil {
+		t.Fatalf("Expected watchdog interval of 30s, got %v, %v", interval, err)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if interval, err := WatchdogInterval(); interval != 0 || err != nil {
+		t.Fatalf("Expected no watchdog for another process, got %v, %v", interval, err)
+	}
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "soon")
+	if _, err := WatchdogInterval(); err == nil {
+		t.Fatalf("Expected error for an invalid WATCHDOG_USEC")
+	}
+}
+
+func TestWatchdogPinger(t *testing.T) {
+	conn := fakeNotifySocket(t)
+	var healthy atomic.Bool
+	healthy.Store(true)
+	wp := NewWatchdogPinger(100*time.Millisecond, func(time.Time) bool {
+		return healthy.Load()
+	})
+	if err := wp.Start(); err != nil {
+		t.Fatalf("Error starting watchdog pinger: %v", err)
+	}
+	defer wp.Stop()
+
+	if state := readNotification(conn, time.Second); state != Watchdog {
+		t.Fatalf("Expected %s while healthy, got %q", Watchdog, state)
+	}
+	healthy.Store(false)
+	// Drain a notification that may have been sent before the health changed.
+	readNotification(conn, 60*time.Millisecond)
+	if state := readNotification(conn, 300*time.Millisecond); state != "" {
+		t.Fatalf("Expected no notifications while unhealthy, got %q", state)
+	}
+	healthy.Store(true)
+	if state := readNotification(conn, time.Second); state != Watchdog {
+		t.Fatalf("Expected %s after recovery, got %q", Watchdog, state)
+	}
+
+	if err := NewWatchdogPinger(0, nil).Start(); err == nil {
+		t.Fatalf("Expected error for a watchdog pinger without interval")
+	}
+}
+
+func TestListeners(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	if result, err := Listeners(); len(result) != 0 || err != nil {
+		t.Fatalf("Expected no listeners without socket activation, got %v, %v", result, err)
+	}
+
+	// Pass a duplicate of a listening socket, as systemd would.
+	original, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer original.Close()
+	file, err := original.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("Error duplicating socket: %v", err)
+	}
+	// Listeners takes ownership of the descriptor, so don't pass the one owned by file.
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		t.Fatalf("Error duplicating socket: %v", err)
+	}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "http")
+	result, err := listeners(fd)
+	if err != nil || len(result) != 1 {
+		t.Fatalf("Expected one listener, got %v, %v", result, err)
+	}
+	defer result[0].Close()
+	if result[0].Addr().String() != original.Addr().String() {
+		t.Fatalf("Expected listener on %s, got %s", original.Addr(), result[0].Addr())
+	}
+	if os.Getenv("LISTEN_FDS") != "" || os.Getenv("LISTEN_PID") != "" {
+		t.Fatalf("Expected socket activation variables to be cleared")
+	}
+
+	// The passed socket accepts connections.
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := result[0].Accept()
+		if err == nil {
+			c.Close()
+		}
+		accepted <- err
+	}()
+	c, err := net.Dial("tcp", original.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	c.Close()
+	if err := <-accepted; err != nil {
+		t.Fatalf("Error accepting on passed socket: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/eclipse/paho.golang/paho"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the service in exported traces.
+const serviceName = "garagedoor-service"
+
+// Attributes recorded on the spans of the service.
+const (
+	AttrCommand = attribute.Key("garagedoor.command")
+	AttrSource  = attribute.Key("garagedoor.source")
+	AttrState   = attribute.Key("garagedoor.state")
+	AttrDoorID  = attribute.Key("garagedoor.door_id")
+)
+
+var (
+	instance *Tracing
+	once     sync.Once
+)
+
+// Tracing is a singleton that sets up the export of OpenTelemetry traces. Until it is started, and when tracing is
+// disabled, spans are created by a no-op provider and cost next to nothing. Trace context is propagated in the W3C
+// traceparent format, in HTTP headers and MQTT user properties.
+type Tracing struct {
+	provider *sdktrace.TracerProvider
+}
+
+// GetTracing returns the one and only Tracing instance.
+func GetTracing() *Tracing {
+	once.Do(func() {
+		instance = &Tracing{}
+	})
+	return instance
+}
+
+// Start exporting traces, when tracing is enabled in the configuration.
+func (t *Tracing) Start() error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if !config.GetTracingEnabled() {
+		return nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.GetTracingExporter() {
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	default:
+		exporter, err = otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpointURL(config.GetTracingEndpoint()))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create %s trace exporter: %v", config.GetTracingExporter(), err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(serviceName),
+		AttrDoorID.String(config.GetDoorID()),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to create trace resource: %v", err)
+	}
+	t.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.GetTracingSampleRatio()))),
+	)
+	otel.SetTracerProvider(t.provider)
+	return nil
+}
+
+// Stop exporting traces, flushing the spans that weren't exported yet.
+func (t *Tracing) Stop(ctx context.Context) error {
+	if t.provider == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
+
+// Tracer returns the tracer for a component, named after its package.
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer("github.com/dlefevre/go.garagedoor-service/" + name)
+}
+
+// RecordError records an error on a span, and marks the span as failed.
+func RecordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// UserProperties adapts the user properties of an MQTT v5 packet for the propagation of trace context.
+type UserProperties struct {
+	Properties *paho.UserProperties
+}
+
+// Get returns the value of the first user property with the given key.
+func (p UserProperties) Get(key string) string {
+	return p.Properties.Get(key)
+}
+
+// Set replaces the user properties with the given key by a single property with the given value.
+func (p UserProperties) Set(key string, value string) {
+	properties := (*p.Properties)[:0]
+	for _, property := range *p.Properties {
+		if property.Key != key {
+			properties = append(properties, property)
+		}
+	}
+	*p.Properties = append(properties, paho.UserProperty{Key: key, Value: value})
+}
+
+// Keys returns the keys of the user properties.
+func (p UserProperties) Keys() []string {
+	keys := make([]string, 0, len(*p.Properties))
+	for _, property := range *p.Properties {
+		keys = append(keys, property.Key)
+	}
+	return keys
+}
+
+// ExtractMQTT returns a context with the trace context propagated in the user properties of a received MQTT message.
+func ExtractMQTT(ctx context.Context, properties *paho.PublishProperties) context.Context {
+	if properties == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, UserProperties{Properties: &properties.User})
+}
+
+// InjectMQTT adds the trace context of ctx to the user properties of an MQTT message to publish.
+func InjectMQTT(ctx context.Context, publish *paho.Publish) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	if publish.Properties == nil {
+		publish.Properties = &paho.PublishProperties{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, UserProperties{Properties: &publish.Properties.User})
+}
@@ -0,0 +1,43 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/eclipse/paho.golang/paho"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMQTTPropagation(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	span := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3, 4},
+		SpanID:     trace.SpanID{5, 6, 7, 8},
+		TraceFlags: trace.FlagsSampled,
+	})
+
+	// Without trace context, no user properties are added.
+	publish := &paho.Publish{Topic: "test"}
+	InjectMQTT(context.Background(), publish)
+	if publish.Properties != nil {
+		t.Fatalf("Expected no properties without trace context, got %+v", publish.Properties)
+	}
+
+	publish.Properties = &paho.PublishProperties{
+		User: paho.UserProperties{{Key: "traceparent", Value: "stale"}, {Key: "origin", Value: "test"}},
+	}
+	InjectMQTT(trace.ContextWithSpanContext(context.Background(), span), publish)
+	if len(publish.Properties.User.GetAll("traceparent")) != 1 || publish.Properties.User.Get("origin") != "test" {
+		t.Fatalf("Expected a single traceparent next to the other properties, got %v", publish.Properties.User)
+	}
+
+	extracted := trace.SpanContextFromContext(ExtractMQTT(context.Background(), publish.Properties))
+	if extracted.TraceID() != span.TraceID() || extracted.SpanID() != span.SpanID() || !extracted.IsRemote() {
+		t.Fatalf("Expected the injected span context, got %+v", extracted)
+	}
+	if ctx := ExtractMQTT(context.Background(), nil); trace.SpanContextFromContext(ctx).IsValid() {
+		t.Fatalf("Expected no span context without properties")
+	}
+}
@@ -0,0 +1,54 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/dlefevre/go.garagedoor-service/alerts"
+	"github.com/labstack/echo/v4"
+)
+
+// AlertsResponse is a response object for the list of alerts, containing a result (ok) and the alerts.
+type AlertsResponse struct {
+	SimpleResponse
+	Alerts []alerts.Alert `json:"alerts"`
+}
+
+// AlertResponse is a response object for a single alert, containing a result (ok) and the alert.
+type AlertResponse struct {
+	SimpleResponse
+	Alert alerts.Alert `json:"alert"`
+}
+
+// List all alerts.
+func listAlerts(c echo.Context) error {
+	return c.JSON(http.StatusOK, AlertsResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Alerts: alerts.GetAlertManager().List(),
+	})
+}
+
+// Acknowledge an alert, which stops repeated notifications.
+func acknowledgeAlert(c echo.Context) error {
+	alert, err := alerts.GetAlertManager().Acknowledge(c.Param("id"), commandSource(c))
+	if err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, alerts.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, ErrorResponse{
+			SimpleResponse: SimpleResponse{
+				Result: "nok",
+			},
+			Message: err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, AlertResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Alert: alert,
+	})
+}
@@ -0,0 +1,58 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/dlefevre/go.garagedoor-service/apikeys"
+	"github.com/labstack/echo/v4"
+)
+
+// Key of the API key in the Echo context, for requests authenticated with an API key.
+const contextKey = "api_key"
+
+// Middleware handler requiring a scope. Requests need an API key, client certificate or user of a browser session that
+// grants the scope.
+func requireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if hasScope(c, scope) {
+				return next(c)
+			}
+			logger.Warn().Msgf("Request to %v refused for %s: missing scope %s", c.Request().RequestURI,
+				commandSource(c), scope)
+			return c.JSON(http.StatusForbidden, ErrorResponse{
+				SimpleResponse: SimpleResponse{
+					Result: "nok",
+				},
+				Message: "Forbidden: missing scope " + scope,
+			})
+		}
+	}
+}
+
+// Check if an authenticated request has a scope.
+func hasScope(c echo.Context, scope string) bool {
+	if key, ok := c.Get(contextKey).(*apikeys.Key); ok {
+		return key.Allows(scope)
+	}
+	if identity, ok := c.Get(contextCert).(*certIdentity); ok {
+		return identity.allows(scope)
+	}
+	if sess, ok := c.Get(contextSession).(*session); ok {
+		return sess.allows(scope)
+	}
+	return false
+}
+
+// Get the source recorded for the commands of an authenticated request: the name of the API key or client
+// certificate, or the user of the browser session.
+func commandSource(c echo.Context) string {
+	user, _ := c.Get(contextUser).(string)
+	switch c.Get(contextAuth) {
+	case authAPIKey:
+		return "key:" + user
+	case authCert:
+		return "cert:" + user
+	}
+	return "user:" + user
+}
@@ -0,0 +1,367 @@
+package web
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/audit"
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/dlefevre/go.garagedoor-service/metrics"
+	"github.com/labstack/echo/v4"
+)
+
+// Number of tracked clients above which clients without recent failures or active bans are forgotten. When they all
+// have recent failures, the one with the oldest failure is forgotten, and when they are all banned, new clients aren't
+// tracked.
+const maxTrackedClients = 1024
+
+// Ban describes a client that is banned after too many failed authentications.
+type Ban struct {
+	IP    string    `json:"ip"`
+	Bans  int       `json:"bans"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+}
+
+// BansResponse is a response object for the list of banned clients, containing a result (ok) and the bans.
+type BansResponse struct {
+	SimpleResponse
+	Bans []Ban `json:"bans"`
+}
+
+// Failed authentications and bans of a single client.
+type client struct {
+	failures    int
+	windowStart time.Time
+	lastFailure time.Time
+	bans        int
+	bannedSince time.Time
+	bannedUntil time.Time
+}
+
+// banList counts failed authentications per client address. A client with too many failures within the window is
+// banned, and every next ban lasts twice as long as the previous one, up to the maximum ban duration. A client
+// without failures for the maximum ban duration starts again with the initial ban duration.
+type banList struct {
+	maxFailures int
+	window      time.Duration
+	banDuration time.Duration
+	maxBan      time.Duration
+	clients     map[string]*client
+	lock        sync.Mutex
+}
+
+// Creates a new banList object.
+func newBanList(maxFailures int, window time.Duration, banDuration time.Duration, maxBan time.Duration) *banList {
+	return &banList{
+		maxFailures: maxFailures,
+		window:      window,
+		banDuration: banDuration,
+		maxBan:      maxBan,
+		clients:     make(map[string]*client),
+	}
+}
+
+// Returns the remaining duration of the ban of a client, or false if it isn't banned.
+func (b *banList) banned(ip string, now time.Time) (time.Duration, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if c, ok := b.clients[ip]; ok && now.Before(c.bannedUntil) {
+		return c.bannedUntil.Sub(now), true
+	}
+	return 0, false
+}
+
+// Record a failed authentication of a client. Returns the ban, and true if the client got banned by this failure.
+func (b *banList) failure(ip string, now time.Time) (Ban, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c, ok := b.clients[ip]
+	if !ok {
+		if len(b.clients) >= maxTrackedClients {
+			b.purge(now)
+		}
+		if len(b.clients) >= maxTrackedClients && !b.evictOldest(now) {
+			return Ban{}, false
+		}
+		c = &client{}
+		b.clients[ip] = c
+	}
+	if !c.lastFailure.IsZero() && now.Sub(c.lastFailure) >= b.maxBan && !now.Before(c.bannedUntil) {
+		c.bans = 0
+	}
+	if now.Sub(c.windowStart) >= b.window {
+		c.failures = 0
+		c.windowStart = now
+	}
+	c.failures++
+	c.lastFailure = now
+	if c.failures < b.maxFailures || now.Before(c.bannedUntil) {
+		return Ban{}, false
+	}
+
+	duration := b.banDuration
+	for i := 0; i < c.bans && duration < b.maxBan; i++ {
+		duration *= 2
+	}
+	if duration > b.maxBan {
+		duration = b.maxBan
+	}
+	c.bans++
+	c.failures = 0
+	c.bannedSince = now
+	c.bannedUntil = now.Add(duration)
+	return c.ban(ip), true
+}
+
+// Forget the failures of a client after a successful authentication. Its previous bans are remembered, so the next
+// ban still lasts longer.
+func (b *banList) success(ip string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if c, ok := b.clients[ip]; ok {
+		c.failures = 0
+	}
+}
+
+// Returns the active bans, sorted by address.
+func (b *banList) list(now time.Time) []Ban {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	bans := make([]Ban, 0)
+	for ip, c := range b.clients {
+		if now.Before(c.bannedUntil) {
+			bans = append(bans, c.ban(ip))
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+	return bans
+}
+
+// Clear the ban and the failures of a client. Returns false, keeping its failures, if the client isn't banned.
+func (b *banList) clear(ip string, now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c, ok := b.clients[ip]
+	if !ok || !now.Before(c.bannedUntil) {
+		return false
+	}
+	delete(b.clients, ip)
+	return true
+}
+
+// Clear all bans and failures. Returns the addresses of the clients that were banned.
+func (b *banList) clearAll(now time.Time) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var cleared []string
+	for ip, c := range b.clients {
+		if now.Before(c.bannedUntil) {
+			cleared = append(cleared, ip)
+		}
+	}
+	sort.Strings(cleared)
+	b.clients = make(map[string]*client)
+	return cleared
+}
+
+// Forget clients that aren't banned and whose failures no longer count. The caller must hold the lock.
+func (b *banList) purge(now time.Time) {
+	for ip, c := range b.clients {
+		if !now.Before(c.bannedUntil) && now.Sub(c.lastFailure) >= b.window &&
+			(c.bans == 0 || now.Sub(c.lastFailure) >= b.maxBan) {
+			delete(b.clients, ip)
+		}
+	}
+}
+
+// Forget the client that isn't banned with the oldest failure. Returns false if all clients are banned. The caller
+// must hold the lock.
+func (b *banList) evictOldest(now time.Time) bool {
+	oldest := ""
+	for ip, c := range b.clients {
+		if now.Before(c.bannedUntil) {
+			continue
+		}
+		if oldest == "" || c.lastFailure.Before(b.clients[oldest].lastFailure) {
+			oldest = ip
+		}
+	}
+	if oldest == "" {
+		return false
+	}
+	delete(b.clients, oldest)
+	return true
+}
+
+// Describe the ban of a client.
+func (c *client) ban(ip string) Ban {
+	return Ban{
+		IP:    ip,
+		Bans:  c.bans,
+		Since: c.bannedSince,
+		Until: c.bannedUntil,
+	}
+}
+
+// Create the function extracting the client address from requests. The X-Forwarded-For header is only believed for
+// requests from a trusted proxy; the addresses in the header are walked from the right, skipping trusted proxies.
+func ipExtractor(proxies []string) echo.IPExtractor {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range proxies {
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			ip := net.ParseIP(proxy)
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		options = append(options, echo.TrustIPRange(network))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// Middleware handler to refuse requests from banned clients with status 429.
+func (s *WebService) rejectBanned(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if remaining, banned := s.bans.banned(c.RealIP(), time.Now()); banned {
+			return tooManyRequests(c, remaining)
+		}
+		return next(c)
+	}
+}
+
+// Record a failed authentication of the client of a request with the given method (api_key, login or metrics) and
+// reason in the audit log. Returns the ban and true if the client is banned as a result, and reports the ban as an
+// event.
+func (s *WebService) authenticationFailed(c echo.Context, method string, reason string) (Ban, bool) {
+	metrics.AuthFailures.WithLabelValues(method).Inc()
+	ip := c.RealIP()
+	ban, banned := s.bans.failure(ip, time.Now())
+	audit.Record(audit.Entry{
+		Type:    audit.TypeAuthFailure,
+		Actor:   "ip:" + ip,
+		Message: reason,
+		Details: map[string]string{
+			"method": method,
+			"path":   c.Request().URL.Path,
+		},
+	})
+	if !banned {
+		return ban, false
+	}
+	message := fmt.Sprintf("Client %s banned until %s after too many failed authentications",
+		ip,
+		ban.Until.Local().Format(time.RFC3339))
+	logger.Warn().Msg(message)
+	audit.Record(audit.Entry{
+		Type:    audit.TypeBan,
+		Actor:   "ip:" + ip,
+		Message: message,
+		Details: map[string]string{"until": ban.Until.Format(time.RFC3339)},
+	})
+	controller.GetDoorControllerService().RecordEvent(controller.Event{
+		Type:    controller.EventBan,
+		Source:  "ip:" + ip,
+		Level:   "warning",
+		Message: message,
+	})
+	return ban, true
+}
+
+// Report a request refused because of a ban or throttling to the client, with the number of seconds to wait before
+// retrying.
+func tooManyRequests(c echo.Context, retryAfter time.Duration) error {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return c.JSON(http.StatusTooManyRequests, ErrorResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "nok",
+		},
+		Message: "Too many requests",
+	})
+}
+
+// List the banned clients.
+func (s *WebService) listBans(c echo.Context) error {
+	return c.JSON(http.StatusOK, BansResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Bans: s.bans.list(time.Now()),
+	})
+}
+
+// Clear the ban of a client.
+func (s *WebService) clearBan(c echo.Context) error {
+	ip := c.Param("ip")
+	if !s.bans.clear(ip, time.Now()) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{
+			SimpleResponse: SimpleResponse{
+				Result: "nok",
+			},
+			Message: "No ban for " + ip,
+		})
+	}
+	recordUnban(c, ip)
+	return c.JSON(http.StatusOK, SimpleResponse{
+		Result: "ok",
+	})
+}
+
+// Clear the bans of all clients.
+func (s *WebService) clearBans(c echo.Context) error {
+	for _, ip := range s.bans.clearAll(time.Now()) {
+		recordUnban(c, ip)
+	}
+	return c.JSON(http.StatusOK, SimpleResponse{
+		Result: "ok",
+	})
+}
+
+// Report a cleared ban as an event.
+func recordUnban(c echo.Context, ip string) {
+	message := fmt.Sprintf("Ban of client %s cleared", ip)
+	logger.Info().Msg(message)
+	audit.Record(audit.Entry{
+		Type:    audit.TypeUnban,
+		Actor:   commandSource(c),
+		Message: message,
+		Details: map[string]string{"ip": ip},
+	})
+	controller.GetDoorControllerService().RecordEvent(controller.Event{
+		Type:    controller.EventUnban,
+		Source:  commandSource(c),
+		Message: message,
+	})
+}
+
+// Create the ban list from the configuration.
+func configuredBanList() *banList {
+	return newBanList(
+		config.GetAuthMaxFailures(),
+		config.GetAuthFailureWindow(),
+		config.GetAuthBanDuration(),
+		config.GetAuthMaxBanDuration())
+}
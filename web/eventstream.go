@@ -0,0 +1,147 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/labstack/echo/v4"
+)
+
+// Interval between keep-alive comments on an idle event stream.
+const keepAliveInterval = 15 * time.Second
+
+// Number of events buffered for a stream. When a client can't keep up, the stream is closed, and the client is
+// expected to reconnect with the Last-Event-ID header to resume.
+const streamBufferSize = 64
+
+// Event types sent on the event stream.
+var streamedEvents = map[string]bool{
+	controller.EventState:           true,
+	controller.EventCommand:         true,
+	controller.EventCommandRejected: true,
+	controller.EventLock:            true,
+	controller.EventUnlock:          true,
+	controller.EventAlert:           true,
+	controller.EventAlertCleared:    true,
+	controller.EventAlertAcked:      true,
+}
+
+// Handler for the Server-Sent Events stream. The current state is sent on connect, followed by the events of the
+// DoorControllerService. Clients that reconnect with a Last-Event-ID header first receive the events they missed, as
+// far as they are retained in the event log.
+func (s *WebService) eventStream(c echo.Context) error {
+	var lastID uint64
+	if header := c.Request().Header.Get("Last-Event-ID"); header != "" {
+		var err error
+		if lastID, err = strconv.ParseUint(header, 10, 64); err != nil {
+			return badRequest(c, "Invalid Last-Event-ID")
+		}
+	}
+
+	// Subscribe before reading the history, so no events are lost in between. Duplicates are skipped by id.
+	dc := controller.GetDoorControllerService()
+	events := make(chan controller.Event)
+	ctx := c.Request().Context()
+	subscription := dc.SubscribeEvents(controller.SubscriberOptions{
+		Name:      "event stream " + c.RealIP(),
+		QueueSize: streamBufferSize,
+		Policy:    controller.Disconnect,
+	}, func(event controller.Event) {
+		if !streamedEvents[event.Type] {
+			return
+		}
+		select {
+		case events <- event:
+		case <-ctx.Done():
+		}
+	})
+	defer subscription.Close()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprintf(res, "retry: 3000\n\n"); err != nil {
+		return nil
+	}
+	current := dc.GetStateEvent()
+	if err := writeStreamMessage(c, "", "state", StateResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		State: current.State,
+		Lock:  dc.GetLockStatus(),
+		Event: &current,
+	}); err != nil {
+		return nil
+	}
+	if lastID > 0 {
+		for _, event := range dc.GetEvents(lastID) {
+			if !streamedEvents[event.Type] {
+				continue
+			}
+			if err := writeStreamEvent(c, event); err != nil {
+				return nil
+			}
+			lastID = event.ID
+		}
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-events:
+			if event.ID <= lastID {
+				continue
+			}
+			if err := writeStreamEvent(c, event); err != nil {
+				return nil
+			}
+			lastID = event.ID
+		case <-keepAlive.C:
+			if _, err := fmt.Fprintf(res, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		case <-subscription.Done():
+			logger.Warn().Msg("Event stream client can't keep up, closing stream")
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-s.streams:
+			return nil
+		}
+	}
+}
+
+// Write an event of the DoorControllerService to the stream, using its id as event id and its type as event name.
+func writeStreamEvent(c echo.Context, event controller.Event) error {
+	return writeStreamMessage(c, strconv.FormatUint(event.ID, 10), event.Type, event)
+}
+
+// Write a message to the stream, and flush it to the client.
+func writeStreamMessage(c echo.Context, id string, name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	res := c.Response()
+	if id != "" {
+		if _, err := fmt.Fprintf(res, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", name, data); err != nil {
+		return err
+	}
+	res.Flush()
+	return nil
+}
@@ -2,11 +2,17 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/dlefevre/go.garagedoor-service/config"
 	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/dlefevre/go.garagedoor-service/metrics"
+	"github.com/dlefevre/go.garagedoor-service/tracing"
 	"github.com/labstack/echo/v4"
-	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/websocket"
 )
 
@@ -21,10 +27,46 @@ type ErrorResponse struct {
 	Message string `json:"message"`
 }
 
-// StateResponse is a response object for the state of the door, containing a result (ok) and the state.
+// StateResponse is a response object for the state of the door, containing a result (ok), the state, the status
+// of the maintenance lock and the state event with the details of the last transition.
 type StateResponse struct {
 	SimpleResponse
-	State string `json:"state"`
+	State string                 `json:"state"`
+	Lock  controller.LockStatus  `json:"lock"`
+	Event *controller.StateEvent `json:"event,omitempty"`
+}
+
+// LockRequest is a request object for engaging the maintenance lock. The duration is optional, and uses Go's
+// duration format (e.g. "2h30m").
+type LockRequest struct {
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"`
+}
+
+// LockResponse is a response object for the maintenance lock, containing a result (ok) and the lock status.
+type LockResponse struct {
+	SimpleResponse
+	Lock controller.LockStatus `json:"lock"`
+}
+
+// EventsResponse is a response object for the event log, containing a result (ok) and the events.
+type EventsResponse struct {
+	SimpleResponse
+	Events []controller.Event `json:"events"`
+}
+
+// BusStatsResponse is a response object for the statistics of the state and event buses, containing a result (ok),
+// the subscribers and the number of dropped items.
+type BusStatsResponse struct {
+	SimpleResponse
+	controller.BusStats
+}
+
+// The client of a websocket: the source recorded for its commands, and whether it may operate the door.
+type wsClient struct {
+	source     string
+	operate    bool
+	connection trace.SpanContext
 }
 
 // CommandMessage is a message object for commands, containing a command.
@@ -32,65 +74,241 @@ type CommandMessage struct {
 	Command string `json:"command"`
 }
 
-// Health check handler.
-func healthCheck(c echo.Context) error {
+// Toggle forwards a toggle request to the DoorControllerService.
+func toggle(c echo.Context) error {
+	dc := controller.GetDoorControllerService()
+	if err := dc.RequestToggle(c.Request().Context(), commandSource(c)); err != nil {
+		return commandError(c, err)
+	}
 	return c.JSON(http.StatusOK, SimpleResponse{
-		Result: "OK",
+		Result: "ok",
 	})
 }
 
-// Toggle forwards a toggle request to the DoorControllerService.
-func toggle(c echo.Context) error {
+// Open forwards an open request to the DoorControllerService. The door is only toggled when it is closed.
+func openDoor(c echo.Context) error {
 	dc := controller.GetDoorControllerService()
-	dc.RequestToggle()
+	if err := dc.RequestOpen(c.Request().Context(), commandSource(c)); err != nil {
+		return commandError(c, err)
+	}
 	return c.JSON(http.StatusOK, SimpleResponse{
 		Result: "ok",
 	})
 }
 
+// Close forwards a close request to the DoorControllerService. The door is only toggled when it is open.
+func closeDoor(c echo.Context) error {
+	dc := controller.GetDoorControllerService()
+	if err := dc.RequestClose(c.Request().Context(), commandSource(c)); err != nil {
+		return commandError(c, err)
+	}
+	return c.JSON(http.StatusOK, SimpleResponse{
+		Result: "ok",
+	})
+}
+
+// Get the events retained in the event log, optionally only those after a given event id.
+func events(c echo.Context) error {
+	var since uint64
+	if s := c.QueryParam("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return badRequest(c, "Invalid value for since")
+		}
+	}
+	dc := controller.GetDoorControllerService()
+	return c.JSON(http.StatusOK, EventsResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Events: dc.GetEvents(since),
+	})
+}
+
+// Get the statistics of the state and event buses.
+func busStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, BusStatsResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		BusStats: controller.GetDoorControllerService().GetBusStats(),
+	})
+}
+
+// Report a bad request to the client.
+func badRequest(c echo.Context, message string) error {
+	return c.JSON(http.StatusBadRequest, ErrorResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "nok",
+		},
+		Message: message,
+	})
+}
+
+// Report a refused command to the client. Commands refused by the command policy result in a 429 status,
+// commands refused because of the maintenance lock in a 423 status, and commands refused by a guard in a 403 status.
+func commandError(c echo.Context, err error) error {
+	status := http.StatusServiceUnavailable
+	if controller.IsRateLimited(err) {
+		status = http.StatusTooManyRequests
+	} else if errors.Is(err, controller.ErrMaintenanceLock) {
+		status = http.StatusLocked
+	} else if errors.Is(err, controller.ErrDenied) {
+		status = http.StatusForbidden
+	}
+	return c.JSON(status, ErrorResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "nok",
+		},
+		Message: err.Error(),
+	})
+}
+
 // Get the current state of the door.
 func state(c echo.Context) error {
 	dc := controller.GetDoorControllerService()
+	event := dc.GetStateEvent()
 	return c.JSON(http.StatusOK, StateResponse{
 		SimpleResponse: SimpleResponse{
 			Result: "ok",
 		},
-		State: dc.GetStateStr(),
+		State: event.State,
+		Lock:  dc.GetLockStatus(),
+		Event: &event,
+	})
+}
+
+// Engage the maintenance lock.
+func lock(c echo.Context) error {
+	var request LockRequest
+	if err := c.Bind(&request); err != nil {
+		return badRequest(c, "Invalid lock request")
+	}
+	if request.Reason == "" {
+		return badRequest(c, "A reason is required")
+	}
+	var duration time.Duration
+	if request.Duration != "" {
+		var err error
+		if duration, err = time.ParseDuration(request.Duration); err != nil || duration < 0 {
+			return badRequest(c, "Invalid duration")
+		}
+	}
+
+	dc := controller.GetDoorControllerService()
+	status, err := dc.Lock(request.Reason, duration, commandSource(c))
+	if err != nil {
+		logger.Error().Msgf("Error engaging maintenance lock: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			SimpleResponse: SimpleResponse{
+				Result: "nok",
+			},
+			Message: "Failed to engage maintenance lock",
+		})
+	}
+	return c.JSON(http.StatusOK, LockResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Lock: status,
+	})
+}
+
+// Release the maintenance lock.
+func unlock(c echo.Context) error {
+	dc := controller.GetDoorControllerService()
+	if err := dc.Unlock(commandSource(c)); err != nil {
+		logger.Error().Msgf("Error releasing maintenance lock: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			SimpleResponse: SimpleResponse{
+				Result: "nok",
+			},
+			Message: "Failed to release maintenance lock",
+		})
+	}
+	return c.JSON(http.StatusOK, LockResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Lock: dc.GetLockStatus(),
 	})
 }
 
-// Handler for the websocket.
+// Handler for the websocket. The protocol is selected by the subprotocol requested by the client: the v2 protocol
+// for ProtocolV2, the original protocol otherwise. Commands need the door:operate scope, and are recorded with the
+// source of the request.
 func ws(c echo.Context) error {
-	websocket.Handler(func(ws *websocket.Conn) {
-		defer ws.Close()
-
-		// Add a state listener to send state updates to the websocket.
-		WebSocketStateListener := &WebSocketStateListener{}
-		WebSocketStateListener.Connect(ws)
-		defer WebSocketStateListener.Disconnect()
-
-		// Read messages from the websocket.
-		dc := controller.GetDoorControllerService()
-		for {
-			var msg []byte
-			if err := websocket.Message.Receive(ws, &msg); err != nil {
-				log.Error().Msgf("Error reading message from websocket: %v", err)
-				break
+	client := wsClient{
+		source:     commandSource(c),
+		operate:    hasScope(c, config.ScopeDoorOperate),
+		connection: trace.SpanContextFromContext(c.Request().Context()),
+	}
+	websocket.Server{
+		Handshake: negotiateProtocol,
+		Handler: func(ws *websocket.Conn) {
+			metrics.WebSocketClients.Inc()
+			defer metrics.WebSocketClients.Dec()
+			if protocol := ws.Config().Protocol; len(protocol) == 1 && protocol[0] == ProtocolV2 {
+				serveV2(ws, client)
+				return
 			}
-			var command CommandMessage
-			if err := json.Unmarshal(msg, &command); err != nil {
-				log.Error().Msgf("Error parsing message from websocket: %v", err)
+			serveV1(ws, client)
+		},
+	}.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// Serve a connection using the original protocol.
+func serveV1(ws *websocket.Conn, client wsClient) {
+	defer ws.Close()
+
+	// Add a state listener to send state updates to the websocket.
+	WebSocketStateListener := &WebSocketStateListener{}
+	WebSocketStateListener.Connect(ws)
+	defer WebSocketStateListener.Disconnect()
+
+	// Read messages from the websocket.
+	dc := controller.GetDoorControllerService()
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			logger.Error().Msgf("Error reading message from websocket: %v", err)
+			break
+		}
+		var command CommandMessage
+		if err := json.Unmarshal(msg, &command); err != nil {
+			logger.Error().Msgf("Error parsing message from websocket: %v", err)
+			break
+		}
+		switch command.Command {
+		case "toggle":
+			if !client.operate {
+				sendError(ws, "Forbidden: missing scope "+config.ScopeDoorOperate)
 				break
 			}
-			switch command.Command {
-			case "toggle":
-				dc.RequestToggle()
-			case "state":
-				dc.RequestState()
-			default:
-				log.Warn().Msgf("Unknown command: %s", command.Command)
+			ctx, span := client.startCommand(command.Command)
+			if err := dc.RequestToggle(ctx, client.source); err != nil {
+				tracing.RecordError(span, err)
+				sendError(ws, err.Error())
 			}
+			span.End()
+		case "state":
+			dc.RequestState()
+		default:
+			logger.Warn().Msgf("Unknown command: %s", command.Command)
 		}
-	}).ServeHTTP(c.Response(), c.Request())
-	return nil
+	}
+}
+
+// Send an error message to the websocket.
+func sendError(ws *websocket.Conn, message string) {
+	err := websocket.JSON.Send(ws, ErrorResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "nok",
+		},
+		Message: message,
+	})
+	if err != nil {
+		logger.Error().Msgf("Error sending error to websocket: %v", err)
+	}
 }
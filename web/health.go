@@ -0,0 +1,92 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/audit"
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/dlefevre/go.garagedoor-service/mqtt"
+	"github.com/dlefevre/go.garagedoor-service/storage"
+	"github.com/labstack/echo/v4"
+)
+
+// Reasons reported for components that are down.
+var (
+	errNotReady     = errors.New("door controller isn't running, or hasn't read the door state yet")
+	errNotConnected = errors.New("not connected to the MQTT broker")
+)
+
+// Status of a healthy component, and of a component that is down.
+const (
+	statusUp   = "up"
+	statusDown = "down"
+)
+
+// ComponentStatus describes the health of a component, with the reason when it is down.
+type ComponentStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// HealthResponse is a response object for the readiness and liveness probes, containing a result (ok when all
+// components are up, nok otherwise) and the status of every component.
+type HealthResponse struct {
+	SimpleResponse
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// Readiness probe, checking the door controller, the GPIO adapter, the connection to the MQTT broker (when MQTT is
+// enabled), the data directory (at most every few seconds, as it writes a file) and the last write to the audit log
+// (when it is enabled). Responds with status 503 when a component is down.
+func readiness(c echo.Context) error {
+	dc := controller.GetDoorControllerService()
+	checks := map[string]error{
+		"gpio":    dc.CheckAdapter(),
+		"storage": storage.GetStore().Check(),
+	}
+	checks["controller"] = nil
+	if !dc.Ready() {
+		checks["controller"] = errNotReady
+	}
+	if config.GetMQTTEnabled() {
+		checks["mqtt"] = nil
+		if !mqtt.GetMQTTService().Connected() {
+			checks["mqtt"] = errNotConnected
+		}
+	}
+	if config.GetAuditEnabled() {
+		checks["audit"] = audit.GetRecorder().Err()
+	}
+	return healthResponse(c, "Readiness", checks)
+}
+
+// Liveness probe, checking that the command and state loops of the door controller still send heartbeats. Responds
+// with status 503 when a loop stalled.
+func liveness(c echo.Context) error {
+	return healthResponse(c, "Liveness", controller.GetDoorControllerService().Liveness(time.Now()))
+}
+
+// Report the result of the checks of a probe, with status 503 when a check failed.
+func healthResponse(c echo.Context, probe string, checks map[string]error) error {
+	response := HealthResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Components: make(map[string]ComponentStatus),
+	}
+	status := http.StatusOK
+	for name, err := range checks {
+		if err == nil {
+			response.Components[name] = ComponentStatus{Status: statusUp}
+			continue
+		}
+		logger.Warn().Msgf("%s check of %s failed: %v", probe, name, err)
+		response.Components[name] = ComponentStatus{Status: statusDown, Message: err.Error()}
+		response.Result = "nok"
+		status = http.StatusServiceUnavailable
+	}
+	return c.JSON(status, response)
+}
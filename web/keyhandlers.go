@@ -0,0 +1,109 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/dlefevre/go.garagedoor-service/apikeys"
+	"github.com/dlefevre/go.garagedoor-service/audit"
+	"github.com/labstack/echo/v4"
+)
+
+// KeysResponse is a response object for the list of API keys, containing a result (ok) and the keys.
+type KeysResponse struct {
+	SimpleResponse
+	Keys []apikeys.KeyStatus `json:"keys"`
+}
+
+// KeySecretResponse is a response object for a created or rotated API key, containing a result (ok), the key and its
+// secret. The secret is only returned once.
+type KeySecretResponse struct {
+	SimpleResponse
+	Key    apikeys.KeyStatus `json:"key"`
+	Secret string            `json:"secret"`
+}
+
+// List all API keys, with when they were last used.
+func listKeys(c echo.Context) error {
+	return c.JSON(http.StatusOK, KeysResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Keys: apikeys.GetKeyManager().List(),
+	})
+}
+
+// Create an API key.
+func createKey(c echo.Context) error {
+	var spec apikeys.KeySpec
+	if err := c.Bind(&spec); err != nil {
+		return badRequest(c, "Invalid key")
+	}
+	key, secret, err := apikeys.GetKeyManager().Create(spec)
+	if err != nil {
+		return keyError(c, err)
+	}
+	recordKeyChange(c, audit.TypeKeyCreate, key.Name)
+	return c.JSON(http.StatusCreated, KeySecretResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Key:    key,
+		Secret: secret,
+	})
+}
+
+// Revoke an API key created at runtime.
+func revokeKey(c echo.Context) error {
+	if err := apikeys.GetKeyManager().Revoke(c.Param("name")); err != nil {
+		return keyError(c, err)
+	}
+	recordKeyChange(c, audit.TypeKeyRevoke, c.Param("name"))
+	return c.JSON(http.StatusOK, SimpleResponse{
+		Result: "ok",
+	})
+}
+
+// Rotate the secret of an API key created at runtime.
+func rotateKey(c echo.Context) error {
+	key, secret, err := apikeys.GetKeyManager().Rotate(c.Param("name"))
+	if err != nil {
+		return keyError(c, err)
+	}
+	recordKeyChange(c, audit.TypeKeyRotate, key.Name)
+	return c.JSON(http.StatusOK, KeySecretResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Key:    key,
+		Secret: secret,
+	})
+}
+
+// Record a change of an API key in the audit log, on behalf of the user of the request.
+func recordKeyChange(c echo.Context, entryType string, name string) {
+	audit.Record(audit.Entry{
+		Type:    entryType,
+		Actor:   commandSource(c),
+		Details: map[string]string{"key": name},
+	})
+}
+
+// Report a failure to manage an API key to the client.
+func keyError(c echo.Context, err error) error {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, apikeys.ErrInvalid):
+		status = http.StatusBadRequest
+	case errors.Is(err, apikeys.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, apikeys.ErrExists), errors.Is(err, apikeys.ErrStatic):
+		status = http.StatusConflict
+	}
+	return c.JSON(status, ErrorResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "nok",
+		},
+		Message: err.Error(),
+	})
+}
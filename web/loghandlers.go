@@ -0,0 +1,74 @@
+package web
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/dlefevre/go.garagedoor-service/audit"
+	"github.com/dlefevre/go.garagedoor-service/logging"
+	"github.com/labstack/echo/v4"
+)
+
+// LogLevelsResponse is a response object for the log levels, containing a result (ok), the default level, the levels
+// of the components that override it, and the names of all components.
+type LogLevelsResponse struct {
+	SimpleResponse
+	logging.Levels
+	Components []string `json:"components"`
+}
+
+// Get the log levels.
+func logLevels(c echo.Context) error {
+	return c.JSON(http.StatusOK, logLevelsResponse())
+}
+
+// Change the log levels until the next restart or reload. The levels of the request are merged with the current
+// ones: an empty default level keeps the current one, and a component with level "default" follows the default level
+// again.
+func setLogLevels(c echo.Context) error {
+	var levels logging.Levels
+	if err := c.Bind(&levels); err != nil {
+		return badRequest(c, "Invalid levels")
+	}
+	if err := logging.GetLogging().SetLevels(levels, false); err != nil {
+		return badRequest(c, err.Error())
+	}
+
+	details := make(map[string]string, len(levels.Levels)+1)
+	if levels.Level != "" {
+		details["level"] = levels.Level
+	}
+	for component, level := range levels.Levels {
+		details["levels."+component] = level
+	}
+	audit.Record(audit.Entry{
+		Type:    audit.TypeLogLevels,
+		Actor:   commandSource(c),
+		Details: details,
+	})
+	logger.Info().Msgf("log levels changed by %s: %s", commandSource(c), formatLevels(details))
+	return c.JSON(http.StatusOK, logLevelsResponse())
+}
+
+// Create the response with the current log levels.
+func logLevelsResponse() LogLevelsResponse {
+	lg := logging.GetLogging()
+	return LogLevelsResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Levels:     lg.Levels(),
+		Components: lg.Components(),
+	}
+}
+
+// Format changed levels as key=level pairs for the log.
+func formatLevels(details map[string]string) string {
+	pairs := make([]string, 0, len(details))
+	for key, level := range details {
+		pairs = append(pairs, key+"="+level)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
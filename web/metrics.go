@@ -0,0 +1,29 @@
+package web
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Middleware handler to authenticate metrics scrapes with the separate username and password for the metrics, using
+// basic authentication. Wrong credentials count as failed authentications of the client.
+func (s *WebService) authenticateMetrics(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		username, password, ok := c.Request().BasicAuth()
+		if !ok {
+			c.Response().Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			return unauthorized(c)
+		}
+		validUser := subtle.ConstantTimeCompare([]byte(username), []byte(config.GetMetricsUsername())) == 1
+		validPassword := bcrypt.CompareHashAndPassword([]byte(config.GetMetricsPassword()), []byte(password)) == nil
+		if !validUser || !validPassword {
+			logger.Warn().Msgf("Unauthorized metrics scrape (ip: %v)", c.RealIP())
+			return s.refuse(c, "metrics", fmt.Sprintf("invalid credentials for user %q", username))
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,24 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/dlefevre/go.garagedoor-service/rules"
+	"github.com/labstack/echo/v4"
+)
+
+// RulesResponse is a response object for the list of rules, containing a result (ok) and the rules.
+type RulesResponse struct {
+	SimpleResponse
+	Rules []rules.RuleStatus `json:"rules"`
+}
+
+// List all rules and their status.
+func listRules(c echo.Context) error {
+	return c.JSON(http.StatusOK, RulesResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Rules: rules.GetRulesEngine().List(),
+	})
+}
@@ -0,0 +1,70 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/dlefevre/go.garagedoor-service/scheduler"
+	"github.com/labstack/echo/v4"
+)
+
+// SchedulesResponse is a response object for the list of schedules, containing a result (ok) and the schedules.
+type SchedulesResponse struct {
+	SimpleResponse
+	Schedules []scheduler.ScheduleStatus `json:"schedules"`
+}
+
+// List all schedules.
+func listSchedules(c echo.Context) error {
+	return c.JSON(http.StatusOK, SchedulesResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Schedules: scheduler.GetScheduler().List(),
+	})
+}
+
+// Add a schedule at runtime.
+func addSchedule(c echo.Context) error {
+	var schedule scheduler.Schedule
+	if err := c.Bind(&schedule); err != nil {
+		return badRequest(c, "Invalid schedule")
+	}
+	if err := scheduler.GetScheduler().Add(schedule); err != nil {
+		return scheduleError(c, err)
+	}
+	return c.JSON(http.StatusCreated, SimpleResponse{
+		Result: "ok",
+	})
+}
+
+// Remove a schedule that was added at runtime.
+func removeSchedule(c echo.Context) error {
+	if err := scheduler.GetScheduler().Remove(c.Param("name")); err != nil {
+		return scheduleError(c, err)
+	}
+	return c.JSON(http.StatusOK, SimpleResponse{
+		Result: "ok",
+	})
+}
+
+// Report an error from the scheduler to the client.
+func scheduleError(c echo.Context, err error) error {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, scheduler.ErrInvalidSchedule):
+		status = http.StatusBadRequest
+	case errors.Is(err, scheduler.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, scheduler.ErrExists), errors.Is(err, scheduler.ErrReadOnly):
+		status = http.StatusConflict
+	default:
+		logger.Error().Msgf("Error managing schedules: %v", err)
+	}
+	return c.JSON(status, ErrorResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "nok",
+		},
+		Message: err.Error(),
+	})
+}
@@ -0,0 +1,316 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Names of the session and CSRF cookies, and of the header carrying the CSRF token.
+const (
+	sessionCookie = "garagedoor_session"
+	csrfCookie    = "garagedoor_csrf"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// Keys of the authenticated principal in the Echo context.
+const (
+	contextUser    = "user"
+	contextAuth    = "auth"
+	contextSession = "session"
+)
+
+// Authentication methods stored in the Echo context.
+const (
+	authAPIKey  = "api_key"
+	authSession = "session"
+	authCert    = "cert"
+)
+
+// Errors returned when authenticating a request with a session cookie.
+var (
+	errNoSession = errors.New("no valid session")
+	errCSRF      = errors.New("missing or invalid CSRF token")
+)
+
+// Hash compared against when logging in with an unknown username, so both cases take as long.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+// LoginRequest is a request object for logging in with a username and password.
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// SessionResponse is a response object for a browser session, containing a result (ok), the username, the scopes of
+// the user, the CSRF token to send in the X-CSRF-Token header of state-changing requests, and the expiry of the
+// session.
+type SessionResponse struct {
+	SimpleResponse
+	Username  string    `json:"username"`
+	Scopes    []string  `json:"scopes"`
+	CSRFToken string    `json:"csrf_token"`
+	Expires   time.Time `json:"expires"`
+}
+
+// A browser session, created by logging in, with the scopes of the user at that time.
+type session struct {
+	username  string
+	scopes    []string
+	csrfToken string
+	expires   time.Time
+}
+
+// Check if the session has a scope.
+func (s *session) allows(scope string) bool {
+	return slices.Contains(s.scopes, config.ScopeAdmin) || slices.Contains(s.scopes, scope)
+}
+
+// sessionStore keeps the sessions in memory, indexed by a hash of the session token, so tokens can't be recovered from
+// the store. Sessions don't survive restarts.
+type sessionStore struct {
+	sessions map[string]*session
+	ttl      time.Duration
+	secure   bool
+	lock     sync.Mutex
+}
+
+// Creates a new sessionStore object.
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		sessions: make(map[string]*session),
+		ttl:      config.GetSessionTTL(),
+		secure:   config.GetSessionSecureCookie(),
+	}
+}
+
+// Create a session for a user with the given scopes. Returns the session token and the session.
+func (s *sessionStore) create(username string, scopes []string, now time.Time) (string, *session, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	csrfToken, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	sess := &session{
+		username:  username,
+		scopes:    scopes,
+		csrfToken: csrfToken,
+		expires:   now.Add(s.ttl),
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, existing := range s.sessions {
+		if now.After(existing.expires) {
+			delete(s.sessions, key)
+		}
+	}
+	s.sessions[hashToken(token)] = sess
+	return token, sess, nil
+}
+
+// Look up a session by its token. Expired sessions are removed.
+func (s *sessionStore) get(token string, now time.Time) (*session, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := hashToken(token)
+	sess, ok := s.sessions[key]
+	if !ok {
+		return nil, false
+	}
+	if now.After(sess.expires) {
+		delete(s.sessions, key)
+		return nil, false
+	}
+	return sess, true
+}
+
+// Remove a session.
+func (s *sessionStore) remove(token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, hashToken(token))
+}
+
+// Set the session and CSRF cookies. The CSRF cookie is readable by scripts, so the web UI can send it as header.
+func (s *sessionStore) setCookies(c echo.Context, token string, sess *session) {
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  sess.expires,
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	c.SetCookie(&http.Cookie{
+		Name:     csrfCookie,
+		Value:    sess.csrfToken,
+		Path:     "/",
+		Expires:  sess.expires,
+		Secure:   s.secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// Clear the session and CSRF cookies.
+func (s *sessionStore) clearCookies(c echo.Context) {
+	for _, name := range []string{sessionCookie, csrfCookie} {
+		c.SetCookie(&http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: name == sessionCookie,
+			Secure:   s.secure,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
+
+// Generate a random token.
+func randomToken() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Hash a session token for use as key in the store.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify a username and password against the users in the configuration file. Returns the user and true when they
+// match.
+func verifyPassword(username string, password string) (config.UserConfig, bool) {
+	for _, user := range config.GetUsers() {
+		if user.Username == username {
+			return user, bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil
+		}
+	}
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+	return config.UserConfig{}, false
+}
+
+// Log in with a username and password, and start a session.
+func (s *WebService) login(c echo.Context) error {
+	var request LoginRequest
+	if err := c.Bind(&request); err != nil {
+		return badRequest(c, "Invalid login request")
+	}
+	user, ok := verifyPassword(request.Username, request.Password)
+	if !ok {
+		logger.Warn().Msgf("Failed login for user %q (ip: %v)", request.Username, c.RealIP())
+		return s.refuse(c, "login", fmt.Sprintf("invalid credentials for user %q", request.Username))
+	}
+	s.bans.success(c.RealIP())
+
+	token, sess, err := s.sessions.create(user.Username, user.Scopes, time.Now())
+	if err != nil {
+		logger.Error().Msgf("Error creating session: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			SimpleResponse: SimpleResponse{
+				Result: "nok",
+			},
+			Message: "Failed to create session",
+		})
+	}
+	s.sessions.setCookies(c, token, sess)
+	logger.Info().Msgf("User %s logged in", request.Username)
+	return c.JSON(http.StatusOK, sessionResponse(sess))
+}
+
+// Log out, ending the session.
+func (s *WebService) logout(c echo.Context) error {
+	if cookie, err := c.Cookie(sessionCookie); err == nil {
+		s.sessions.remove(cookie.Value)
+	}
+	s.sessions.clearCookies(c)
+	return c.JSON(http.StatusOK, SimpleResponse{
+		Result: "ok",
+	})
+}
+
+// Get the current session, e.g. for the web UI to retrieve the CSRF token.
+func (s *WebService) currentSession(c echo.Context) error {
+	cookie, err := c.Cookie(sessionCookie)
+	if err != nil {
+		return unauthorized(c)
+	}
+	sess, ok := s.sessions.get(cookie.Value, time.Now())
+	if !ok {
+		return unauthorized(c)
+	}
+	return c.JSON(http.StatusOK, sessionResponse(sess))
+}
+
+// Create the response for a session.
+func sessionResponse(sess *session) SessionResponse {
+	return SessionResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Username:  sess.username,
+		Scopes:    sess.scopes,
+		CSRFToken: sess.csrfToken,
+		Expires:   sess.expires,
+	}
+}
+
+// Authenticate a request with a session cookie, returning the session. Returns errNoSession when there is no valid
+// session. State-changing requests must carry the CSRF token of the session in the X-CSRF-Token header, and websocket
+// handshakes must come from the same origin, otherwise errCSRF is returned.
+func (s *WebService) authenticateSession(c echo.Context) (*session, error) {
+	cookie, err := c.Cookie(sessionCookie)
+	if err != nil {
+		return nil, errNoSession
+	}
+	sess, ok := s.sessions.get(cookie.Value, time.Now())
+	if !ok {
+		return nil, errNoSession
+	}
+
+	req := c.Request()
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		if c.IsWebSocket() && !sameOrigin(req) {
+			logger.Warn().Msgf("Cross-origin websocket for user %s refused", sess.username)
+			return nil, errCSRF
+		}
+	default:
+		header := req.Header.Get(csrfHeader)
+		if subtle.ConstantTimeCompare([]byte(header), []byte(sess.csrfToken)) != 1 {
+			logger.Warn().Msgf("Missing or invalid CSRF token for user %s on %v", sess.username, req.RequestURI)
+			return nil, errCSRF
+		}
+	}
+	return sess, nil
+}
+
+// Check that the Origin header of a request matches its host.
+func sameOrigin(req *http.Request) bool {
+	origin, err := url.Parse(req.Header.Get("Origin"))
+	if err != nil {
+		return false
+	}
+	return origin.Host == req.Host
+}
@@ -0,0 +1,315 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/pki"
+	"github.com/dlefevre/go.garagedoor-service/storage"
+	"github.com/labstack/echo/v4"
+)
+
+// Interval between checks of the certificate files for changes.
+const certCheckInterval = 2 * time.Second
+
+// Key of the client certificate identity in the Echo context, for requests authenticated with a client certificate.
+const contextCert = "client_cert"
+
+// certReloader keeps the server certificate and the CA bundle for client certificates, and reloads them when their
+// files change. Changes are picked up by new connections, at most every certCheckInterval. When the changed files
+// can't be loaded (e.g. because the certificate was written but the key not yet), the previous ones are kept.
+type certReloader struct {
+	certFile  string
+	keyFile   string
+	caFile    string
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	checked   time.Time
+	lock      sync.Mutex
+}
+
+// Creates a new certReloader object, and loads the files. The CA file is optional.
+func newCertReloader(certFile string, keyFile string, caFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	modTimes, err := r.modified()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTimes); err != nil {
+		return nil, err
+	}
+	r.checked = time.Now()
+	return r, nil
+}
+
+// Reload the files if they changed since they were last loaded, checking at most every certCheckInterval.
+func (r *certReloader) refresh(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if now.Sub(r.checked) < certCheckInterval {
+		return
+	}
+	r.checked = now
+
+	modTimes, err := r.modified()
+	if err != nil {
+		logger.Error().Msgf("Error checking certificate files: %v", err)
+		return
+	}
+	changed := false
+	for file, modTime := range modTimes {
+		changed = changed || !modTime.Equal(r.modTimes[file])
+	}
+	if !changed {
+		return
+	}
+	if err := r.load(modTimes); err != nil {
+		logger.Error().Msgf("Error reloading certificates, keeping the previous ones: %v", err)
+		return
+	}
+	logger.Info().Msgf("Reloaded certificate %s", r.certFile)
+}
+
+// Get the modification times of the files.
+func (r *certReloader) modified() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// Load the files. The caller must hold the lock, or be the constructor.
+func (r *certReloader) load(modTimes map[string]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate %s: %v", r.certFile, err)
+	}
+	var clientCAs *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("error reading client CA file: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", r.caFile)
+		}
+	}
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return nil
+}
+
+// Create a TLS configuration for the given minimum version ("1.2" or "1.3") and client authentication ("none",
+// "optional" or "require"), using the current certificates for every new connection.
+func (r *certReloader) tlsConfig(minVersion string, clientAuth string) (*tls.Config, error) {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.NoClientCert,
+	}
+	switch minVersion {
+	case "1.2":
+	case "1.3":
+		base.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported minimum TLS version %s", minVersion)
+	}
+	switch clientAuth {
+	case "none":
+	case "optional":
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unsupported client authentication %s", clientAuth)
+	}
+	if base.ClientAuth != tls.NoClientCert && r.caFile == "" {
+		return nil, errors.New("client certificates can't be verified without a CA file")
+	}
+
+	server := base.Clone()
+	server.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.refresh(time.Now())
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		current := base.Clone()
+		current.Certificates = []tls.Certificate{*r.cert}
+		current.ClientCAs = r.clientCAs
+		return current, nil
+	}
+	return server, nil
+}
+
+// Create the TLS configuration of the web server from the configuration file. Without certificate files, the local CA
+// and a server certificate it issued are used, and created when they don't exist yet. Without a CA file, client
+// certificates are verified against the local CA.
+func configuredTLS() (*tls.Config, error) {
+	authority := pki.NewAuthority(config.GetTLSDir())
+	certFile := config.GetTLSCertFile()
+	keyFile := config.GetTLSKeyFile()
+	if certFile == "" {
+		issued, err := authority.EnsureServer(config.GetTLSHostnames(), time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if issued {
+			logger.Info().Msgf("Issued server certificate %s for %v with the local CA", authority.CertFile(),
+				config.GetTLSHostnames())
+		}
+		certFile = authority.CertFile()
+		keyFile = authority.KeyFile()
+	}
+	caFile := ""
+	if config.GetTLSClientAuth() != "none" {
+		caFile = config.GetTLSClientCAFile()
+		if caFile == "" {
+			if err := authority.EnsureCA(); err != nil {
+				return nil, err
+			}
+			caFile = authority.CAFile()
+		}
+	}
+	r, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	return r.tlsConfig(config.GetTLSMinVersion(), config.GetTLSClientAuth())
+}
+
+// The identity of a client certificate: the name recorded as source of its commands, its scopes and the pinned
+// fingerprint, if any. As for API keys, the admin scope grants all scopes.
+type certIdentity struct {
+	name        string
+	fingerprint string
+	scopes      map[string]bool
+}
+
+// Check if the identity has a scope.
+func (i *certIdentity) allows(scope string) bool {
+	return i.scopes[config.ScopeAdmin] || i.scopes[scope]
+}
+
+// Index the configured client certificates by subject.
+func certIdentities(certs []config.ClientCertConfig) map[string]*certIdentity {
+	identities := make(map[string]*certIdentity)
+	for _, cert := range certs {
+		identity := &certIdentity{
+			name:        cert.Name,
+			fingerprint: cert.Fingerprint,
+			scopes:      make(map[string]bool),
+		}
+		for _, scope := range cert.Scopes {
+			identity.scopes[scope] = true
+		}
+		identities[cert.Subject] = identity
+	}
+	return identities
+}
+
+// ReloadClientCerts replaces the mapping of client certificates to names and scopes, e.g. after the configuration
+// file changed. Requests authenticated afterwards use the new mapping.
+func (s *WebService) ReloadClientCerts(certs []config.ClientCertConfig) {
+	identities := certIdentities(certs)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.clientCerts = identities
+}
+
+// Get the identity of the verified client certificate of a request, or nil if the request has no verified client
+// certificate, its subject isn't mapped to an identity, it isn't the certificate pinned for the subject, or it was
+// revoked.
+func (s *WebService) clientCertIdentity(c echo.Context) *certIdentity {
+	state := c.Request().TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	if s.revokedCerts.revoked(cert, time.Now()) {
+		logger.Warn().Msgf("Revoked client certificate %s (serial: %s, ip: %v)", cert.Subject,
+			pki.Serial(cert.SerialNumber), c.RealIP())
+		return nil
+	}
+	s.lock.RLock()
+	identity := s.clientCerts[cert.Subject.String()]
+	s.lock.RUnlock()
+	if identity == nil {
+		return nil
+	}
+	if identity.fingerprint != "" && identity.fingerprint != pki.Fingerprint(cert) {
+		logger.Warn().Msgf("Client certificate of %s (ip: %v) doesn't match the pinned fingerprint", identity.name,
+			c.RealIP())
+		return nil
+	}
+	return identity
+}
+
+// revokedCerts keeps the serial numbers of the revoked client certificates, and reloads them when the document in the
+// store changes, checking at most every certCheckInterval. A certificate revoked with the command line is refused
+// within seconds. When the document can't be read, the previous revocations are kept.
+type revokedCerts struct {
+	store   *storage.Store
+	serials map[string]pki.Revocation
+	modTime time.Time
+	checked time.Time
+	lock    sync.Mutex
+}
+
+// Creates a new revokedCerts object. The revocations are loaded with the first check.
+func newRevokedCerts(store *storage.Store) *revokedCerts {
+	return &revokedCerts{
+		store:   store,
+		serials: make(map[string]pki.Revocation),
+	}
+}
+
+// Check if a certificate was revoked.
+func (r *revokedCerts) revoked(cert *x509.Certificate, now time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.refresh(now)
+	_, revoked := r.serials[pki.Serial(cert.SerialNumber)]
+	return revoked
+}
+
+// Reload the revocations if the document changed since it was last read. The caller must hold the lock.
+func (r *revokedCerts) refresh(now time.Time) {
+	if !r.checked.IsZero() && now.Sub(r.checked) < certCheckInterval {
+		return
+	}
+	r.checked = now
+	modTime, err := pki.RevocationsModTime(r.store)
+	if err != nil {
+		logger.Error().Msgf("Error checking revoked client certificates: %v", err)
+		return
+	}
+	if modTime.Equal(r.modTime) {
+		return
+	}
+	serials, err := pki.Revocations(r.store)
+	if err != nil {
+		logger.Error().Msgf("Error loading revoked client certificates, keeping the previous ones: %v", err)
+		return
+	}
+	r.serials = serials
+	r.modTime = modTime
+}
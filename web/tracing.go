@@ -0,0 +1,70 @@
+package web
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/dlefevre/go.garagedoor-service/tracing"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer for the spans of requests and websocket commands.
+var tracer = tracing.Tracer("web")
+
+// Routes that aren't traced, as they are requested often and never actuate the door.
+var untracedRoutes = map[string]bool{
+	"/readyz":  true,
+	"/healthz": true,
+	"/metrics": true,
+	"/":        true,
+	"/ui*":     true,
+}
+
+// Middleware handler to trace requests, continuing the trace of the client when the request has a traceparent
+// header. Errors are handled here, so the status of the response is known when the span ends.
+func traceRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		route := c.Path()
+		if untracedRoutes[route] {
+			return next(c)
+		}
+		req := c.Request()
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.Start(ctx, req.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(req.Method),
+				semconv.HTTPRoute(route),
+				semconv.ClientAddress(c.RealIP())))
+		defer span.End()
+		c.SetRequest(req.WithContext(ctx))
+
+		if err := next(c); err != nil {
+			span.RecordError(err)
+			c.Error(err)
+		}
+		status := c.Response().Status
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return nil
+	}
+}
+
+// Start the span of a command received on a websocket. Commands start their own trace, linked to the span of the
+// request that opened the connection, as that span lasts as long as the connection.
+func (c wsClient) startCommand(command string) (context.Context, trace.Span) {
+	return tracer.Start(context.Background(), "websocket.command",
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithLinks(trace.Link{SpanContext: c.connection}),
+		trace.WithAttributes(
+			tracing.AttrCommand.String(command),
+			tracing.AttrSource.String(c.source)))
+}
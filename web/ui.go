@@ -0,0 +1,20 @@
+package web
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// The web control panel: a single page that uses the session login, the event stream and the command endpoints.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// Get the files of the web control panel, rooted at the ui directory.
+func uiFS() fs.FS {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return files
+}
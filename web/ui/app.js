@@ -0,0 +1,347 @@
+// Garage door control panel. Logs in with a browser session, follows the door over the event stream, and sends
+// commands with a hold-to-confirm gesture.
+"use strict";
+
+const HOLD_DURATION = 1000;
+const HISTORY_SIZE = 20;
+const STREAMED_EVENTS = ["command", "command_rejected", "lock", "unlock", "alert", "alert_cleared", "alert_acked"];
+
+let csrfToken = "";
+let stream = null;
+let current = { state: "unknown", lock: { locked: false } };
+
+const $ = (id) => document.getElementById(id);
+
+// Send a request to the API. State-changing requests carry the CSRF token of the session.
+async function api(method, path, body) {
+  const headers = { "Accept": "application/json" };
+  if (method !== "GET") {
+    headers["X-CSRF-Token"] = csrfToken;
+  }
+  if (body !== undefined) {
+    headers["Content-Type"] = "application/json";
+  }
+  const response = await fetch(path, {
+    method,
+    headers,
+    credentials: "same-origin",
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  let data = {};
+  try {
+    data = await response.json();
+  } catch (e) {
+    // Not every response has a body.
+  }
+  if (response.status === 401) {
+    showLogin();
+  }
+  return { ok: response.ok, status: response.status, data };
+}
+
+function showLogin() {
+  if (stream) {
+    stream.close();
+    stream = null;
+  }
+  $("panel").hidden = true;
+  $("login").hidden = false;
+}
+
+function showPanel() {
+  $("login").hidden = true;
+  $("panel").hidden = false;
+  connect();
+  loadHistory();
+  loadAlerts();
+}
+
+async function start() {
+  const result = await api("GET", "/session");
+  if (result.ok) {
+    csrfToken = result.data.csrf_token;
+    showPanel();
+  } else {
+    showLogin();
+  }
+}
+
+async function login(event) {
+  event.preventDefault();
+  const form = event.target;
+  const error = $("login-error");
+  error.hidden = true;
+  const result = await api("POST", "/login", {
+    username: form.username.value,
+    password: form.password.value,
+  });
+  if (!result.ok) {
+    error.textContent = result.data.message || "Login failed";
+    error.hidden = false;
+    return;
+  }
+  form.password.value = "";
+  csrfToken = result.data.csrf_token;
+  showPanel();
+}
+
+async function logout() {
+  await api("POST", "/logout");
+  csrfToken = "";
+  showLogin();
+}
+
+// Follow the door over the event stream. The browser reconnects by itself, resuming from the last event id.
+function connect() {
+  if (stream) {
+    stream.close();
+  }
+  stream = new EventSource("/events/stream");
+  stream.onopen = () => setConnection(true);
+  stream.onerror = async () => {
+    setConnection(false);
+    if (stream && stream.readyState === EventSource.CLOSED) {
+      // The stream was refused, most likely because the session expired.
+      const result = await api("GET", "/session");
+      if (result.ok) {
+        setTimeout(connect, 3000);
+      }
+    }
+  };
+  stream.addEventListener("state", (message) => {
+    const data = JSON.parse(message.data);
+    if (data.result) {
+      // Sent when connecting: the state, the lock status and the last transition.
+      current.lock = data.lock;
+      updateState(data.state, data.event);
+      return;
+    }
+    updateState(data.state, null);
+    addHistory(data);
+  });
+  for (const type of STREAMED_EVENTS) {
+    stream.addEventListener(type, (message) => {
+      const data = JSON.parse(message.data);
+      addHistory(data);
+      if (type === "lock" || type === "unlock") {
+        loadState();
+      } else if (type.startsWith("alert")) {
+        loadAlerts();
+      }
+    });
+  }
+}
+
+function setConnection(live) {
+  const element = $("connection");
+  element.textContent = live ? "live" : "offline";
+  element.classList.toggle("live", live);
+}
+
+async function loadState() {
+  const result = await api("GET", "/state");
+  if (result.ok) {
+    current.lock = result.data.lock;
+    updateState(result.data.state, result.data.event);
+  }
+}
+
+function updateState(state, event) {
+  current.state = state;
+  const element = $("state");
+  element.textContent = state;
+  element.className = "state " + state;
+
+  if (event && event.cause) {
+    $("state-detail").textContent = event.source ? `${event.cause} (${event.source})` : event.cause;
+  }
+
+  const lock = $("lock");
+  if (current.lock && current.lock.locked) {
+    let text = "Locked for maintenance";
+    if (current.lock.reason) {
+      text += ": " + current.lock.reason;
+    }
+    if (current.lock.expires) {
+      text += ` until ${formatTime(current.lock.expires)}`;
+    }
+    lock.textContent = text;
+    lock.hidden = false;
+  } else {
+    lock.hidden = true;
+  }
+
+  const action = $("action");
+  if (state === "open") {
+    action.dataset.command = "close";
+    action.querySelector(".label").textContent = "Hold to close";
+  } else if (state === "closed") {
+    action.dataset.command = "open";
+    action.querySelector(".label").textContent = "Hold to open";
+  } else {
+    action.dataset.command = "toggle";
+    action.querySelector(".label").textContent = "Hold to toggle";
+  }
+  for (const button of document.querySelectorAll(".hold")) {
+    button.disabled = Boolean(current.lock && current.lock.locked);
+  }
+}
+
+async function loadHistory() {
+  const result = await api("GET", "/events");
+  if (!result.ok) {
+    return;
+  }
+  const list = $("history");
+  list.replaceChildren();
+  const events = result.data.events.filter((event) => event.type === "state" || STREAMED_EVENTS.includes(event.type));
+  for (const event of events.slice(-HISTORY_SIZE)) {
+    addHistory(event);
+  }
+  if (!list.children.length) {
+    list.append(emptyItem("No events"));
+  }
+}
+
+function addHistory(event) {
+  const list = $("history");
+  const empty = list.querySelector(".empty");
+  if (empty) {
+    empty.remove();
+  }
+  if (event.id && list.querySelector(`[data-id="${event.id}"]`)) {
+    return;
+  }
+  const item = document.createElement("li");
+  if (event.id) {
+    item.dataset.id = event.id;
+  }
+  const text = document.createElement("span");
+  text.textContent = describe(event);
+  if (event.level) {
+    text.className = event.level;
+  }
+  const time = document.createElement("time");
+  time.textContent = formatTime(event.time);
+  item.append(text, time);
+  list.prepend(item);
+  while (list.children.length > HISTORY_SIZE) {
+    list.lastChild.remove();
+  }
+}
+
+function describe(event) {
+  const source = event.source ? ` by ${event.source}` : "";
+  switch (event.type) {
+    case "state":
+      return `Door ${event.state}`;
+    case "command":
+      return `${capitalize(event.command)}${source}`;
+    case "command_rejected":
+      return `${capitalize(event.command)}${source} refused: ${event.message}`;
+    case "lock":
+      return `Locked${source}` + (event.message ? `: ${event.message}` : "");
+    case "unlock":
+      return `Unlocked${source}`;
+    default:
+      return event.message || event.type;
+  }
+}
+
+async function loadAlerts() {
+  const result = await api("GET", "/alerts");
+  if (!result.ok) {
+    return;
+  }
+  const list = $("alerts");
+  list.replaceChildren();
+  for (const alert of result.data.alerts.filter((alert) => alert.level !== "none")) {
+    const item = document.createElement("li");
+    const text = document.createElement("span");
+    text.className = alert.level;
+    text.textContent = `Door left open since ${formatTime(alert.since)}`;
+    item.append(text);
+    if (alert.acknowledged) {
+      const by = document.createElement("time");
+      by.textContent = `acknowledged by ${alert.acknowledged_by}`;
+      item.append(by);
+    } else {
+      const button = document.createElement("button");
+      button.textContent = "Acknowledge";
+      button.addEventListener("click", async () => {
+        await api("POST", `/alerts/${encodeURIComponent(alert.id)}/ack`);
+        loadAlerts();
+      });
+      item.append(button);
+    }
+    list.append(item);
+  }
+  if (!list.children.length) {
+    list.append(emptyItem("No alerts"));
+  }
+}
+
+// Commands are only sent when the button is held down for the hold duration, so a stray tap doesn't move the door.
+function setUpHoldButton(button) {
+  let timer = null;
+  button.style.setProperty("--hold-duration", `${HOLD_DURATION}ms`);
+
+  const cancel = () => {
+    clearTimeout(timer);
+    timer = null;
+    button.classList.remove("holding");
+  };
+  button.addEventListener("pointerdown", (event) => {
+    if (button.disabled) {
+      return;
+    }
+    event.preventDefault();
+    button.setPointerCapture(event.pointerId);
+    button.classList.add("holding");
+    timer = setTimeout(() => {
+      cancel();
+      if (navigator.vibrate) {
+        navigator.vibrate(50);
+      }
+      sendCommand(button.dataset.command);
+    }, HOLD_DURATION);
+  });
+  for (const type of ["pointerup", "pointercancel", "lostpointercapture"]) {
+    button.addEventListener(type, cancel);
+  }
+  button.addEventListener("contextmenu", (event) => event.preventDefault());
+}
+
+async function sendCommand(command) {
+  const element = $("command-result");
+  element.textContent = `Sending ${command}…`;
+  const result = await api("POST", "/" + command);
+  element.textContent = result.ok ? `${capitalize(command)} sent` : result.data.message || `${command} failed`;
+}
+
+function emptyItem(text) {
+  const item = document.createElement("li");
+  item.className = "empty";
+  item.textContent = text;
+  return item;
+}
+
+function formatTime(value) {
+  if (!value) {
+    return "";
+  }
+  const date = new Date(value);
+  const today = new Date().toDateString() === date.toDateString();
+  return today ? date.toLocaleTimeString() : date.toLocaleString();
+}
+
+function capitalize(text) {
+  return text ? text.charAt(0).toUpperCase() + text.slice(1) : "";
+}
+
+$("login-form").addEventListener("submit", login);
+$("logout").addEventListener("click", logout);
+for (const button of document.querySelectorAll(".hold")) {
+  setUpHoldButton(button);
+}
+start();
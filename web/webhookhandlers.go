@@ -0,0 +1,80 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/dlefevre/go.garagedoor-service/webhooks"
+	"github.com/labstack/echo/v4"
+)
+
+// WebhookDeliveriesResponse is a response object for webhook deliveries, containing a result (ok) and the deliveries.
+type WebhookDeliveriesResponse struct {
+	SimpleResponse
+	Deliveries []webhooks.Delivery `json:"deliveries"`
+}
+
+// WebhookDeliveryResponse is a response object for a single webhook delivery, containing a result (ok) and the
+// delivery.
+type WebhookDeliveryResponse struct {
+	SimpleResponse
+	Delivery webhooks.Delivery `json:"delivery"`
+}
+
+// List the webhook deliveries waiting to be sent.
+func listPendingWebhooks(c echo.Context) error {
+	return c.JSON(http.StatusOK, WebhookDeliveriesResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Deliveries: webhooks.GetDispatcher().Pending(),
+	})
+}
+
+// List the webhook deliveries for which all attempts failed.
+func listDeadLetters(c echo.Context) error {
+	return c.JSON(http.StatusOK, WebhookDeliveriesResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Deliveries: webhooks.GetDispatcher().DeadLetters(),
+	})
+}
+
+// Move a dead letter back to the queue.
+func replayDeadLetter(c echo.Context) error {
+	delivery, err := webhooks.GetDispatcher().Replay(c.Param("id"))
+	if err != nil {
+		return webhookError(c, err)
+	}
+	return c.JSON(http.StatusOK, WebhookDeliveryResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "ok",
+		},
+		Delivery: delivery,
+	})
+}
+
+// Discard a dead letter.
+func discardDeadLetter(c echo.Context) error {
+	if err := webhooks.GetDispatcher().Discard(c.Param("id")); err != nil {
+		return webhookError(c, err)
+	}
+	return c.JSON(http.StatusOK, SimpleResponse{
+		Result: "ok",
+	})
+}
+
+// Report an error from the webhook dispatcher to the client.
+func webhookError(c echo.Context, err error) error {
+	status := http.StatusInternalServerError
+	if errors.Is(err, webhooks.ErrNotFound) {
+		status = http.StatusNotFound
+	}
+	return c.JSON(status, ErrorResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "nok",
+		},
+		Message: err.Error(),
+	})
+}
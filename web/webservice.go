@@ -2,27 +2,44 @@ package web
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"sync"
 	"time"
 
+	"github.com/dlefevre/go.garagedoor-service/apikeys"
 	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/logging"
+	"github.com/dlefevre/go.garagedoor-service/metrics"
+	"github.com/dlefevre/go.garagedoor-service/storage"
+	"github.com/dlefevre/go.garagedoor-service/systemd"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"github.com/rs/zerolog/log"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// Logger of the web component.
+var logger = logging.Logger("web")
+
+// Logger of the request log, a component of its own so it can be silenced or made verbose separately.
+var requestLogger = logging.Logger("http")
+
 var (
 	instance *WebService
 	once     sync.Once
 )
 
-// WebService is a singleton that encapsulates the web server, and retains a cache of valid API keys.
+// WebService is a singleton that encapsulates the web server, and keeps the browser sessions.
 type WebService struct {
-	echo    *echo.Echo
-	apiKeys map[string]bool
+	echo         *echo.Echo
+	streams      chan struct{}
+	sessions     *sessionStore
+	bans         *banList
+	clientCerts  map[string]*certIdentity
+	revokedCerts *revokedCerts
+	lock         sync.RWMutex
 }
 
 // GetWebService returns the one and only WebServiceImpl instance.
@@ -36,87 +53,245 @@ func GetWebService() *WebService {
 // Creates a new WebServiceImpl object.
 func newWebService() *WebService {
 	return &WebService{
-		echo:    nil,
-		apiKeys: make(map[string]bool),
+		echo:         nil,
+		sessions:     newSessionStore(),
+		bans:         configuredBanList(),
+		clientCerts:  certIdentities(config.GetTLSClientCerts()),
+		revokedCerts: newRevokedCerts(storage.GetStore()),
 	}
 }
 
 // Configure the Echo web server.
 func (s *WebService) setUpEcho() {
 	s.echo = echo.New()
+	s.streams = make(chan struct{})
+	s.echo.IPExtractor = ipExtractor(config.GetTrustedProxies())
 
 	s.echo.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		LogMethod:     true,
 		LogURI:        true,
 		LogStatus:     true,
-		LogValuesFunc: logger,
+		LogLatency:    true,
+		LogRemoteIP:   true,
+		LogValuesFunc: logRequest,
 	}))
+	s.echo.Use(traceRequests)
+
+	s.echo.GET("/readyz", readiness)
+	s.echo.GET("/healthz", liveness)
+	s.echo.POST("/login", s.login, s.rejectBanned)
+	s.echo.GET("/session", s.currentSession)
 
-	s.echo.GET("/readyz", healthCheck)
-	s.echo.GET("/healthz", healthCheck)
+	ui := uiFS()
+	s.echo.FileFS("/", "index.html", ui)
+	s.echo.StaticFS("/ui", ui)
 
 	protected := s.echo.Group("")
-	protected.Use(s.validateAPIKey)
+	protected.Use(s.rejectBanned, s.authenticate)
+
+	protected.POST("/logout", s.logout)
+
+	read := requireScope(config.ScopeStateRead)
+	operate := requireScope(config.ScopeDoorOperate)
+	admin := requireScope(config.ScopeAdmin)
 
-	protected.POST("/toggle", toggle)
-	protected.GET("/state", state)
-	protected.GET("/ws", ws)
+	protected.POST("/toggle", toggle, operate)
+	protected.POST("/open", openDoor, operate)
+	protected.POST("/close", closeDoor, operate)
+	protected.GET("/state", state, read)
+	protected.GET("/events", events, read)
+	protected.GET("/events/stream", s.eventStream, read)
+	protected.GET("/events/subscribers", busStats, admin)
+	protected.POST("/lock", lock, admin)
+	protected.DELETE("/lock", unlock, admin)
+	protected.GET("/schedules", listSchedules, read)
+	protected.POST("/schedules", addSchedule, admin)
+	protected.DELETE("/schedules/:name", removeSchedule, admin)
+	protected.GET("/rules", listRules, read)
+	protected.GET("/alerts", listAlerts, read)
+	protected.POST("/alerts/:id/ack", acknowledgeAlert, operate)
+	protected.GET("/webhooks/pending", listPendingWebhooks, admin)
+	protected.GET("/webhooks/dead-letters", listDeadLetters, admin)
+	protected.POST("/webhooks/dead-letters/:id/replay", replayDeadLetter, admin)
+	protected.DELETE("/webhooks/dead-letters/:id", discardDeadLetter, admin)
+	protected.GET("/keys", listKeys, admin)
+	protected.POST("/keys", createKey, admin)
+	protected.DELETE("/keys/:name", revokeKey, admin)
+	protected.POST("/keys/:name/rotate", rotateKey, admin)
+	protected.GET("/bans", s.listBans, admin)
+	protected.DELETE("/bans", s.clearBans, admin)
+	protected.DELETE("/bans/:ip", s.clearBan, admin)
+	protected.GET("/log/levels", logLevels, admin)
+	protected.PUT("/log/levels", setLogLevels, admin)
+	protected.GET("/ws", ws, read)
+
+	if config.GetMetricsEnabled() {
+		handler := echo.WrapHandler(metrics.Handler())
+		switch config.GetMetricsAuth() {
+		case "none":
+			s.echo.GET("/metrics", handler)
+		case "basic":
+			s.echo.GET("/metrics", handler, s.rejectBanned, s.authenticateMetrics)
+		default:
+			protected.GET("/metrics", handler, read)
+		}
+	}
 }
 
-// Start the web server.
+// Start the web server, serving HTTPS when TLS is enabled. The server listens on the socket passed by systemd socket
+// activation, or binds bind.host:bind.port itself without socket activation. The server is listening when Start
+// returns.
 func (s *WebService) Start() {
 	s.setUpEcho()
-	address := fmt.Sprintf("%s:%d", config.GetBindHost(), config.GetBindPort())
+	listener, err := listen()
+	if err != nil {
+		logger.Fatal().Msgf("%v", err)
+	}
+	server := s.echo.Server
+	if config.GetTLSEnabled() {
+		tlsConfig, err := configuredTLS()
+		if err != nil {
+			logger.Fatal().Msgf("Error loading TLS configuration: %v", err)
+		}
+		server = s.echo.TLSServer
+		server.TLSConfig = tlsConfig
+		s.echo.TLSListener = tls.NewListener(listener, tlsConfig)
+	} else {
+		s.echo.Listener = listener
+	}
 	go func() {
-		if err := s.echo.Start(address); err != nil && err != http.ErrServerClosed {
-			log.Fatal().Msgf("%v", err)
+		if err := s.echo.StartServer(server); err != nil && err != http.ErrServerClosed {
+			logger.Fatal().Msgf("%v", err)
 		}
 	}()
 }
 
-// Stop the web server.
+// Get the socket passed by socket activation, or bind bind.host:bind.port when the service wasn't socket activated.
+func listen() (net.Listener, error) {
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 {
+		for _, extra := range listeners[1:] {
+			logger.Warn().Msgf("Ignoring additional socket %s passed by socket activation", extra.Addr())
+			extra.Close()
+		}
+		logger.Info().Msgf("Listening on %s, passed by socket activation", listeners[0].Addr())
+		return listeners[0], nil
+	}
+	address := fmt.Sprintf("%s:%d", config.GetBindHost(), config.GetBindPort())
+	return net.Listen("tcp", address)
+}
+
+// Stop the web server. Open event streams are closed first, as they would otherwise block the shutdown.
 func (s *WebService) Stop() {
+	close(s.streams)
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	if err := s.echo.Shutdown(ctx); err != nil {
-		log.Fatal().Msgf("%v", err)
+		logger.Fatal().Msgf("%v", err)
 	}
 	s.echo = nil
 
 }
 
-// Middleware handler to validate the API key. The API key is first matched against an internal
-// cache of valid keys, then against the list of keys in the configuration file.
-func (s *WebService) validateAPIKey(next echo.HandlerFunc) echo.HandlerFunc {
+// Middleware handler to authenticate requests, either with an API key in the x-api-key header, with a verified client
+// certificate whose subject is mapped to an identity, or with a session cookie. The API key is verified by the
+// KeyManager, and must not be expired or used outside its time windows. When too many unknown keys are tried, requests
+// with an uncached key are refused with status 429. Invalid API keys count as failed authentications of the client,
+// which is banned after too many failures. The user (the name of the key or certificate for API keys and client
+// certificates), the authentication method and the API key are stored in the context.
+func (s *WebService) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		apiKey := c.Request().Header.Get("x-api-key")
-		if s.apiKeys[apiKey] {
+		if apiKey := c.Request().Header.Get("x-api-key"); apiKey != "" {
+			now := time.Now()
+			key, err := apikeys.GetKeyManager().Verify(apiKey, now)
+			if errors.Is(err, apikeys.ErrThrottled) {
+				logger.Warn().Msgf("Throttled API key verification for %v (ip: %v)", c.Request().RequestURI, c.RealIP())
+				return tooManyRequests(c, time.Second)
+			}
+			if err == nil {
+				err = key.Usable(now)
+			}
+			if err != nil {
+				logger.Warn().Msgf("Unauthorized request to %v (ip: %v): %v", c.Request().RequestURI, c.RealIP(), err)
+				return s.refuse(c, authAPIKey, err.Error())
+			}
+			s.bans.success(c.RealIP())
+			apikeys.GetKeyManager().Used(key.Name, now)
+			c.Set(contextUser, key.Name)
+			c.Set(contextAuth, authAPIKey)
+			c.Set(contextKey, key)
 			return next(c)
 		}
 
-		for _, digest := range config.GetAPIKeys() {
-			if err := bcrypt.CompareHashAndPassword([]byte(digest), []byte(apiKey)); err == nil {
-				s.apiKeys[apiKey] = true
-				return next(c)
-			}
+		if identity := s.clientCertIdentity(c); identity != nil {
+			c.Set(contextUser, identity.name)
+			c.Set(contextAuth, authCert)
+			c.Set(contextCert, identity)
+			return next(c)
+		}
+
+		sess, err := s.authenticateSession(c)
+		if err == nil {
+			c.Set(contextUser, sess.username)
+			c.Set(contextAuth, authSession)
+			c.Set(contextSession, sess)
+			return next(c)
+		}
+		if errors.Is(err, errCSRF) {
+			return c.JSON(http.StatusForbidden, ErrorResponse{
+				SimpleResponse: SimpleResponse{
+					Result: "nok",
+				},
+				Message: "Forbidden",
+			})
 		}
 
-		log.Warn().Msgf("Unauthorized request to %v (forwarded ip: %v)",
-			c.Request().RequestURI,
-			c.Request().Header.Get("x-forwarded-for"))
-		return c.JSON(http.StatusUnauthorized, ErrorResponse{
-			SimpleResponse: SimpleResponse{
-				Result: "nok",
-			},
-			Message: "Unauthorized",
-		})
+		logger.Warn().Msgf("Unauthorized request to %v (ip: %v)", c.Request().RequestURI, c.RealIP())
+		return unauthorized(c)
 	}
 }
 
-// Middleware handler to log requests.
-func logger(c echo.Context, v middleware.RequestLoggerValues) error {
-	log.Info().
+// Refuse a request after a failed authentication with the given method and reason, with status 429 if the client got
+// banned as a result.
+func (s *WebService) refuse(c echo.Context, method string, reason string) error {
+	if ban, banned := s.authenticationFailed(c, method, reason); banned {
+		return tooManyRequests(c, time.Until(ban.Until))
+	}
+	return unauthorized(c)
+}
+
+// Report an unauthorized request to the client.
+func unauthorized(c echo.Context) error {
+	return c.JSON(http.StatusUnauthorized, ErrorResponse{
+		SimpleResponse: SimpleResponse{
+			Result: "nok",
+		},
+		Message: "Unauthorized",
+	})
+}
+
+// Routes whose requests are logged at debug level.
+var quietRoutes = map[string]bool{
+	"/readyz":  true,
+	"/healthz": true,
+	"/metrics": true,
+}
+
+// Middleware handler to log requests. Probes and metrics scrapes are logged at debug level, as they are frequent.
+func logRequest(c echo.Context, v middleware.RequestLoggerValues) error {
+	event := requestLogger.Info()
+	if quietRoutes[c.Path()] {
+		event = requestLogger.Debug()
+	}
+	event.
+		Str("method", v.Method).
 		Str("URI", v.URI).
 		Int("status", v.Status).
+		Dur("latency", v.Latency).
+		Str("remote_ip", v.RemoteIP).
 		Msg("request")
 
 	return nil
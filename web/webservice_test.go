@@ -1,22 +1,52 @@
 package web
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/dlefevre/go.garagedoor-service/alerts"
+	"github.com/dlefevre/go.garagedoor-service/audit"
+	"github.com/dlefevre/go.garagedoor-service/config"
 	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/dlefevre/go.garagedoor-service/pki"
+	"github.com/dlefevre/go.garagedoor-service/scheduler"
+	"github.com/dlefevre/go.garagedoor-service/storage"
+	"github.com/dlefevre/go.garagedoor-service/tracing"
+	"github.com/dlefevre/go.garagedoor-service/webhooks"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 	"golang.org/x/net/websocket"
 )
 
 func init() {
 	// Set the environment variable for the configuration path
 	os.Setenv("GARAGESERVICE_CONFIG_PATH", "..")
+	dataDir, _ := os.MkdirTemp("", "garagedoor-service-test")
+	os.Setenv("GARAGESERVICE_DATA_DIR", dataDir)
+	// The tests toggle the door in quick succession.
+	os.Setenv("GARAGESERVICE_COMMAND_MIN_INTERVAL", "0s")
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 }
 
@@ -35,19 +65,31 @@ func teardown() {
 	dc.Stop()
 	ws := GetWebService()
 	ws.Stop()
+	// The server closed its connections, so a kept-alive connection must not be reused by the next test.
+	http.DefaultClient.CloseIdleConnections()
 }
 
+// Toggle the door through the API. A toggle requested while the previous one is still being executed is coalesced,
+// so it is retried until the previous one is done.
 func toggleHelper(t *testing.T) {
 	client := &http.Client{}
 
-	req, err := http.NewRequest("POST", "http://localhost:8000/toggle", nil)
-	if err != nil {
-		t.Fatalf("Error creating request: %v", err)
-	}
-	req.Header.Add("x-api-key", "test")
-	resp, err := client.Do(req)
-	if err != nil {
-		t.Fatalf("Error sending request: %v", err)
+	var resp *http.Response
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		req, err := http.NewRequest("POST", "http://localhost:8000/toggle", nil)
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		req.Header.Add("x-api-key", "test")
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		if resp.StatusCode != http.StatusTooManyRequests || time.Now().After(deadline) {
+			break
+		}
+		resp.Body.Close()
+		time.Sleep(50 * time.Millisecond)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
@@ -139,50 +181,1269 @@ func TestWebSocket(t *testing.T) {
 	}
 	defer ws.Close()
 
-	// Listen for responses
-	stateStr := ""
+	// Listen for responses.
+	responses := make(chan StateResponse, 100)
 	go func() {
+		defer close(responses)
+		for {
+			var response StateResponse
+			if err := websocket.JSON.Receive(ws, &response); err != nil {
+				return
+			}
+			responses <- response
+		}
+	}()
+
+	// Send a command until the door reports the expected state. A toggle sent while the previous one is still being
+	// executed is coalesced and refused, so it is sent again.
+	send := func(command string, expected string) {
+		t.Helper()
+		if err := websocket.JSON.Send(ws, CommandMessage{Command: command}); err != nil {
+			t.Fatalf("Error sending %s command: %v", command, err)
+		}
+		timeout := time.After(3 * time.Second)
 		for {
-			var msg []byte
-			if err := websocket.Message.Receive(ws, &msg); err != nil {
-				break
+			select {
+			case response, ok := <-responses:
+				if !ok {
+					t.Fatalf("Expected state to be %s, connection closed", expected)
+				}
+				if response.Result != "ok" {
+					time.Sleep(50 * time.Millisecond)
+					if err := websocket.JSON.Send(ws, CommandMessage{Command: command}); err != nil {
+						t.Fatalf("Error sending %s command: %v", command, err)
+					}
+				} else if response.State == expected {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("Expected state to be %s", expected)
+			}
+		}
+	}
+	send("state", "closed")
+	send("toggle", "open")
+	send("toggle", "closed")
+}
+
+func lockHelper(t *testing.T, method string, body string, expectedLocked bool) {
+	client := &http.Client{}
+
+	req, err := http.NewRequest(method, "http://localhost:8000/lock", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Add("x-api-key", "test")
+	req.Header.Add("content-type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got %d", resp.StatusCode)
+	}
+	var myResponse LockResponse
+	if err := json.NewDecoder(resp.Body).Decode(&myResponse); err != nil {
+		t.Fatalf("Error unmarshalling response: %v", err)
+	}
+	if myResponse.Lock.Locked != expectedLocked {
+		t.Fatalf("Expected locked to be %v, got %v", expectedLocked, myResponse.Lock.Locked)
+	}
+}
+
+func TestLock(t *testing.T) {
+	setup()
+	defer teardown()
+
+	lockHelper(t, "POST", `{"reason": "maintenance", "duration": "1h"}`, true)
+
+	req, err := http.NewRequest("POST", "http://localhost:8000/toggle", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Add("x-api-key", "test")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusLocked {
+		t.Fatalf("Expected status code 423, got %d", resp.StatusCode)
+	}
+
+	lockHelper(t, "DELETE", "", false)
+	toggleHelper(t)
+}
+
+// A message received on the event stream.
+type streamMessage struct {
+	id    string
+	event string
+	data  string
+}
+
+// Connect to the event stream, and pass the received messages on the returned channel.
+func streamHelper(t *testing.T, lastEventID string) (chan streamMessage, func()) {
+	req, err := http.NewRequest("GET", "http://localhost:8000/events/stream", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Add("x-api-key", "test")
+	if lastEventID != "" {
+		req.Header.Add("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected event stream, got status code %d", resp.StatusCode)
+	}
+
+	messages := make(chan streamMessage, 16)
+	go func() {
+		defer close(messages)
+		scanner := bufio.NewScanner(resp.Body)
+		var message streamMessage
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if message.event != "" {
+					messages <- message
+				}
+				message = streamMessage{}
+			case strings.HasPrefix(line, "id: "):
+				message.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				message.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				message.data = strings.TrimPrefix(line, "data: ")
 			}
-			var myResponse StateResponse
-			if err := json.Unmarshal(msg, &myResponse); err != nil {
-				log.Fatal().Msgf("Error unmarshalling response: %v", err)
+		}
+	}()
+	return messages, func() { resp.Body.Close() }
+}
+
+// Wait for the next message on the event stream with the given event name, skipping others.
+func expectStreamMessage(t *testing.T, messages chan streamMessage, event string) streamMessage {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				t.Fatalf("Event stream closed while waiting for %s", event)
 			}
-			if myResponse.Result != "ok" {
-				log.Fatal().Msgf("Expected result to be ok, got %s", myResponse.Result)
+			if message.event == event {
+				return message
 			}
-			stateStr = myResponse.State
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %s on the event stream", event)
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	setup()
+	defer teardown()
+
+	messages, closeStream := streamHelper(t, "")
+	initial := expectStreamMessage(t, messages, "state")
+	var stateResponse StateResponse
+	if err := json.Unmarshal([]byte(initial.data), &stateResponse); err != nil {
+		t.Fatalf("Error unmarshalling state: %v", err)
+	}
+	if initial.id != "" || stateResponse.State != "closed" {
+		t.Fatalf("Expected initial closed state without id, got %+v", initial)
+	}
+
+	toggleHelper(t)
+	command := expectStreamMessage(t, messages, "command")
+	var event controller.Event
+	if err := json.Unmarshal([]byte(command.data), &event); err != nil {
+		t.Fatalf("Error unmarshalling event: %v", err)
+	}
+	if event.Source != "key:test" || command.id == "" {
+		t.Fatalf("Expected command event from key test with an id, got %+v", command)
+	}
+	state := expectStreamMessage(t, messages, "state")
+	if !strings.Contains(state.data, `"state":"open"`) {
+		t.Fatalf("Expected open state event, got %s", state.data)
+	}
+	closeStream()
+
+	// Resume from before the command, which replays the missed events.
+	id, _ := strconv.ParseUint(command.id, 10, 64)
+	messages, closeStream = streamHelper(t, strconv.FormatUint(id-1, 10))
+	defer closeStream()
+	expectStreamMessage(t, messages, "state")
+	replayed := expectStreamMessage(t, messages, "command")
+	if replayed.id != command.id {
+		t.Fatalf("Expected command %s to be replayed, got %s", command.id, replayed.id)
+	}
+
+	toggleHelper(t)
+	time.Sleep(500 * time.Millisecond)
+}
+
+// Connect to the websocket using the v2 protocol.
+func dialV2(t *testing.T) *websocket.Conn {
+	config, err := websocket.NewConfig("ws://localhost:8000/ws", "http://localhost:8000")
+	if err != nil {
+		t.Fatalf("Error creating websocket config: %v", err)
+	}
+	config.Protocol = []string{ProtocolV2, ProtocolV1}
+	config.Header = http.Header{
+		"x-api-key": []string{"test"},
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatalf("Error connecting to websocket: %v", err)
+	}
+	return ws
+}
+
+// Receive the next message of the given type from a v2 websocket, skipping others.
+func expectProtocolMessage(t *testing.T, ws *websocket.Conn, messageType string) ProtocolMessage {
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var message ProtocolMessage
+		if err := websocket.JSON.Receive(ws, &message); err != nil {
+			t.Fatalf("Error waiting for %s message: %v", messageType, err)
 		}
+		if message.Type == messageType {
+			return message
+		}
+	}
+}
+
+func TestWebSocketV2(t *testing.T) {
+	setup()
+	defer teardown()
+
+	ws := dialV2(t)
+	defer ws.Close()
+
+	initial := expectProtocolMessage(t, ws, MessageState)
+	if initial.State != "closed" || initial.Lock == nil {
+		t.Fatalf("Expected initial closed state with lock status, got %+v", initial)
+	}
+
+	// Malformed input is reported, and doesn't close the connection.
+	if err := websocket.Message.Send(ws, "{not json"); err != nil {
+		t.Fatalf("Error sending message: %v", err)
+	}
+	expectProtocolMessage(t, ws, MessageError)
+	websocket.JSON.Send(ws, ProtocolMessage{Type: MessageCommand, Command: "toggle"})
+	if message := expectProtocolMessage(t, ws, MessageError); message.Reason != "missing request id" {
+		t.Fatalf("Expected missing request id error, got %+v", message)
+	}
+	websocket.JSON.Send(ws, ProtocolMessage{Type: MessageCommand, ID: "1", Command: "fly"})
+	if message := expectProtocolMessage(t, ws, MessageNack); message.ID != "1" || message.Reason == "" {
+		t.Fatalf("Expected nack with reason for request 1, got %+v", message)
+	}
+
+	websocket.JSON.Send(ws, ProtocolMessage{Type: MessagePing, ID: "hb"})
+	if message := expectProtocolMessage(t, ws, MessagePong); message.ID != "hb" {
+		t.Fatalf("Expected pong for hb, got %+v", message)
+	}
+
+	websocket.JSON.Send(ws, ProtocolMessage{Type: MessageCommand, ID: "2", Command: "open"})
+	if message := expectProtocolMessage(t, ws, MessageAck); message.ID != "2" {
+		t.Fatalf("Expected ack for request 2, got %+v", message)
+	}
+	result := expectProtocolMessage(t, ws, MessageCommandResult)
+	if result.ID != "2" || result.Result != ResultCompleted || result.State != "open" {
+		t.Fatalf("Expected completed result for request 2, got %+v", result)
+	}
+
+	// Opening an open door completes immediately.
+	time.Sleep(600 * time.Millisecond)
+	websocket.JSON.Send(ws, ProtocolMessage{Type: MessageCommand, ID: "3", Command: "open"})
+	expectProtocolMessage(t, ws, MessageAck)
+	if result := expectProtocolMessage(t, ws, MessageCommandResult); result.ID != "3" || result.State != "open" {
+		t.Fatalf("Expected immediate result for request 3, got %+v", result)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	websocket.JSON.Send(ws, ProtocolMessage{Type: MessageCommand, ID: "4", Command: "close"})
+	expectProtocolMessage(t, ws, MessageAck)
+	if result := expectProtocolMessage(t, ws, MessageCommandResult); result.ID != "4" || result.State != "closed" {
+		t.Fatalf("Expected closed result for request 4, got %+v", result)
+	}
+}
+
+func TestWebSocketV2IdleTimeout(t *testing.T) {
+	setup()
+	defer teardown()
+
+	previousPing, previousIdle := pingInterval, idleTimeout
+	pingInterval, idleTimeout = 50*time.Millisecond, 200*time.Millisecond
+	defer func() {
+		pingInterval, idleTimeout = previousPing, previousIdle
 	}()
 
-	cmdState := CommandMessage{
-		Command: "state",
+	ws := dialV2(t)
+	defer ws.Close()
+	expectProtocolMessage(t, ws, MessagePing)
+
+	// Without answering, the server closes the connection after the idle timeout.
+	start := time.Now()
+	ws.SetReadDeadline(start.Add(2 * time.Second))
+	for {
+		var message ProtocolMessage
+		if err := websocket.JSON.Receive(ws, &message); err != nil {
+			break
+		}
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Expected the server to close the idle connection")
+	}
+}
+
+// Log in, and return the session cookies and the CSRF token.
+func loginHelper(t *testing.T, username string, password string, expectedStatus int) ([]*http.Cookie, string) {
+	body := fmt.Sprintf(`{"username": %q, "password": %q}`, username, password)
+	resp, err := http.Post("http://localhost:8000/login", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Expected status code %d, got %d", expectedStatus, resp.StatusCode)
+	}
+	var session SessionResponse
+	json.NewDecoder(resp.Body).Decode(&session)
+	return resp.Cookies(), session.CSRFToken
+}
+
+// Send a request with session cookies, and optionally a CSRF token, and return the status code.
+func sessionRequest(t *testing.T, method string, path string, cookies []*http.Cookie, csrfToken string) int {
+	req, err := http.NewRequest(method, "http://localhost:8000"+path, nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	if csrfToken != "" {
+		req.Header.Add("X-CSRF-Token", csrfToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSessionLogin(t *testing.T) {
+	setup()
+	defer teardown()
+
+	loginHelper(t, "admin", "wrong", http.StatusUnauthorized)
+	loginHelper(t, "nobody", "test", http.StatusUnauthorized)
+	cookies, csrfToken := loginHelper(t, "admin", "test", http.StatusOK)
+	if csrfToken == "" || len(cookies) != 2 {
+		t.Fatalf("Expected session and CSRF cookies, and a CSRF token")
+	}
+	for _, cookie := range cookies {
+		if cookie.Name == "garagedoor_session" && (!cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode) {
+			t.Fatalf("Expected HttpOnly strict session cookie, got %+v", cookie)
+		}
+	}
+
+	if status := sessionRequest(t, "GET", "/state", cookies, ""); status != http.StatusOK {
+		t.Fatalf("Expected state to be readable with a session, got %d", status)
+	}
+	if status := sessionRequest(t, "POST", "/toggle", cookies, ""); status != http.StatusForbidden {
+		t.Fatalf("Expected toggle without CSRF token to be forbidden, got %d", status)
 	}
-	cmdToggle := CommandMessage{
-		Command: "toggle",
+	if status := sessionRequest(t, "POST", "/toggle", cookies, "wrong"); status != http.StatusForbidden {
+		t.Fatalf("Expected toggle with wrong CSRF token to be forbidden, got %d", status)
 	}
-	if err := websocket.JSON.Send(ws, cmdState); err != nil {
-		t.Fatalf("Error sending state command: %v", err)
+	if status := sessionRequest(t, "POST", "/toggle", cookies, csrfToken); status != http.StatusOK {
+		t.Fatalf("Expected toggle with CSRF token to be accepted, got %d", status)
 	}
 	time.Sleep(500 * time.Millisecond)
-	if stateStr != "closed" {
-		t.Fatalf("Expected state to be closed, got %s", stateStr)
+	toggleHelper(t)
+	time.Sleep(500 * time.Millisecond)
+
+	if status := sessionRequest(t, "POST", "/logout", cookies, csrfToken); status != http.StatusOK {
+		t.Fatalf("Expected logout to succeed, got %d", status)
+	}
+	if status := sessionRequest(t, "GET", "/state", cookies, ""); status != http.StatusUnauthorized {
+		t.Fatalf("Expected session to be invalid after logout, got %d", status)
+	}
+}
+
+func TestSessionScopes(t *testing.T) {
+	setup()
+	defer teardown()
+
+	// The admin user is granted the admin scope in the configuration file.
+	cookies, _ := loginHelper(t, "admin", "test", http.StatusOK)
+	if status := sessionRequest(t, "GET", "/bans", cookies, ""); status != http.StatusOK {
+		t.Fatalf("Expected bans to be listed by the admin user, got %d", status)
+	}
+
+	// Users without scopes can read and operate, but not manage.
+	token, sess, err := GetWebService().sessions.create("operator", config.DefaultUserScopes, time.Now())
+	if err != nil {
+		t.Fatalf("Error creating session: %v", err)
+	}
+	cookies = []*http.Cookie{{Name: sessionCookie, Value: token}}
+	if status := sessionRequest(t, "GET", "/state", cookies, ""); status != http.StatusOK {
+		t.Fatalf("Expected state to be readable by an operator, got %d", status)
+	}
+	for _, route := range [][2]string{{"GET", "/bans"}, {"GET", "/keys"}, {"POST", "/lock"}, {"PUT", "/log/levels"}} {
+		if status := sessionRequest(t, route[0], route[1], cookies, sess.csrfToken); status != http.StatusForbidden {
+			t.Fatalf("Expected %s %s to be forbidden for an operator, got %d", route[0], route[1], status)
+		}
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	store := newSessionStore()
+	now := time.Now()
+	token, _, err := store.create("admin", config.DefaultUserScopes, now)
+	if err != nil {
+		t.Fatalf("Error creating session: %v", err)
+	}
+	if _, ok := store.get(token, now.Add(store.ttl-time.Second)); !ok {
+		t.Fatalf("Expected session to be valid before expiry")
+	}
+	if _, ok := store.get(token, now.Add(store.ttl+time.Second)); ok {
+		t.Fatalf("Expected session to be expired")
+	}
+	if len(store.sessions) != 0 {
+		t.Fatalf("Expected expired session to be removed")
+	}
+}
+
+func TestControlPanel(t *testing.T) {
+	setup()
+	defer teardown()
+
+	// The panel is served without authentication, the API behind it isn't.
+	for path, contentType := range map[string]string{
+		"/":                        "text/html",
+		"/ui/app.js":               "javascript",
+		"/ui/style.css":            "text/css",
+		"/ui/manifest.webmanifest": "",
+	} {
+		res, err := http.Get("http://localhost:8000" + path)
+		if err != nil {
+			t.Fatalf("Error getting %s: %v", path, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d", path, res.StatusCode)
+		}
+		if !strings.Contains(res.Header.Get("Content-Type"), contentType) {
+			t.Fatalf("Unexpected content type for %s: %s", path, res.Header.Get("Content-Type"))
+		}
+		if len(body) == 0 {
+			t.Fatalf("Expected content for %s", path)
+		}
 	}
-	if err := websocket.JSON.Send(ws, cmdToggle); err != nil {
-		t.Fatalf("Error sending toggle command: %v", err)
+	if status := sessionRequest(t, "POST", "/open", nil, ""); status != http.StatusUnauthorized {
+		t.Fatalf("Expected open without session to be unauthorized, got %d", status)
+	}
+
+	// Open and close, as the panel does with a session.
+	cookies, csrfToken := loginHelper(t, "admin", "test", http.StatusOK)
+	if status := sessionRequest(t, "POST", "/open", cookies, csrfToken); status != http.StatusOK {
+		t.Fatalf("Expected open to succeed, got %d", status)
+	}
+	time.Sleep(500 * time.Millisecond)
+	stateHelper(t, "open")
+	if status := sessionRequest(t, "POST", "/close", cookies, csrfToken); status != http.StatusOK {
+		t.Fatalf("Expected close to succeed, got %d", status)
 	}
 	time.Sleep(500 * time.Millisecond)
-	if stateStr != "open" {
-		t.Fatalf("Expected state to be open, got %s", stateStr)
+	stateHelper(t, "closed")
+}
+
+func keyRequest(t *testing.T, method string, path string, key string) int {
+	req, err := http.NewRequest(method, "http://localhost:8000"+path, nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("x-api-key", key)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func keyRequestBody(t *testing.T, method string, path string, key string, body string, v any) int {
+	req, err := http.NewRequest(method, "http://localhost:8000"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("x-api-key", key)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer res.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatalf("Error decoding response: %v", err)
+		}
+	}
+	return res.StatusCode
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	setup()
+	defer teardown()
+
+	var created KeySecretResponse
+	status := keyRequestBody(t, "POST", "/keys", "test", `{"name": "reader", "scopes": ["state:read"]}`, &created)
+	if status != http.StatusCreated || created.Secret == "" || created.Key.Source != "runtime" {
+		t.Fatalf("Expected key to be created, got %d: %+v", status, created)
+	}
+	defer keyRequest(t, "DELETE", "/keys/reader", "test")
+	reader := created.Secret
+
+	if status := keyRequest(t, "GET", "/state", reader); status != http.StatusOK {
+		t.Fatalf("Expected state:read key to read the state, got %d", status)
+	}
+	if status := keyRequest(t, "POST", "/toggle", reader); status != http.StatusForbidden {
+		t.Fatalf("Expected state:read key to be refused the toggle, got %d", status)
+	}
+	if status := keyRequest(t, "POST", "/lock", reader); status != http.StatusForbidden {
+		t.Fatalf("Expected state:read key to be refused the lock, got %d", status)
+	}
+	if status := keyRequest(t, "GET", "/keys", reader); status != http.StatusForbidden {
+		t.Fatalf("Expected state:read key to be refused the key list, got %d", status)
+	}
+	status = keyRequestBody(t, "POST", "/keys", "test", `{"name": "reader", "scopes": ["admin"]}`, nil)
+	if status != http.StatusConflict {
+		t.Fatalf("Expected duplicate key name to be refused, got %d", status)
+	}
+	status = keyRequestBody(t, "POST", "/keys", "test", `{"name": "bad", "scopes": ["root"]}`, nil)
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected unknown scope to be refused, got %d", status)
+	}
+
+	// The list includes the last use of the key.
+	var list KeysResponse
+	if status := keyRequestBody(t, "GET", "/keys", "test", "", &list); status != http.StatusOK {
+		t.Fatalf("Expected key list, got %d", status)
 	}
-	if err := websocket.JSON.Send(ws, cmdToggle); err != nil {
-		t.Fatalf("Error sending toggle command: %v", err)
+	found := false
+	for _, key := range list.Keys {
+		if key.Name == "reader" {
+			found = key.LastUsed != nil
+		}
+	}
+	if !found {
+		t.Fatalf("Expected key reader with last use in %+v", list.Keys)
+	}
+
+	// Rotating replaces the secret right away.
+	var rotated KeySecretResponse
+	if status := keyRequestBody(t, "POST", "/keys/reader/rotate", "test", "", &rotated); status != http.StatusOK {
+		t.Fatalf("Expected key to be rotated, got %d", status)
+	}
+	if status := keyRequest(t, "GET", "/state", reader); status != http.StatusUnauthorized {
+		t.Fatalf("Expected old secret to be refused after rotation, got %d", status)
+	}
+	if status := keyRequest(t, "GET", "/state", rotated.Secret); status != http.StatusOK {
+		t.Fatalf("Expected new secret to be accepted, got %d", status)
+	}
+
+	// Revoking refuses the cached key right away, static keys can't be revoked.
+	if status := keyRequest(t, "DELETE", "/keys/reader", "test"); status != http.StatusOK {
+		t.Fatalf("Expected key to be revoked, got %d", status)
+	}
+	if status := keyRequest(t, "GET", "/state", rotated.Secret); status != http.StatusUnauthorized {
+		t.Fatalf("Expected revoked key to be refused, got %d", status)
+	}
+	if status := keyRequest(t, "DELETE", "/keys/test", "test"); status != http.StatusConflict {
+		t.Fatalf("Expected static key revocation to be refused, got %d", status)
+	}
+}
+
+func TestSchedules(t *testing.T) {
+	setup()
+	defer teardown()
+
+	var created KeySecretResponse
+	status := keyRequestBody(t, "POST", "/keys", "test", `{"name": "reader", "scopes": ["state:read"]}`, &created)
+	if status != http.StatusCreated {
+		t.Fatalf("Expected key to be created, got %d", status)
+	}
+	defer keyRequest(t, "DELETE", "/keys/reader", "test")
+	reader := created.Secret
+
+	schedule := `{"name": "close-at-night", "cron": "0 22 * * *", "action": "close"}`
+	if status := keyRequestBody(t, "POST", "/schedules", reader, schedule, nil); status != http.StatusForbidden {
+		t.Fatalf("Expected adding a schedule to require the admin scope, got %d", status)
+	}
+	invalid := `{"name": "bad", "cron": "0 25 * * *", "action": "close"}`
+	if status := keyRequestBody(t, "POST", "/schedules", "test", invalid, nil); status != http.StatusBadRequest {
+		t.Fatalf("Expected invalid schedule to be refused, got %d", status)
+	}
+	if status := keyRequestBody(t, "POST", "/schedules", "test", `{"name":`, nil); status != http.StatusBadRequest {
+		t.Fatalf("Expected malformed schedule to be refused, got %d", status)
+	}
+	if status := keyRequestBody(t, "POST", "/schedules", "test", schedule, nil); status != http.StatusCreated {
+		t.Fatalf("Expected schedule to be added, got %d", status)
+	}
+	if status := keyRequestBody(t, "POST", "/schedules", "test", schedule, nil); status != http.StatusConflict {
+		t.Fatalf("Expected duplicate schedule name to be refused, got %d", status)
+	}
+
+	// Reading the schedules only requires the state:read scope.
+	var list SchedulesResponse
+	if status := keyRequestBody(t, "GET", "/schedules", reader, "", &list); status != http.StatusOK ||
+		len(list.Schedules) != 1 || list.Schedules[0].Origin != scheduler.OriginRuntime ||
+		list.Schedules[0].NextRun == nil {
+		t.Fatalf("Expected the added schedule with its next run, got %d: %+v", status, list.Schedules)
+	}
+
+	if status := keyRequest(t, "DELETE", "/schedules/close-at-night", reader); status != http.StatusForbidden {
+		t.Fatalf("Expected removing a schedule to require the admin scope, got %d", status)
+	}
+	if status := keyRequest(t, "DELETE", "/schedules/close-at-night", "test"); status != http.StatusOK {
+		t.Fatalf("Expected schedule to be removed, got %d", status)
+	}
+	if status := keyRequest(t, "DELETE", "/schedules/close-at-night", "test"); status != http.StatusNotFound {
+		t.Fatalf("Expected removed schedule not to be found, got %d", status)
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	setup()
+	defer teardown()
+
+	secrets := make(map[string]string)
+	for _, key := range []struct{ name, scope string }{{"reader", "state:read"}, {"operator", "door:operate"}} {
+		var created KeySecretResponse
+		body := `{"name": "` + key.name + `", "scopes": ["` + key.scope + `"]}`
+		if status := keyRequestBody(t, "POST", "/keys", "test", body, &created); status != http.StatusCreated {
+			t.Fatalf("Expected key %s to be created, got %d", key.name, status)
+		}
+		defer keyRequest(t, "DELETE", "/keys/"+key.name, "test")
+		secrets[key.name] = created.Secret
+	}
+
+	var list AlertsResponse
+	if status := keyRequestBody(t, "GET", "/alerts", secrets["reader"], "", &list); status != http.StatusOK ||
+		len(list.Alerts) != 1 || list.Alerts[0].ID != alerts.LeftOpen || list.Alerts[0].Level != alerts.LevelNone {
+		t.Fatalf("Expected the left open alert, not raised, got %d: %+v", status, list.Alerts)
+	}
+
+	// Only the door:operate scope acknowledges alerts, and only raised ones.
+	path := "/alerts/" + alerts.LeftOpen + "/ack"
+	if status := keyRequest(t, "POST", path, secrets["reader"]); status != http.StatusForbidden {
+		t.Fatalf("Expected acknowledging to require the door:operate scope, got %d", status)
+	}
+	if status := keyRequest(t, "POST", path, secrets["operator"]); status != http.StatusConflict {
+		t.Fatalf("Expected acknowledging an alert that isn't raised to conflict, got %d", status)
+	}
+	if status := keyRequest(t, "POST", "/alerts/unknown/ack", secrets["operator"]); status != http.StatusNotFound {
+		t.Fatalf("Expected acknowledging an unknown alert to fail, got %d", status)
+	}
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	setup()
+	defer teardown()
+
+	var created KeySecretResponse
+	status := keyRequestBody(t, "POST", "/keys", "test", `{"name": "operator", "scopes": ["door:operate"]}`, &created)
+	if status != http.StatusCreated {
+		t.Fatalf("Expected key to be created, got %d", status)
+	}
+	defer keyRequest(t, "DELETE", "/keys/operator", "test")
+	operator := created.Secret
+
+	// Deliveries for a subscriber that is no longer configured become dead letters when the dispatcher starts.
+	err := storage.GetStore().Save("webhook_deliveries", map[string][]webhooks.Delivery{
+		"pending": {
+			{ID: "first", Subscriber: "removed", Event: "state", Payload: []byte(`{}`)},
+			{ID: "second", Subscriber: "removed", Event: "state", Payload: []byte(`{}`)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error saving deliveries: %v", err)
+	}
+	dispatcher := webhooks.GetDispatcher()
+	if err := dispatcher.Start(); err != nil {
+		t.Fatalf("Error starting dispatcher: %v", err)
+	}
+	defer dispatcher.Stop()
+
+	for _, request := range []struct{ method, path string }{
+		{"GET", "/webhooks/pending"},
+		{"GET", "/webhooks/dead-letters"},
+		{"POST", "/webhooks/dead-letters/first/replay"},
+		{"DELETE", "/webhooks/dead-letters/first"},
+	} {
+		if status := keyRequest(t, request.method, request.path, operator); status != http.StatusForbidden {
+			t.Fatalf("Expected %s %s to require the admin scope, got %d", request.method, request.path, status)
+		}
+	}
+
+	var list WebhookDeliveriesResponse
+	if status := keyRequestBody(t, "GET", "/webhooks/dead-letters", "test", "", &list); status != http.StatusOK ||
+		len(list.Deliveries) != 2 {
+		t.Fatalf("Expected 2 dead letters, got %d: %+v", status, list.Deliveries)
+	}
+
+	var replayed WebhookDeliveryResponse
+	status = keyRequestBody(t, "POST", "/webhooks/dead-letters/first/replay", "test", "", &replayed)
+	if status != http.StatusOK || replayed.Delivery.ID != "first" || replayed.Delivery.Attempts != 0 {
+		t.Fatalf("Expected dead letter to be replayed, got %d: %+v", status, replayed.Delivery)
+	}
+	list = WebhookDeliveriesResponse{}
+	if status := keyRequestBody(t, "GET", "/webhooks/pending", "test", "", &list); status != http.StatusOK ||
+		len(list.Deliveries) != 1 || list.Deliveries[0].ID != "first" {
+		t.Fatalf("Expected the replayed delivery to be pending, got %d: %+v", status, list.Deliveries)
+	}
+
+	if status := keyRequest(t, "DELETE", "/webhooks/dead-letters/second", "test"); status != http.StatusOK {
+		t.Fatalf("Expected dead letter to be discarded, got %d", status)
+	}
+	if status := keyRequest(t, "DELETE", "/webhooks/dead-letters/second", "test"); status != http.StatusNotFound {
+		t.Fatalf("Expected discarded dead letter not to be found, got %d", status)
+	}
+	if status := keyRequest(t, "POST", "/webhooks/dead-letters/first/replay", "test"); status != http.StatusNotFound {
+		t.Fatalf("Expected replayed dead letter not to be found, got %d", status)
+	}
+	list = WebhookDeliveriesResponse{}
+	if status := keyRequestBody(t, "GET", "/webhooks/dead-letters", "test", "", &list); status != http.StatusOK ||
+		len(list.Deliveries) != 0 {
+		t.Fatalf("Expected no dead letters, got %d: %+v", status, list.Deliveries)
+	}
+}
+
+func TestBanList(t *testing.T) {
+	b := newBanList(3, time.Minute, time.Minute, 5*time.Minute)
+	now := time.Now()
+
+	// Failures outside the window don't add up.
+	b.failure("10.0.0.1", now)
+	b.failure("10.0.0.1", now.Add(time.Second))
+	if _, banned := b.failure("10.0.0.1", now.Add(2*time.Minute)); banned {
+		t.Fatalf("Expected failures outside the window not to ban the client")
+	}
+
+	// Every next ban lasts twice as long, up to the maximum.
+	at := now.Add(time.Hour)
+	for i, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute} {
+		var ban Ban
+		var banned bool
+		for j := 0; j < 3; j++ {
+			ban, banned = b.failure("10.0.0.2", at)
+		}
+		if !banned || ban.Bans != i+1 || ban.Until.Sub(at) != expected {
+			t.Fatalf("Expected ban %d of %v, got %+v", i+1, expected, ban)
+		}
+		remaining, banned := b.banned("10.0.0.2", at.Add(time.Second))
+		if !banned || remaining != expected-time.Second {
+			t.Fatalf("Expected client to be banned for %v, got %v", expected-time.Second, remaining)
+		}
+		at = ban.Until
+	}
+	if _, banned := b.banned("10.0.0.2", at); banned {
+		t.Fatalf("Expected ban to end")
+	}
+
+	// Without failures for the maximum ban duration, the ban duration starts over.
+	at = at.Add(5 * time.Minute)
+	for j := 0; j < 3; j++ {
+		b.failure("10.0.0.2", at)
+	}
+	if list := b.list(at); len(list) != 1 || list[0].Until.Sub(at) != time.Minute {
+		t.Fatalf("Expected the initial ban duration again, got %+v", list)
+	}
+	if b.clear("10.0.0.1", at) || !b.clear("10.0.0.2", at) {
+		t.Fatalf("Expected only the banned client to be cleared")
+	}
+	if len(b.list(at)) != 0 || b.clients["10.0.0.1"] == nil {
+		t.Fatalf("Expected no bans after clearing, and the failures of the client that wasn't banned to be kept")
+	}
+}
+
+func TestBanListBounded(t *testing.T) {
+	// When all tracked clients have recent failures, the oldest one is forgotten.
+	b := newBanList(3, time.Minute, time.Minute, 5*time.Minute)
+	now := time.Now()
+	for i := 0; i < maxTrackedClients; i++ {
+		b.failure(fmt.Sprintf("10.0.%d.%d", i/256, i%256), now.Add(time.Duration(i)*time.Millisecond))
+	}
+	b.failure("10.1.0.0", now.Add(time.Second))
+	if len(b.clients) != maxTrackedClients || b.clients["10.0.0.0"] != nil || b.clients["10.1.0.0"] == nil {
+		t.Fatalf("Expected the client with the oldest failure to make room, got %d clients", len(b.clients))
+	}
+
+	// When all tracked clients are banned, new clients aren't tracked.
+	b = newBanList(1, time.Minute, time.Minute, 5*time.Minute)
+	for i := 0; i < maxTrackedClients; i++ {
+		b.failure(fmt.Sprintf("10.0.%d.%d", i/256, i%256), now)
+	}
+	if _, banned := b.failure("10.1.0.0", now); banned || len(b.clients) != maxTrackedClients {
+		t.Fatalf("Expected new clients not to be tracked, got %d clients", len(b.clients))
+	}
+}
+
+func TestIPExtractor(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/state", nil)
+	req.RemoteAddr = "10.0.0.5:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.6")
+
+	if ip := ipExtractor(nil)(req); ip != "10.0.0.5" {
+		t.Fatalf("Expected X-Forwarded-For to be ignored without trusted proxies, got %s", ip)
+	}
+	if ip := ipExtractor([]string{"10.0.0.0/24"})(req); ip != "203.0.113.7" {
+		t.Fatalf("Expected X-Forwarded-For from trusted proxies to be believed, got %s", ip)
+	}
+	if ip := ipExtractor([]string{"10.0.0.5"})(req); ip != "10.0.0.6" {
+		t.Fatalf("Expected untrusted proxy in X-Forwarded-For to be the client, got %s", ip)
+	}
+	if ip := ipExtractor([]string{"192.168.1.1"})(req); ip != "10.0.0.5" {
+		t.Fatalf("Expected X-Forwarded-For from untrusted peer to be ignored, got %s", ip)
+	}
+}
+
+func TestBruteForceLockout(t *testing.T) {
+	setup()
+	defer teardown()
+	s := GetWebService()
+	s.bans.clearAll(time.Now())
+	defer s.bans.clearAll(time.Now())
+
+	// Missing credentials don't count as failures.
+	for i := 0; i < 10; i++ {
+		if status := keyRequest(t, "GET", "/state", ""); status != http.StatusUnauthorized {
+			t.Fatalf("Expected missing key to be unauthorized, got %d", status)
+		}
+	}
+	for i := 1; i < 5; i++ {
+		if status := keyRequest(t, "GET", "/state", fmt.Sprintf("wrong-%d", i)); status != http.StatusUnauthorized {
+			t.Fatalf("Expected wrong key to be unauthorized, got %d", status)
+		}
+	}
+	if _, status := loginHelper(t, "admin", "wrong", http.StatusTooManyRequests); status != "" {
+		t.Fatalf("Expected no session for banned client")
+	}
+
+	// Banned clients are refused, even with a valid key.
+	req, _ := http.NewRequest("GET", "http://localhost:8000/state", nil)
+	req.Header.Set("x-api-key", "test")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") != "60" {
+		t.Fatalf("Expected banned client to get 429 with Retry-After, got %d, %q", res.StatusCode,
+			res.Header.Get("Retry-After"))
+	}
+
+	bans := s.bans.list(time.Now())
+	if len(bans) != 1 || bans[0].IP != "127.0.0.1" {
+		t.Fatalf("Expected a ban for 127.0.0.1, got %+v", bans)
+	}
+	found := false
+	for _, event := range controller.GetDoorControllerService().GetEvents(0) {
+		found = found || event.Type == controller.EventBan && event.Source == "ip:127.0.0.1"
+	}
+	if !found {
+		t.Fatalf("Expected the ban to be recorded as event")
+	}
+
+	// Clear the ban of this client, and ban another one to check the endpoints.
+	s.bans.clear("127.0.0.1", time.Now())
+	for i := 0; i < 5; i++ {
+		s.bans.failure("192.0.2.1", time.Now())
+	}
+
+	var list BansResponse
+	if status := keyRequestBody(t, "GET", "/bans", "test", "", &list); status != http.StatusOK ||
+		len(list.Bans) != 1 || list.Bans[0].IP != "192.0.2.1" || list.Bans[0].Bans != 1 {
+		t.Fatalf("Expected the ban list, got %d: %+v", status, list)
+	}
+	if status := keyRequest(t, "DELETE", "/bans/192.0.2.1", "test"); status != http.StatusOK {
+		t.Fatalf("Expected ban to be cleared, got %d", status)
+	}
+	if status := keyRequest(t, "DELETE", "/bans/192.0.2.1", "test"); status != http.StatusNotFound {
+		t.Fatalf("Expected unknown ban to be not found, got %d", status)
+	}
+}
+
+// Create a certificate signed by the given parent, or a self-signed CA certificate without parent.
+func certHelper(t *testing.T, commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey,
+	serial int64) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestTLSClientCerts(t *testing.T) {
+	setup()
+	defer teardown()
+	s := GetWebService()
+
+	dir := t.TempDir()
+	ca, caKey, caPEM, _ := certHelper(t, "test-ca", nil, nil, 1)
+	_, _, serverPEM, serverKeyPEM := certHelper(t, "localhost", ca, caKey, 2)
+	phone, _, phonePEM, phoneKeyPEM := certHelper(t, "alice-phone", ca, caKey, 3)
+	_, _, otherPEM, otherKeyPEM := certHelper(t, "unknown-phone", ca, caKey, 4)
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	os.WriteFile(certFile, serverPEM, 0600)
+	os.WriteFile(keyFile, serverKeyPEM, 0600)
+	os.WriteFile(caFile, caPEM, 0600)
+
+	r, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("Error loading certificates: %v", err)
+	}
+	if _, err := r.tlsConfig("1.1", "optional"); err == nil {
+		t.Fatalf("Expected TLS 1.1 to be refused")
+	}
+	serverConfig, err := r.tlsConfig("1.3", "optional")
+	if err != nil {
+		t.Fatalf("Error creating TLS configuration: %v", err)
+	}
+
+	// Serve the routes of the web service over TLS on another port.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server := &http.Server{Handler: s.echo}
+	go server.Serve(tls.NewListener(listener, serverConfig))
+	defer server.Close()
+	s.ReloadClientCerts([]config.ClientCertConfig{
+		{Subject: "CN=alice-phone", Name: "alice-phone", Scopes: []string{config.ScopeStateRead}},
+	})
+	defer s.ReloadClientCerts(config.GetTLSClientCerts())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	request := func(method string, path string, certPEM []byte, keyPEM []byte, maxVersion uint16) (int, error) {
+		clientConfig := &tls.Config{RootCAs: roots, MaxVersion: maxVersion}
+		if certPEM != nil {
+			cert, _ := tls.X509KeyPair(certPEM, keyPEM)
+			clientConfig.Certificates = []tls.Certificate{cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		req, _ := http.NewRequest(method, "https://"+listener.Addr().String()+path, nil)
+		res, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	if status, err := request("GET", "/state", phonePEM, phoneKeyPEM, 0); err != nil || status != http.StatusOK {
+		t.Fatalf("Expected mapped client certificate to read the state, got %d, %v", status, err)
+	}
+	if status, _ := request("POST", "/toggle", phonePEM, phoneKeyPEM, 0); status != http.StatusForbidden {
+		t.Fatalf("Expected mapped client certificate without door:operate to be refused, got %d", status)
+	}
+	if status, _ := request("GET", "/state", otherPEM, otherKeyPEM, 0); status != http.StatusUnauthorized {
+		t.Fatalf("Expected unmapped client certificate to be unauthorized, got %d", status)
+	}
+	if status, _ := request("GET", "/state", nil, nil, 0); status != http.StatusUnauthorized {
+		t.Fatalf("Expected request without client certificate to be unauthorized, got %d", status)
+	}
+	if _, err := request("GET", "/state", phonePEM, phoneKeyPEM, tls.VersionTLS12); err == nil {
+		t.Fatalf("Expected TLS 1.2 to be refused")
+	}
+
+	// A pinned fingerprint only accepts that certificate for the subject.
+	pin := func(cert *x509.Certificate) {
+		s.ReloadClientCerts([]config.ClientCertConfig{
+			{Subject: "CN=alice-phone", Name: "alice-phone", Fingerprint: pki.Fingerprint(cert),
+				Scopes: []string{config.ScopeStateRead}},
+		})
+	}
+	pin(phone)
+	if status, err := request("GET", "/state", phonePEM, phoneKeyPEM, 0); err != nil || status != http.StatusOK {
+		t.Fatalf("Expected pinned client certificate to read the state, got %d, %v", status, err)
+	}
+	reissued, _, _, _ := certHelper(t, "alice-phone", ca, caKey, 6)
+	pin(reissued)
+	if status, _ := request("GET", "/state", phonePEM, phoneKeyPEM, 0); status != http.StatusUnauthorized {
+		t.Fatalf("Expected client certificate with another fingerprint to be unauthorized, got %d", status)
+	}
+
+	// A revoked certificate is refused, even when it is pinned.
+	pin(phone)
+	store := storage.NewStore(t.TempDir())
+	revoked := s.revokedCerts
+	s.revokedCerts = newRevokedCerts(store)
+	defer func() { s.revokedCerts = revoked }()
+	if err := pki.Revoke(store, pki.Revocation{Serial: pki.Serial(phone.SerialNumber)}); err != nil {
+		t.Fatalf("Error revoking client certificate: %v", err)
+	}
+	if status, _ := request("GET", "/state", phonePEM, phoneKeyPEM, 0); status != http.StatusUnauthorized {
+		t.Fatalf("Expected revoked client certificate to be unauthorized, got %d", status)
+	}
+
+	// A new certificate is picked up by new connections.
+	_, _, renewedPEM, renewedKeyPEM := certHelper(t, "localhost", ca, caKey, 5)
+	os.WriteFile(certFile, renewedPEM, 0600)
+	os.WriteFile(keyFile, renewedKeyPEM, 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	r.lock.Lock()
+	r.checked = time.Time{}
+	r.lock.Unlock()
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 5 {
+		t.Fatalf("Expected the renewed certificate, got serial %d", serial)
+	}
+}
+
+func TestLocalCA(t *testing.T) {
+	serverConfig, err := configuredTLS()
+	if err != nil {
+		t.Fatalf("Error creating TLS configuration: %v", err)
+	}
+	for _, name := range []string{"ca.crt", "ca.key", "server.crt", "server.key"} {
+		if _, err := os.Stat(filepath.Join(config.GetTLSDir(), name)); err != nil {
+			t.Fatalf("Expected %s to be created in the tls directory: %v", name, err)
+		}
+	}
+	current, err := serverConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil || len(current.Certificates) != 1 {
+		t.Fatalf("Expected the server certificate of the local CA, got %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	setup()
+	defer teardown()
+
+	if status := keyRequest(t, "GET", "/metrics", ""); status != http.StatusUnauthorized {
+		t.Fatalf("Expected metrics to require authentication, got %d", status)
+	}
+	if status := keyRequest(t, "POST", "/toggle", "test"); status != http.StatusOK {
+		t.Fatalf("Expected toggle to succeed, got %d", status)
+	}
+	time.Sleep(750 * time.Millisecond)
+
+	req, _ := http.NewRequest("GET", "http://localhost:8000/metrics", nil)
+	req.Header.Set("x-api-key", "test")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected metrics, got %d", res.StatusCode)
 	}
+	for _, expected := range []string{
+		`garagedoor_commands_total{command="toggle",result="accepted",source="key:test"}`,
+		`garagedoor_relay_pulses_total`,
+		`garagedoor_door_state{state="open"}`,
+		`garagedoor_websocket_clients 0`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("Expected %q in the metrics:\n%s", expected, body)
+		}
+	}
+}
+
+func healthHelper(t *testing.T, path string) (int, HealthResponse) {
+	res, err := http.Get("http://localhost:8000" + path)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer res.Body.Close()
+	var health HealthResponse
+	if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	return res.StatusCode, health
+}
+
+func TestHealthProbes(t *testing.T) {
+	setup()
+	defer teardown()
 	time.Sleep(500 * time.Millisecond)
-	if stateStr != "closed" {
-		t.Fatalf("Expected state to be closed, got %s", stateStr)
+
+	status, health := healthHelper(t, "/healthz")
+	if status != http.StatusOK || health.Components[controller.LoopCommand].Status != "up" ||
+		health.Components[controller.LoopState].Status != "up" {
+		t.Fatalf("Expected both loops to be alive, got %d: %+v", status, health)
+	}
+
+	// MQTT is enabled in the test configuration, but there is no broker.
+	status, health = healthHelper(t, "/readyz")
+	if status != http.StatusServiceUnavailable || health.Result != "nok" {
+		t.Fatalf("Expected not ready without MQTT connection, got %d: %+v", status, health)
+	}
+	for _, name := range []string{"controller", "gpio", "storage"} {
+		if health.Components[name].Status != "up" {
+			t.Fatalf("Expected %s to be up, got %+v", name, health.Components)
+		}
+	}
+	if mqtt := health.Components["mqtt"]; mqtt.Status != "down" || mqtt.Message == "" {
+		t.Fatalf("Expected mqtt to be down with a reason, got %+v", mqtt)
+	}
+}
+
+func TestRequestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+	if err := tracing.GetTracing().Start(); err != nil {
+		t.Fatalf("Error starting tracing: %v", err)
+	}
+	setup()
+	defer teardown()
+
+	// The trace of the client is continued by the request, and by the command it queues.
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		req, _ := http.NewRequest("POST", "http://localhost:8000/toggle", nil)
+		req.Header.Set("x-api-key", "test")
+		req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusTooManyRequests || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if status := keyRequest(t, "GET", "/healthz", ""); status != http.StatusOK {
+		t.Fatalf("Expected liveness probe to succeed, got %d", status)
+	}
+	time.Sleep(time.Second)
+
+	names := make(map[string]bool)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() == traceID {
+			names[span.Name()] = true
+		}
+		if span.Name() == "GET /healthz" {
+			t.Fatalf("Expected probes not to be traced")
+		}
+	}
+	for _, name := range []string{"POST /toggle", "controller.request", "controller.execute", "controller.confirm"} {
+		if !names[name] {
+			t.Fatalf("Expected span %s in the trace of the client, got %v", name, names)
+		}
+	}
+	keyRequest(t, "POST", "/toggle", "test")
+	time.Sleep(750 * time.Millisecond)
+}
+
+func TestAuditLog(t *testing.T) {
+	setup()
+	defer teardown()
+
+	// Failed authentications and accepted commands are appended to a valid hash chain.
+	keyRequest(t, "POST", "/toggle", "wrong")
+	keyRequest(t, "POST", "/toggle", "test")
+	files, err := audit.NewLog(config.GetAuditFile(), 0, 0).Files()
+	if err != nil {
+		t.Fatalf("Error listing audit files: %v", err)
+	}
+	if _, err := audit.Verify(files); err != nil {
+		t.Fatalf("Expected a valid audit log, got %v", err)
+	}
+
+	data, err := os.ReadFile(config.GetAuditFile())
+	if err != nil {
+		t.Fatalf("Error reading audit log: %v", err)
+	}
+	var failure, command bool
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry audit.Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Error decoding audit entry: %v", err)
+		}
+		switch {
+		case entry.Type == audit.TypeAuthFailure && entry.Details["path"] == "/toggle":
+			failure = entry.Actor == "ip:127.0.0.1" && entry.Details["method"] == "api_key"
+		case entry.Type == audit.TypeCommand && entry.Outcome == "accepted":
+			command = strings.HasPrefix(entry.Actor, "key:") && entry.Details["command"] == "toggle"
+		}
+	}
+	if !failure || !command {
+		t.Fatalf("Expected audit entries of the failed authentication and the command, got:\n%s", data)
+	}
+	time.Sleep(750 * time.Millisecond)
+}
+
+func TestLogLevels(t *testing.T) {
+	setup()
+	defer teardown()
+
+	var res LogLevelsResponse
+	if status := keyRequestBody(t, "GET", "/log/levels", "test", "", &res); status != http.StatusOK ||
+		res.Level == "" || len(res.Components) == 0 {
+		t.Fatalf("Expected log levels, got %d, %+v", status, res)
+	}
+
+	// Levels are merged, and a component with level "default" follows the default level again.
+	body := `{"levels":{"gpio":"debug","http":"warn"}}`
+	if status := keyRequestBody(t, "PUT", "/log/levels", "test", body, &res); status != http.StatusOK ||
+		res.Levels.Levels["gpio"] != "debug" || res.Levels.Levels["http"] != "warn" {
+		t.Fatalf("Expected levels of gpio and http to be changed, got %d, %+v", status, res)
+	}
+	body = `{"levels":{"gpio":"default"}}`
+	res = LogLevelsResponse{}
+	if status := keyRequestBody(t, "PUT", "/log/levels", "test", body, &res); status != http.StatusOK ||
+		res.Levels.Levels["gpio"] != "" || res.Levels.Levels["http"] != "warn" {
+		t.Fatalf("Expected gpio to follow the default level again, got %d, %+v", status, res)
+	}
+	for _, body := range []string{`{"level":"loud"}`, `{"levels":{"garage":"debug"}}`} {
+		if status := keyRequestBody(t, "PUT", "/log/levels", "test", body, nil); status != http.StatusBadRequest {
+			t.Fatalf("Expected %s to be rejected, got %d", body, status)
+		}
 	}
+	keyRequestBody(t, "PUT", "/log/levels", "test", `{"levels":{"http":"default"}}`, nil)
 }
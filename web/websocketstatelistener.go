@@ -2,40 +2,49 @@ package web
 
 import (
 	"github.com/dlefevre/go.garagedoor-service/controller"
-	"github.com/google/uuid"
-	"github.com/rs/zerolog/log"
 	"golang.org/x/net/websocket"
 )
 
 // WebSocketStateListener implements the handler to report state changes to a websocket, and register and unregister
 // the listener with the DoorControllerService.
 type WebSocketStateListener struct {
-	ws *websocket.Conn
-	id uuid.UUID
+	ws           *websocket.Conn
+	subscription *controller.Subscription
 }
 
 // StateChanged handles sending state updates to the websocket.
-func (w *WebSocketStateListener) StateChanged(state string) {
+func (w *WebSocketStateListener) StateChanged(event controller.StateEvent) {
+	dc := controller.GetDoorControllerService()
 	err := websocket.JSON.Send(w.ws, StateResponse{
 		SimpleResponse: SimpleResponse{
 			Result: "ok",
 		},
-		State: state,
+		State: event.State,
+		Lock:  dc.GetLockStatus(),
+		Event: &event,
 	})
 	if err != nil {
-		log.Error().Msgf("Error sending state to websocket: %v", err)
+		logger.Error().Msgf("Error sending state to websocket: %v", err)
 	}
 }
 
-// Connect registers the websocket, and adds a state listener to send state updates to the websocket.
+// Connect registers the websocket, and adds a state listener to send state updates to the websocket. When the
+// websocket can't keep up with the state updates, it is closed.
 func (w *WebSocketStateListener) Connect(ws *websocket.Conn) {
 	w.ws = ws
 	dc := controller.GetDoorControllerService()
-	w.id = dc.AddStateListener(w.StateChanged)
+	w.subscription = dc.SubscribeState(controller.SubscriberOptions{
+		Name:      "websocket " + ws.Request().RemoteAddr,
+		QueueSize: 16,
+		Policy:    controller.Disconnect,
+	}, w.StateChanged)
+	go func() {
+		<-w.subscription.Done()
+		ws.Close()
+	}()
 }
 
 // Disconnect removes the state listener.
 func (w *WebSocketStateListener) Disconnect() {
-	dc := controller.GetDoorControllerService()
-	dc.RemoveStateListener(w.id)
+	w.subscription.Close()
 }
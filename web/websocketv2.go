@@ -0,0 +1,349 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/dlefevre/go.garagedoor-service/tracing"
+	"golang.org/x/net/websocket"
+)
+
+// Websocket subprotocols. Clients that don't request a subprotocol get the original (v1) protocol.
+const (
+	ProtocolV1 = "garagedoor.v1"
+	ProtocolV2 = "garagedoor.v2"
+)
+
+// Message types of the v2 websocket protocol.
+const (
+	MessageCommand       = "command"        // MessageCommand requests a command, sent by the client
+	MessageAck           = "ack"            // MessageAck confirms a command was accepted
+	MessageNack          = "nack"           // MessageNack reports a command was refused, with a reason
+	MessageState         = "state"          // MessageState reports the state of the door
+	MessageCommandResult = "command_result" // MessageCommandResult reports the outcome of an accepted command
+	MessageError         = "error"          // MessageError reports a message that couldn't be handled
+	MessagePing          = "ping"           // MessagePing is a heartbeat, answered with a pong
+	MessagePong          = "pong"           // MessagePong answers a ping
+)
+
+// Results reported in command result messages.
+const (
+	ResultCompleted = "completed" // ResultCompleted means the door reached the requested state
+	ResultTimeout   = "timeout"   // ResultTimeout means the door didn't reach the requested state in time
+)
+
+// Heartbeat settings of the v2 protocol. The server sends a ping every pingInterval, and closes connections on which
+// nothing was received for idleTimeout.
+var (
+	pingInterval         = 20 * time.Second
+	idleTimeout          = 60 * time.Second
+	writeTimeout         = 10 * time.Second
+	commandResultTimeout = 60 * time.Second
+)
+
+// ProtocolMessage is a message of the v2 websocket protocol. Depending on the type, only part of the fields are used.
+// Commands carry a request id chosen by the client, which is echoed in the ack, nack and command result messages.
+type ProtocolMessage struct {
+	Type    string                 `json:"type"`
+	ID      string                 `json:"id,omitempty"`
+	Command string                 `json:"command,omitempty"`
+	Reason  string                 `json:"reason,omitempty"`
+	Result  string                 `json:"result,omitempty"`
+	State   string                 `json:"state,omitempty"`
+	Lock    *controller.LockStatus `json:"lock,omitempty"`
+	Event   *controller.StateEvent `json:"event,omitempty"`
+}
+
+// A command that was accepted, and waits for the door to reach its target state.
+type pendingCommand struct {
+	command  string
+	target   string
+	deadline time.Time
+}
+
+// A connection using the v2 protocol. A single goroutine writes to the connection, while another one reads from it.
+type wsSession struct {
+	ws           *websocket.Conn
+	client       wsClient
+	incoming     chan []byte
+	states       chan controller.StateEvent
+	done         chan struct{}
+	quit         chan struct{}
+	pending      map[string]pendingCommand
+	subscription *controller.Subscription
+}
+
+// Select the subprotocol during the websocket handshake, and verify the origin like websocket.Handler does.
+func negotiateProtocol(cfg *websocket.Config, req *http.Request) error {
+	var err error
+	cfg.Origin, err = websocket.Origin(cfg, req)
+	if err == nil && cfg.Origin == nil {
+		return fmt.Errorf("null origin")
+	}
+	if err != nil {
+		return err
+	}
+
+	selected := ""
+	for _, protocol := range cfg.Protocol {
+		if protocol == ProtocolV2 {
+			selected = ProtocolV2
+			break
+		}
+		if protocol == ProtocolV1 {
+			selected = ProtocolV1
+		}
+	}
+	cfg.Protocol = nil
+	if selected != "" {
+		cfg.Protocol = []string{selected}
+	}
+	return nil
+}
+
+// Serve a connection using the v2 protocol.
+func serveV2(ws *websocket.Conn, client wsClient) {
+	s := &wsSession{
+		ws:       ws,
+		client:   client,
+		incoming: make(chan []byte),
+		states:   make(chan controller.StateEvent),
+		done:     make(chan struct{}),
+		quit:     make(chan struct{}),
+		pending:  make(map[string]pendingCommand),
+	}
+	// The subscription buffers the state updates while the session loop is busy. A client that can't keep up is
+	// disconnected.
+	dc := controller.GetDoorControllerService()
+	s.subscription = dc.SubscribeState(controller.SubscriberOptions{
+		Name:      "websocket " + ws.Request().RemoteAddr,
+		QueueSize: 16,
+		Policy:    controller.Disconnect,
+	}, func(event controller.StateEvent) {
+		select {
+		case s.states <- event:
+		case <-s.quit:
+		}
+	})
+	defer s.subscription.Close()
+
+	go s.read()
+	s.run()
+}
+
+// Read messages from the connection, and pass them on to the session loop. Ends the session when the connection
+// fails, or when nothing was received for the idle timeout.
+func (s *wsSession) read() {
+	defer close(s.done)
+	for {
+		if err := s.ws.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return
+		}
+		var msg []byte
+		if err := websocket.Message.Receive(s.ws, &msg); err != nil {
+			logger.Debug().Msgf("Websocket closed: %v", err)
+			return
+		}
+		select {
+		case s.incoming <- msg:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// Session loop, handling incoming messages, state updates, heartbeats and command timeouts.
+func (s *wsSession) run() {
+	defer close(s.quit)
+	defer s.ws.Close()
+
+	dc := controller.GetDoorControllerService()
+	if !s.send(s.stateMessage("", dc.GetStateEvent())) {
+		return
+	}
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	timeouts := time.NewTicker(time.Second)
+	defer timeouts.Stop()
+	for {
+		var ok bool
+		select {
+		case <-s.done:
+			return
+		case <-s.subscription.Done():
+			logger.Warn().Msg("Websocket client can't keep up, closing connection")
+			return
+		case msg := <-s.incoming:
+			ok = s.handle(msg)
+		case event := <-s.states:
+			ok = s.stateChanged(event)
+		case <-ticker.C:
+			ok = s.send(ProtocolMessage{Type: MessagePing})
+		case now := <-timeouts.C:
+			ok = s.expire(now)
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// Handle a message from the client. Returns false if the connection failed.
+func (s *wsSession) handle(msg []byte) bool {
+	var message ProtocolMessage
+	if err := json.Unmarshal(msg, &message); err != nil {
+		return s.send(ProtocolMessage{Type: MessageError, Reason: "invalid message: " + err.Error()})
+	}
+	switch message.Type {
+	case MessageCommand:
+		return s.command(message)
+	case MessagePing:
+		return s.send(ProtocolMessage{Type: MessagePong, ID: message.ID})
+	case MessagePong:
+		return true
+	default:
+		return s.send(ProtocolMessage{Type: MessageError, ID: message.ID,
+			Reason: fmt.Sprintf("unknown message type %q", message.Type)})
+	}
+}
+
+// Handle a command from the client, answering with an ack or a nack. Returns false if the connection failed.
+func (s *wsSession) command(message ProtocolMessage) bool {
+	if message.ID == "" {
+		return s.send(ProtocolMessage{Type: MessageError, Command: message.Command, Reason: "missing request id"})
+	}
+	if _, exists := s.pending[message.ID]; exists {
+		return s.send(ProtocolMessage{Type: MessageNack, ID: message.ID, Command: message.Command,
+			Reason: "duplicate request id"})
+	}
+
+	dc := controller.GetDoorControllerService()
+	event := dc.GetStateEvent()
+	current := event.State
+	if message.Command != "state" && !s.client.operate {
+		return s.send(ProtocolMessage{Type: MessageNack, ID: message.ID, Command: message.Command,
+			Reason: "forbidden: missing scope " + config.ScopeDoorOperate})
+	}
+	var err error
+	target := ""
+	ctx, span := s.client.startCommand(message.Command)
+	defer span.End()
+	switch message.Command {
+	case "toggle":
+		err = dc.RequestToggle(ctx, s.client.source)
+		switch current {
+		case "open":
+			target = "closed"
+		case "closed":
+			target = "open"
+		}
+	case "open":
+		err = dc.RequestOpen(ctx, s.client.source)
+		target = "open"
+	case "close":
+		err = dc.RequestClose(ctx, s.client.source)
+		target = "closed"
+	case "state":
+		return s.send(ProtocolMessage{Type: MessageAck, ID: message.ID, Command: message.Command}) &&
+			s.send(s.stateMessage(message.ID, event))
+	default:
+		return s.send(ProtocolMessage{Type: MessageNack, ID: message.ID, Command: message.Command,
+			Reason: fmt.Sprintf("unknown command %q", message.Command)})
+	}
+	if err != nil {
+		tracing.RecordError(span, err)
+		return s.send(ProtocolMessage{Type: MessageNack, ID: message.ID, Command: message.Command,
+			Reason: nackReason(err)})
+	}
+	if !s.send(ProtocolMessage{Type: MessageAck, ID: message.ID, Command: message.Command}) {
+		return false
+	}
+
+	if target == current {
+		return s.send(ProtocolMessage{Type: MessageCommandResult, ID: message.ID, Command: message.Command,
+			Result: ResultCompleted, State: current})
+	}
+	s.pending[message.ID] = pendingCommand{
+		command:  message.Command,
+		target:   target,
+		deadline: time.Now().Add(commandResultTimeout),
+	}
+	return true
+}
+
+// Send a state update, and complete the pending commands that reached their target state.
+func (s *wsSession) stateChanged(event controller.StateEvent) bool {
+	if !s.send(s.stateMessage("", event)) {
+		return false
+	}
+	state := event.State
+	for id, pending := range s.pending {
+		if pending.target == state || (pending.target == "" && state != "unknown") {
+			delete(s.pending, id)
+			if !s.send(ProtocolMessage{Type: MessageCommandResult, ID: id, Command: pending.command,
+				Result: ResultCompleted, State: state}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Report the pending commands that didn't complete in time.
+func (s *wsSession) expire(now time.Time) bool {
+	for id, pending := range s.pending {
+		if now.After(pending.deadline) {
+			delete(s.pending, id)
+			state := controller.GetDoorControllerService().GetStateStr()
+			if !s.send(ProtocolMessage{Type: MessageCommandResult, ID: id, Command: pending.command,
+				Result: ResultTimeout, State: state}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Create a state message, including the maintenance lock status and the state event.
+func (s *wsSession) stateMessage(id string, event controller.StateEvent) ProtocolMessage {
+	lock := controller.GetDoorControllerService().GetLockStatus()
+	return ProtocolMessage{
+		Type:  MessageState,
+		ID:    id,
+		State: event.State,
+		Lock:  &lock,
+		Event: &event,
+	}
+}
+
+// Send a message to the client. Returns false if the connection failed.
+func (s *wsSession) send(message ProtocolMessage) bool {
+	if err := s.ws.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return false
+	}
+	if err := websocket.JSON.Send(s.ws, message); err != nil {
+		logger.Error().Msgf("Error sending message to websocket: %v", err)
+		return false
+	}
+	return true
+}
+
+// Describe why a command was refused, in the same terms as the HTTP status codes used by commandError.
+func nackReason(err error) string {
+	switch {
+	case controller.IsRateLimited(err):
+		return "rate limited: " + err.Error()
+	case errors.Is(err, controller.ErrMaintenanceLock):
+		return "locked: " + err.Error()
+	case errors.Is(err, controller.ErrDenied):
+		return "denied: " + err.Error()
+	default:
+		return "unavailable: " + err.Error()
+	}
+}
@@ -0,0 +1,484 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/dlefevre/go.garagedoor-service/logging"
+	"github.com/dlefevre/go.garagedoor-service/storage"
+	"github.com/google/uuid"
+)
+
+// Logger of the webhooks component.
+var logger = logging.Logger("webhooks")
+
+// Name of the document holding the pending deliveries and dead letters.
+const document = "webhook_deliveries"
+
+// Maximum number of retained dead letters. The oldest are discarded first.
+const maxDeadLetters = 100
+
+// Timeout for a single delivery attempt.
+const deliveryTimeout = 10 * time.Second
+
+// Headers sent with every delivery.
+const (
+	HeaderEvent     = "X-Garagedoor-Event"
+	HeaderDelivery  = "X-Garagedoor-Delivery"
+	HeaderSignature = "X-Garagedoor-Signature"
+)
+
+// ErrNotFound is returned when replaying or discarding a dead letter that doesn't exist.
+var ErrNotFound = errors.New("webhooks: delivery not found")
+
+var (
+	instance *Dispatcher
+	once     sync.Once
+)
+
+// Payload is the body of a webhook delivery. Next to the event, it carries the door state and the maintenance lock
+// status at the time of the event, as sent to websocket clients. The event of a state change carries the state event,
+// with the previous state, the cause, the sequence number and the time of the change.
+type Payload struct {
+	Delivery string                `json:"delivery"`
+	Event    controller.Event      `json:"event"`
+	State    string                `json:"state"`
+	Lock     controller.LockStatus `json:"lock"`
+}
+
+// Delivery is a payload queued for a subscriber, or a dead letter when all attempts failed.
+type Delivery struct {
+	ID          string          `json:"id"`
+	Subscriber  string          `json:"subscriber"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Created     time.Time       `json:"created"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// The persisted state of the dispatcher.
+type deliveries struct {
+	Pending     []Delivery `json:"pending"`
+	DeadLetters []Delivery `json:"dead_letters"`
+}
+
+// A webhook subscriber, with the channel waking up its delivery loop.
+type subscriber struct {
+	name   string
+	url    string
+	events map[string]bool
+	secret string
+	wake   chan struct{}
+}
+
+// Dispatcher sends the events of the DoorControllerService to the configured webhook subscribers. Deliveries are kept
+// in a persistent queue, and retried with exponential backoff. Deliveries that keep failing are moved to the dead
+// letters, from where they can be replayed. Every subscriber has its own delivery loop, so a subscriber that is down
+// doesn't delay the others.
+type Dispatcher struct {
+	subscribers    map[string]*subscriber
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	store          *storage.Store
+	client         *http.Client
+
+	state      deliveries
+	listenerID uuid.UUID
+	stop       chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	lock       sync.Mutex
+}
+
+// GetDispatcher returns the one and only Dispatcher instance.
+func GetDispatcher() *Dispatcher {
+	once.Do(func() {
+		instance = newDispatcher(storage.GetStore(), config.GetWebhookSubscribers())
+	})
+	return instance
+}
+
+// Creates a new Dispatcher object for the given subscribers.
+func newDispatcher(store *storage.Store, cfgs []config.WebhookSubscriberConfig) *Dispatcher {
+	d := &Dispatcher{
+		subscribers:    make(map[string]*subscriber),
+		maxAttempts:    config.GetWebhookMaxAttempts(),
+		initialBackoff: config.GetWebhookInitialBackoff(),
+		maxBackoff:     config.GetWebhookMaxBackoff(),
+		store:          store,
+		client: &http.Client{
+			Timeout: deliveryTimeout,
+		},
+		ctx: context.Background(),
+	}
+	for _, cfg := range cfgs {
+		s := &subscriber{
+			name:   cfg.Name,
+			url:    cfg.URL,
+			events: make(map[string]bool),
+			secret: cfg.Secret,
+			wake:   make(chan struct{}, 1),
+		}
+		for _, event := range cfg.Events {
+			s.events[event] = true
+		}
+		d.subscribers[cfg.Name] = s
+	}
+	return d
+}
+
+// Start loads the persisted deliveries, subscribes to the events of the DoorControllerService, and starts delivering.
+func (d *Dispatcher) Start() error {
+	d.lock.Lock()
+	err := d.store.Load(document, &d.state)
+	if err == nil {
+		d.dropUnknown()
+	}
+	d.lock.Unlock()
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	if len(d.state.Pending) > 0 {
+		logger.Info().Msgf("resuming %d pending webhook deliveries", len(d.state.Pending))
+	}
+
+	d.listenerID = controller.GetDoorControllerService().AddEventListener(d.eventReceived)
+	d.stop = make(chan struct{})
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, s := range d.subscribers {
+		d.wg.Add(1)
+		go d.loop(s)
+	}
+	logger.Info().Msgf("webhook dispatcher started with %d subscribers", len(d.subscribers))
+	return nil
+}
+
+// Stop unsubscribes from events and stops delivering, interrupting the delivery in progress. Pending deliveries remain
+// queued for the next start.
+func (d *Dispatcher) Stop() {
+	if d.stop == nil {
+		return
+	}
+	controller.GetDoorControllerService().RemoveEventListener(d.listenerID)
+	close(d.stop)
+	d.cancel()
+	d.wg.Wait()
+	d.stop = nil
+}
+
+// Pending returns the deliveries waiting to be sent.
+func (d *Dispatcher) Pending() []Delivery {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]Delivery{}, d.state.Pending...)
+}
+
+// DeadLetters returns the deliveries for which all attempts failed.
+func (d *Dispatcher) DeadLetters() []Delivery {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]Delivery{}, d.state.DeadLetters...)
+}
+
+// Replay moves a dead letter back to the queue, resetting its attempts. Returns the requeued delivery.
+func (d *Dispatcher) Replay(id string) (Delivery, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	index := d.deadLetterIndex(id)
+	if index < 0 {
+		return Delivery{}, ErrNotFound
+	}
+	delivery := d.state.DeadLetters[index]
+	delivery.Attempts = 0
+	delivery.NextAttempt = time.Now()
+	delivery.LastError = ""
+	d.state.DeadLetters = append(d.state.DeadLetters[:index], d.state.DeadLetters[index+1:]...)
+	d.state.Pending = append(d.state.Pending, delivery)
+	d.save()
+	if s, ok := d.subscribers[delivery.Subscriber]; ok {
+		s.notify()
+	}
+	logger.Info().Msgf("replaying webhook delivery %s to %s", delivery.ID, delivery.Subscriber)
+	return delivery, nil
+}
+
+// Discard removes a dead letter.
+func (d *Dispatcher) Discard(id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	index := d.deadLetterIndex(id)
+	if index < 0 {
+		return ErrNotFound
+	}
+	d.state.DeadLetters = append(d.state.DeadLetters[:index], d.state.DeadLetters[index+1:]...)
+	d.save()
+	return nil
+}
+
+// Move the pending deliveries of subscribers that are no longer configured to the dead letters, as no delivery loop
+// will send them. The caller must hold the lock.
+func (d *Dispatcher) dropUnknown() {
+	pending := d.state.Pending[:0]
+	for _, delivery := range d.state.Pending {
+		if _, ok := d.subscribers[delivery.Subscriber]; ok {
+			pending = append(pending, delivery)
+			continue
+		}
+		logger.Warn().Msgf("webhook subscriber %s is no longer configured, moving delivery %s to the dead letters",
+			delivery.Subscriber, delivery.ID)
+		delivery.LastError = fmt.Sprintf("unknown subscriber %s", delivery.Subscriber)
+		d.state.DeadLetters = append(d.state.DeadLetters, delivery)
+	}
+	d.state.Pending = pending
+	if len(d.state.DeadLetters) > maxDeadLetters {
+		d.state.DeadLetters = d.state.DeadLetters[len(d.state.DeadLetters)-maxDeadLetters:]
+	}
+}
+
+// Find the index of a dead letter. The caller must hold the lock.
+func (d *Dispatcher) deadLetterIndex(id string) int {
+	for i, delivery := range d.state.DeadLetters {
+		if delivery.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Event listener, queueing a delivery for every subscriber of the event type.
+func (d *Dispatcher) eventReceived(event controller.Event) {
+	dc := controller.GetDoorControllerService()
+	state := event.State
+	if event.Type != controller.EventState {
+		state = dc.GetStateStr()
+	}
+	lock := dc.GetLockStatus()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	queued := make([]*subscriber, 0, len(d.subscribers))
+	for _, s := range d.subscribers {
+		if len(s.events) > 0 && !s.events[event.Type] {
+			continue
+		}
+		id := uuid.NewString()
+		payload, err := json.Marshal(Payload{
+			Delivery: id,
+			Event:    event,
+			State:    state,
+			Lock:     lock,
+		})
+		if err != nil {
+			logger.Error().Msgf("failed to encode webhook payload: %v", err)
+			continue
+		}
+		d.state.Pending = append(d.state.Pending, Delivery{
+			ID:          id,
+			Subscriber:  s.name,
+			Event:       event.Type,
+			Payload:     payload,
+			Created:     event.Time,
+			NextAttempt: event.Time,
+		})
+		queued = append(queued, s)
+	}
+	if len(queued) > 0 {
+		d.save()
+		for _, s := range queued {
+			s.notify()
+		}
+	}
+}
+
+// Wake up the delivery loop of the subscriber.
+func (s *subscriber) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Persist the pending deliveries and dead letters. The caller must hold the lock.
+func (d *Dispatcher) save() {
+	if err := d.store.Save(document, d.state); err != nil {
+		logger.Error().Msgf("failed to persist webhook deliveries: %v", err)
+	}
+}
+
+// Delivery loop of a subscriber, sending its due deliveries when woken up and at least every second.
+func (d *Dispatcher) loop(s *subscriber) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		d.deliverDue(s, time.Now())
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// Send all deliveries to the subscriber that are due, and requeue or dead-letter the failed ones. Stops early when the
+// dispatcher is stopped, a delivery interrupted by stopping doesn't count as an attempt.
+func (d *Dispatcher) deliverDue(s *subscriber, now time.Time) {
+	d.lock.Lock()
+	due := make([]Delivery, 0)
+	for _, delivery := range d.state.Pending {
+		if delivery.Subscriber == s.name && !delivery.NextAttempt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	d.lock.Unlock()
+
+	for _, delivery := range due {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		err := d.send(d.ctx, s, delivery)
+		if d.ctx.Err() != nil {
+			return
+		}
+		d.completed(delivery, err, time.Now())
+	}
+}
+
+// Update the queue after a delivery attempt.
+func (d *Dispatcher) completed(delivery Delivery, err error, now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	index := -1
+	for i, pending := range d.state.Pending {
+		if pending.ID == delivery.ID {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return
+	}
+	d.state.Pending = append(d.state.Pending[:index], d.state.Pending[index+1:]...)
+
+	delivery.Attempts++
+	if err == nil {
+		logger.Debug().Msgf("webhook delivery %s to %s succeeded", delivery.ID, delivery.Subscriber)
+	} else if delivery.Attempts >= d.maxAttempts {
+		logger.Error().Msgf("webhook delivery %s to %s failed %d times, moving it to the dead letters: %v",
+			delivery.ID, delivery.Subscriber, delivery.Attempts, err)
+		delivery.LastError = err.Error()
+		d.state.DeadLetters = append(d.state.DeadLetters, delivery)
+		if len(d.state.DeadLetters) > maxDeadLetters {
+			d.state.DeadLetters = d.state.DeadLetters[len(d.state.DeadLetters)-maxDeadLetters:]
+		}
+	} else {
+		delay := d.backoff(delivery.Attempts)
+		logger.Warn().Msgf("webhook delivery %s to %s failed, retrying in %s: %v",
+			delivery.ID, delivery.Subscriber, delay, err)
+		delivery.LastError = err.Error()
+		delivery.NextAttempt = now.Add(delay)
+		d.state.Pending = append(d.state.Pending, delivery)
+	}
+	d.save()
+}
+
+// Calculate the delay before the next attempt, after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.initialBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= d.maxBackoff {
+			return d.maxBackoff
+		}
+	}
+	return min(delay, d.maxBackoff)
+}
+
+// Send a delivery to its subscriber.
+func (d *Dispatcher) send(ctx context.Context, s *subscriber, delivery Delivery) error {
+	ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	if s.secret != "" {
+		req.Header.Set(HeaderSignature, Sign(s.secret, time.Now(), delivery.Payload))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Sign returns the signature header for a payload, in the format "t=<unix timestamp>,v1=<signature>". The signature
+// is the hex encoded HMAC-SHA256 of the timestamp, a dot and the payload, using the subscriber's secret as key.
+// Receivers should recompute the signature, and reject deliveries with an old timestamp to prevent replays.
+func Sign(secret string, timestamp time.Time, payload []byte) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature header created by Sign, and that its timestamp isn't older than the given tolerance.
+func Verify(secret string, header string, payload []byte, tolerance time.Duration) bool {
+	var ts, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			ts = value
+		case "v1":
+			signature = value
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || signature == "" {
+		return false
+	}
+	timestamp := time.Unix(unix, 0)
+	if tolerance > 0 && time.Since(timestamp) > tolerance {
+		return false
+	}
+	expected := Sign(secret, timestamp, payload)
+	return hmac.Equal([]byte(expected), []byte("t="+ts+",v1="+signature))
+}
@@ -0,0 +1,272 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dlefevre/go.garagedoor-service/config"
+	"github.com/dlefevre/go.garagedoor-service/controller"
+	"github.com/dlefevre/go.garagedoor-service/storage"
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	os.Setenv("GARAGESERVICE_CONFIG_PATH", "..")
+	dataDir, _ := os.MkdirTemp("", "garagedoor-service-test")
+	os.Setenv("GARAGESERVICE_DATA_DIR", dataDir)
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+}
+
+// Receives webhook deliveries, verifying their signature, and fails while failing is set.
+type receiver struct {
+	secret   string
+	payloads []Payload
+	failing  bool
+	invalid  int
+	lock     sync.Mutex
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.failing {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	if !Verify(r.secret, req.Header.Get(HeaderSignature), body, time.Minute) {
+		r.invalid++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var payload Payload
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Delivery != req.Header.Get(HeaderDelivery) {
+		r.invalid++
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.payloads = append(r.payloads, payload)
+}
+
+func (r *receiver) received() []Payload {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Payload{}, r.payloads...)
+}
+
+// Create a dispatcher with a fresh store, and a single subscriber for the given server.
+func testDispatcher(t *testing.T, url string, secret string, events ...string) *Dispatcher {
+	d := newDispatcher(storage.NewStore(t.TempDir()), []config.WebhookSubscriberConfig{
+		{
+			Name:   "automation",
+			URL:    url,
+			Events: events,
+			Secret: secret,
+		},
+	})
+	d.maxAttempts = 3
+	d.initialBackoff = time.Millisecond
+	d.maxBackoff = 5 * time.Millisecond
+	return d
+}
+
+// Deliver all due deliveries, until the queue is empty or the timeout expires.
+func drain(d *Dispatcher, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, s := range d.subscribers {
+			d.deliverDue(s, time.Now())
+		}
+		if len(d.Pending()) == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	payload := []byte(`{"state":"open"}`)
+	header := Sign("secret", time.Now(), payload)
+	if !Verify("secret", header, payload, time.Minute) {
+		t.Fatalf("Expected signature %s to be valid", header)
+	}
+	if Verify("other", header, payload, time.Minute) {
+		t.Fatalf("Expected signature to be invalid with another secret")
+	}
+	if Verify("secret", header, []byte(`{"state":"closed"}`), time.Minute) {
+		t.Fatalf("Expected signature to be invalid for another payload")
+	}
+	old := Sign("secret", time.Now().Add(-time.Hour), payload)
+	if Verify("secret", old, payload, time.Minute) {
+		t.Fatalf("Expected old signature to be rejected")
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	r := &receiver{secret: "secret"}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	d := testDispatcher(t, server.URL, "secret", controller.EventState, controller.EventCommand)
+	now := time.Now()
+	d.eventReceived(controller.Event{ID: 1, Time: now, Type: controller.EventState, State: "open",
+		StateEvent: &controller.StateEvent{State: "open", Previous: "closed", Changed: now, Sequence: 7,
+			Cause: controller.CauseCommand, Source: "http"}})
+	d.eventReceived(controller.Event{ID: 2, Time: now, Type: controller.EventAlert, Level: "warning"})
+	d.eventReceived(controller.Event{ID: 3, Time: now, Type: controller.EventCommand, Command: "close", Source: "http"})
+	drain(d, time.Second)
+
+	payloads := r.received()
+	if r.invalid > 0 || len(payloads) != 2 {
+		t.Fatalf("Expected 2 valid deliveries, got %d (%d invalid)", len(payloads), r.invalid)
+	}
+	if payloads[0].Event.ID != 1 || payloads[0].State != "open" {
+		t.Fatalf("Expected state event first, got %+v", payloads[0])
+	}
+	if se := payloads[0].Event.StateEvent; se == nil || se.Previous != "closed" || se.Sequence != 7 ||
+		se.Cause != controller.CauseCommand || !se.Changed.Equal(now) {
+		t.Fatalf("Expected state event details in the delivery, got %+v", se)
+	}
+	if payloads[1].Event.Command != "close" || payloads[1].Event.Source != "http" {
+		t.Fatalf("Expected command event second, got %+v", payloads[1])
+	}
+}
+
+func TestDeadLetterAndReplay(t *testing.T) {
+	r := &receiver{secret: "secret", failing: true}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	d := testDispatcher(t, server.URL, "secret")
+	d.eventReceived(controller.Event{ID: 1, Time: time.Now(), Type: controller.EventLock, Message: "painting"})
+	drain(d, time.Second)
+
+	deadLetters := d.DeadLetters()
+	if len(deadLetters) != 1 || deadLetters[0].Attempts != 3 || deadLetters[0].LastError == "" {
+		t.Fatalf("Expected 1 dead letter after 3 attempts, got %+v", deadLetters)
+	}
+
+	// The dead letters survive a restart.
+	restarted := newDispatcher(d.store, []config.WebhookSubscriberConfig{
+		{Name: "automation", URL: server.URL, Secret: "secret"},
+	})
+	if err := restarted.store.Load(document, &restarted.state); err != nil {
+		t.Fatalf("Error loading deliveries: %v", err)
+	}
+	if len(restarted.DeadLetters()) != 1 {
+		t.Fatalf("Expected dead letter to be persisted")
+	}
+
+	if _, err := restarted.Replay("unknown"); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	r.lock.Lock()
+	r.failing = false
+	r.lock.Unlock()
+	if _, err := restarted.Replay(deadLetters[0].ID); err != nil {
+		t.Fatalf("Error replaying delivery: %v", err)
+	}
+	drain(restarted, time.Second)
+
+	payloads := r.received()
+	if len(payloads) != 1 || payloads[0].Delivery != deadLetters[0].ID || payloads[0].Event.Message != "painting" {
+		t.Fatalf("Expected replayed delivery, got %+v", payloads)
+	}
+	if len(restarted.DeadLetters()) != 0 || len(restarted.Pending()) != 0 {
+		t.Fatalf("Expected empty queue and dead letters after replay")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := newDispatcher(storage.NewStore(t.TempDir()), nil)
+	d.initialBackoff = 10 * time.Second
+	d.maxBackoff = time.Minute
+	expected := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for i, delay := range expected {
+		if got := d.backoff(i + 1); got != delay {
+			t.Fatalf("Expected backoff %s after %d attempts, got %s", delay, i+1, got)
+		}
+	}
+}
+
+func TestStopInterruptsDeliveries(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	d := testDispatcher(t, server.URL, "secret", controller.EventState)
+	for i := 0; i < 20; i++ {
+		d.eventReceived(controller.Event{ID: uint64(i + 1), Time: time.Now(), Type: controller.EventState,
+			State: "open"})
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Error starting dispatcher: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	d.Stop()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected Stop to interrupt the deliveries, took %s", elapsed)
+	}
+	pending := d.Pending()
+	if len(pending) != 20 {
+		t.Fatalf("Expected all deliveries to remain pending, got %d", len(pending))
+	}
+	for _, delivery := range pending {
+		if delivery.Attempts != 0 {
+			t.Fatalf("Expected interrupted delivery not to count as an attempt, got %+v", delivery)
+		}
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer slow.Close()
+	defer close(release)
+	r := &receiver{secret: "secret"}
+	healthy := httptest.NewServer(r)
+	defer healthy.Close()
+
+	d := newDispatcher(storage.NewStore(t.TempDir()), []config.WebhookSubscriberConfig{
+		{Name: "slow", URL: slow.URL, Secret: "secret"},
+		{Name: "healthy", URL: healthy.URL, Secret: "secret"},
+	})
+	if err := d.Start(); err != nil {
+		t.Fatalf("Error starting dispatcher: %v", err)
+	}
+	defer d.Stop()
+
+	// The healthy subscriber receives every event while the slow one is stuck on its first delivery.
+	for i := 0; i < 5; i++ {
+		d.eventReceived(controller.Event{ID: uint64(i + 1), Time: time.Now(), Type: controller.EventState,
+			State: "open"})
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(r.received()) < 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if received := len(r.received()); received != 5 {
+		t.Fatalf("Expected the healthy subscriber to receive 5 deliveries, got %d", received)
+	}
+}